@@ -0,0 +1,497 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package bolt
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	boltdb "go.etcd.io/bbolt"
+
+	"github.com/yunify/metad/log"
+	"github.com/yunify/metad/store"
+	"github.com/yunify/metad/util"
+	"github.com/yunify/metad/util/flatmap"
+)
+
+const SELF_MAPPING_PATH = "/_metad/mapping"
+const RULE_PATH = "/_metad/rule"
+
+const (
+	changePut    = "PUT"
+	changeDelete = "DELETE"
+)
+
+var (
+	kvBucket     = []byte("kv")
+	changeBucket = []byte("changes")
+
+	// MaxChanges is the max count of changes keep in the change feed,
+	// the Sync which fall behind the change feed will do a full reload.
+	MaxChanges = 10000
+)
+
+type change struct {
+	Revision uint64 `json:"revision"`
+	Type     string `json:"type"`
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+}
+
+// Client is a backend store data, mapping and rules in a local bolt file.
+type Client struct {
+	db            *boltdb.DB
+	prefix        string
+	mappingPrefix string
+	rulePrefix    string
+
+	// notifyChan is closed and replaced after every commit, for wake up the syncs.
+	notifyChan chan struct{}
+	notifyLock sync.Mutex
+}
+
+// NewBoltClient returns a *bolt.Client with the bolt file.
+func NewBoltClient(group string, prefix string, file string) (*Client, error) {
+	if file == "" {
+		return nil, fmt.Errorf("bolt backend require a file")
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return nil, err
+	}
+	db, err := boltdb.Open(file, 0600, &boltdb.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open bolt file %s error: %s", file, err.Error())
+	}
+	err = db.Update(func(tx *boltdb.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(kvBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(changeBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Client{
+		db:            db,
+		prefix:        prefix,
+		mappingPrefix: path.Join(SELF_MAPPING_PATH, group),
+		rulePrefix:    path.Join(RULE_PATH, group),
+		notifyChan:    make(chan struct{}),
+	}, nil
+}
+
+func (c *Client) Get(nodePath string, dir bool) (interface{}, error) {
+	return c.internalGet(c.prefix, nodePath, dir)
+}
+
+func (c *Client) Put(nodePath string, value interface{}, replace bool) error {
+	return c.internalPut(c.prefix, nodePath, value, replace)
+}
+
+func (c *Client) Delete(nodePath string, dir bool) error {
+	return c.update(func(tx *boltdb.Tx, rev uint64) []*change {
+		return deleteValues(tx, rev, c.prefix, nodePath, nil)
+	})
+}
+
+// PutIfMatch is not supported, bolt backend does not keep the revision of every key.
+func (c *Client) PutIfMatch(nodePath string, value interface{}, replace bool, rev int64) error {
+	return store.ErrConditionNotSupported
+}
+
+// DeleteIfMatch is not supported, bolt backend does not keep the revision of every key.
+func (c *Client) DeleteIfMatch(nodePath string, dir bool, rev int64) error {
+	return store.ErrConditionNotSupported
+}
+
+// Txn is not supported.
+func (c *Client) Txn(ops []store.TxnOp) error {
+	return store.ErrTxnNotSupported
+}
+
+// PutWithTTL is not supported.
+func (c *Client) PutWithTTL(nodePath string, value interface{}, replace bool, ttl time.Duration) error {
+	return store.ErrTTLNotSupported
+}
+
+// KeepAlive is not supported.
+func (c *Client) KeepAlive(nodePath string) error {
+	return store.ErrTTLNotSupported
+}
+
+func (c *Client) Sync(s store.Store, stopChan chan bool) {
+	initWG := &sync.WaitGroup{}
+	initWG.Add(1)
+	go c.internalSync(c.prefix, stopChan, initWG, newReloadStoreFunc(s), newProcessSyncChangeFunc(s))
+	initWG.Wait()
+}
+
+func (c *Client) GetMapping(nodePath string, dir bool) (interface{}, error) {
+	return c.internalGet(c.mappingPrefix, nodePath, dir)
+}
+
+func (c *Client) PutMapping(nodePath string, mapping interface{}, replace bool) error {
+	log.Debug("UpdateMapping nodePath:%s, mapping:%v, replace:%v", nodePath, mapping, replace)
+	return c.internalPut(c.mappingPrefix, nodePath, mapping, replace)
+}
+
+func (c *Client) DeleteMapping(nodePath string, dir bool) error {
+	return c.update(func(tx *boltdb.Tx, rev uint64) []*change {
+		return deleteValues(tx, rev, c.mappingPrefix, nodePath, nil)
+	})
+}
+
+// PutMappingWithTTL is not supported.
+func (c *Client) PutMappingWithTTL(nodePath string, mapping interface{}, replace bool, ttl time.Duration) error {
+	return store.ErrTTLNotSupported
+}
+
+// KeepAliveMapping is not supported.
+func (c *Client) KeepAliveMapping(nodePath string) error {
+	return store.ErrTTLNotSupported
+}
+
+func (c *Client) SyncMapping(mapping store.Store, stopChan chan bool) {
+	initWG := &sync.WaitGroup{}
+	initWG.Add(1)
+	go c.internalSync(c.mappingPrefix, stopChan, initWG, newReloadStoreFunc(mapping), newProcessSyncChangeFunc(mapping))
+	initWG.Wait()
+}
+
+func (c *Client) GetAccessRule() (map[string][]store.AccessRule, error) {
+	var values map[string]string
+	err := c.db.View(func(tx *boltdb.Tx) error {
+		values = getValues(tx, c.rulePrefix, "/")
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return toAccessRules(values), nil
+}
+
+func (c *Client) PutAccessRule(rules map[string][]store.AccessRule) error {
+	values := make(map[string]string, len(rules))
+	for k, v := range rules {
+		values[k] = store.MarshalAccessRule(v)
+	}
+	return c.update(func(tx *boltdb.Tx, rev uint64) []*change {
+		return putValues(tx, rev, c.rulePrefix, "/", values)
+	})
+}
+
+func (c *Client) DeleteAccessRule(hosts []string) error {
+	return c.update(func(tx *boltdb.Tx, rev uint64) []*change {
+		var changes []*change
+		for _, host := range hosts {
+			if host == "" {
+				continue
+			}
+			changes = append(changes, deleteValues(tx, rev, c.rulePrefix, path.Join("/", host), nil)...)
+		}
+		return changes
+	})
+}
+
+func (c *Client) SyncAccessRule(accessStore store.AccessStore, stopChan chan bool) {
+	initWG := &sync.WaitGroup{}
+	initWG.Add(1)
+	go c.internalSync(c.rulePrefix, stopChan, initWG, func(values map[string]string) {
+		rules := toAccessRules(values)
+		for host := range accessStore.GetAccessRule(nil) {
+			if _, ok := rules[host]; !ok {
+				accessStore.Delete(host)
+			}
+		}
+		accessStore.Puts(rules)
+	}, func(ch *change, nodePath string) {
+		_, host := path.Split(nodePath)
+		switch ch.Type {
+		case changePut:
+			rules, err := store.UnmarshalAccessRule(ch.Value)
+			if err != nil {
+				log.Error("Unexpect rule json value in bolt [%s]", ch.Value)
+			}
+			accessStore.Put(host, rules)
+		case changeDelete:
+			accessStore.Delete(host)
+		}
+	})
+	initWG.Wait()
+}
+
+func (c *Client) internalGet(prefix, nodePath string, dir bool) (interface{}, error) {
+	var result interface{}
+	err := c.db.View(func(tx *boltdb.Tx) error {
+		if dir {
+			result = flatmap.Expand(getValues(tx, prefix, nodePath), nodePath)
+		} else {
+			v := tx.Bucket(kvBucket).Get([]byte(util.AppendPathPrefix(nodePath, prefix)))
+			result = string(v)
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (c *Client) internalPut(prefix, nodePath string, value interface{}, replace bool) error {
+	var values map[string]string
+	switch t := value.(type) {
+	case map[string]interface{}, map[string]string, []interface{}:
+		values = flatmap.Flatten(t)
+	case string:
+		values = map[string]string{"/": t}
+	default:
+		log.Warning("Set unexpect value type: %s", reflect.TypeOf(value))
+		values = map[string]string{"/": fmt.Sprintf("%v", t)}
+	}
+	return c.update(func(tx *boltdb.Tx, rev uint64) []*change {
+		var changes []*change
+		if replace {
+			// delete and put are in same transaction, so the subtree is replaced atomically.
+			changes = deleteValues(tx, rev, prefix, nodePath, values)
+		}
+		return append(changes, putValues(tx, rev, prefix, nodePath, values)...)
+	})
+}
+
+// update run fn in a writable transaction with a new revision, and append the changes to the change feed.
+func (c *Client) update(fn func(tx *boltdb.Tx, rev uint64) []*change) error {
+	err := c.db.Update(func(tx *boltdb.Tx) error {
+		changeBucket := tx.Bucket(changeBucket)
+		rev, err := changeBucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		changes := fn(tx, rev)
+		if len(changes) == 0 {
+			// write a empty change as the revision mark, so readChanges can detect compaction by the gap.
+			changes = append(changes, &change{Revision: rev})
+		}
+		for i, ch := range changes {
+			b, err := json.Marshal(ch)
+			if err != nil {
+				return err
+			}
+			// changes in same revision are ordered by the index.
+			if err = changeBucket.Put(changeKey(rev, uint32(i)), b); err != nil {
+				return err
+			}
+		}
+		return compactChanges(changeBucket, rev)
+	})
+	if err != nil {
+		return err
+	}
+	c.notifyLock.Lock()
+	close(c.notifyChan)
+	c.notifyChan = make(chan struct{})
+	c.notifyLock.Unlock()
+	return nil
+}
+
+func (c *Client) notify() <-chan struct{} {
+	c.notifyLock.Lock()
+	defer c.notifyLock.Unlock()
+	return c.notifyChan
+}
+
+// internalSync load all values under the prefix, then replay the change feed to the store.
+func (c *Client) internalSync(prefix string, stopChan chan bool, initWG *sync.WaitGroup, reloadFunc func(values map[string]string), processChangeFunc func(ch *change, nodePath string)) {
+	var rev uint64
+	init := false
+	for {
+		notify := c.notify()
+		err := c.db.View(func(tx *boltdb.Tx) error {
+			var changes []*change
+			ok := false
+			if init {
+				if changes, ok = readChanges(tx, rev); !ok {
+					log.Warning("Sync %s fall behind the change feed, reload.", prefix)
+				}
+			}
+			if !ok {
+				reloadFunc(getValues(tx, prefix, "/"))
+				rev = tx.Bucket(changeBucket).Sequence()
+				return nil
+			}
+			for _, ch := range changes {
+				if nodePath, ok := trimPrefix(ch.Key, prefix); ok && ch.Type != "" {
+					log.Debug("process sync change, type: %s, prefix: %v, nodePath:%v, value: %v ", ch.Type, prefix, nodePath, ch.Value)
+					processChangeFunc(ch, nodePath)
+				}
+				rev = ch.Revision
+			}
+			return nil
+		})
+		if err != nil {
+			log.Error("Sync %s from bolt error: %s", prefix, err.Error())
+		}
+		if !init {
+			init = true
+			log.Info("Init store for prefix %s success.", prefix)
+			initWG.Done()
+		}
+		select {
+		case <-notify:
+		case <-stopChan:
+			log.Info("Sync %s stop.", prefix)
+			return
+		}
+	}
+}
+
+func newReloadStoreFunc(s store.Store) func(values map[string]string) {
+	return func(values map[string]string) {
+		store.ApplyFlatmap(s, values, nil, 0)
+	}
+}
+
+func newProcessSyncChangeFunc(s store.Store) func(ch *change, nodePath string) {
+	return func(ch *change, nodePath string) {
+		switch ch.Type {
+		case changePut:
+			s.Put(nodePath, ch.Value)
+		case changeDelete:
+			s.Delete(nodePath)
+		}
+	}
+}
+
+// readChanges return the changes after the revision, return false if the changes has been compacted.
+func readChanges(tx *boltdb.Tx, rev uint64) ([]*change, bool) {
+	b := tx.Bucket(changeBucket)
+	if b.Sequence() == rev {
+		return nil, true
+	}
+	cursor := b.Cursor()
+	k, v := cursor.Seek(changeKey(rev+1, 0))
+	if k == nil || binary.BigEndian.Uint64(k) != rev+1 {
+		// every revision is written to the feed, so a gap means compacted.
+		return nil, false
+	}
+	var changes []*change
+	for ; k != nil; k, v = cursor.Next() {
+		ch := &change{}
+		if err := json.Unmarshal(v, ch); err != nil {
+			log.Error("Unexpect change value in bolt [%s]", string(v))
+			continue
+		}
+		changes = append(changes, ch)
+	}
+	return changes, true
+}
+
+// compactChanges remove the oldest changes, only keep MaxChanges revisions.
+func compactChanges(b *boltdb.Bucket, rev uint64) error {
+	if rev <= uint64(MaxChanges) {
+		return nil
+	}
+	end := string(changeKey(rev-uint64(MaxChanges), 0))
+	var keys [][]byte
+	cursor := b.Cursor()
+	for k, _ := cursor.First(); k != nil && string(k) < end; k, _ = cursor.Next() {
+		keys = append(keys, append([]byte{}, k...))
+	}
+	// delete after iteration, delete by cursor while iterating may skip keys.
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func changeKey(rev uint64, idx uint32) []byte {
+	k := make([]byte, 12)
+	binary.BigEndian.PutUint64(k, rev)
+	binary.BigEndian.PutUint32(k[8:], idx)
+	return k
+}
+
+// getValues return the flatmap under the nodePath, keys are relative to the prefix.
+func getValues(tx *boltdb.Tx, prefix, nodePath string) map[string]string {
+	values := make(map[string]string)
+	key := util.AppendPathPrefix(nodePath, prefix)
+	cursor := tx.Bucket(kvBucket).Cursor()
+	for k, v := cursor.Seek([]byte(key)); k != nil && strings.HasPrefix(string(k), key); k, v = cursor.Next() {
+		if nodePath, ok := trimPrefix(string(k), prefix); ok && isUnder(string(k), key) {
+			values[nodePath] = string(v)
+		}
+	}
+	return values
+}
+
+// putValues put the flatmap under the nodePath, and return the changes.
+func putValues(tx *boltdb.Tx, rev uint64, prefix, nodePath string, values map[string]string) []*change {
+	b := tx.Bucket(kvBucket)
+	newPrefix := util.AppendPathPrefix(nodePath, prefix)
+	changes := make([]*change, 0, len(values))
+	for k, v := range values {
+		k = util.AppendPathPrefix(k, newPrefix)
+		if old := b.Get([]byte(k)); old != nil && string(old) == v {
+			continue
+		}
+		b.Put([]byte(k), []byte(v))
+		changes = append(changes, &change{Revision: rev, Type: changePut, Key: k, Value: v})
+	}
+	return changes
+}
+
+// deleteValues delete the values under the nodePath, except the keys in keeps, and return the changes.
+func deleteValues(tx *boltdb.Tx, rev uint64, prefix, nodePath string, keeps map[string]string) []*change {
+	b := tx.Bucket(kvBucket)
+	var changes []*change
+	for k := range getValues(tx, prefix, nodePath) {
+		if _, ok := keeps[util.TrimPathPrefix(k, nodePath)]; ok {
+			continue
+		}
+		key := util.AppendPathPrefix(k, prefix)
+		b.Delete([]byte(key))
+		changes = append(changes, &change{Revision: rev, Type: changeDelete, Key: key})
+	}
+	return changes
+}
+
+// trimPrefix trim the prefix of the key, return false if the key is not under the prefix.
+func trimPrefix(key, prefix string) (string, bool) {
+	prefix = path.Join("/", prefix)
+	if !isUnder(key, prefix) {
+		return "", false
+	}
+	// avoid output mapping and rule config as metadata when prefix is "/"
+	if prefix == "/" && (isUnder(key, SELF_MAPPING_PATH) || isUnder(key, RULE_PATH)) {
+		return "", false
+	}
+	return util.TrimPathPrefix(key, prefix), true
+}
+
+func isUnder(key, nodePath string) bool {
+	return nodePath == "/" || key == nodePath || strings.HasPrefix(key, nodePath+"/")
+}
+
+func toAccessRules(values map[string]string) map[string][]store.AccessRule {
+	result := make(map[string][]store.AccessRule)
+	for k, v := range values {
+		rules, err := store.UnmarshalAccessRule(v)
+		if err != nil {
+			log.Error("Unexpect rule json value in bolt [%s]", v)
+			continue
+		}
+		_, host := path.Split(k)
+		result[host] = rules
+	}
+	return result
+}
@@ -0,0 +1,136 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package bolt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	boltdb "go.etcd.io/bbolt"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yunify/metad/log"
+	"github.com/yunify/metad/store"
+)
+
+func init() {
+	log.SetLevel("debug")
+	rand.Seed(int64(time.Now().Nanosecond()))
+}
+
+func TestClientSyncStop(t *testing.T) {
+	file := tempFile(t)
+	defer os.RemoveAll(filepath.Dir(file))
+
+	prefix := fmt.Sprintf("/prefix%v", rand.Intn(1000))
+	stopChan := make(chan bool)
+	storeClient, err := NewBoltClient("default", prefix, file)
+	assert.NoError(t, err)
+	go func() {
+		time.Sleep(3 * time.Second)
+		stopChan <- true
+	}()
+
+	metastore := store.New()
+	// expect internalSync not block after stopChan has signal
+	initWG := &sync.WaitGroup{}
+	initWG.Add(1)
+	storeClient.internalSync(prefix, stopChan, initWG, newReloadStoreFunc(metastore), newProcessSyncChangeFunc(metastore))
+	initWG.Wait()
+}
+
+func TestClientReopen(t *testing.T) {
+	file := tempFile(t)
+	defer os.RemoveAll(filepath.Dir(file))
+
+	storeClient, err := NewBoltClient("default", "/prefix", file)
+	assert.NoError(t, err)
+
+	values := map[string]interface{}{
+		"nodes": map[string]interface{}{
+			"1": "node1",
+			"2": "node2",
+		},
+	}
+	assert.NoError(t, storeClient.Put("/", values, true))
+	assert.NoError(t, storeClient.PutMapping("/192.168.1.1/node", "/nodes/1", false))
+	assert.NoError(t, storeClient.PutAccessRule(map[string][]store.AccessRule{
+		"192.168.1.1": {{Path: "/nodes", Mode: store.AccessModeRead}},
+	}))
+	assert.NoError(t, storeClient.db.Close())
+
+	storeClient, err = NewBoltClient("default", "/prefix", file)
+	assert.NoError(t, err)
+
+	val, err := storeClient.Get("/", true)
+	assert.NoError(t, err)
+	assert.Equal(t, values, val)
+
+	val, err = storeClient.GetMapping("/192.168.1.1/node", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "/nodes/1", val)
+
+	rules, err := storeClient.GetAccessRule()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(rules["192.168.1.1"]))
+}
+
+func TestClientChangeCompacted(t *testing.T) {
+	file := tempFile(t)
+	defer os.RemoveAll(filepath.Dir(file))
+
+	oldMaxChanges := MaxChanges
+	MaxChanges = 3
+	defer func() {
+		MaxChanges = oldMaxChanges
+	}()
+
+	storeClient, err := NewBoltClient("default", "", file)
+	assert.NoError(t, err)
+	assert.NoError(t, storeClient.Put("/deleted", "value", false))
+
+	metastore := store.New()
+	stopChan := make(chan bool)
+	defer func() {
+		stopChan <- true
+	}()
+	storeClient.Sync(metastore, stopChan)
+	_, val := metastore.Get("/deleted")
+	assert.Equal(t, "value", val)
+
+	// write directly, skip the notify, for simulate the sync fall behind the change feed.
+	for i := 0; i < 5; i++ {
+		err = storeClient.db.Update(func(tx *boltdb.Tx) error {
+			b := tx.Bucket(changeBucket)
+			rev, _ := b.NextSequence()
+			putValues(tx, rev, "", "/", map[string]string{fmt.Sprintf("/%v", i): "v"})
+			return compactChanges(b, rev)
+		})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, storeClient.Delete("/deleted", false))
+	time.Sleep(100 * time.Millisecond)
+
+	_, val = metastore.Get("/deleted")
+	assert.Nil(t, val)
+	for i := 0; i < 5; i++ {
+		_, val = metastore.Get(fmt.Sprintf("/%v", i))
+		assert.Equal(t, "v", val)
+	}
+}
+
+func tempFile(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "metad-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "metad.db")
+}
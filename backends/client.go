@@ -8,9 +8,14 @@ import (
 	"errors"
 	"path"
 	"strings"
+	"time"
 
+	"github.com/yunify/metad/backends/bolt"
+	"github.com/yunify/metad/backends/embedded"
 	"github.com/yunify/metad/backends/etcdv3"
+	"github.com/yunify/metad/backends/file"
 	"github.com/yunify/metad/backends/local"
+	"github.com/yunify/metad/backends/upstream"
 	"github.com/yunify/metad/log"
 	"github.com/yunify/metad/store"
 )
@@ -23,11 +28,26 @@ type StoreClient interface {
 	// Delete
 	// if the 'key' represent a dir, 'dir' should be true.
 	Delete(nodePath string, dir bool) error
+	// PutWithTTL put the value same as Put, the keys put are deleted after ttl unless kept alive.
+	// return store.ErrTTLNotSupported if the backend not support.
+	PutWithTTL(nodePath string, value interface{}, replace bool, ttl time.Duration) error
+	// KeepAlive reset the ttl of the keys under nodePath, return store.ErrNoTTL if no key has ttl.
+	KeepAlive(nodePath string) error
+	// PutIfMatch put the value only if the modified revision of nodePath is rev, rev 0 means nodePath not exist.
+	// return store.ErrRevisionConflict if not match, store.ErrConditionNotSupported if the backend not support.
+	PutIfMatch(nodePath string, value interface{}, replace bool, rev int64) error
+	// DeleteIfMatch delete nodePath only if the modified revision of nodePath is rev.
+	DeleteIfMatch(nodePath string, dir bool, rev int64) error
+	// Txn apply the ops of data, mapping and access rule atomically, the ops are applied in order.
+	// return store.ErrRevisionConflict if any precondition not match, store.ErrTxnNotSupported if the backend not support.
+	Txn(ops []store.TxnOp) error
 	Sync(store store.Store, stopChan chan bool)
 
 	GetMapping(nodePath string, dir bool) (interface{}, error)
 	PutMapping(nodePath string, mapping interface{}, replace bool) error
 	DeleteMapping(nodePath string, dir bool) error
+	PutMappingWithTTL(nodePath string, mapping interface{}, replace bool, ttl time.Duration) error
+	KeepAliveMapping(nodePath string) error
 	SyncMapping(mapping store.Store, stopChan chan bool)
 
 	GetAccessRule() (map[string][]store.AccessRule, error)
@@ -54,8 +74,62 @@ func New(config Config) (StoreClient, error) {
 	case "etcd", "etcdv3":
 		// Create the etcdv3 client upfront and use it for the life of the process.
 		return etcdv3.NewEtcdClient(config.Group, config.Prefix, backendNodes, config.ClientCert, config.ClientKey, config.ClientCaKeys, config.BasicAuth, config.Username, config.Password)
+	case "embedded":
+		// the nodes are the client urls of the embedded etcd member.
+		server, err := embedded.Start(embedded.Config{
+			Name:           config.EmbedName,
+			DataDir:        config.EmbedDataDir,
+			PeerURLs:       config.EmbedPeerURLs,
+			ClientURLs:     backendNodes,
+			InitialCluster: config.EmbedInitialCluster,
+			ClusterState:   config.EmbedClusterState,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return etcdv3.NewEtcdClient(config.Group, config.Prefix, server.ClientURLs(), config.ClientCert, config.ClientKey, config.ClientCaKeys, config.BasicAuth, config.Username, config.Password)
+	case "layered":
+		layers := make([]StoreClient, 0, len(config.Layers))
+		for _, layerConfig := range config.Layers {
+			if layerConfig.Group == "" {
+				layerConfig.Group = config.Group
+			}
+			if layerConfig.Prefix == "" {
+				layerConfig.Prefix = config.Prefix
+			}
+			layer, err := New(layerConfig)
+			if err != nil {
+				return nil, err
+			}
+			layers = append(layers, layer)
+		}
+		return NewLayeredClient(layers, config.WriteLayer)
+	case "upstream":
+		// the nodes are the manage address of upstream metad.
+		upstreamClient, err := upstream.NewUpstreamClient(config.Prefix, backendNodes)
+		if err != nil {
+			return nil, err
+		}
+		if config.MappingBackend == nil {
+			return upstreamClient, nil
+		}
+		mappingConfig := *config.MappingBackend
+		if mappingConfig.Group == "" {
+			mappingConfig.Group = config.Group
+		}
+		mappingClient, err := New(mappingConfig)
+		if err != nil {
+			return nil, err
+		}
+		return NewMappingSeparatedClient(upstreamClient, mappingClient), nil
 	case "local":
 		return local.NewLocalClient()
+	case "file":
+		// the first node is the directory of data files.
+		return file.NewFileClient(config.Group, config.Prefix, backendNodes[0])
+	case "bolt":
+		// the first node is the bolt file.
+		return bolt.NewBoltClient(config.Group, config.Prefix, backendNodes[0])
 	}
 
 	return nil, errors.New("Invalid backend")
@@ -65,6 +139,14 @@ func GetDefaultBackends(backend string) []string {
 	switch backend {
 	case "etcd", "etcdv3":
 		return []string{"http://127.0.0.1:2379"}
+	case "embedded":
+		return embedded.DefaultClientURLs
+	case "file":
+		return []string{"/var/lib/metad"}
+	case "bolt":
+		return []string{"/var/lib/metad/metad.db"}
+	case "upstream":
+		return []string{"http://127.0.0.1:9611"}
 	default:
 		return nil
 	}
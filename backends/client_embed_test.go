@@ -0,0 +1,26 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+//go:build embed
+// +build embed
+
+package backends
+
+import (
+	"io/ioutil"
+
+	"github.com/yunify/metad/backends/embedded"
+)
+
+// run the backend tests against a in-process etcd member, without external etcd.
+func init() {
+	dir, err := ioutil.TempDir("", "metad-embedded")
+	if err != nil {
+		panic(err)
+	}
+	embedded.DefaultDataDir = dir
+	embedded.DefaultPeerURLs = []string{"http://localhost:12380"}
+	embedded.DefaultClientURLs = []string{"http://127.0.0.1:12379"}
+	backendNodes = append(backendNodes, "embedded")
+}
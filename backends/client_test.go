@@ -7,7 +7,9 @@ package backends
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -22,6 +24,8 @@ var (
 	backendNodes = []string{
 		"etcdv3",
 		"local",
+		"file",
+		"bolt",
 	}
 )
 
@@ -36,7 +40,7 @@ func TestClientGetPut(t *testing.T) {
 
 		prefix := fmt.Sprintf("/prefix%v", rand.Intn(1000))
 
-		nodes := GetDefaultBackends(backend)
+		nodes := testBackendNodes(backend)
 
 		config := Config{
 			Backend:      backend,
@@ -70,7 +74,7 @@ func TestClientGetsPuts(t *testing.T) {
 
 		prefix := fmt.Sprintf("/prefix%v", rand.Intn(1000))
 
-		nodes := GetDefaultBackends(backend)
+		nodes := testBackendNodes(backend)
 
 		config := Config{
 			Backend:      backend,
@@ -138,7 +142,7 @@ func TestClientPutJSON(t *testing.T) {
 
 		prefix := fmt.Sprintf("/prefix%v", rand.Intn(1000))
 
-		nodes := GetDefaultBackends(backend)
+		nodes := testBackendNodes(backend)
 
 		config := Config{
 			Backend:      backend,
@@ -237,7 +241,7 @@ func TestClientNoPrefix(t *testing.T) {
 			stopChan <- true
 		}()
 
-		nodes := GetDefaultBackends(backend)
+		nodes := testBackendNodes(backend)
 
 		config := Config{
 			Backend:      backend,
@@ -313,7 +317,7 @@ func TestClientSync(t *testing.T) {
 			stopChan <- true
 		}()
 
-		nodes := GetDefaultBackends(backend)
+		nodes := testBackendNodes(backend)
 
 		config := Config{
 			Backend:      backend,
@@ -348,12 +352,82 @@ func TestClientSync(t *testing.T) {
 	}
 }
 
+func TestClientIfMatch(t *testing.T) {
+	for _, backend := range backendNodes {
+		println("Test backend: ", backend)
+
+		prefix := fmt.Sprintf("/prefix%v", rand.Intn(1000))
+
+		stopChan := make(chan bool)
+		defer func() {
+			stopChan <- true
+		}()
+
+		nodes := testBackendNodes(backend)
+
+		config := Config{
+			Backend:      backend,
+			BackendNodes: nodes,
+			Prefix:       prefix,
+		}
+		storeClient, err := New(config)
+		assert.NoError(t, err)
+
+		storeClient.Delete("/", true)
+
+		metastore := store.New()
+		storeClient.Sync(metastore, stopChan)
+
+		err = storeClient.PutIfMatch("/nodes/1/ip", "192.168.1.1", false, 0)
+		if err == store.ErrConditionNotSupported {
+			assert.Equal(t, store.ErrConditionNotSupported, storeClient.DeleteIfMatch("/nodes/1/ip", false, 0))
+			continue
+		}
+		assert.NoError(t, err)
+		// the node exist now.
+		assert.Equal(t, store.ErrRevisionConflict, storeClient.PutIfMatch("/nodes/1/ip", "192.168.1.2", false, 0))
+		time.Sleep(1000 * time.Millisecond)
+
+		// the revision synced to store can be used for conditional write.
+		_, ipRev := metastore.GetRevision("/nodes/1/ip")
+		_, dirRev := metastore.GetRevision("/nodes")
+		assert.True(t, ipRev > 0)
+		assert.Equal(t, ipRev, dirRev)
+		assert.NoError(t, storeClient.PutIfMatch("/nodes/1/ip", "192.168.1.2", false, ipRev))
+		assert.Equal(t, store.ErrRevisionConflict, storeClient.PutIfMatch("/nodes/1/ip", "192.168.1.3", false, ipRev))
+		err = storeClient.PutIfMatch("/nodes", map[string]interface{}{"2": map[string]interface{}{"ip": "192.168.1.3"}}, false, dirRev)
+		if err == store.ErrConditionNotSupported {
+			// the backend only support the precondition of leaf.
+			assert.Equal(t, store.ErrConditionNotSupported, storeClient.DeleteIfMatch("/nodes", true, dirRev))
+			storeClient.Delete("/", true)
+			continue
+		}
+		assert.Equal(t, store.ErrRevisionConflict, err)
+		time.Sleep(1000 * time.Millisecond)
+
+		_, dirRev = metastore.GetRevision("/nodes")
+		assert.NoError(t, storeClient.PutIfMatch("/nodes", map[string]interface{}{"2": map[string]interface{}{"ip": "192.168.1.3"}}, true, dirRev))
+		time.Sleep(1000 * time.Millisecond)
+		_, val := metastore.Get("/nodes")
+		assert.Equal(t, map[string]interface{}{"2": map[string]interface{}{"ip": "192.168.1.3"}}, val)
+
+		assert.Equal(t, store.ErrRevisionConflict, storeClient.DeleteIfMatch("/nodes", true, dirRev))
+		_, dirRev = metastore.GetRevision("/nodes")
+		assert.NoError(t, storeClient.DeleteIfMatch("/nodes", true, dirRev))
+		time.Sleep(1000 * time.Millisecond)
+		_, val = metastore.Get("/nodes")
+		assert.Nil(t, val)
+
+		storeClient.Delete("/", true)
+	}
+}
+
 func TestMapping(t *testing.T) {
 	for _, backend := range backendNodes {
 		println("Test backend: ", backend)
 		prefix := fmt.Sprintf("/prefix%v", rand.Intn(1000))
 		group := fmt.Sprintf("/group%v", rand.Intn(1000))
-		nodes := GetDefaultBackends(backend)
+		nodes := testBackendNodes(backend)
 
 		config := Config{
 			Backend:      backend,
@@ -402,7 +476,7 @@ func TestMappingSync(t *testing.T) {
 		defer func() {
 			stopChan <- true
 		}()
-		nodes := GetDefaultBackends(backend)
+		nodes := testBackendNodes(backend)
 
 		config := Config{
 			Backend:      backend,
@@ -530,7 +604,7 @@ func NewTestClient(backend string) StoreClient {
 	prefix := fmt.Sprintf("/prefix%v", rand.Intn(1000))
 	group := fmt.Sprintf("/group%v", rand.Intn(1000))
 	println("Test backend: ", backend)
-	nodes := GetDefaultBackends(backend)
+	nodes := testBackendNodes(backend)
 
 	config := Config{
 		Backend:      backend,
@@ -545,6 +619,26 @@ func NewTestClient(backend string) StoreClient {
 	return storeClient
 }
 
+// testBackendNodes return the backend nodes for test, the file based backends use a temp dir.
+func testBackendNodes(backend string) []string {
+	switch backend {
+	case "file":
+		dir, err := ioutil.TempDir("", "metad-"+backend)
+		if err != nil {
+			panic(err)
+		}
+		return []string{dir}
+	case "bolt":
+		dir, err := ioutil.TempDir("", "metad-"+backend)
+		if err != nil {
+			panic(err)
+		}
+		return []string{filepath.Join(dir, "metad.db")}
+	default:
+		return GetDefaultBackends(backend)
+	}
+}
+
 func FillTestData(storeClient StoreClient) map[string]string {
 	testData := make(map[string]interface{})
 	for i := 0; i < 5; i++ {
@@ -596,3 +690,114 @@ func ValidTestData(t *testing.T, testData map[string]string, metastore store.Sto
 		assert.Equal(t, v, storeVal, "valid data fail for backend %s", backend)
 	}
 }
+
+func TestClientTxn(t *testing.T) {
+	for _, backend := range backendNodes {
+		storeClient := NewTestClient(backend)
+		storeClient.Delete("/", true)
+		storeClient.DeleteMapping("/", true)
+
+		rules := []store.AccessRule{{Path: "/clusters/cl-1", Mode: store.AccessModeRead}}
+		zero := int64(0)
+		ops := []store.TxnOp{
+			{Target: store.TxnTargetData, Action: store.TxnActionMerge, Path: "/clusters/cl-1/hosts/i-1", Value: "192.168.1.1", IfMatch: &zero},
+			{Target: store.TxnTargetMapping, Action: store.TxnActionPut, Path: "/192.168.1.1", Value: map[string]interface{}{"host": "/clusters/cl-1/hosts/i-1"}},
+			{Target: store.TxnTargetRule, Action: store.TxnActionPut, Path: "192.168.1.1", Rules: rules},
+		}
+		err := storeClient.Txn(ops)
+		if err == store.ErrTxnNotSupported {
+			continue
+		}
+		assert.NoError(t, err)
+
+		val, err := storeClient.Get("/clusters/cl-1/hosts", true)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{"i-1": "192.168.1.1"}, val)
+		val, err = storeClient.GetMapping("/192.168.1.1/host", false)
+		assert.NoError(t, err)
+		assert.Equal(t, "/clusters/cl-1/hosts/i-1", val)
+		rulesGet, err := storeClient.GetAccessRule()
+		assert.NoError(t, err)
+		assert.Equal(t, rules, rulesGet["192.168.1.1"])
+
+		// the precondition fail, no op is applied.
+		ops = []store.TxnOp{
+			{Target: store.TxnTargetData, Action: store.TxnActionMerge, Path: "/clusters/cl-1/hosts/i-1", Value: "192.168.1.2", IfMatch: &zero},
+			{Target: store.TxnTargetMapping, Action: store.TxnActionDelete, Path: "/192.168.1.1", Dir: true},
+		}
+		assert.Equal(t, store.ErrRevisionConflict, storeClient.Txn(ops))
+		val, err = storeClient.GetMapping("/192.168.1.1/host", false)
+		assert.NoError(t, err)
+		assert.Equal(t, "/clusters/cl-1/hosts/i-1", val)
+
+		// the later op apply on the result of the former.
+		ops = []store.TxnOp{
+			{Target: store.TxnTargetData, Action: store.TxnActionPut, Path: "/clusters/cl-1", Value: map[string]interface{}{"hosts": map[string]interface{}{"i-2": "192.168.1.2"}}},
+			{Target: store.TxnTargetData, Action: store.TxnActionMerge, Path: "/clusters/cl-1/hosts/i-3", Value: "192.168.1.3"},
+			{Target: store.TxnTargetMapping, Action: store.TxnActionDelete, Path: "/192.168.1.1", Dir: true},
+			{Target: store.TxnTargetRule, Action: store.TxnActionDelete, Path: "192.168.1.1"},
+		}
+		assert.NoError(t, storeClient.Txn(ops))
+		val, err = storeClient.Get("/clusters/cl-1", true)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{"hosts": map[string]interface{}{"i-2": "192.168.1.2", "i-3": "192.168.1.3"}}, val)
+		val, err = storeClient.GetMapping("/192.168.1.1", true)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{}, val)
+		rulesGet, err = storeClient.GetAccessRule()
+		assert.NoError(t, err)
+		_, ok := rulesGet["192.168.1.1"]
+		assert.False(t, ok)
+
+		storeClient.Delete("/", true)
+	}
+}
+
+func TestClientTTL(t *testing.T) {
+	for _, backend := range backendNodes {
+		stopChan := make(chan bool)
+		defer func() {
+			stopChan <- true
+		}()
+		storeClient := NewTestClient(backend)
+		storeClient.Delete("/", true)
+
+		metastore := store.New()
+		storeClient.Sync(metastore, stopChan)
+
+		ttl := 2 * time.Second
+		err := storeClient.PutWithTTL("/agents/1", map[string]interface{}{"status": "up"}, false, ttl)
+		if err == store.ErrTTLNotSupported {
+			assert.Equal(t, store.ErrTTLNotSupported, storeClient.KeepAlive("/agents/1"))
+			continue
+		}
+		assert.NoError(t, err)
+		assert.NoError(t, storeClient.PutWithTTL("/agents/2", map[string]interface{}{"status": "up"}, false, ttl))
+		assert.NoError(t, storeClient.Put("/agents/3", map[string]interface{}{"status": "up"}, false))
+		assert.Equal(t, store.ErrNoTTL, storeClient.KeepAlive("/agents/3"))
+		assert.NoError(t, storeClient.PutWithTTL("/agents/4", map[string]interface{}{"status": "up"}, false, ttl))
+		// put the unchanged value without ttl cancel the ttl.
+		assert.NoError(t, storeClient.Put("/agents/4", map[string]interface{}{"status": "up"}, true))
+		assert.Equal(t, store.ErrNoTTL, storeClient.KeepAlive("/agents/4"))
+
+		time.Sleep(1500 * time.Millisecond)
+		assert.NoError(t, storeClient.KeepAlive("/agents/1"))
+		time.Sleep(1500 * time.Millisecond)
+
+		_, val := metastore.Get("/agents")
+		assert.Equal(t, map[string]interface{}{
+			"1": map[string]interface{}{"status": "up"},
+			"3": map[string]interface{}{"status": "up"},
+			"4": map[string]interface{}{"status": "up"},
+		}, val)
+
+		time.Sleep(2000 * time.Millisecond)
+		_, val = metastore.Get("/agents")
+		assert.Equal(t, map[string]interface{}{
+			"3": map[string]interface{}{"status": "up"},
+			"4": map[string]interface{}{"status": "up"},
+		}, val)
+
+		storeClient.Delete("/", true)
+	}
+}
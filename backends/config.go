@@ -5,14 +5,32 @@
 package backends
 
 type Config struct {
-	Backend      string
-	Prefix       string
-	Group        string
-	BasicAuth    bool
-	ClientCaKeys string
-	ClientCert   string
-	ClientKey    string
-	BackendNodes []string
-	Password     string
-	Username     string
+	Backend      string   `yaml:"backend"`
+	Prefix       string   `yaml:"prefix"`
+	Group        string   `yaml:"group"`
+	BasicAuth    bool     `yaml:"basic_auth"`
+	ClientCaKeys string   `yaml:"client_ca_keys"`
+	ClientCert   string   `yaml:"client_cert"`
+	ClientKey    string   `yaml:"client_key"`
+	BackendNodes []string `yaml:"nodes"`
+	Password     string   `yaml:"password"`
+	Username     string   `yaml:"username"`
+
+	// EmbedName, EmbedDataDir, EmbedPeerURLs, EmbedInitialCluster and EmbedClusterState
+	// configure the in-process etcd member, only used with -backend=embedded.
+	EmbedName           string   `yaml:"embed_name,omitempty"`
+	EmbedDataDir        string   `yaml:"embed_data_dir,omitempty"`
+	EmbedPeerURLs       []string `yaml:"embed_peer_urls,omitempty"`
+	EmbedInitialCluster string   `yaml:"embed_initial_cluster,omitempty"`
+	EmbedClusterState   string   `yaml:"embed_cluster_state,omitempty"`
+
+	// Layers is the backends stacked by -backend=layered, the first has the highest priority,
+	// the layer's group and prefix default to the parent's.
+	Layers []Config `yaml:"layers,omitempty"`
+	// WriteLayer is the index of the layer which metadata writes go to.
+	WriteLayer int `yaml:"write_layer,omitempty"`
+
+	// MappingBackend keeps the mapping and access rule separately from metadata, the group defaults to the parent's.
+	// Used by -backend=upstream, so every tier of metad can has its own mapping group.
+	MappingBackend *Config `yaml:"mapping_backend,omitempty"`
 }
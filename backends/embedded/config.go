@@ -0,0 +1,60 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package embedded
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	DefaultName       = "default"
+	DefaultDataDir    = "/var/lib/metad/etcd"
+	DefaultPeerURLs   = []string{"http://localhost:2380"}
+	DefaultClientURLs = []string{"http://127.0.0.1:2379"}
+
+	ErrNotSupported = errors.New("embedded etcd is not compiled in, rebuild metad with '-tags embed'")
+)
+
+// Config is the configuration of the in-process etcd member.
+type Config struct {
+	Name string
+	// DataDir is the directory the member keeps wal and snapshot files.
+	DataDir string
+	// PeerURLs is the urls listen on for peer traffic, also advertised to other members.
+	PeerURLs []string
+	// ClientURLs is the urls listen on for client traffic, metad connects to the member by them.
+	ClientURLs []string
+	// InitialCluster is the initial cluster configuration for bootstrapping, eg: "m1=http://10.0.0.1:2380,m2=http://10.0.0.2:2380".
+	InitialCluster string
+	// ClusterState is "new" when bootstrapping a new cluster, or "existing" when join a exist cluster.
+	ClusterState string
+}
+
+func (c *Config) setDefaults() {
+	if c.Name == "" {
+		c.Name = DefaultName
+	}
+	if c.DataDir == "" {
+		c.DataDir = DefaultDataDir
+	}
+	if len(c.PeerURLs) == 0 {
+		c.PeerURLs = DefaultPeerURLs
+	}
+	if len(c.ClientURLs) == 0 {
+		c.ClientURLs = DefaultClientURLs
+	}
+	if c.InitialCluster == "" {
+		members := make([]string, 0, len(c.PeerURLs))
+		for _, u := range c.PeerURLs {
+			members = append(members, fmt.Sprintf("%s=%s", c.Name, u))
+		}
+		c.InitialCluster = strings.Join(members, ",")
+	}
+	if c.ClusterState == "" {
+		c.ClusterState = "new"
+	}
+}
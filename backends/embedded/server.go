@@ -0,0 +1,115 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+//go:build embed
+// +build embed
+
+package embedded
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/embed"
+
+	"github.com/yunify/metad/log"
+)
+
+var (
+	StartTimeout = 60 * time.Second
+
+	lock   sync.Mutex
+	server *Server
+)
+
+// Server is a etcd member running in metad process.
+type Server struct {
+	config Config
+	etcd   *embed.Etcd
+}
+
+// Start the in-process etcd member and wait it ready to serve client requests.
+// Only one member can run in a process, so Start return the running one if it already started.
+func Start(config Config) (*Server, error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	config.setDefaults()
+	if server != nil {
+		if server.config.DataDir != config.DataDir {
+			return nil, fmt.Errorf("embedded etcd already started with data dir %s", server.config.DataDir)
+		}
+		return server, nil
+	}
+
+	cfg := embed.NewConfig()
+	cfg.Name = config.Name
+	cfg.Dir = config.DataDir
+	cfg.InitialCluster = config.InitialCluster
+	cfg.ClusterState = config.ClusterState
+	cfg.InitialClusterToken = "metad-cluster"
+	peerURLs, err := parseURLs(config.PeerURLs)
+	if err != nil {
+		return nil, err
+	}
+	cfg.LPUrls, cfg.APUrls = peerURLs, peerURLs
+	clientURLs, err := parseURLs(config.ClientURLs)
+	if err != nil {
+		return nil, err
+	}
+	cfg.LCUrls, cfg.ACUrls = clientURLs, clientURLs
+
+	log.Info("Starting embedded etcd %s, data dir: %s, initial cluster: %s", config.Name, config.DataDir, config.InitialCluster)
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+		log.Info("Embedded etcd %s is ready", config.Name)
+	case err := <-e.Err():
+		e.Close()
+		return nil, err
+	case <-time.After(StartTimeout):
+		e.Server.Stop()
+		e.Close()
+		return nil, fmt.Errorf("embedded etcd %s start timeout after %v", config.Name, StartTimeout)
+	}
+	go func() {
+		for err := range e.Err() {
+			log.Error("Embedded etcd error: %s", err.Error())
+		}
+	}()
+	server = &Server{config: config, etcd: e}
+	return server, nil
+}
+
+// ClientURLs return the urls for metad connect to the member.
+func (s *Server) ClientURLs() []string {
+	return s.config.ClientURLs
+}
+
+// Stop the member, the data dir is kept.
+func (s *Server) Stop() {
+	lock.Lock()
+	defer lock.Unlock()
+	s.etcd.Close()
+	if server == s {
+		server = nil
+	}
+}
+
+func parseURLs(urls []string) ([]url.URL, error) {
+	result := make([]url.URL, 0, len(urls))
+	for _, s := range urls {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid url %s: %s", s, err.Error())
+		}
+		result = append(result, *u)
+	}
+	return result, nil
+}
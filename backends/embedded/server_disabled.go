@@ -0,0 +1,27 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+//go:build !embed
+// +build !embed
+
+package embedded
+
+// Server is a etcd member running in metad process.
+type Server struct {
+	config Config
+}
+
+// Start always fail, as the embedded etcd is only available when build with the embed tag.
+func Start(config Config) (*Server, error) {
+	return nil, ErrNotSupported
+}
+
+// ClientURLs return the urls for metad connect to the member.
+func (s *Server) ClientURLs() []string {
+	return s.config.ClientURLs
+}
+
+// Stop the member.
+func (s *Server) Stop() {
+}
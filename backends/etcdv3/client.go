@@ -30,7 +30,15 @@ const RULE_PATH = "/_metad/rule"
 
 var (
 	//see github.com/coreos/etcd/etcdserver/api/v3rpc/key.go
+	// it should be same as the --max-txn-ops of etcd server.
 	MaxOpsPerTxn = 128
+	// PageSize is the max keys count of one range request, big prefix is loaded page by page.
+	PageSize int64 = 1000
+	// MinRetryInterval and MaxRetryInterval is the range of backoff interval when sync fail.
+	MinRetryInterval = 100 * time.Millisecond
+	MaxRetryInterval = 30 * time.Second
+	// TxnRetryTimes is the max retry times of Txn when the keys read by it are changed by others before commit.
+	TxnRetryTimes = 3
 )
 
 // Client is a wrapper around the etcd client
@@ -112,10 +120,40 @@ func (c *Client) Delete(nodePath string, dir bool) error {
 	return c.internalDelete(c.prefix, nodePath, dir)
 }
 
+// PutWithTTL put the value with a new lease of ttl, the lease is shared by all the keys put.
+func (c *Client) PutWithTTL(nodePath string, value interface{}, replace bool, ttl time.Duration) error {
+	return c.internalPutWithTTL(c.prefix, nodePath, value, replace, ttl)
+}
+
+func (c *Client) KeepAlive(nodePath string) error {
+	return c.keepAlive(c.prefix, nodePath)
+}
+
+func (c *Client) PutIfMatch(nodePath string, value interface{}, replace bool, rev int64) error {
+	return c.internalPutIfMatch(c.prefix, nodePath, value, replace, rev)
+}
+
+func (c *Client) DeleteIfMatch(nodePath string, dir bool, rev int64) error {
+	return c.internalDeleteIfMatch(c.prefix, nodePath, dir, rev)
+}
+
+func (c *Client) Txn(ops []store.TxnOp) error {
+	for i := 0; ; i++ {
+		err := c.internalTxn(ops)
+		if err != errTxnRetry {
+			return err
+		}
+		if i >= TxnRetryTimes {
+			return store.ErrRevisionConflict
+		}
+		log.Warning("Txn conflict with concurrent write, retry %v.", i+1)
+	}
+}
+
 func (c *Client) Sync(store store.Store, stopChan chan bool) {
 	initWG := &sync.WaitGroup{}
 	initWG.Add(1)
-	go c.internalSync(c.prefix, stopChan, initWG, c.newInitStoreFunc(c.prefix, store), newProcessSyncChangeFunc(store))
+	go c.internalSync(c.prefix, stopChan, initWG, c.newReloadStoreFunc(c.prefix, store), newProcessSyncChangeFunc(store))
 	initWG.Wait()
 }
 
@@ -141,19 +179,31 @@ func (c *Client) DeleteMapping(nodePath string, dir bool) error {
 	return c.internalDelete(c.mappingPrefix, nodePath, dir)
 }
 
+func (c *Client) PutMappingWithTTL(nodePath string, mapping interface{}, replace bool, ttl time.Duration) error {
+	return c.internalPutWithTTL(c.mappingPrefix, nodePath, mapping, replace, ttl)
+}
+
+func (c *Client) KeepAliveMapping(nodePath string) error {
+	return c.keepAlive(c.mappingPrefix, nodePath)
+}
+
 func (c *Client) SyncMapping(mapping store.Store, stopChan chan bool) {
 	initWG := &sync.WaitGroup{}
 	initWG.Add(1)
-	go c.internalSync(c.mappingPrefix, stopChan, initWG, c.newInitStoreFunc(c.mappingPrefix, mapping), newProcessSyncChangeFunc(mapping))
+	go c.internalSync(c.mappingPrefix, stopChan, initWG, c.newReloadStoreFunc(c.mappingPrefix, mapping), newProcessSyncChangeFunc(mapping))
 	initWG.Wait()
 }
 
 func (c *Client) GetAccessRule() (map[string][]store.AccessRule, error) {
-	result := make(map[string][]store.AccessRule)
 	m, err := c.internalGets(c.rulePrefix, "/")
 	if err != nil {
 		return nil, err
 	}
+	return toAccessRules(m), nil
+}
+
+func toAccessRules(m map[string]string) map[string][]store.AccessRule {
+	result := make(map[string][]store.AccessRule)
 	for k, v := range m {
 		rules, err := store.UnmarshalAccessRule(v)
 		if err != nil {
@@ -163,7 +213,7 @@ func (c *Client) GetAccessRule() (map[string][]store.AccessRule, error) {
 		_, host := path.Split(k)
 		result[host] = rules
 	}
-	return result, nil
+	return result
 }
 
 func (c *Client) PutAccessRule(rules map[string][]store.AccessRule) error {
@@ -190,13 +240,22 @@ func (c *Client) DeleteAccessRule(hosts []string) error {
 func (c *Client) SyncAccessRule(accessStore store.AccessStore, stopChan chan bool) {
 	initWG := &sync.WaitGroup{}
 	initWG.Add(1)
-	go c.internalSync(c.rulePrefix, stopChan, initWG, func() error {
-		val, err := c.GetAccessRule()
+	go c.internalSync(c.rulePrefix, stopChan, initWG, func() (int64, error) {
+		m, rev, err := c.internalGetsWithRev(c.rulePrefix, "/")
 		if err != nil {
-			return err
+			return 0, err
 		}
-		accessStore.Puts(val)
-		return nil
+		if err = c.checkStaging(c.rulePrefix, rev); err != nil {
+			return 0, err
+		}
+		rules := toAccessRules(m)
+		for host := range accessStore.GetAccessRule(nil) {
+			if _, ok := rules[host]; !ok {
+				accessStore.Delete(host)
+			}
+		}
+		accessStore.Puts(rules)
+		return rev, nil
 	}, func(event *client.Event, nodePath, value string) {
 		_, host := path.Split(nodePath)
 		switch event.Type {
@@ -216,18 +275,48 @@ func (c *Client) SyncAccessRule(accessStore store.AccessStore, stopChan chan boo
 }
 
 func (c *Client) internalGets(prefix, nodePath string) (map[string]string, error) {
+	vars, _, err := c.internalGetsWithRev(prefix, nodePath)
+	return vars, err
+}
+
+// internalGetsWithRev get the values under nodePath, return the values and the revision.
+func (c *Client) internalGetsWithRev(prefix, nodePath string) (map[string]string, int64, error) {
 	vars := make(map[string]string)
-	resp, err := c.client.Get(context.Background(), util.AppendPathPrefix(nodePath, prefix), client.WithPrefix())
+	rev, err := c.rangeGet(util.AppendPathPrefix(nodePath, prefix), func(resp *client.GetResponse) {
+		handleGetResp(prefix, resp, vars)
+	})
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
+	log.Debug("GetValues prefix:%s, nodePath:%s, revision:%v, resp:%v", prefix, nodePath, rev, vars)
+	return vars, rev, nil
+}
 
-	err = handleGetResp(prefix, resp, vars)
-	if err != nil {
-		return nil, err
+// rangeGet get the keys with the key prefix page by page, all pages are read at the revision of the first page,
+// so the result is a consistent snapshot, return the revision.
+func (c *Client) rangeGet(key string, handle func(resp *client.GetResponse)) (int64, error) {
+	end := client.GetPrefixRangeEnd(key)
+	var rev int64
+	for {
+		opts := []client.OpOption{client.WithRange(end), client.WithLimit(PageSize)}
+		if rev > 0 {
+			opts = append(opts, client.WithRev(rev))
+		}
+		resp, err := c.client.Get(context.Background(), key, opts...)
+		if err != nil {
+			return 0, err
+		}
+		if rev == 0 {
+			rev = resp.Header.Revision
+		}
+		handle(resp)
+		if !resp.More || len(resp.Kvs) == 0 {
+			break
+		}
+		// next page start after the last key.
+		key = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
 	}
-	log.Debug("GetValues prefix:%s, nodePath:%s, resp:%v", prefix, nodePath, vars)
-	return vars, nil
+	return rev, nil
 }
 
 func (c *Client) internalGet(prefix, nodePath string) (string, error) {
@@ -242,101 +331,195 @@ func (c *Client) internalGet(prefix, nodePath string) (string, error) {
 	}
 }
 
-// nodeWalk recursively descends nodes, updating vars.
-func handleGetResp(prefix string, resp *client.GetResponse, vars map[string]string) error {
+// handleGetResp put the kvs of resp to vars.
+func handleGetResp(prefix string, resp *client.GetResponse, vars map[string]string) {
 	if resp != nil {
 		kvs := resp.Kvs
 		for _, kv := range kvs {
 			key := string(kv.Key)
 			value := string(kv.Value)
 			// avoid output mapping config as metadata when prefix is "/"
-			if (prefix == "" || prefix == "/") && strings.HasPrefix(key, SELF_MAPPING_PATH) {
+			if isMetadConfig(prefix, key) {
 				continue
 			}
 			vars[util.TrimPathPrefix(key, prefix)] = value
 		}
-		//TODO handle resp.More for pages
 	}
-	return nil
 }
 
-func (c *Client) internalSync(prefix string, stopChan chan bool, initWG *sync.WaitGroup, initStoreFunc func() error, processChangeFunc func(event *client.Event, nodePath, value string)) {
-	var rev int64 = 0
-	init := false
-	stop := false
-	cancelRoutine := make(chan bool)
-	defer close(cancelRoutine)
-
-	var ctx context.Context
-	var cancel context.CancelFunc
+func isMetadConfig(prefix, key string) bool {
+	return key == stagingKey(prefix) || key == journalKey(prefix) ||
+		(prefix == "" || prefix == "/") && (strings.HasPrefix(key, SELF_MAPPING_PATH) || strings.HasPrefix(key, RULE_PATH))
+}
 
+// internalSync load all values under prefix by reloadFunc, then watch the change after the loaded revision.
+// if the revision has been compacted, reload all values. if the watch fail, retry with backoff.
+func (c *Client) internalSync(prefix string, stopChan chan bool, initWG *sync.WaitGroup, reloadFunc func() (int64, error), processChangeFunc func(event *client.Event, nodePath, value string)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	go func() {
 		select {
 		case <-stopChan:
 			log.Info("Sync %s stop.", prefix)
-			stop = true
-			if cancel != nil {
-				cancel()
-			}
-		case <-cancelRoutine:
-			return
+			cancel()
+		case <-ctx.Done():
 		}
 	}()
 
+	init := false
+	defer func() {
+		if !init {
+			initWG.Done()
+		}
+	}()
+
+	marker := stagingKey(prefix)
+	journal := journalKey(prefix)
+	process := func(event *client.Event) {
+		nodePath := util.TrimPathPrefix(string(event.Kv.Key), prefix)
+		value := string(event.Kv.Value)
+		log.Debug("process sync change, event_type: %s, prefix: %v, nodePath:%v, value: %v ", event.Type, prefix, nodePath, value)
+		processChangeFunc(event, nodePath, value)
+	}
+
+	// rev is the revision already synced, 0 means need reload.
+	var rev int64 = 0
+	retryInterval := MinRetryInterval
 	for {
-		if stop {
-			if !init {
-				initWG.Done()
-			}
+		if ctx.Err() != nil {
 			return
 		}
-		ctx, cancel = context.WithCancel(context.Background())
-		watchChan := c.client.Watch(ctx, prefix, client.WithPrefix(), client.WithRev(rev))
-		if watchChan == nil {
-			continue
-		}
-		for !init {
-			if stop {
-				initWG.Done()
-				return
-			}
-			err := initStoreFunc()
+		if rev == 0 {
+			var err error
+			rev, err = reloadFunc()
 			if err != nil {
-				log.Error("Get init value from etcd nodePath:%s, error-type: %s, error: %s", prefix, reflect.TypeOf(err), err.Error())
-				time.Sleep(time.Duration(1000) * time.Millisecond)
-				log.Info("Init store for prefix %s fail, retry.", prefix)
+				if err == errStaging {
+					log.Info("Staged write of prefix %s in progress, reload after %v.", prefix, retryInterval)
+					c.recoverStaging(prefix)
+				} else {
+					log.Error("Get init value from etcd nodePath:%s, error-type: %s, error: %s", prefix, reflect.TypeOf(err), err.Error())
+					log.Info("Init store for prefix %s fail, retry after %v.", prefix, retryInterval)
+				}
+				rev = 0
+				if !backoff(ctx, &retryInterval) {
+					return
+				}
 				continue
 			}
-			log.Info("Init store for prefix %s success.", prefix)
-			init = true
-			initWG.Done()
+			log.Info("Init store for prefix %s success, revision: %v.", prefix, rev)
+			if !init {
+				init = true
+				initWG.Done()
+			}
 		}
+
+		watchCtx, watchCancel := context.WithCancel(ctx)
+		watchChan := c.client.Watch(watchCtx, prefix, client.WithPrefix(), client.WithRev(rev+1))
+		compacted := false
+		// the changes of the staged write are buffered until the journal deleted.
+		staging := false
+		var staged []*client.Event
 		for resp := range watchChan {
+			if resp.CompactRevision != 0 {
+				log.Warning("Sync %s revision %v has been compacted to %v, reload all.", prefix, rev, resp.CompactRevision)
+				compacted = true
+				break
+			}
+			if err := resp.Err(); err != nil {
+				log.Error("Watch %s error: %s", prefix, err.Error())
+				break
+			}
 			for _, event := range resp.Events {
-				nodePath := string(event.Kv.Key)
+				key := string(event.Kv.Key)
+				if key == journal {
+					staging = event.Type == mvccpb.PUT
+					if !staging {
+						log.Debug("Apply %v staged changes of prefix %s.", len(staged), prefix)
+						for _, e := range staged {
+							process(e)
+						}
+						staged = nil
+					}
+					continue
+				}
+				if key == marker {
+					// the marker is deleted with the journal left, the writer crashed, roll back its write.
+					if staging && event.Type == mvccpb.DELETE {
+						c.recoverStaging(prefix)
+					}
+					continue
+				}
 				// avoid sync mapping config as metadata when prefix is "/"
-				if (prefix == "" || prefix == "/") && (strings.HasPrefix(nodePath, SELF_MAPPING_PATH) || strings.HasPrefix(nodePath, RULE_PATH)) {
+				if isMetadConfig(prefix, key) {
 					continue
 				}
-
-				nodePath = util.TrimPathPrefix(nodePath, prefix)
-				value := string(event.Kv.Value)
-				log.Debug("process sync change, event_type: %s, prefix: %v, nodePath:%v, value: %v ", event.Type, prefix, nodePath, value)
-				processChangeFunc(event, nodePath, value)
+				if staging {
+					staged = append(staged, event)
+					continue
+				}
+				process(event)
 			}
-			rev = resp.Header.Revision
+			// the staged changes are lost when rewatch, so keep the revision before the staged write until it finish.
+			if !staging && resp.Header.Revision > rev {
+				rev = resp.Header.Revision
+			}
+			retryInterval = MinRetryInterval
 		}
+		watchCancel()
+		if compacted {
+			rev = 0
+			continue
+		}
+		if ctx.Err() == nil {
+			log.Warning("Watch %s closed, rewatch from revision %v after %v.", prefix, rev+1, retryInterval)
+		}
+		if !backoff(ctx, &retryInterval) {
+			return
+		}
+	}
+}
+
+// backoff wait the interval and double it for next time, return false if ctx is done.
+func backoff(ctx context.Context, interval *time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(*interval):
+	}
+	*interval *= 2
+	if *interval > MaxRetryInterval {
+		*interval = MaxRetryInterval
 	}
+	return true
 }
 
-func (c *Client) newInitStoreFunc(prefix string, store store.Store) func() error {
-	return func() error {
-		val, err := c.internalGets(prefix, "/")
+// newReloadStoreFunc load all values under prefix, and apply the difference to the store with the revision of etcd.
+func (c *Client) newReloadStoreFunc(prefix string, s store.Store) func() (int64, error) {
+	return func() (int64, error) {
+		kvs := make(map[string]*mvccpb.KeyValue)
+		rev, err := c.rangeGet(util.AppendPathPrefix("/", prefix), func(resp *client.GetResponse) {
+			for _, kv := range resp.Kvs {
+				key := string(kv.Key)
+				if isMetadConfig(prefix, key) {
+					continue
+				}
+				kvs[util.TrimPathPrefix(key, prefix)] = kv
+			}
+		})
 		if err != nil {
-			return err
+			return 0, err
+		}
+		if err = c.checkStaging(prefix, rev); err != nil {
+			return 0, err
 		}
-		store.PutBulk("/", val)
-		return nil
+		values := make(map[string]string, len(kvs))
+		for k, kv := range kvs {
+			values[k] = string(kv.Value)
+		}
+		store.ApplyFlatmap(s, values, func(nodePath string) (int64, int64) {
+			return kvs[nodePath].CreateRevision, kvs[nodePath].ModRevision
+		}, rev)
+		return rev, nil
 	}
 }
 
@@ -344,68 +527,218 @@ func newProcessSyncChangeFunc(store store.Store) func(event *client.Event, nodeP
 	return func(event *client.Event, nodePath, value string) {
 		switch event.Type {
 		case mvccpb.PUT:
-			store.Put(nodePath, value)
+			store.PutWithRevision(nodePath, value, event.Kv.CreateRevision, event.Kv.ModRevision)
 		case mvccpb.DELETE:
-			store.Delete(nodePath)
+			store.DeleteWithRevision(nodePath, event.Kv.ModRevision)
 		default:
 			log.Warning("Unknow watch event type: %s ", event.Type)
-			store.Put(nodePath, value)
-
+			store.PutWithRevision(nodePath, value, event.Kv.CreateRevision, event.Kv.ModRevision)
 		}
 	}
 }
 
-func (c *Client) internalPut(prefix, nodePath string, value interface{}, replace bool) error {
+// internalPut put the value under nodePath, the opts is for the put ops, such as lease.
+func (c *Client) internalPut(prefix, nodePath string, value interface{}, replace bool, opts ...client.OpOption) error {
 	switch t := value.(type) {
 	case map[string]interface{}, map[string]string, []interface{}:
 		flatValues := flatmap.Flatten(t)
-		return c.internalPutValues(prefix, nodePath, flatValues, replace)
+		return c.internalPutValues(prefix, nodePath, flatValues, replace, opts...)
 	case string:
-		return c.internalPutValue(prefix, nodePath, t)
+		return c.internalPutValue(prefix, nodePath, t, opts...)
 	default:
 		log.Warning("Set unexpect value type: %s", reflect.TypeOf(value))
 		val := fmt.Sprintf("%v", t)
-		return c.internalPutValue(prefix, nodePath, val)
+		return c.internalPutValue(prefix, nodePath, val, opts...)
 	}
 }
 
-func (c *Client) internalPutValues(prefix string, nodePath string, values map[string]string, replace bool) error {
+// internalPutValues put the values under nodePath, if replace is true, the keys under nodePath not in values are deleted.
+// The puts and deletes are committed in one txn, so watchers see the replace as a single revision,
+// unless the ops count exceed MaxOpsPerTxn, then they are committed by chunks while holding the staging marker,
+// and the syncers apply the chunks together after the journal deleted, or the chunks are rolled back if any fail.
+// The txn fail if the keys read are changed by others before commit, then read and retry up to TxnRetryTimes.
+func (c *Client) internalPutValues(prefix string, nodePath string, values map[string]string, replace bool, opts ...client.OpOption) error {
 
 	new_prefix := util.AppendPathPrefix(nodePath, prefix)
-	ops := make([]client.Op, 0, len(values)+1)
-	if replace {
-		//delete and put can not in same txn.
-		c.internalDelete(prefix, nodePath, true)
+	var s *staging
+	defer func() {
+		if s != nil {
+			c.endStaging(s)
+		}
+	}()
+	for i := 0; ; {
+		var old map[string]*mvccpb.KeyValue
+		// the staged write read the old values for the journal.
+		if replace || s != nil {
+			var err error
+			old, err = c.getReplaced(prefix, new_prefix)
+			if err != nil {
+				return err
+			}
+		}
+		items := putValuesOps(new_prefix, values, old, replace, opts...)
+		if s == nil && len(items) > MaxOpsPerTxn {
+			log.Info("Put %s with %v ops exceed MaxOpsPerTxn %v, commit by chunks with staging.", new_prefix, len(items), MaxOpsPerTxn)
+			var err error
+			s, err = c.beginStaging(prefix, true)
+			if err != nil {
+				return err
+			}
+			// read again while holding the marker.
+			continue
+		}
+		var err error
+		if s != nil {
+			err = c.commitStaged(s, items)
+		} else {
+			err = c.commitKeyOps(items, nil)
+		}
+		if err != errTxnRetry {
+			return err
+		}
+		if i >= TxnRetryTimes {
+			return store.ErrRevisionConflict
+		}
+		i++
+		log.Warning("Put %s conflict with concurrent write, retry %v.", new_prefix, i+1)
 	}
+}
+
+// keyOp is the op of a key and the compare which guarantee the key is unchanged since read, either may be empty.
+// prev is the kv read before the op, it is kept in the journal of the staged write.
+type keyOp struct {
+	key  string
+	prev *mvccpb.KeyValue
+	cmps []client.Cmp
+	ops  []client.Op
+}
+
+// putValuesOps return the ops for put the values under nodePath, the unchanged values in old are skipped unless opts present,
+// if replace is true, the keys in old but not in values are deleted.
+// If old is read, the keys in it are compared with the read revision, and the others should not be created.
+func putValuesOps(nodePath string, values map[string]string, old map[string]*mvccpb.KeyValue, replace bool, opts ...client.OpOption) []keyOp {
+	items := make([]keyOp, 0, len(values)+len(old))
+	keys := make(map[string]bool, len(values))
 	for k, v := range values {
-		k = util.AppendPathPrefix(k, new_prefix)
-		ops = append(ops, client.OpPut(k, v))
-		log.Debug("SetValue prefix:%s, nodePath:%s, value:%s", new_prefix, k, v)
-	}
-	for ok := true; ok; {
-		var commitOps []client.Op
-		if len(ops) > MaxOpsPerTxn {
-			commitOps = ops[:MaxOpsPerTxn]
-			ops = ops[MaxOpsPerTxn:]
-		} else {
-			commitOps = ops
-			ok = false
+		k = util.AppendPathPrefix(k, nodePath)
+		keys[k] = true
+		kv, ok := old[k]
+		item := keyOp{key: k, prev: kv}
+		if ok {
+			item.cmps = []client.Cmp{client.Compare(client.ModRevision(k), "=", kv.ModRevision)}
+		} else if old != nil {
+			item.cmps = []client.Cmp{client.Compare(client.ModRevision(k), "=", 0)}
+		}
+		// the unchanged value should be put again for attach the new lease, or detach the old lease.
+		if !ok || string(kv.Value) != v || len(opts) > 0 || kv.Lease != 0 {
+			item.ops = []client.Op{client.OpPut(k, v, opts...)}
+			log.Debug("SetValue prefix:%s, nodePath:%s, value:%s", nodePath, k, v)
+		}
+		items = append(items, item)
+	}
+	if replace {
+		for k, kv := range old {
+			if !keys[k] {
+				items = append(items, keyOp{
+					key:  k,
+					prev: kv,
+					cmps: []client.Cmp{client.Compare(client.ModRevision(k), "=", kv.ModRevision)},
+					ops:  []client.Op{client.OpDelete(k)},
+				})
+				log.Debug("DeleteValue prefix:%s, nodePath:%s", nodePath, k)
+			}
+		}
+	}
+	return items
+}
+
+// getReplaced get the kvs which will be replaced by put nodePath as dir, include the nodePath self.
+func (c *Client) getReplaced(prefix string, nodePath string) (map[string]*mvccpb.KeyValue, error) {
+	old := make(map[string]*mvccpb.KeyValue)
+	dirKey := nodePath
+	// etcdv3 has not dir, for avoid replace "/nodes1" when replace "/nodes", so add "/" to dir nodePath end.
+	if dirKey[len(dirKey)-1] != '/' {
+		dirKey = dirKey + "/"
+	}
+	_, err := c.rangeGet(dirKey, func(resp *client.GetResponse) {
+		for _, kv := range resp.Kvs {
+			key := string(kv.Key)
+			// when replace "/", should avoid delete mapping
+			if isMetadConfig(prefix, key) {
+				continue
+			}
+			old[key] = kv
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if dirKey != nodePath {
+		resp, err := c.client.Get(context.Background(), nodePath)
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range resp.Kvs {
+			old[string(kv.Key)] = kv
+		}
+	}
+	return old, nil
+}
+
+// commitKeyOps commit the items in one txn, or by chunks of MaxOpsPerTxn if staging,
+// every chunk put the journal with the old values of the chunks committed.
+// return errTxnRetry if any compare fail.
+func (c *Client) commitKeyOps(items []keyOp, s *staging) error {
+	size := MaxOpsPerTxn
+	if s != nil {
+		// one compare for the staging marker, and one op for the journal.
+		size--
+	}
+	for len(items) > 0 {
+		chunk := items
+		if len(chunk) > size {
+			chunk = chunk[:size]
+		}
+		items = items[len(chunk):]
+		var cmps []client.Cmp
+		var ops []client.Op
+		var journal map[string]*journalEntry
+		if s != nil {
+			if err := c.holdStaging(s); err != nil {
+				return err
+			}
+			cmps = append(cmps, client.Compare(client.ModRevision(s.key), "=", s.rev))
+			// the journal is put before the chunk, so the syncers buffer the chunk.
+			var op client.Op
+			var err error
+			journal, op, err = s.journalOp(chunk)
+			if err != nil {
+				return err
+			}
+			ops = append(ops, op)
+		}
+		for _, item := range chunk {
+			cmps = append(cmps, item.cmps...)
+			ops = append(ops, item.ops...)
 		}
-		txn := c.client.Txn(context.TODO())
-		txn.Then(commitOps...)
-		resp, err := txn.Commit()
+		resp, err := c.client.Txn(context.TODO()).If(cmps...).Then(ops...).Commit()
 		log.Debug("SetValues err:%v, resp:%v", err, resp)
 		if err != nil {
 			return err
 		}
+		if !resp.Succeeded {
+			return errTxnRetry
+		}
+		if s != nil {
+			s.journal = journal
+		}
 	}
-
 	return nil
 }
 
-func (c *Client) internalPutValue(prefix string, nodePath string, value string) error {
+func (c *Client) internalPutValue(prefix string, nodePath string, value string, opts ...client.OpOption) error {
 	nodePath = util.AppendPathPrefix(nodePath, prefix)
-	resp, err := c.client.Put(context.TODO(), nodePath, value)
+	resp, err := c.client.Put(context.TODO(), nodePath, value, opts...)
 	log.Debug("SetValue nodePath: %s, value:%s, resp:%v", nodePath, value, resp)
 	if err != nil {
 		return err
@@ -458,3 +791,137 @@ func (c *Client) internalDelete(prefix, nodePath string, dir bool) error {
 	}
 	return err
 }
+
+// internalPutWithTTL put the value with a new lease of ttl,
+// and revoke the old leases of the keys under nodePath which are not used by any key after put.
+func (c *Client) internalPutWithTTL(prefix, nodePath string, value interface{}, replace bool, ttl time.Duration) error {
+	old, err := c.getReplaced(prefix, util.AppendPathPrefix(nodePath, prefix))
+	if err != nil {
+		return err
+	}
+	leaseID, err := c.grant(ttl)
+	if err != nil {
+		return err
+	}
+	if err = c.internalPut(prefix, nodePath, value, replace, client.WithLease(leaseID)); err != nil {
+		c.revoke(leaseID)
+		return err
+	}
+	for lease := range kvLeases(old) {
+		if lease == leaseID {
+			continue
+		}
+		resp, err := c.client.TimeToLive(context.TODO(), lease, client.WithAttachedKeys())
+		if err != nil {
+			log.Warning("Get lease %v error: %s", lease, err.Error())
+			continue
+		}
+		// the lease has expired if ttl is -1.
+		if resp.TTL > 0 && len(resp.Keys) == 0 {
+			log.Debug("Revoke superseded lease %v", lease)
+			c.revoke(lease)
+		}
+	}
+	return nil
+}
+
+// kvLeases return the leases of the kvs.
+func kvLeases(kvs map[string]*mvccpb.KeyValue) map[client.LeaseID]bool {
+	leases := make(map[client.LeaseID]bool)
+	for _, kv := range kvs {
+		if kv.Lease != 0 {
+			leases[client.LeaseID(kv.Lease)] = true
+		}
+	}
+	return leases
+}
+
+// grant create a lease with the ttl, the ttl is rounded up to seconds.
+func (c *Client) grant(ttl time.Duration) (client.LeaseID, error) {
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	resp, err := c.client.Grant(context.TODO(), seconds)
+	if err != nil {
+		return client.NoLease, err
+	}
+	return resp.ID, nil
+}
+
+// keepAlive renew the leases of the keys under nodePath, return store.ErrNoTTL if no key has lease.
+func (c *Client) keepAlive(prefix, nodePath string) error {
+	kvs, err := c.getReplaced(prefix, util.AppendPathPrefix(nodePath, prefix))
+	if err != nil {
+		return err
+	}
+	leases := kvLeases(kvs)
+	if len(leases) == 0 {
+		return store.ErrNoTTL
+	}
+	for leaseID := range leases {
+		resp, err := c.client.KeepAliveOnce(context.TODO(), leaseID)
+		log.Debug("KeepAlive lease %v, err:%v, resp:%v", leaseID, err, resp)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// internalPutIfMatch put the value only if the modified revision of nodePath is rev, 0 means nodePath not exist.
+// The dir value is not supported, etcd can not compare a key range, so the keys created under the dir by others
+// between the read and the txn can not be detected.
+func (c *Client) internalPutIfMatch(prefix, nodePath string, value interface{}, replace bool, rev int64) error {
+	key := util.AppendPathPrefix(nodePath, prefix)
+	var ops []client.Op
+	switch t := value.(type) {
+	case map[string]interface{}, map[string]string, []interface{}:
+		return store.ErrConditionNotSupported
+	case string:
+		ops = []client.Op{client.OpPut(key, t)}
+	default:
+		log.Warning("Set unexpect value type: %s", reflect.TypeOf(value))
+		ops = []client.Op{client.OpPut(key, fmt.Sprintf("%v", t))}
+	}
+	return c.commitIfMatch(key, []client.Cmp{client.Compare(client.ModRevision(key), "=", rev)}, ops)
+}
+
+// internalDeleteIfMatch delete nodePath only if the modified revision of nodePath is rev, the dir is not supported, same as internalPutIfMatch.
+func (c *Client) internalDeleteIfMatch(prefix, nodePath string, dir bool, rev int64) error {
+	if dir {
+		return store.ErrConditionNotSupported
+	}
+	key := util.AppendPathPrefix(nodePath, prefix)
+	return c.commitIfMatch(key, []client.Cmp{client.Compare(client.ModRevision(key), "=", rev)}, []client.Op{client.OpDelete(key)})
+}
+
+// checkRevision check the max modified revision of the kvs is rev, 0 means the kvs is empty.
+func checkRevision(kvs map[string]*mvccpb.KeyValue, rev int64) error {
+	if len(kvs) == 0 && rev != 0 {
+		return store.ErrRevisionConflict
+	}
+	for _, kv := range kvs {
+		// the dir revision include the deleted keys, so it may be greater than every exist key.
+		if kv.ModRevision > rev {
+			return store.ErrRevisionConflict
+		}
+	}
+	return nil
+}
+
+// commitIfMatch commit the ops in one txn if all the compares success, otherwise return store.ErrRevisionConflict.
+func (c *Client) commitIfMatch(key string, cmps []client.Cmp, ops []client.Op) error {
+	if len(cmps) > MaxOpsPerTxn || len(ops) > MaxOpsPerTxn {
+		return fmt.Errorf("Conditional write %s with %v compares and %v ops exceed MaxOpsPerTxn %v", key, len(cmps), len(ops), MaxOpsPerTxn)
+	}
+	resp, err := c.client.Txn(context.TODO()).If(cmps...).Then(ops...).Commit()
+	log.Debug("Conditional write %s err:%v, resp:%v", key, err, resp)
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return store.ErrRevisionConflict
+	}
+	return nil
+}
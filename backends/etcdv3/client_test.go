@@ -11,10 +11,13 @@ import (
 	"testing"
 	"time"
 
+	client "github.com/coreos/etcd/clientv3"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
 
 	"github.com/yunify/metad/log"
 	"github.com/yunify/metad/store"
+	"github.com/yunify/metad/util"
 )
 
 func init() {
@@ -45,7 +48,7 @@ func TestClientSyncStop(t *testing.T) {
 	doneWG.Add(1)
 
 	go func() {
-		storeClient.internalSync(prefix, stopChan, initWG, storeClient.newInitStoreFunc(prefix, metastore), newProcessSyncChangeFunc(metastore))
+		storeClient.internalSync(prefix, stopChan, initWG, storeClient.newReloadStoreFunc(prefix, metastore), newProcessSyncChangeFunc(metastore))
 		doneWG.Done()
 	}()
 	initWG.Wait()
@@ -74,11 +77,294 @@ func TestClientSyncStopWhenInitError(t *testing.T) {
 	doneWG := &sync.WaitGroup{}
 	doneWG.Add(1)
 	go func() {
-		storeClient.internalSync(prefix, stopChan, initWG, func() error {
-			return fmt.Errorf("always error")
+		storeClient.internalSync(prefix, stopChan, initWG, func() (int64, error) {
+			return 0, fmt.Errorf("always error")
 		}, newProcessSyncChangeFunc(metastore))
 		doneWG.Done()
 	}()
 	initWG.Wait()
 	doneWG.Wait()
 }
+
+func TestClientGetsPage(t *testing.T) {
+	oldPageSize := PageSize
+	PageSize = 2
+	defer func() {
+		PageSize = oldPageSize
+	}()
+
+	prefix := fmt.Sprintf("/prefix%v", rand.Intn(1000))
+	nodes := []string{"http://127.0.0.1:2379"}
+	storeClient, err := NewEtcdClient("default", prefix, nodes, "", "", "", false, "", "")
+	assert.NoError(t, err)
+	defer storeClient.Delete("/", true)
+
+	values := map[string]string{}
+	for i := 0; i < 5; i++ {
+		values[fmt.Sprintf("/%v", i)] = fmt.Sprintf("%v", i)
+	}
+	assert.NoError(t, storeClient.internalPutValues(prefix, "/", values, true))
+
+	m, rev, err := storeClient.internalGetsWithRev(prefix, "/")
+	assert.NoError(t, err)
+	assert.True(t, rev > 0)
+	assert.Equal(t, values, m)
+}
+
+func TestClientSyncCompacted(t *testing.T) {
+	prefix := fmt.Sprintf("/prefix%v", rand.Intn(1000))
+	nodes := []string{"http://127.0.0.1:2379"}
+	storeClient, err := NewEtcdClient("default", prefix, nodes, "", "", "", false, "", "")
+	assert.NoError(t, err)
+	defer storeClient.Delete("/", true)
+
+	assert.NoError(t, storeClient.Put("/deleted", "value", false))
+	_, staleRev, err := storeClient.internalGetsWithRev(prefix, "/")
+	assert.NoError(t, err)
+	assert.NoError(t, storeClient.Delete("/deleted", false))
+	assert.NoError(t, storeClient.Put("/new", "value", false))
+	_, rev, err := storeClient.internalGetsWithRev(prefix, "/")
+	assert.NoError(t, err)
+	_, err = storeClient.client.Compact(context.Background(), rev)
+	assert.NoError(t, err)
+
+	metastore := store.New()
+	metastore.Put("/deleted", "value")
+	reloadFunc := storeClient.newReloadStoreFunc(prefix, metastore)
+	first := true
+	stopChan := make(chan bool)
+	initWG := &sync.WaitGroup{}
+	initWG.Add(1)
+	// the first load return a compacted revision, as the sync fall behind.
+	go storeClient.internalSync(prefix, stopChan, initWG, func() (int64, error) {
+		if first {
+			first = false
+			return staleRev, nil
+		}
+		return reloadFunc()
+	}, newProcessSyncChangeFunc(metastore))
+	initWG.Wait()
+	time.Sleep(1000 * time.Millisecond)
+	stopChan <- true
+
+	_, val := metastore.Get("/deleted")
+	assert.Nil(t, val)
+	_, val = metastore.Get("/new")
+	assert.Equal(t, "value", val)
+}
+
+func TestClientReplaceInOneRevision(t *testing.T) {
+	prefix := fmt.Sprintf("/prefix%v", rand.Intn(1000))
+	nodes := []string{"http://127.0.0.1:2379"}
+	storeClient, err := NewEtcdClient("default", prefix, nodes, "", "", "", false, "", "")
+	assert.NoError(t, err)
+	defer storeClient.Delete("/", true)
+
+	assert.NoError(t, storeClient.Put("/nodes", map[string]interface{}{"1": "node1", "2": "node2"}, true))
+	assert.NoError(t, storeClient.Put("/nodes1", "keep", false))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watchChan := storeClient.client.Watch(ctx, prefix, client.WithPrefix())
+	assert.NoError(t, storeClient.Put("/nodes", map[string]interface{}{"2": "node2", "3": "node3"}, true))
+
+	resp := <-watchChan
+	// delete 1 and put 3 in one revision, 2 is unchanged.
+	assert.Equal(t, 2, len(resp.Events))
+	for _, event := range resp.Events {
+		assert.Equal(t, resp.Events[0].Kv.ModRevision, event.Kv.ModRevision)
+	}
+
+	val, err := storeClient.Get("/", true)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"nodes":  map[string]interface{}{"2": "node2", "3": "node3"},
+		"nodes1": "keep",
+	}, val)
+}
+
+func TestClientDirIfMatch(t *testing.T) {
+	prefix := fmt.Sprintf("/prefix%v", rand.Intn(1000))
+	nodes := []string{"http://127.0.0.1:2379"}
+	storeClient, err := NewEtcdClient("default", prefix, nodes, "", "", "", false, "", "")
+	assert.NoError(t, err)
+	defer storeClient.Delete("/", true)
+
+	assert.NoError(t, storeClient.Put("/nodes", map[string]interface{}{"1": "node1"}, true))
+	resp, err := storeClient.client.Get(context.Background(), prefix+"/nodes/1")
+	assert.NoError(t, err)
+	rev := resp.Kvs[0].ModRevision
+
+	// the keys created in the dir can not be compared, so the dir precondition is not supported.
+	assert.Equal(t, store.ErrConditionNotSupported, storeClient.PutIfMatch("/nodes", map[string]interface{}{"2": "node2"}, false, rev))
+	assert.Equal(t, store.ErrConditionNotSupported, storeClient.DeleteIfMatch("/nodes", true, rev))
+	ops := []store.TxnOp{{Target: store.TxnTargetData, Action: store.TxnActionDelete, Path: "/nodes", IfMatch: &rev}}
+	assert.Equal(t, store.ErrConditionNotSupported, storeClient.Txn(ops))
+
+	ops = []store.TxnOp{{Target: store.TxnTargetData, Action: store.TxnActionMerge, Path: "/nodes/1", Value: "node1-1", IfMatch: &rev}}
+	assert.NoError(t, storeClient.Txn(ops))
+	assert.Equal(t, store.ErrRevisionConflict, storeClient.PutIfMatch("/nodes/1", "node1-2", false, rev))
+}
+
+func TestClientReplaceStaged(t *testing.T) {
+	prefix := fmt.Sprintf("/prefix%v", rand.Intn(1000))
+	nodes := []string{"http://127.0.0.1:2379"}
+	storeClient, err := NewEtcdClient("default", prefix, nodes, "", "", "", false, "", "")
+	assert.NoError(t, err)
+	defer storeClient.Delete("/", true)
+
+	oldMaxOps := MaxOpsPerTxn
+	MaxOpsPerTxn = 4
+	defer func() { MaxOpsPerTxn = oldMaxOps }()
+
+	values := make(map[string]interface{})
+	for i := 0; i < 10; i++ {
+		values[fmt.Sprintf("%v", i)] = fmt.Sprintf("node%v", i)
+	}
+	assert.NoError(t, storeClient.Put("/nodes", values, true))
+
+	stopChan := make(chan bool)
+	defer func() { stopChan <- true }()
+	metastore := store.New()
+	processChangeFunc := newProcessSyncChangeFunc(metastore)
+	initWG := &sync.WaitGroup{}
+	initWG.Add(1)
+	go storeClient.internalSync(prefix, stopChan, initWG, storeClient.newReloadStoreFunc(prefix, metastore), func(event *client.Event, nodePath, value string) {
+		// the changes are applied after the whole write committed.
+		m, err := storeClient.internalGets(prefix, "/nodes")
+		assert.NoError(t, err)
+		assert.Equal(t, 8, len(m))
+		processChangeFunc(event, nodePath, value)
+	})
+	initWG.Wait()
+
+	newValues := make(map[string]interface{})
+	for i := 2; i < 10; i++ {
+		newValues[fmt.Sprintf("%v", i)] = fmt.Sprintf("new%v", i)
+	}
+	assert.NoError(t, storeClient.Put("/nodes", newValues, true))
+	time.Sleep(1000 * time.Millisecond)
+
+	_, val := metastore.Get("/nodes")
+	assert.Equal(t, newValues, val)
+	resp, err := storeClient.client.Get(context.Background(), stagingKey(prefix))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(resp.Kvs))
+	resp, err = storeClient.client.Get(context.Background(), journalKey(prefix))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(resp.Kvs))
+}
+
+func TestClientStagedRollback(t *testing.T) {
+	prefix := fmt.Sprintf("/prefix%v", rand.Intn(1000))
+	nodes := []string{"http://127.0.0.1:2379"}
+	storeClient, err := NewEtcdClient("default", prefix, nodes, "", "", "", false, "", "")
+	assert.NoError(t, err)
+	defer storeClient.Delete("/", true)
+
+	oldMaxOps := MaxOpsPerTxn
+	MaxOpsPerTxn = 4
+	defer func() { MaxOpsPerTxn = oldMaxOps }()
+
+	values := make(map[string]interface{})
+	for i := 0; i < 10; i++ {
+		values[fmt.Sprintf("%v", i)] = fmt.Sprintf("node%v", i)
+	}
+	assert.NoError(t, storeClient.Put("/nodes", values, true))
+
+	stopChan := make(chan bool)
+	defer func() { stopChan <- true }()
+	metastore := store.New()
+	processChangeFunc := newProcessSyncChangeFunc(metastore)
+	initWG := &sync.WaitGroup{}
+	initWG.Add(1)
+	go storeClient.internalSync(prefix, stopChan, initWG, storeClient.newReloadStoreFunc(prefix, metastore), func(event *client.Event, nodePath, value string) {
+		// the syncer only apply the changes after the journal deleted.
+		resp, err := storeClient.client.Get(context.Background(), journalKey(prefix))
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(resp.Kvs))
+		processChangeFunc(event, nodePath, value)
+	})
+	initWG.Wait()
+
+	newValues := make(map[string]string)
+	for i := 2; i < 10; i++ {
+		newValues[fmt.Sprintf("/%v", i)] = fmt.Sprintf("new%v", i)
+	}
+	nodePath := util.AppendPathPrefix("/nodes", prefix)
+	stagedItems := func() []keyOp {
+		old, err := storeClient.getReplaced(prefix, nodePath)
+		assert.NoError(t, err)
+		return putValuesOps(nodePath, newValues, old, true)
+	}
+
+	// the last chunk fail by a concurrent write, the chunks committed are rolled back.
+	s, err := storeClient.beginStaging(prefix, true)
+	assert.NoError(t, err)
+	items := stagedItems()
+	conflictKey := items[len(items)-1].key
+	_, err = storeClient.client.Put(context.Background(), conflictKey, "concurrent")
+	assert.NoError(t, err)
+	assert.Equal(t, errTxnRetry, storeClient.commitStaged(s, items))
+	storeClient.endStaging(s)
+	time.Sleep(1000 * time.Millisecond)
+
+	expect := make(map[string]interface{})
+	for k, v := range values {
+		expect[k] = v
+	}
+	conflictNode := util.TrimPathPrefix(conflictKey, nodePath)[1:]
+	expect[conflictNode] = "concurrent"
+	m, err := storeClient.Get("/nodes", true)
+	assert.NoError(t, err)
+	assert.Equal(t, expect, m)
+	_, val := metastore.Get("/nodes")
+	assert.Equal(t, expect, val)
+
+	// the writer crash after the first chunk, the write is rolled back after the marker deleted.
+	s, err = storeClient.beginStaging(prefix, true)
+	assert.NoError(t, err)
+	items = stagedItems()
+	assert.NoError(t, storeClient.commitKeyOps(items[:MaxOpsPerTxn-1], s))
+	storeClient.endStaging(s)
+	time.Sleep(1000 * time.Millisecond)
+
+	m, err = storeClient.Get("/nodes", true)
+	assert.NoError(t, err)
+	assert.Equal(t, expect, m)
+	_, val = metastore.Get("/nodes")
+	assert.Equal(t, expect, val)
+	resp, err := storeClient.client.Get(context.Background(), journalKey(prefix))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(resp.Kvs))
+}
+
+func TestClientRevokeSupersededLease(t *testing.T) {
+	prefix := fmt.Sprintf("/prefix%v", rand.Intn(1000))
+	nodes := []string{"http://127.0.0.1:2379"}
+	storeClient, err := NewEtcdClient("default", prefix, nodes, "", "", "", false, "", "")
+	assert.NoError(t, err)
+	defer storeClient.Delete("/", true)
+
+	leaseOf := func(key string) int64 {
+		resp, err := storeClient.client.Get(context.Background(), prefix+key)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(resp.Kvs))
+		return resp.Kvs[0].Lease
+	}
+	ttl := 10 * time.Second
+	assert.NoError(t, storeClient.PutWithTTL("/agents", map[string]interface{}{"1": "up", "2": "up"}, true, ttl))
+	oldLease := leaseOf("/agents/1")
+
+	// the old lease is still used by "/agents/2".
+	assert.NoError(t, storeClient.PutWithTTL("/agents/1", "up", false, ttl))
+	resp, err := storeClient.client.TimeToLive(context.Background(), client.LeaseID(oldLease))
+	assert.NoError(t, err)
+	assert.True(t, resp.TTL > 0)
+
+	assert.NoError(t, storeClient.PutWithTTL("/agents", map[string]interface{}{"1": "up", "2": "up"}, true, ttl))
+	assert.NotEqual(t, oldLease, leaseOf("/agents/2"))
+	resp, err = storeClient.client.TimeToLive(context.Background(), client.LeaseID(oldLease))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1), resp.TTL)
+}
@@ -0,0 +1,259 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package etcdv3
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	client "github.com/coreos/etcd/clientv3"
+	"golang.org/x/net/context"
+
+	"github.com/yunify/metad/log"
+	"github.com/yunify/metad/store"
+	"github.com/yunify/metad/util"
+)
+
+// STAGING_PATH is the staging marker key under the prefix, it is the lock held with a lease by the write
+// which exceed MaxOpsPerTxn and is committed by chunks.
+const STAGING_PATH = "/_metad/staging"
+
+// JOURNAL_PATH is the undo journal of the staged write, it keep the old values of the keys committed, and is put in the txn of every chunk.
+// The syncers buffer the changes while the journal exists, and apply them together after it deleted,
+// so they never see a partial write. The journal is deleted after the whole write committed, or rolled back by it.
+const JOURNAL_PATH = "/_metad/journal"
+
+// StagingTTL is the lease ttl of the staging marker, and the max time to wait for the other staged write.
+// If the writer crash, the marker is deleted after ttl, then the partial write is rolled back by the journal.
+var StagingTTL = 60 * time.Second
+
+// errStaging means a staged write is in progress, the reload should retry after it finish.
+var errStaging = errors.New("Staged write in progress")
+
+// staging is the staging marker held by the writer.
+type staging struct {
+	key        string
+	journalKey string
+	lease      client.LeaseID
+	// rev is the modified revision of the marker, the chunks compare it to make sure the marker still held.
+	rev int64
+	// journal is the old value of the keys committed, nil value means the key not exists before.
+	journal map[string]*journalEntry
+}
+
+// journalEntry is the old value of a key in the journal, the lease is restored if it is still alive.
+type journalEntry struct {
+	Value string `json:"value"`
+	Lease int64  `json:"lease,omitempty"`
+}
+
+func stagingKey(prefix string) string {
+	return util.AppendPathPrefix(STAGING_PATH, prefix)
+}
+
+func journalKey(prefix string) string {
+	return util.AppendPathPrefix(JOURNAL_PATH, prefix)
+}
+
+// beginStaging put the staging marker of prefix with a lease, if another staged write is in progress, wait it finish,
+// or return errStaging if not wait. The journal left by the crashed writer is rolled back before return.
+func (c *Client) beginStaging(prefix string, wait bool) (*staging, error) {
+	key := stagingKey(prefix)
+	lease, err := c.grant(StagingTTL)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(StagingTTL)
+	retryInterval := MinRetryInterval
+	for {
+		resp, err := c.client.Txn(context.TODO()).
+			If(client.Compare(client.CreateRevision(key), "=", 0)).
+			Then(client.OpPut(key, "", client.WithLease(lease)), client.OpGet(journalKey(prefix))).
+			Commit()
+		if err != nil {
+			c.revoke(lease)
+			return nil, err
+		}
+		if resp.Succeeded {
+			s := &staging{key: key, journalKey: journalKey(prefix), lease: lease, rev: resp.Header.Revision}
+			if kvs := resp.Responses[1].GetResponseRange().Kvs; len(kvs) > 0 {
+				log.Warning("Roll back the staged write of prefix %s left by the crashed writer.", prefix)
+				if err = json.Unmarshal(kvs[0].Value, &s.journal); err == nil {
+					err = c.rollbackStaging(s)
+				}
+				if err != nil {
+					c.endStaging(s)
+					return nil, err
+				}
+			}
+			return s, nil
+		}
+		if !wait {
+			c.revoke(lease)
+			return nil, errStaging
+		}
+		if time.Now().After(deadline) {
+			c.revoke(lease)
+			return nil, store.ErrRevisionConflict
+		}
+		log.Info("Another staged write of prefix %s in progress, retry after %v.", prefix, retryInterval)
+		backoff(context.Background(), &retryInterval)
+	}
+}
+
+// holdStaging renew the lease of the staging marker before commit a chunk.
+func (c *Client) holdStaging(s *staging) error {
+	_, err := c.client.KeepAliveOnce(context.TODO(), s.lease)
+	return err
+}
+
+// endStaging delete the staging marker by revoke its lease.
+func (c *Client) endStaging(s *staging) {
+	c.revoke(s.lease)
+}
+
+func (c *Client) revoke(lease client.LeaseID) {
+	if _, err := c.client.Revoke(context.TODO(), lease); err != nil {
+		log.Error("Revoke lease %v error: %s", lease, err.Error())
+	}
+}
+
+// commitStaged commit the items by chunks while holding the staging marker, then delete the journal.
+// If any chunk fail, the chunks committed are rolled back, and the error of the chunk is returned.
+func (c *Client) commitStaged(s *staging, items []keyOp) error {
+	err := c.commitKeyOps(items, s)
+	if err == nil {
+		return c.finishStaging(s)
+	}
+	if s.journal != nil {
+		if rerr := c.rollbackStaging(s); rerr != nil {
+			log.Error("Roll back the staged write error: %s, retry after the staging marker deleted.", rerr.Error())
+		}
+	}
+	return err
+}
+
+// journalOp return the journal with the old values of the chunk added, and the op to put it.
+// The journal of the staging is replaced by it only after the chunk committed.
+func (s *staging) journalOp(chunk []keyOp) (map[string]*journalEntry, client.Op, error) {
+	journal := make(map[string]*journalEntry, len(s.journal)+len(chunk))
+	for k, entry := range s.journal {
+		journal[k] = entry
+	}
+	for _, item := range chunk {
+		if len(item.ops) == 0 {
+			continue
+		}
+		if _, ok := journal[item.key]; ok {
+			continue
+		}
+		var entry *journalEntry
+		if item.prev != nil {
+			entry = &journalEntry{Value: string(item.prev.Value), Lease: item.prev.Lease}
+		}
+		journal[item.key] = entry
+	}
+	data, err := json.Marshal(journal)
+	if err != nil {
+		return nil, client.Op{}, err
+	}
+	return journal, client.OpPut(s.journalKey, string(data)), nil
+}
+
+// finishStaging delete the journal after the whole write committed, then the syncers apply the staged changes.
+func (c *Client) finishStaging(s *staging) error {
+	resp, err := c.client.Txn(context.TODO()).
+		If(client.Compare(client.ModRevision(s.key), "=", s.rev)).
+		Then(client.OpDelete(s.journalKey)).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return store.ErrRevisionConflict
+	}
+	s.journal = nil
+	return nil
+}
+
+// rollbackStaging restore the old values in the journal by chunks, then delete the journal.
+// The key whose old lease has expired is deleted, as the lease would have deleted it.
+func (c *Client) rollbackStaging(s *staging) error {
+	alive := make(map[int64]bool)
+	var ops []client.Op
+	for k, entry := range s.journal {
+		if entry == nil {
+			ops = append(ops, client.OpDelete(k))
+			continue
+		}
+		if entry.Lease == 0 {
+			ops = append(ops, client.OpPut(k, entry.Value))
+			continue
+		}
+		ok, checked := alive[entry.Lease]
+		if !checked {
+			resp, err := c.client.TimeToLive(context.TODO(), client.LeaseID(entry.Lease))
+			if err != nil {
+				return err
+			}
+			ok = resp.TTL > 0
+			alive[entry.Lease] = ok
+		}
+		if ok {
+			ops = append(ops, client.OpPut(k, entry.Value, client.WithLease(client.LeaseID(entry.Lease))))
+		} else {
+			ops = append(ops, client.OpDelete(k))
+		}
+	}
+	ops = append(ops, client.OpDelete(s.journalKey))
+	for len(ops) > 0 {
+		chunk := ops
+		if len(chunk) > MaxOpsPerTxn {
+			chunk = chunk[:MaxOpsPerTxn]
+		}
+		ops = ops[len(chunk):]
+		if err := c.holdStaging(s); err != nil {
+			return err
+		}
+		resp, err := c.client.Txn(context.TODO()).
+			If(client.Compare(client.ModRevision(s.key), "=", s.rev)).
+			Then(chunk...).
+			Commit()
+		if err != nil {
+			return err
+		}
+		if !resp.Succeeded {
+			return store.ErrRevisionConflict
+		}
+	}
+	log.Info("Roll back %v keys of the staged write.", len(s.journal))
+	s.journal = nil
+	return nil
+}
+
+// recoverStaging roll back the staged write of prefix if its writer crashed, that is the journal exists without the marker.
+func (c *Client) recoverStaging(prefix string) {
+	s, err := c.beginStaging(prefix, false)
+	if err != nil {
+		if err != errStaging {
+			log.Error("Recover the staged write of prefix %s error: %s", prefix, err.Error())
+		}
+		return
+	}
+	c.endStaging(s)
+}
+
+// checkStaging return errStaging if the journal of prefix exists at the revision.
+func (c *Client) checkStaging(prefix string, rev int64) error {
+	resp, err := c.client.Get(context.Background(), journalKey(prefix), client.WithRev(rev), client.WithCountOnly())
+	if err != nil {
+		return err
+	}
+	if resp.Count > 0 {
+		return errStaging
+	}
+	return nil
+}
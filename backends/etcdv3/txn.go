@@ -0,0 +1,181 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package etcdv3
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+
+	client "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"golang.org/x/net/context"
+
+	"github.com/yunify/metad/log"
+	"github.com/yunify/metad/store"
+	"github.com/yunify/metad/util"
+	"github.com/yunify/metad/util/flatmap"
+)
+
+// errTxnRetry means the keys read by the txn are changed before commit, the txn should retry.
+var errTxnRetry = errors.New("Txn should retry")
+
+// txnView is the keys the txn read and the result after apply the ops on them.
+type txnView struct {
+	read   map[string]*mvccpb.KeyValue
+	values map[string]string
+}
+
+// internalTxn read the keys the ops touched, apply the ops on them in memory,
+// then commit the difference in one etcd txn, which compare every read key is unchanged.
+func (c *Client) internalTxn(ops []store.TxnOp) error {
+	view := &txnView{read: make(map[string]*mvccpb.KeyValue), values: make(map[string]string)}
+	for _, op := range ops {
+		prefix, key := c.txnKey(op)
+		var kvs map[string]*mvccpb.KeyValue
+		var err error
+		if op.Target == store.TxnTargetRule {
+			kvs, err = c.getExact(key)
+		} else {
+			kvs, err = c.getReplaced(prefix, key)
+		}
+		if err != nil {
+			return err
+		}
+		if op.IfMatch != nil {
+			// same as internalPutIfMatch, the precondition of dir is not supported.
+			if isDirOp(op, key, kvs) {
+				return store.ErrConditionNotSupported
+			}
+			if err = checkRevision(kvs, *op.IfMatch); err != nil {
+				return err
+			}
+		}
+		for k, kv := range kvs {
+			if _, ok := view.read[k]; !ok {
+				view.read[k] = kv
+				view.values[k] = string(kv.Value)
+			}
+		}
+	}
+
+	for _, op := range ops {
+		prefix, key := c.txnKey(op)
+		switch op.Action {
+		case store.TxnActionPut, store.TxnActionMerge:
+			if op.Target == store.TxnTargetRule {
+				view.values[key] = store.MarshalAccessRule(op.Rules)
+				continue
+			}
+			switch t := op.Value.(type) {
+			case map[string]interface{}, map[string]string, []interface{}:
+				if op.Action == store.TxnActionPut {
+					view.delete(prefix, key, true)
+				}
+				for k, v := range flatmap.Flatten(t) {
+					view.values[util.AppendPathPrefix(k, key)] = v
+				}
+			case string:
+				view.values[key] = t
+			default:
+				log.Warning("Set unexpect value type: %s", reflect.TypeOf(op.Value))
+				view.values[key] = fmt.Sprintf("%v", t)
+			}
+		case store.TxnActionDelete:
+			view.delete(prefix, key, op.Dir)
+		}
+	}
+
+	var cmps []client.Cmp
+	var txnOps []client.Op
+	for k, kv := range view.read {
+		cmps = append(cmps, client.Compare(client.ModRevision(k), "=", kv.ModRevision))
+		if _, ok := view.values[k]; !ok {
+			txnOps = append(txnOps, client.OpDelete(k))
+			log.Debug("Txn delete key:%s", k)
+		}
+	}
+	for k, v := range view.values {
+		kv, ok := view.read[k]
+		if !ok {
+			// the key should not be created by others.
+			cmps = append(cmps, client.Compare(client.ModRevision(k), "=", 0))
+		} else if string(kv.Value) == v {
+			continue
+		}
+		txnOps = append(txnOps, client.OpPut(k, v))
+		log.Debug("Txn put key:%s, value:%s", k, v)
+	}
+	if len(cmps) > MaxOpsPerTxn || len(txnOps) > MaxOpsPerTxn {
+		return fmt.Errorf("Txn with %v compares and %v ops exceed MaxOpsPerTxn %v", len(cmps), len(txnOps), MaxOpsPerTxn)
+	}
+	resp, err := c.client.Txn(context.TODO()).If(cmps...).Then(txnOps...).Commit()
+	log.Debug("Txn err:%v, resp:%v", err, resp)
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return errTxnRetry
+	}
+	return nil
+}
+
+// isDirOp check the op put a dir value, or the path of op is a dir.
+func isDirOp(op store.TxnOp, key string, kvs map[string]*mvccpb.KeyValue) bool {
+	switch op.Value.(type) {
+	case map[string]interface{}, map[string]string, []interface{}:
+		return true
+	}
+	if op.Action == store.TxnActionDelete && op.Dir {
+		return true
+	}
+	for k := range kvs {
+		if k != key {
+			return true
+		}
+	}
+	return false
+}
+
+// txnKey return the prefix and the etcd key of the op.
+func (c *Client) txnKey(op store.TxnOp) (prefix string, key string) {
+	switch op.Target {
+	case store.TxnTargetMapping:
+		prefix = c.mappingPrefix
+	case store.TxnTargetRule:
+		prefix = c.rulePrefix
+	default:
+		prefix = c.prefix
+	}
+	return prefix, util.AppendPathPrefix(path.Join("/", op.Path), prefix)
+}
+
+// getExact get the kv of the key only, without the keys under it.
+func (c *Client) getExact(key string) (map[string]*mvccpb.KeyValue, error) {
+	resp, err := c.client.Get(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+	kvs := make(map[string]*mvccpb.KeyValue, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		kvs[string(kv.Key)] = kv
+	}
+	return kvs, nil
+}
+
+// delete remove the key, and the keys under it if dir is true.
+func (v *txnView) delete(prefix, key string, dir bool) {
+	dirKey := key
+	if !strings.HasSuffix(dirKey, "/") {
+		dirKey = dirKey + "/"
+	}
+	for k := range v.values {
+		if k == key || (dir && strings.HasPrefix(k, dirKey) && !isMetadConfig(prefix, k)) {
+			delete(v.values, k)
+		}
+	}
+}
@@ -0,0 +1,745 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package file
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/yunify/metad/atomic"
+	"github.com/yunify/metad/log"
+	"github.com/yunify/metad/store"
+	"github.com/yunify/metad/util"
+	"github.com/yunify/metad/util/flatmap"
+)
+
+const SELF_MAPPING_PATH = "/_metad/mapping"
+const RULE_PATH = "/_metad/rule"
+
+// ROOT_DOCUMENT is the document name which is mounted at the directory contains it,
+// other documents are mounted at their relative path without extension.
+const ROOT_DOCUMENT = "_root"
+
+var (
+	documentExts = []string{".yaml", ".yml", ".json"}
+	// reloadDelay is the time to wait for more file changes before reload.
+	reloadDelay = 100 * time.Millisecond
+)
+
+type document struct {
+	file  string
+	mount string
+	// the flatmap which loaded from or written to the file, keys are full node path.
+	flat map[string]string
+}
+
+// Client is a backend which keep data, mapping and rules in a directory of YAML/JSON files.
+type Client struct {
+	root        string
+	dataDir     string
+	mappingFile string
+	ruleFile    string
+
+	data        store.Store
+	mapping     store.Store
+	rules       map[string][]store.AccessRule
+	accessStore store.AccessStore
+	documents   []*document
+	// mappingFlat is the flatmap loaded from or written to the mapping file.
+	mappingFlat map[string]string
+
+	watcher    *dirWatcher
+	changeChan chan bool
+	lock       sync.Mutex
+}
+
+// NewFileClient returns a *file.Client serve metadata from the dir.
+func NewFileClient(group string, prefix string, dir string) (*Client, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("file backend require a directory")
+	}
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	// data and mapping share the version, keep their revisions comparable.
+	// The revisions are not persisted, so the version start from the start time in microseconds,
+	// the revision got before restart does not match any node after restart.
+	version := atomic.AtomicLong(time.Now().UnixNano() / int64(time.Microsecond))
+	c := &Client{
+		root:        root,
+		dataDir:     filepath.Join(root, filepath.FromSlash(prefix)),
+		mappingFile: filepath.Join(root, filepath.FromSlash(path.Join(SELF_MAPPING_PATH, group))),
+		ruleFile:    filepath.Join(root, filepath.FromSlash(path.Join(RULE_PATH, group))),
+		data:        store.NewWithVersion(&version),
+		mapping:     store.NewWithVersion(&version),
+		rules:       map[string][]store.AccessRule{},
+		changeChan:  make(chan bool, 1),
+	}
+	for _, d := range []string{c.dataDir, filepath.Dir(c.mappingFile), filepath.Dir(c.ruleFile)} {
+		if err = os.MkdirAll(d, 0755); err != nil {
+			return nil, err
+		}
+	}
+	c.mappingFile = findDocument(c.mappingFile)
+	c.ruleFile = findDocument(c.ruleFile)
+
+	if err = c.load(); err != nil {
+		return nil, err
+	}
+	go c.processChange()
+	if err = c.watch(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Client) Get(nodePath string, dir bool) (interface{}, error) {
+	_, r := c.data.Get(nodePath)
+	if r != nil {
+		return r, nil
+	} else {
+		if dir {
+			return map[string]interface{}{}, nil
+		} else {
+			return "", nil
+		}
+	}
+}
+
+func (c *Client) Put(nodePath string, value interface{}, replace bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.updateData(nodePath, func(s store.Store) {
+		if replace {
+			s.Delete(nodePath)
+		}
+		s.Put(nodePath, normalizeValue(value))
+	})
+}
+
+func (c *Client) Delete(nodePath string, dir bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.updateData(nodePath, func(s store.Store) {
+		s.Delete(nodePath)
+	})
+}
+
+func (c *Client) PutIfMatch(nodePath string, value interface{}, replace bool, rev int64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, modifiedRev := c.data.GetRevision(nodePath); modifiedRev != rev {
+		return store.ErrRevisionConflict
+	}
+	return c.updateData(nodePath, func(s store.Store) {
+		if replace {
+			s.Delete(nodePath)
+		}
+		s.Put(nodePath, normalizeValue(value))
+	})
+}
+
+func (c *Client) DeleteIfMatch(nodePath string, dir bool, rev int64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, modifiedRev := c.data.GetRevision(nodePath); modifiedRev != rev {
+		return store.ErrRevisionConflict
+	}
+	return c.updateData(nodePath, func(s store.Store) {
+		s.Delete(nodePath)
+	})
+}
+
+// Txn is not supported, the data, mapping and rules are saved in different files.
+func (c *Client) Txn(ops []store.TxnOp) error {
+	return store.ErrTxnNotSupported
+}
+
+// PutWithTTL is not supported.
+func (c *Client) PutWithTTL(nodePath string, value interface{}, replace bool, ttl time.Duration) error {
+	return store.ErrTTLNotSupported
+}
+
+// KeepAlive is not supported.
+func (c *Client) KeepAlive(nodePath string) error {
+	return store.ErrTTLNotSupported
+}
+
+func (c *Client) Sync(s store.Store, stopChan chan bool) {
+	go c.internalSync("data", c.data, s, stopChan)
+}
+
+func (c *Client) GetMapping(nodePath string, dir bool) (interface{}, error) {
+	_, r := c.mapping.Get(nodePath)
+	if r != nil {
+		return r, nil
+	} else {
+		if dir {
+			return map[string]interface{}{}, nil
+		} else {
+			return "", nil
+		}
+	}
+}
+
+func (c *Client) PutMapping(nodePath string, mapping interface{}, replace bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.updateMapping(nodePath, func(s store.Store) {
+		if replace {
+			s.Delete(nodePath)
+		}
+		s.Put(nodePath, normalizeValue(mapping))
+	})
+}
+
+func (c *Client) DeleteMapping(nodePath string, dir bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.updateMapping(nodePath, func(s store.Store) {
+		s.Delete(nodePath)
+	})
+}
+
+// PutMappingWithTTL is not supported.
+func (c *Client) PutMappingWithTTL(nodePath string, mapping interface{}, replace bool, ttl time.Duration) error {
+	return store.ErrTTLNotSupported
+}
+
+// KeepAliveMapping is not supported.
+func (c *Client) KeepAliveMapping(nodePath string) error {
+	return store.ErrTTLNotSupported
+}
+
+func (c *Client) SyncMapping(mapping store.Store, stopChan chan bool) {
+	go c.internalSync("mapping", c.mapping, mapping, stopChan)
+}
+
+func (c *Client) GetAccessRule() (map[string][]store.AccessRule, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return copyRules(c.rules), nil
+}
+
+func copyRules(rules map[string][]store.AccessRule) map[string][]store.AccessRule {
+	result := make(map[string][]store.AccessRule, len(rules))
+	for k, v := range rules {
+		result[k] = v
+	}
+	return result
+}
+
+func (c *Client) PutAccessRule(rules map[string][]store.AccessRule) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	newRules := copyRules(c.rules)
+	for k, v := range rules {
+		newRules[k] = v
+	}
+	if err := writeDocument(c.ruleFile, newRules); err != nil {
+		return err
+	}
+	c.rules = newRules
+	for k, v := range rules {
+		if c.accessStore != nil {
+			c.accessStore.Put(k, v)
+		}
+	}
+	return nil
+}
+
+func (c *Client) DeleteAccessRule(hosts []string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	newRules := copyRules(c.rules)
+	for _, host := range hosts {
+		delete(newRules, host)
+	}
+	if err := writeDocument(c.ruleFile, newRules); err != nil {
+		return err
+	}
+	c.rules = newRules
+	for _, host := range hosts {
+		if c.accessStore != nil {
+			c.accessStore.Delete(host)
+		}
+	}
+	return nil
+}
+
+func (c *Client) SyncAccessRule(accessStore store.AccessStore, stopChan chan bool) {
+	c.lock.Lock()
+	c.accessStore = accessStore
+	c.accessStore.Puts(c.rules)
+	c.lock.Unlock()
+	go func() {
+		select {
+		case <-stopChan:
+			c.lock.Lock()
+			c.accessStore = nil
+			c.lock.Unlock()
+		}
+	}()
+}
+
+func (c *Client) internalSync(name string, from store.Store, to store.Store, stopChan chan bool) {
+	w := from.Watch("/", 5000)
+	store.Replicate(from, to)
+	for {
+		select {
+		case e, ok := <-w.EventChan():
+			if !ok {
+				return
+			}
+			log.Debug("processEvent %s %s %s", e.Action, e.Path, e.Value)
+			switch e.Action {
+			case store.Delete:
+				to.DeleteWithRevision(e.Path, e.Rev)
+			case store.Update:
+				to.PutWithRevision(e.Path, e.Value, 0, e.Rev)
+			case store.Resync:
+				log.Warning("Sync %s lost events, resync", name)
+				store.Replicate(from, to)
+			}
+		case <-stopChan:
+			log.Info("Stop sync %s", name)
+			w.Remove()
+			return
+		}
+	}
+}
+
+// notifyChange is called by the watcher when files under the watched dirs changed.
+func (c *Client) notifyChange() {
+	select {
+	case c.changeChan <- true:
+	default:
+	}
+}
+
+// processChange reload files after the changes stop for a while, for avoid reload half written files.
+func (c *Client) processChange() {
+	for range c.changeChan {
+		for {
+			timer := time.NewTimer(reloadDelay)
+			select {
+			case <-c.changeChan:
+				timer.Stop()
+				continue
+			case <-timer.C:
+			}
+			break
+		}
+		log.Debug("Reload files in %s", c.root)
+		if err := c.load(); err != nil {
+			log.Error("Reload files in %s error: %s, keep the old value.", c.root, err.Error())
+		}
+		if err := c.addWatches(); err != nil {
+			log.Error("Watch dirs in %s error: %s", c.root, err.Error())
+		}
+	}
+}
+
+// watchDirs return all the dirs should be watched.
+func (c *Client) watchDirs() []string {
+	dirs := []string{filepath.Dir(c.mappingFile), filepath.Dir(c.ruleFile)}
+	filepath.Walk(c.dataDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		if c.isReserved(p) {
+			return filepath.SkipDir
+		}
+		dirs = append(dirs, p)
+		return nil
+	})
+	return dirs
+}
+
+func (c *Client) isReserved(p string) bool {
+	return p == filepath.Join(c.root, "_metad")
+}
+
+// load read all the files, and apply the difference to the stores.
+func (c *Client) load() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	documents, data, err := c.loadDocuments()
+	if err != nil {
+		return err
+	}
+	mapping, err := readFlatDocument(c.mappingFile)
+	if err != nil {
+		return err
+	}
+	rules := map[string][]store.AccessRule{}
+	if err = readDocument(c.ruleFile, &rules); err != nil {
+		return err
+	}
+
+	c.documents = documents
+	c.mappingFlat = mapping
+	store.ApplyFlatmap(c.data, data, nil, 0)
+	store.ApplyFlatmap(c.mapping, mapping, nil, 0)
+	for host := range c.rules {
+		if _, ok := rules[host]; !ok && c.accessStore != nil {
+			c.accessStore.Delete(host)
+		}
+	}
+	for host, v := range rules {
+		if !reflect.DeepEqual(c.rules[host], v) && c.accessStore != nil {
+			c.accessStore.Put(host, v)
+		}
+	}
+	c.rules = rules
+	return nil
+}
+
+func (c *Client) loadDocuments() ([]*document, map[string]string, error) {
+	var documents []*document
+	err := filepath.Walk(c.dataDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if c.isReserved(p) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ext := filepath.Ext(p)
+		if strings.HasPrefix(info.Name(), ".") || !isDocumentExt(ext) {
+			return nil
+		}
+		rel, err := filepath.Rel(c.dataDir, strings.TrimSuffix(p, ext))
+		if err != nil {
+			return err
+		}
+		mount := path.Join("/", filepath.ToSlash(rel))
+		if path.Base(mount) == ROOT_DOCUMENT {
+			mount = path.Dir(mount)
+		}
+		flat, err := readFlatDocument(p)
+		if err != nil {
+			return err
+		}
+		d := &document{file: p, mount: mount, flat: make(map[string]string, len(flat))}
+		for k, v := range flat {
+			d.flat[util.AppendPathPrefix(k, mount)] = v
+		}
+		documents = append(documents, d)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	// the deeper document override the shallower one.
+	sort.SliceStable(documents, func(i, j int) bool {
+		return len(documents[i].mount) < len(documents[j].mount)
+	})
+	data := make(map[string]string)
+	for _, d := range documents {
+		for k, v := range d.flat {
+			data[k] = v
+		}
+	}
+	return documents, data, nil
+}
+
+// owner return the document which the nodePath belongs to, the document with the longest mount path win.
+func (c *Client) owner(nodePath string) *document {
+	var result *document
+	for _, d := range c.documents {
+		if d.mount == "/" || d.mount == nodePath || strings.HasPrefix(nodePath, d.mount+"/") {
+			if result == nil || len(d.mount) > len(result.mount) {
+				result = d
+			}
+		}
+	}
+	return result
+}
+
+func (c *Client) rootDocument() *document {
+	for _, d := range c.documents {
+		if d.mount == "/" {
+			return d
+		}
+	}
+	d := &document{file: findDocument(filepath.Join(c.dataDir, ROOT_DOCUMENT)), mount: "/", flat: map[string]string{}}
+	c.documents = append(c.documents, d)
+	return d
+}
+
+// updateData apply the change on a copy of the subtree at nodePath, and write the documents affected before apply
+// the result to the data, so the data is not changed if the write fail.
+func (c *Client) updateData(nodePath string, change func(s store.Store)) error {
+	old, changed := changedSubtree(c.data, nodePath, change)
+	owner := func(k string) *document {
+		if d := c.owner(k); d != nil {
+			return d
+		}
+		return c.rootDocument()
+	}
+	if err := saveDocuments(c.documents, owner, old, changed); err != nil {
+		return err
+	}
+	applyChanged(c.data, old, changed)
+	return nil
+}
+
+// updateMapping apply the change to the mapping after write the mapping file, same as updateData.
+func (c *Client) updateMapping(nodePath string, change func(s store.Store)) error {
+	old, changed := changedSubtree(c.mapping, nodePath, change)
+	d := &document{file: c.mappingFile, mount: "/", flat: c.mappingFlat}
+	owner := func(k string) *document {
+		return d
+	}
+	if err := saveDocuments([]*document{d}, owner, old, changed); err != nil {
+		return err
+	}
+	c.mappingFlat = d.flat
+	applyChanged(c.mapping, old, changed)
+	return nil
+}
+
+// saveDocuments write the documents affected by the change of the subtree from old to changed, the others are not written.
+// The changed key is written to its owner, and removed from the shallower documents which also contain it.
+func saveDocuments(documents []*document, owner func(k string) *document, old, changed map[string]string) error {
+	var affected []*document
+	contents := make(map[*document]map[string]string)
+	content := func(d *document) map[string]string {
+		if contents[d] == nil {
+			flat := make(map[string]string, len(d.flat))
+			for k, v := range d.flat {
+				flat[k] = v
+			}
+			contents[d] = flat
+			affected = append(affected, d)
+		}
+		return contents[d]
+	}
+	update := func(k string) {
+		d := owner(k)
+		v, ok := changed[k]
+		if ok && d.flat[k] != v || !ok && hasKey(d.flat, k) {
+			if ok {
+				content(d)[k] = v
+			} else {
+				delete(content(d), k)
+			}
+		}
+		for _, other := range documents {
+			if other != d && hasKey(other.flat, k) {
+				delete(content(other), k)
+			}
+		}
+	}
+	for k := range old {
+		if _, ok := changed[k]; !ok {
+			update(k)
+		}
+	}
+	for k, v := range changed {
+		if ov, ok := old[k]; !ok || ov != v {
+			update(k)
+		}
+	}
+	for _, d := range affected {
+		flat := contents[d]
+		rel := make(map[string]string, len(flat))
+		for k, v := range flat {
+			rel[util.TrimPathPrefix(k, d.mount)] = v
+		}
+		if err := writeFlatDocument(d.file, rel); err != nil {
+			return err
+		}
+		d.flat = flat
+	}
+	return nil
+}
+
+func hasKey(flat map[string]string, k string) bool {
+	_, ok := flat[k]
+	return ok
+}
+
+func isDocumentExt(ext string) bool {
+	for _, e := range documentExts {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// findDocument return the exist document file for the name, if not exist, use yaml as default.
+func findDocument(name string) string {
+	for _, ext := range documentExts {
+		if _, err := os.Stat(name + ext); err == nil {
+			return name + ext
+		}
+	}
+	return name + documentExts[0]
+}
+
+func readDocument(file string, v interface{}) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	// json is a subset of yaml, so use yaml to parse both.
+	if err = yaml.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("parse %s error: %s", file, err.Error())
+	}
+	return nil
+}
+
+func readFlatDocument(file string) (map[string]string, error) {
+	var v interface{}
+	if err := readDocument(file, &v); err != nil {
+		return nil, err
+	}
+	switch t := v.(type) {
+	case nil:
+		return map[string]string{}, nil
+	case map[interface{}]interface{}, []interface{}:
+		return flatmap.Flatten(t), nil
+	default:
+		return map[string]string{"/": fmt.Sprintf("%v", t)}, nil
+	}
+}
+
+func writeFlatDocument(file string, flat map[string]string) error {
+	if v, ok := flat["/"]; ok && len(flat) == 1 {
+		return writeDocument(file, v)
+	}
+	return writeDocument(file, flatmap.Expand(flat, "/"))
+}
+
+func writeDocument(file string, v interface{}) error {
+	var data []byte
+	var err error
+	if filepath.Ext(file) == ".json" {
+		data, err = json.MarshalIndent(v, "", "  ")
+	} else {
+		data, err = yaml.Marshal(v)
+	}
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, data)
+}
+
+// writeFileAtomic write data to a temp file, then rename it to file, so the reader never see a half written file.
+func writeFileAtomic(file string, data []byte) error {
+	dir, name := filepath.Split(file)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "."+name+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), file)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// subtreeFlatmap return the flatmap of the subtree at nodePath with full path keys,
+// include the leaves on the path of nodePath, which are replaced if the change put under them.
+func subtreeFlatmap(s store.Store, nodePath string) map[string]string {
+	nodePath = path.Join("/", nodePath)
+	result := map[string]string{}
+	for p := path.Dir(nodePath); p != "/"; p = path.Dir(p) {
+		if _, val := s.Get(p); val != nil {
+			if v, ok := val.(string); ok {
+				result[p] = v
+			}
+			break
+		}
+	}
+	switch t := getValue(s, nodePath).(type) {
+	case map[string]interface{}:
+		for k, v := range flatmap.Flatten(t) {
+			result[util.AppendPathPrefix(k, nodePath)] = v
+		}
+	case string:
+		result[nodePath] = t
+	}
+	return result
+}
+
+func getValue(s store.Store, nodePath string) interface{} {
+	_, val := s.Get(nodePath)
+	return val
+}
+
+// changedSubtree apply the change on a copy of the subtree at nodePath, return the flatmap before and after the change.
+func changedSubtree(s store.Store, nodePath string, change func(s store.Store)) (old map[string]string, changed map[string]string) {
+	old = subtreeFlatmap(s, nodePath)
+	tmp := store.New()
+	defer tmp.Destroy()
+	tmp.PutBulk("/", old)
+	change(tmp)
+	changed = map[string]string{}
+	if m, ok := getValue(tmp, "/").(map[string]interface{}); ok {
+		changed = flatmap.Flatten(m)
+	}
+	return old, changed
+}
+
+// applyChanged apply the change of the subtree from old to changed to the store.
+func applyChanged(s store.Store, old, changed map[string]string) {
+	for k := range old {
+		if _, ok := changed[k]; !ok {
+			s.Delete(k)
+		}
+	}
+	for k, v := range changed {
+		if ov, ok := old[k]; !ok || ov != v {
+			s.PutWithRevision(k, v, 0, 0)
+		}
+	}
+}
+
+func normalizeValue(value interface{}) interface{} {
+	switch t := value.(type) {
+	case map[string]interface{}, map[string]string, []interface{}, string:
+		return t
+	default:
+		log.Warning("Set unexpect value type: %s", reflect.TypeOf(value))
+		return fmt.Sprintf("%v", t)
+	}
+}
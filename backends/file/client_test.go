@@ -0,0 +1,284 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package file
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yunify/metad/log"
+	"github.com/yunify/metad/store"
+)
+
+func init() {
+	log.SetLevel("debug")
+	rand.Seed(int64(time.Now().Nanosecond()))
+}
+
+func TestClientSyncStop(t *testing.T) {
+
+	stopChan := make(chan bool)
+
+	storeClient, err := NewFileClient("default", "", tempDir(t))
+	assert.NoError(t, err)
+
+	go func() {
+		time.Sleep(3000 * time.Millisecond)
+		stopChan <- true
+	}()
+
+	metastore := store.New()
+	// expect internalSync not block after stopChan has signal
+	storeClient.internalSync("data", storeClient.data, metastore, stopChan)
+}
+
+func TestClientSyncStopPending(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	storeClient, err := NewFileClient("default", "", dir)
+	assert.NoError(t, err)
+
+	stopChan := make(chan bool)
+	metastore := store.New()
+	done := make(chan bool)
+	go func() {
+		storeClient.internalSync("data", storeClient.data, metastore, stopChan)
+		close(done)
+	}()
+
+	// stop while the file change is not reloaded yet.
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "nodes.json"), []byte(`{"1":{"name":"node1"}}`), 0644))
+	stopChan <- true
+	select {
+	case <-done:
+	case <-time.After(1 * time.Second):
+		t.Fatal("internalSync not return after stop")
+	}
+
+	// the reload after stop is not synced.
+	time.Sleep(3 * reloadDelay)
+	_, val := storeClient.data.Get("/nodes/1/name")
+	assert.Equal(t, "node1", val)
+	_, val = metastore.Get("/nodes")
+	assert.Nil(t, val)
+}
+
+func TestClientPersist(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	storeClient, err := NewFileClient("default", "/prefix", dir)
+	assert.NoError(t, err)
+
+	values := map[string]interface{}{
+		"nodes": map[string]interface{}{
+			"1": map[string]interface{}{
+				"ip":   "192.168.1.1",
+				"name": "node1",
+			},
+		},
+	}
+	assert.NoError(t, storeClient.Put("/", values, true))
+	mappings := map[string]interface{}{
+		"192.168.1.1": map[string]interface{}{
+			"node": "/nodes/1",
+		},
+	}
+	assert.NoError(t, storeClient.PutMapping("/", mappings, true))
+	rules := map[string][]store.AccessRule{
+		"192.168.1.1": {{Path: "/nodes", Mode: store.AccessModeRead}},
+	}
+	assert.NoError(t, storeClient.PutAccessRule(rules))
+
+	// data, mapping and rules are in separate files.
+	assert.True(t, exists(filepath.Join(dir, "prefix", ROOT_DOCUMENT+".yaml")))
+	assert.True(t, exists(filepath.Join(dir, "_metad", "mapping", "default.yaml")))
+	assert.True(t, exists(filepath.Join(dir, "_metad", "rule", "default.yaml")))
+
+	_, rev := storeClient.data.GetRevision("/nodes/1/ip")
+
+	storeClient2, err := NewFileClient("default", "/prefix", dir)
+	assert.NoError(t, err)
+
+	val, err := storeClient2.Get("/", true)
+	assert.NoError(t, err)
+	assert.Equal(t, values, val)
+
+	// the revision before restart does not match.
+	_, rev2 := storeClient2.data.GetRevision("/nodes/1/ip")
+	assert.True(t, rev2 > rev)
+	assert.Equal(t, store.ErrRevisionConflict, storeClient2.PutIfMatch("/nodes/1/ip", "192.168.1.2", false, rev))
+
+	val, err = storeClient2.GetMapping("/", true)
+	assert.NoError(t, err)
+	assert.Equal(t, mappings, val)
+
+	rulesGet, err := storeClient2.GetAccessRule()
+	assert.NoError(t, err)
+	assert.Equal(t, rules, rulesGet)
+}
+
+func TestClientDocuments(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "clusters"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "clusters", "cl-1.yaml"), []byte("name: cl-1\nenv:\n  size: 3\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "version.json"), []byte(`"1.0"`), 0644))
+
+	storeClient, err := NewFileClient("default", "", dir)
+	assert.NoError(t, err)
+
+	val, err := storeClient.Get("/clusters/cl-1/env/size", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "3", val)
+
+	val, err = storeClient.Get("/version", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.0", val)
+
+	// the change is written back to the document own the node.
+	assert.NoError(t, storeClient.Put("/clusters/cl-1/env/size", "5", false))
+	assert.NoError(t, storeClient.Put("/clusters/cl-2/name", "cl-2", false))
+	storeClient2, err := NewFileClient("default", "", dir)
+	assert.NoError(t, err)
+	val, err = storeClient2.Get("/clusters/cl-1/env/size", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "5", val)
+	assert.Equal(t, "/clusters/cl-1", storeClient2.owner("/clusters/cl-1/env/size").mount)
+	assert.Equal(t, "/", storeClient2.owner("/clusters/cl-2/name").mount)
+
+	// no temp file left.
+	files, err := filepath.Glob(filepath.Join(dir, "clusters", ".*"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(files))
+}
+
+func TestClientDocumentsWriteAffected(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "clusters"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "clusters", "cl-1.yaml"), []byte("name: cl-1\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "clusters", "cl-2.yaml"), []byte("name: cl-2\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "_root.yaml"), []byte("clusters:\n  cl-1:\n    name: old\n    zone: z1\n"), 0644))
+
+	storeClient, err := NewFileClient("default", "", dir)
+	assert.NoError(t, err)
+	val, err := storeClient.Get("/clusters/cl-1/name", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "cl-1", val)
+
+	// only the document own the node is written, the others can not be written.
+	blocker := filepath.Join(dir, "blocker")
+	assert.NoError(t, ioutil.WriteFile(blocker, []byte{}, 0644))
+	storeClient.owner("/clusters/cl-2").file = filepath.Join(blocker, "cl-2.yaml")
+	storeClient.rootDocument().file = filepath.Join(blocker, ROOT_DOCUMENT+".yaml")
+	assert.NoError(t, storeClient.Put("/clusters/cl-1/size", "3", false))
+	assert.Error(t, storeClient.Put("/clusters/cl-2/size", "3", false))
+
+	// the deleted node is removed from the shallower document too.
+	storeClient.rootDocument().file = filepath.Join(dir, ROOT_DOCUMENT+".yaml")
+	assert.NoError(t, storeClient.Delete("/clusters/cl-1/name", false))
+	storeClient2, err := NewFileClient("default", "", dir)
+	assert.NoError(t, err)
+	_, val = storeClient2.data.Get("/clusters/cl-1")
+	assert.Equal(t, map[string]interface{}{"size": "3", "zone": "z1"}, val)
+	_, val = storeClient2.data.Get("/clusters/cl-2")
+	assert.Equal(t, map[string]interface{}{"name": "cl-2"}, val)
+}
+
+func TestClientWriteFail(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	storeClient, err := NewFileClient("default", "", dir)
+	assert.NoError(t, err)
+	assert.NoError(t, storeClient.Put("/nodes/1/name", "node1", false))
+	assert.NoError(t, storeClient.PutMapping("/192.168.1.1/node", "/nodes/1", false))
+
+	// the documents can not be written under a file.
+	blocker := filepath.Join(dir, "blocker")
+	assert.NoError(t, ioutil.WriteFile(blocker, []byte{}, 0644))
+	storeClient.rootDocument().file = filepath.Join(blocker, ROOT_DOCUMENT+".yaml")
+	storeClient.mappingFile = filepath.Join(blocker, "mapping.yaml")
+	storeClient.ruleFile = filepath.Join(blocker, "rule.yaml")
+
+	// the memory is not changed when the write fail.
+	assert.Error(t, storeClient.Put("/nodes/1/name", "node1-1", false))
+	assert.Error(t, storeClient.Delete("/nodes", true))
+	val, err := storeClient.Get("/nodes/1/name", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "node1", val)
+
+	assert.Error(t, storeClient.PutMapping("/192.168.1.1", map[string]interface{}{"host": "/nodes/1"}, true))
+	val, err = storeClient.GetMapping("/192.168.1.1", true)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"node": "/nodes/1"}, val)
+
+	assert.Error(t, storeClient.PutAccessRule(map[string][]store.AccessRule{"192.168.1.1": {{Path: "/nodes", Mode: store.AccessModeRead}}}))
+	rules, err := storeClient.GetAccessRule()
+	assert.NoError(t, err)
+	assert.Empty(t, rules)
+}
+
+func TestClientWatchFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	stopChan := make(chan bool)
+	defer func() {
+		stopChan <- true
+	}()
+
+	storeClient, err := NewFileClient("default", "", dir)
+	assert.NoError(t, err)
+
+	metastore := store.New()
+	storeClient.Sync(metastore, stopChan)
+	accessStore := store.NewAccessStore()
+	storeClient.SyncAccessRule(accessStore, stopChan)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "nodes.json"), []byte(`{"1":{"name":"node1"}}`), 0644))
+	time.Sleep(1000 * time.Millisecond)
+	_, val := metastore.Get("/nodes/1/name")
+	assert.Equal(t, "node1", val)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "nodes.json"), []byte(`{"2":{"name":"node2"}}`), 0644))
+	time.Sleep(1000 * time.Millisecond)
+	_, val = metastore.Get("/nodes/1/name")
+	assert.Nil(t, val)
+	_, val = metastore.Get("/nodes/2/name")
+	assert.Equal(t, "node2", val)
+
+	assert.NoError(t, os.Remove(filepath.Join(dir, "nodes.json")))
+	time.Sleep(1000 * time.Millisecond)
+	_, val = metastore.Get("/nodes")
+	assert.Nil(t, val)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "_metad", "rule", "default.yaml"), []byte("192.168.1.1:\n- path: /nodes\n  mode: 1\n"), 0644))
+	time.Sleep(1000 * time.Millisecond)
+	assert.NotNil(t, accessStore.Get("192.168.1.1"))
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "metad-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func exists(file string) bool {
+	_, err := os.Stat(file)
+	return err == nil
+}
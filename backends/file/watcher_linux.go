@@ -0,0 +1,60 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package file
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/yunify/metad/log"
+)
+
+const watchMask = unix.IN_CLOSE_WRITE | unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_DELETE_SELF
+
+// dirWatcher watch dirs by inotify.
+type dirWatcher struct {
+	fd   int
+	file *os.File
+}
+
+func (c *Client) watch() error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	// os.File with a nonblocking fd use the runtime poller, so the read will not block a thread.
+	c.watcher = &dirWatcher{fd: fd, file: os.NewFile(uintptr(fd), "inotify")}
+	if err = c.addWatches(); err != nil {
+		c.watcher.file.Close()
+		return err
+	}
+	go func() {
+		buf := make([]byte, 4096*unix.SizeofInotifyEvent)
+		for {
+			_, err := c.watcher.file.Read(buf)
+			if err != nil {
+				log.Error("Read inotify event for %s error: %s, stop watch.", c.root, err.Error())
+				return
+			}
+			// every event will cause a full reload, so no need to parse the events.
+			c.notifyChange()
+		}
+	}()
+	return nil
+}
+
+// addWatches add watch for all dirs, add a watched dir again is harmless.
+func (c *Client) addWatches() error {
+	for _, dir := range c.watchDirs() {
+		if _, err := unix.InotifyAddWatch(c.watcher.fd, dir, watchMask); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package file
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var pollInterval = 1 * time.Second
+
+// dirWatcher watch dirs by polling the files' modify time, for the platforms without inotify.
+type dirWatcher struct {
+	signature string
+}
+
+func (c *Client) watch() error {
+	c.watcher = &dirWatcher{signature: c.signature()}
+	go func() {
+		for range time.Tick(pollInterval) {
+			signature := c.signature()
+			if signature != c.watcher.signature {
+				c.watcher.signature = signature
+				c.notifyChange()
+			}
+		}
+	}()
+	return nil
+}
+
+func (c *Client) addWatches() error {
+	return nil
+}
+
+func (c *Client) signature() string {
+	var signature string
+	for _, dir := range c.watchDirs() {
+		files, _ := filepath.Glob(filepath.Join(dir, "*"))
+		for _, f := range files {
+			if info, err := os.Stat(f); err == nil && !info.IsDir() {
+				signature += fmt.Sprintf("%s:%d:%d;", f, info.Size(), info.ModTime().UnixNano())
+			}
+		}
+	}
+	return signature
+}
@@ -0,0 +1,230 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/yunify/metad/log"
+	"github.com/yunify/metad/store"
+	"github.com/yunify/metad/util/flatmap"
+)
+
+// LayeredClient stacks multiple StoreClients in priority order, the first layer has the highest priority.
+// Metadata is merged per leaf node: a leaf in higher layer overrides the same leaf in lower layers,
+// and hides the lower layers' leaves under it, the dir in higher layer also hides the same path leaf in lower layers.
+// Metadata writes, mapping and access rule go to the write layer.
+type LayeredClient struct {
+	layers     []StoreClient
+	writeLayer StoreClient
+}
+
+// NewLayeredClient create a LayeredClient, writeLayer is the index of the layer for write.
+func NewLayeredClient(layers []StoreClient, writeLayer int) (*LayeredClient, error) {
+	if len(layers) == 0 {
+		return nil, errors.New("Layered backend require at least one layer")
+	}
+	if writeLayer < 0 || writeLayer >= len(layers) {
+		return nil, fmt.Errorf("Invalid write layer %v, layers count: %v", writeLayer, len(layers))
+	}
+	return &LayeredClient{layers: layers, writeLayer: layers[writeLayer]}, nil
+}
+
+// Get merge the whole layers by mergeLayers, then get nodePath from the result,
+// so a "" leaf is found, and a leaf hidden by the higher layer's dir or leaf is not.
+func (c *LayeredClient) Get(nodePath string, dir bool) (interface{}, error) {
+	flats := make([]map[string]string, 0, len(c.layers))
+	for _, layer := range c.layers {
+		val, err := layer.Get("/", true)
+		if err != nil {
+			return nil, err
+		}
+		flats = append(flats, toFlatmap(val))
+	}
+	merged := mergeLayers(flats)
+	nodePath = path.Join("/", nodePath)
+	if v, ok := merged[nodePath]; ok {
+		return v, nil
+	}
+	if !dir {
+		return "", nil
+	}
+	sub := make(map[string]string)
+	for k, v := range merged {
+		if nodePath == "/" {
+			sub[k] = v
+		} else if strings.HasPrefix(k, nodePath+"/") {
+			sub[strings.TrimPrefix(k, nodePath)] = v
+		}
+	}
+	return flatmap.Expand(sub, "/"), nil
+}
+
+func (c *LayeredClient) Put(nodePath string, value interface{}, replace bool) error {
+	return c.writeLayer.Put(nodePath, value, replace)
+}
+
+func (c *LayeredClient) Delete(nodePath string, dir bool) error {
+	return c.writeLayer.Delete(nodePath, dir)
+}
+
+func (c *LayeredClient) PutWithTTL(nodePath string, value interface{}, replace bool, ttl time.Duration) error {
+	return c.writeLayer.PutWithTTL(nodePath, value, replace, ttl)
+}
+
+func (c *LayeredClient) KeepAlive(nodePath string) error {
+	return c.writeLayer.KeepAlive(nodePath)
+}
+
+// PutIfMatch is not supported, the revisions of the merged data are not same as any layer.
+func (c *LayeredClient) PutIfMatch(nodePath string, value interface{}, replace bool, rev int64) error {
+	return store.ErrConditionNotSupported
+}
+
+// DeleteIfMatch is not supported, the revisions of the merged data are not same as any layer.
+func (c *LayeredClient) DeleteIfMatch(nodePath string, dir bool, rev int64) error {
+	return store.ErrConditionNotSupported
+}
+
+// Txn is not supported.
+func (c *LayeredClient) Txn(ops []store.TxnOp) error {
+	return store.ErrTxnNotSupported
+}
+
+// Sync sync every layer to a separate store, and keep the merged result in the given store.
+func (c *LayeredClient) Sync(s store.Store, stopChan chan bool) {
+	layerStores := make([]store.Store, len(c.layers))
+	layerStopChans := make([]chan bool, len(c.layers))
+	watchers := make([]store.Watcher, len(c.layers))
+	changeChan := make(chan bool, 1)
+	for i, layer := range c.layers {
+		layerStores[i] = store.New()
+		// buffered, the stop never block even if the layer sync has exited.
+		layerStopChans[i] = make(chan bool, 1)
+		// watch before sync, avoid missing the change during init.
+		watchers[i] = layerStores[i].Watch("/", 100)
+		go func(w store.Watcher) {
+			for range w.EventChan() {
+				select {
+				case changeChan <- true:
+				default:
+					// a merge is pending, the change will be included.
+				}
+			}
+		}(watchers[i])
+		layer.Sync(layerStores[i], layerStopChans[i])
+	}
+	store.ApplyFlatmap(s, mergeStores(layerStores), nil, 0)
+	go func() {
+		for {
+			select {
+			case <-changeChan:
+				store.ApplyFlatmap(s, mergeStores(layerStores), nil, 0)
+			case <-stopChan:
+				log.Debug("Stop layered sync")
+				for i := range c.layers {
+					watchers[i].Remove()
+					layerStopChans[i] <- true
+				}
+				return
+			}
+		}
+	}()
+}
+
+func (c *LayeredClient) GetMapping(nodePath string, dir bool) (interface{}, error) {
+	return c.writeLayer.GetMapping(nodePath, dir)
+}
+
+func (c *LayeredClient) PutMapping(nodePath string, mapping interface{}, replace bool) error {
+	return c.writeLayer.PutMapping(nodePath, mapping, replace)
+}
+
+func (c *LayeredClient) DeleteMapping(nodePath string, dir bool) error {
+	return c.writeLayer.DeleteMapping(nodePath, dir)
+}
+
+func (c *LayeredClient) PutMappingWithTTL(nodePath string, mapping interface{}, replace bool, ttl time.Duration) error {
+	return c.writeLayer.PutMappingWithTTL(nodePath, mapping, replace, ttl)
+}
+
+func (c *LayeredClient) KeepAliveMapping(nodePath string) error {
+	return c.writeLayer.KeepAliveMapping(nodePath)
+}
+
+func (c *LayeredClient) SyncMapping(mapping store.Store, stopChan chan bool) {
+	c.writeLayer.SyncMapping(mapping, stopChan)
+}
+
+func (c *LayeredClient) GetAccessRule() (map[string][]store.AccessRule, error) {
+	return c.writeLayer.GetAccessRule()
+}
+
+func (c *LayeredClient) PutAccessRule(rules map[string][]store.AccessRule) error {
+	return c.writeLayer.PutAccessRule(rules)
+}
+
+func (c *LayeredClient) DeleteAccessRule(hosts []string) error {
+	return c.writeLayer.DeleteAccessRule(hosts)
+}
+
+func (c *LayeredClient) SyncAccessRule(accessStore store.AccessStore, stopChan chan bool) {
+	c.writeLayer.SyncAccessRule(accessStore, stopChan)
+}
+
+func mergeStores(stores []store.Store) map[string]string {
+	flats := make([]map[string]string, 0, len(stores))
+	for _, s := range stores {
+		_, val := s.Get("/")
+		flats = append(flats, toFlatmap(val))
+	}
+	return mergeLayers(flats)
+}
+
+// mergeLayers merge the flatmaps, the first has the highest priority.
+func mergeLayers(flats []map[string]string) map[string]string {
+	result := make(map[string]string)
+	dirs := make(map[string]bool)
+	for _, flat := range flats {
+		accepted := make(map[string]string)
+		for k, v := range flat {
+			if _, ok := result[k]; ok || dirs[k] || hasLeafAncestor(result, k) {
+				continue
+			}
+			accepted[k] = v
+		}
+		for k, v := range accepted {
+			result[k] = v
+			for p := path.Dir(k); p != "/" && p != "."; p = path.Dir(p) {
+				dirs[p] = true
+			}
+		}
+	}
+	return result
+}
+
+func hasLeafAncestor(flat map[string]string, nodePath string) bool {
+	for p := path.Dir(nodePath); p != "/" && p != "."; p = path.Dir(p) {
+		if _, ok := flat[p]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func toFlatmap(val interface{}) map[string]string {
+	switch t := val.(type) {
+	case map[string]interface{}:
+		return flatmap.Flatten(t)
+	case map[string]string:
+		return flatmap.Flatten(t)
+	default:
+		return map[string]string{}
+	}
+}
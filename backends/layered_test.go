@@ -0,0 +1,113 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package backends
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yunify/metad/store"
+)
+
+func TestMergeLayers(t *testing.T) {
+	flats := []map[string]string{
+		{"/a/b": "top", "/c": "top"},
+		{"/a/b": "middle", "/a/d": "middle", "/c/e": "middle", "/f": "middle"},
+		{"/a": "bottom", "/f/g": "bottom", "/h": "bottom"},
+	}
+	assert.Equal(t, map[string]string{
+		"/a/b": "top",
+		"/a/d": "middle",
+		"/c":   "top",
+		"/f":   "middle",
+		"/h":   "bottom",
+	}, mergeLayers(flats))
+}
+
+func TestLayeredClient(t *testing.T) {
+	config := Config{
+		Backend: "layered",
+		Layers: []Config{
+			{Backend: "local"},
+			{Backend: "local"},
+			{Backend: "local"},
+		},
+		WriteLayer: 1,
+	}
+	c, err := New(config)
+	assert.NoError(t, err)
+	storeClient := c.(*LayeredClient)
+	top, live, defaults := storeClient.layers[0], storeClient.layers[1], storeClient.layers[2]
+
+	assert.NoError(t, defaults.Put("/", map[string]interface{}{
+		"env": map[string]interface{}{
+			"size":  "1",
+			"image": "default",
+		},
+	}, false))
+	assert.NoError(t, storeClient.Put("/env/size", "3", false))
+	assert.NoError(t, top.Put("/env/image", "override", false))
+
+	// write go to the write layer.
+	val, err := live.Get("/env/size", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "3", val)
+
+	val, err = storeClient.Get("/env", true)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"size": "3", "image": "override"}, val)
+
+	val, err = storeClient.Get("/env/size", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "3", val)
+
+	// the empty leaf is found, and the leaf hidden by the higher layer's dir is not.
+	assert.NoError(t, top.Put("/env/empty", "", false))
+	assert.NoError(t, defaults.Put("/env/empty/sub", "default", false))
+	assert.NoError(t, top.Put("/env/name", "", false))
+	assert.NoError(t, defaults.Put("/env/name", "default", false))
+	assert.NoError(t, top.Put("/label/k", "v", false))
+	assert.NoError(t, defaults.Put("/label", "default", false))
+	val, err = storeClient.Get("/env/name", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "", val)
+	val, err = storeClient.Get("/env/empty/sub", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "", val)
+	val, err = storeClient.Get("/label", false)
+	assert.NoError(t, err)
+	assert.Equal(t, "", val)
+	val, err = storeClient.Get("/label", true)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"k": "v"}, val)
+	assert.NoError(t, top.Delete("/env/empty", false))
+	assert.NoError(t, top.Delete("/env/name", false))
+	assert.NoError(t, defaults.Delete("/env/name", false))
+	assert.NoError(t, defaults.Delete("/env/empty", true))
+	assert.NoError(t, top.Delete("/label", true))
+	assert.NoError(t, defaults.Delete("/label", false))
+
+	metastore := store.New()
+	stopChan := make(chan bool)
+	defer func() {
+		stopChan <- true
+	}()
+	storeClient.Sync(metastore, stopChan)
+	time.Sleep(100 * time.Millisecond)
+	_, val = metastore.Get("/env")
+	assert.Equal(t, map[string]interface{}{"size": "3", "image": "override"}, val)
+
+	// remove the override, fallback to lower layer.
+	assert.NoError(t, top.Delete("/env/image", false))
+	assert.NoError(t, storeClient.Delete("/env/size", false))
+	time.Sleep(100 * time.Millisecond)
+	_, val = metastore.Get("/env")
+	assert.Equal(t, map[string]interface{}{"size": "1", "image": "default"}, val)
+
+	_, err = NewLayeredClient(storeClient.layers, 3)
+	assert.Error(t, err)
+}
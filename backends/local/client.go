@@ -5,6 +5,11 @@
 package local
 
 import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/yunify/metad/atomic"
 	"github.com/yunify/metad/log"
 	"github.com/yunify/metad/store"
 )
@@ -15,12 +20,16 @@ type Client struct {
 	mapping     store.Store
 	rules       map[string][]store.AccessRule
 	accessStore store.AccessStore
+	// lock keep the revision check and write of conditional write and txn atomic.
+	lock sync.Mutex
 }
 
 func NewLocalClient() (*Client, error) {
+	// data and mapping share the version, keep their revisions comparable.
+	version := new(atomic.AtomicLong)
 	return &Client{
-		data:    store.New(),
-		mapping: store.New(),
+		data:    store.NewWithVersion(version),
+		mapping: store.NewWithVersion(version),
 		rules:   map[string][]store.AccessRule{},
 	}, nil
 }
@@ -40,18 +49,117 @@ func (c *Client) Get(nodePath string, dir bool) (interface{}, error) {
 }
 
 func (c *Client) Put(nodePath string, value interface{}, replace bool) error {
-	if replace {
-		c.data.Delete(nodePath)
-	}
-	c.data.Put(nodePath, value)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.internalPut(nodePath, value, replace)
 	return nil
 }
 
 func (c *Client) Delete(nodePath string, dir bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.data.Delete(nodePath)
+	return nil
+}
+
+func (c *Client) PutWithTTL(nodePath string, value interface{}, replace bool, ttl time.Duration) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	putValueWithTTL(c.data, nodePath, value, replace, ttl)
+	return nil
+}
+
+func (c *Client) KeepAlive(nodePath string) error {
+	if c.data.Refresh(nodePath) == 0 {
+		return store.ErrNoTTL
+	}
+	return nil
+}
+
+func (c *Client) PutIfMatch(nodePath string, value interface{}, replace bool, rev int64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, modifiedRev := c.data.GetRevision(nodePath); modifiedRev != rev {
+		return store.ErrRevisionConflict
+	}
+	c.internalPut(nodePath, value, replace)
+	return nil
+}
+
+func (c *Client) DeleteIfMatch(nodePath string, dir bool, rev int64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, modifiedRev := c.data.GetRevision(nodePath); modifiedRev != rev {
+		return store.ErrRevisionConflict
+	}
 	c.data.Delete(nodePath)
 	return nil
 }
 
+func (c *Client) internalPut(nodePath string, value interface{}, replace bool) {
+	putValue(c.data, nodePath, value, replace)
+}
+
+// Txn check the preconditions and apply the ops with the lock, so no other write between them.
+func (c *Client) Txn(ops []store.TxnOp) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, op := range ops {
+		if op.IfMatch == nil {
+			continue
+		}
+		s := c.txnStore(op)
+		if s == nil {
+			return fmt.Errorf("Txn target %s does not support if_match", op.Target)
+		}
+		if _, modifiedRev := s.GetRevision(op.Path); modifiedRev != *op.IfMatch {
+			return store.ErrRevisionConflict
+		}
+	}
+	for _, op := range ops {
+		if op.Target == store.TxnTargetRule {
+			if op.Action == store.TxnActionDelete {
+				c.deleteAccessRule([]string{op.Path})
+			} else {
+				c.putAccessRule(map[string][]store.AccessRule{op.Path: op.Rules})
+			}
+			continue
+		}
+		s := c.txnStore(op)
+		if op.Action == store.TxnActionDelete {
+			s.Delete(op.Path)
+		} else {
+			putValue(s, op.Path, op.Value, op.Action == store.TxnActionPut)
+		}
+	}
+	return nil
+}
+
+func (c *Client) txnStore(op store.TxnOp) store.Store {
+	switch op.Target {
+	case store.TxnTargetData:
+		return c.data
+	case store.TxnTargetMapping:
+		return c.mapping
+	default:
+		return nil
+	}
+}
+
+func putValue(s store.Store, nodePath string, value interface{}, replace bool) {
+	if replace {
+		s.Delete(nodePath)
+	}
+	s.Put(nodePath, value)
+}
+
+func putValueWithTTL(s store.Store, nodePath string, value interface{}, replace bool, ttl time.Duration) {
+	if replace {
+		s.Delete(nodePath)
+	}
+	s.PutWithTTL(nodePath, value, ttl)
+}
+
 func (c *Client) Sync(s store.Store, stopChan chan bool) {
 	go c.internalSync("data", c.data, s, stopChan)
 }
@@ -70,23 +178,40 @@ func (c *Client) GetMapping(nodePath string, dir bool) (interface{}, error) {
 }
 
 func (c *Client) PutMapping(nodePath string, mapping interface{}, replace bool) error {
-	if replace {
-		c.mapping.Delete(nodePath)
-	}
-	c.mapping.Put(nodePath, mapping)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	putValue(c.mapping, nodePath, mapping, replace)
 	return nil
 }
 
 func (c *Client) DeleteMapping(nodePath string, dir bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	c.mapping.Delete(nodePath)
 	return nil
 }
 
+func (c *Client) PutMappingWithTTL(nodePath string, mapping interface{}, replace bool, ttl time.Duration) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	putValueWithTTL(c.mapping, nodePath, mapping, replace, ttl)
+	return nil
+}
+
+func (c *Client) KeepAliveMapping(nodePath string) error {
+	if c.mapping.Refresh(nodePath) == 0 {
+		return store.ErrNoTTL
+	}
+	return nil
+}
+
 func (c *Client) SyncMapping(mapping store.Store, stopChan chan bool) {
 	go c.internalSync("mapping", c.mapping, mapping, stopChan)
 }
 
 func (c *Client) GetAccessRule() (map[string][]store.AccessRule, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	result := make(map[string][]store.AccessRule, len(c.rules))
 	for k, v := range c.rules {
 		result[k] = v
@@ -95,44 +220,57 @@ func (c *Client) GetAccessRule() (map[string][]store.AccessRule, error) {
 }
 
 func (c *Client) PutAccessRule(rules map[string][]store.AccessRule) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.putAccessRule(rules)
+	return nil
+}
+
+func (c *Client) DeleteAccessRule(hosts []string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.deleteAccessRule(hosts)
+	return nil
+}
+
+func (c *Client) putAccessRule(rules map[string][]store.AccessRule) {
 	for k, v := range rules {
 		c.rules[k] = v
 		if c.accessStore != nil {
 			c.accessStore.Put(k, v)
 		}
 	}
-	return nil
 }
 
-func (c *Client) DeleteAccessRule(hosts []string) error {
+func (c *Client) deleteAccessRule(hosts []string) {
 	for _, host := range hosts {
 		delete(c.rules, host)
 		if c.accessStore != nil {
 			c.accessStore.Delete(host)
 		}
 	}
-	return nil
 }
 
 func (c *Client) SyncAccessRule(accessStore store.AccessStore, stopChan chan bool) {
+	c.lock.Lock()
 	c.accessStore = accessStore
 	for k, v := range c.rules {
 		c.accessStore.Put(k, v)
 	}
+	c.lock.Unlock()
 	go func() {
 		select {
 		case <-stopChan:
+			c.lock.Lock()
 			c.accessStore = nil
+			c.lock.Unlock()
 		}
 	}()
 }
 
 func (c *Client) internalSync(name string, from store.Store, to store.Store, stopChan chan bool) {
 	w := from.Watch("/", 5000)
-	_, meta := from.Get("/")
-	if meta != nil {
-		to.Put("/", meta)
-	}
+	store.Replicate(from, to)
 	for {
 		select {
 		case e, ok := <-w.EventChan():
@@ -142,9 +280,12 @@ func (c *Client) internalSync(name string, from store.Store, to store.Store, sto
 			log.Debug("processEvent %s %s %s", e.Action, e.Path, e.Value)
 			switch e.Action {
 			case store.Delete:
-				to.Delete(e.Path)
+				to.DeleteWithRevision(e.Path, e.Rev)
 			case store.Update:
-				to.Put(e.Path, e.Value)
+				to.PutWithRevision(e.Path, e.Value, 0, e.Rev)
+			case store.Resync:
+				log.Warning("Sync %s lost events, resync", name)
+				store.Replicate(from, to)
 			}
 		case <-stopChan:
 			log.Info("Stop sync %s", name)
@@ -0,0 +1,81 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package backends
+
+import (
+	"time"
+
+	"github.com/yunify/metad/store"
+)
+
+// MappingSeparatedClient serves metadata from one StoreClient, mapping and access rule from another.
+type MappingSeparatedClient struct {
+	StoreClient
+	mapping StoreClient
+}
+
+func NewMappingSeparatedClient(data StoreClient, mapping StoreClient) *MappingSeparatedClient {
+	return &MappingSeparatedClient{StoreClient: data, mapping: mapping}
+}
+
+// Txn apply the ops by the client the ops belong to, the ops belong to both clients is not supported.
+func (c *MappingSeparatedClient) Txn(ops []store.TxnOp) error {
+	data, mapping := 0, 0
+	for _, op := range ops {
+		if op.Target == store.TxnTargetData {
+			data++
+		} else {
+			mapping++
+		}
+	}
+	switch {
+	case mapping == 0:
+		return c.StoreClient.Txn(ops)
+	case data == 0:
+		return c.mapping.Txn(ops)
+	default:
+		return store.ErrTxnNotSupported
+	}
+}
+
+func (c *MappingSeparatedClient) GetMapping(nodePath string, dir bool) (interface{}, error) {
+	return c.mapping.GetMapping(nodePath, dir)
+}
+
+func (c *MappingSeparatedClient) PutMapping(nodePath string, mapping interface{}, replace bool) error {
+	return c.mapping.PutMapping(nodePath, mapping, replace)
+}
+
+func (c *MappingSeparatedClient) DeleteMapping(nodePath string, dir bool) error {
+	return c.mapping.DeleteMapping(nodePath, dir)
+}
+
+func (c *MappingSeparatedClient) PutMappingWithTTL(nodePath string, mapping interface{}, replace bool, ttl time.Duration) error {
+	return c.mapping.PutMappingWithTTL(nodePath, mapping, replace, ttl)
+}
+
+func (c *MappingSeparatedClient) KeepAliveMapping(nodePath string) error {
+	return c.mapping.KeepAliveMapping(nodePath)
+}
+
+func (c *MappingSeparatedClient) SyncMapping(mapping store.Store, stopChan chan bool) {
+	c.mapping.SyncMapping(mapping, stopChan)
+}
+
+func (c *MappingSeparatedClient) GetAccessRule() (map[string][]store.AccessRule, error) {
+	return c.mapping.GetAccessRule()
+}
+
+func (c *MappingSeparatedClient) PutAccessRule(rules map[string][]store.AccessRule) error {
+	return c.mapping.PutAccessRule(rules)
+}
+
+func (c *MappingSeparatedClient) DeleteAccessRule(hosts []string) error {
+	return c.mapping.DeleteAccessRule(hosts)
+}
+
+func (c *MappingSeparatedClient) SyncAccessRule(accessStore store.AccessStore, stopChan chan bool) {
+	c.mapping.SyncAccessRule(accessStore, stopChan)
+}
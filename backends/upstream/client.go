@@ -0,0 +1,419 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yunify/metad/log"
+	"github.com/yunify/metad/store"
+	"github.com/yunify/metad/util/flatmap"
+)
+
+var (
+	// PollInterval is the interval of polling mapping and access rule, they do not support long-polling.
+	PollInterval = 5 * time.Second
+	// RetryInterval is the interval of retry after request upstream failed.
+	RetryInterval = 1 * time.Second
+	// WaitTimeout is the max time of a long-polling request, the client request again after it if nothing changed.
+	WaitTimeout = 5 * time.Minute
+	// RequestTimeout is the timeout of the http client exceed WaitTimeout, avoid hanging on a dead connection.
+	RequestTimeout = 30 * time.Second
+
+	ErrNotFound = errors.New("Not found")
+	// errResync is returned when upstream can not compute the changes after the version, the client should get the full data.
+	errResync = errors.New("Resync")
+)
+
+// change is the change of a leaf returned by upstream with watch_format=changes, the path is relative to the watched path.
+type change struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	New  string `json:"new"`
+}
+
+// Client is a client for the manage api of upstream metad.
+type Client struct {
+	endpoints  []string
+	prefix     string
+	httpClient *http.Client
+	lock       sync.Mutex
+	current    int
+}
+
+// NewUpstreamClient returns a *Client for the upstream metad, endpoints is the manage address of upstream metad,
+// such as http://10.0.0.1:9611, the request failover to next endpoint when error.
+func NewUpstreamClient(prefix string, endpoints []string) (*Client, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("Upstream backend require at least one endpoint")
+	}
+	machines := make([]string, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+			endpoint = "http://" + endpoint
+		}
+		machines = append(machines, strings.TrimRight(endpoint, "/"))
+	}
+	return &Client{endpoints: machines, prefix: prefix, httpClient: &http.Client{Timeout: WaitTimeout + RequestTimeout}}, nil
+}
+
+// Get queries upstream metad for nodePath.
+func (c *Client) Get(nodePath string, dir bool) (interface{}, error) {
+	return c.internalGet("/v1/data", path.Join(c.prefix, nodePath), dir)
+}
+
+func (c *Client) Put(nodePath string, value interface{}, replace bool) error {
+	return c.internalPut("/v1/data", path.Join(c.prefix, nodePath), value, replace)
+}
+
+func (c *Client) Delete(nodePath string, dir bool) error {
+	return c.internalDelete("/v1/data", path.Join(c.prefix, nodePath))
+}
+
+// PutIfMatch is not supported, the revisions of the synced data are not same as upstream.
+func (c *Client) PutIfMatch(nodePath string, value interface{}, replace bool, rev int64) error {
+	return store.ErrConditionNotSupported
+}
+
+// DeleteIfMatch is not supported, the revisions of the synced data are not same as upstream.
+func (c *Client) DeleteIfMatch(nodePath string, dir bool, rev int64) error {
+	return store.ErrConditionNotSupported
+}
+
+// Txn is not supported.
+func (c *Client) Txn(ops []store.TxnOp) error {
+	return store.ErrTxnNotSupported
+}
+
+// PutWithTTL is not supported.
+func (c *Client) PutWithTTL(nodePath string, value interface{}, replace bool, ttl time.Duration) error {
+	return store.ErrTTLNotSupported
+}
+
+// KeepAlive is not supported.
+func (c *Client) KeepAlive(nodePath string) error {
+	return store.ErrTTLNotSupported
+}
+
+func (c *Client) Sync(s store.Store, stopChan chan bool) {
+	initWG := &sync.WaitGroup{}
+	initWG.Add(1)
+	go c.internalSync(path.Join("/v1/data", c.prefix), stopChan, initWG, newApplyStoreFunc(s), newApplyChangesFunc(s))
+	initWG.Wait()
+}
+
+func (c *Client) GetMapping(nodePath string, dir bool) (interface{}, error) {
+	return c.internalGet("/v1/mapping", nodePath, dir)
+}
+
+func (c *Client) PutMapping(nodePath string, mapping interface{}, replace bool) error {
+	return c.internalPut("/v1/mapping", nodePath, mapping, replace)
+}
+
+func (c *Client) DeleteMapping(nodePath string, dir bool) error {
+	return c.internalDelete("/v1/mapping", nodePath)
+}
+
+// PutMappingWithTTL is not supported.
+func (c *Client) PutMappingWithTTL(nodePath string, mapping interface{}, replace bool, ttl time.Duration) error {
+	return store.ErrTTLNotSupported
+}
+
+// KeepAliveMapping is not supported.
+func (c *Client) KeepAliveMapping(nodePath string) error {
+	return store.ErrTTLNotSupported
+}
+
+func (c *Client) SyncMapping(mapping store.Store, stopChan chan bool) {
+	initWG := &sync.WaitGroup{}
+	initWG.Add(1)
+	go c.internalSync("/v1/mapping", stopChan, initWG, newApplyStoreFunc(mapping), nil)
+	initWG.Wait()
+}
+
+func (c *Client) GetAccessRule() (map[string][]store.AccessRule, error) {
+	var rules map[string][]store.AccessRule
+	_, err := c.do(context.Background(), "GET", "/v1/rule", nil, &rules)
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (c *Client) PutAccessRule(rules map[string][]store.AccessRule) error {
+	_, err := c.do(context.Background(), "PUT", "/v1/rule", rules, nil)
+	return err
+}
+
+func (c *Client) DeleteAccessRule(hosts []string) error {
+	_, err := c.do(context.Background(), "DELETE", "/v1/rule?hosts="+url.QueryEscape(strings.Join(hosts, ",")), nil, nil)
+	return err
+}
+
+func (c *Client) SyncAccessRule(accessStore store.AccessStore, stopChan chan bool) {
+	initWG := &sync.WaitGroup{}
+	initWG.Add(1)
+	go c.internalSync("/v1/rule", stopChan, initWG, func(val interface{}) {
+		// re-marshal to convert the generic json value to rules.
+		data, _ := json.Marshal(val)
+		var rules map[string][]store.AccessRule
+		if err := json.Unmarshal(data, &rules); err != nil {
+			log.Error("Unexpect access rule from upstream: %s", string(data))
+			return
+		}
+		for host := range accessStore.GetAccessRule(nil) {
+			if _, ok := rules[host]; !ok {
+				accessStore.Delete(host)
+			}
+		}
+		accessStore.Puts(rules)
+	}, nil)
+	initWG.Wait()
+}
+
+// internalSync fetch the uri from upstream and apply the result, then wait for next change.
+// If applyChanges is not nil, wait the changes by long-polling with prev_version and watch_format=changes,
+// and only apply the changes, otherwise fetch the uri again after PollInterval.
+// If the uri is not found, the local data is kept, and the uri is fetched again after RetryInterval.
+func (c *Client) internalSync(uri string, stopChan chan bool, initWG *sync.WaitGroup, apply func(val interface{}), applyChanges func(changes []change)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stopChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	inited := false
+	resync := true
+	var version int64
+	for {
+		var currentVersion int64
+		var err error
+		if resync {
+			var val interface{}
+			currentVersion, err = c.do(ctx, "GET", uri, nil, &val)
+			if err == ErrNotFound {
+				// the uri may be not created yet, not wipe the local data, and there is no version to wait from.
+				log.Warning("Sync %s from upstream not found, keep the local data, retry after %v", uri, RetryInterval)
+				if !inited {
+					inited = true
+					initWG.Done()
+				}
+				select {
+				case <-time.After(RetryInterval):
+				case <-ctx.Done():
+				}
+				continue
+			}
+			if err == nil {
+				apply(val)
+				resync = applyChanges == nil
+			}
+		} else {
+			var changes []change
+			waitCtx, waitCancel := context.WithTimeout(ctx, WaitTimeout)
+			currentVersion, err = c.do(waitCtx, "GET", fmt.Sprintf("%s?wait=true&prev_version=%d&watch_format=changes", uri, version), nil, &changes)
+			timeout := waitCtx.Err() == context.DeadlineExceeded
+			waitCancel()
+			if err != nil && timeout && ctx.Err() == nil {
+				// nothing changed in the wait window, wait again.
+				continue
+			}
+			if err == errResync || err == ErrNotFound {
+				log.Warning("Sync %s from upstream lost changes, resync", uri)
+				resync = true
+				continue
+			}
+			if err == nil {
+				applyChanges(changes)
+			}
+		}
+		if ctx.Err() != nil {
+			log.Info("Stop sync %s from upstream", uri)
+			if !inited {
+				initWG.Done()
+			}
+			return
+		}
+		if err != nil {
+			log.Error("Sync %s from upstream error: %s, retry after %v", uri, err.Error(), RetryInterval)
+			select {
+			case <-time.After(RetryInterval):
+				continue
+			case <-ctx.Done():
+				continue
+			}
+		}
+		// keep the last good version if upstream response without it.
+		if currentVersion > 0 {
+			version = currentVersion
+		}
+		if !inited {
+			inited = true
+			initWG.Done()
+		}
+		if applyChanges == nil {
+			select {
+			case <-time.After(PollInterval):
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+func (c *Client) internalGet(uriPrefix, nodePath string, dir bool) (interface{}, error) {
+	var val interface{}
+	_, err := c.do(context.Background(), "GET", path.Join(uriPrefix, nodePath), nil, &val)
+	if err == ErrNotFound {
+		if dir {
+			return map[string]interface{}{}, nil
+		}
+		return "", nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+func (c *Client) internalPut(uriPrefix, nodePath string, value interface{}, replace bool) error {
+	// POST means replace old value, PUT means merge to old value.
+	method := "PUT"
+	if replace {
+		method = "POST"
+	}
+	_, err := c.do(context.Background(), method, path.Join(uriPrefix, nodePath), value, nil)
+	return err
+}
+
+func (c *Client) internalDelete(uriPrefix, nodePath string) error {
+	_, err := c.do(context.Background(), "DELETE", path.Join(uriPrefix, nodePath), nil, nil)
+	return err
+}
+
+// do send the request to upstream, and decode the json response to result, return the upstream data version.
+func (c *Client) do(ctx context.Context, method, uri string, body interface{}, result interface{}) (int64, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+	}
+	var lastErr error
+	for i := 0; i < len(c.endpoints); i++ {
+		endpoint := c.endpoint()
+		var reader io.Reader
+		if data != nil {
+			reader = bytes.NewReader(data)
+		}
+		req, err := http.NewRequest(method, endpoint+uri, reader)
+		if err != nil {
+			return 0, err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Accept", "application/json")
+		if data != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			log.Warning("Request upstream %s error: %s", endpoint, err.Error())
+			lastErr = err
+			c.failover(endpoint)
+			continue
+		}
+		return handleResponse(resp, result)
+	}
+	return 0, lastErr
+}
+
+func (c *Client) endpoint() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.endpoints[c.current]
+}
+
+func (c *Client) failover(endpoint string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.endpoints[c.current] == endpoint {
+		c.current = (c.current + 1) % len(c.endpoints)
+	}
+}
+
+func handleResponse(resp *http.Response, result interface{}) (int64, error) {
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	version, _ := strconv.ParseInt(resp.Header.Get("X-Metad-Version"), 10, 64)
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return version, ErrNotFound
+	case resp.StatusCode == http.StatusGone:
+		return version, errResync
+	case resp.StatusCode != http.StatusOK:
+		var errResp struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(data, &errResp) == nil && errResp.Message != "" {
+			return version, fmt.Errorf("Upstream response %v: %s", resp.StatusCode, errResp.Message)
+		}
+		return version, fmt.Errorf("Upstream response %v: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	if result != nil {
+		if err := json.Unmarshal(data, result); err != nil {
+			return version, err
+		}
+	}
+	return version, nil
+}
+
+func newApplyChangesFunc(s store.Store) func(changes []change) {
+	return func(changes []change) {
+		for _, ch := range changes {
+			if ch.Op == "remove" {
+				s.Delete(ch.Path)
+			} else {
+				s.Put(ch.Path, ch.New)
+			}
+		}
+	}
+}
+
+func newApplyStoreFunc(s store.Store) func(val interface{}) {
+	return func(val interface{}) {
+		flat := map[string]string{}
+		switch t := val.(type) {
+		case map[string]interface{}:
+			flat = flatmap.Flatten(t)
+		case string:
+			log.Warning("Unexpect leaf value from upstream: %s", t)
+		}
+		store.ApplyFlatmap(s, flat, nil, 0)
+	}
+}
@@ -17,6 +17,13 @@ import (
 	"github.com/yunify/metad/log"
 )
 
+const (
+	// DefaultTemplatePath is the default data path of the named templates.
+	DefaultTemplatePath = "/_templates"
+	// DefaultCloudInitPath is the default data path of the cloud-init documents.
+	DefaultCloudInitPath = "/_cloudinit"
+)
+
 type Nodes []string
 
 // String returns the string representation of a node var.
@@ -40,18 +47,34 @@ var (
 	prefix       string
 	listen       string
 	listenManage string
+	listenIMDS   string
+	identity     string
+	proxyHeader  string
+	tlsCert      string
+	tlsKey       string
+	tlsClientCA  string
 	configFile   string
 	pidFile      string
 
-	backend      string
-	basicAuth    bool
-	clientCaKeys string
-	clientCert   string
-	clientKey    string
-	nodes        Nodes
-	username     string
-	password     string
-	group        string
+	backend       string
+	basicAuth     bool
+	clientCaKeys  string
+	clientCert    string
+	clientKey     string
+	nodes         Nodes
+	username      string
+	password      string
+	group         string
+	templatePath  string
+	cloudInitPath string
+
+	trustedProxies Nodes
+
+	embedName           string
+	embedDataDir        string
+	embedPeerURLs       Nodes
+	embedInitialCluster string
+	embedClusterState   string
 )
 
 type Config struct {
@@ -70,6 +93,41 @@ type Config struct {
 	Username     string   `yaml:"username"`
 	Password     string   `yaml:"password"`
 	Group        string   `yaml:"Group"`
+	// TemplatePath is the data path of the named templates rendered by /_metad/render.
+	TemplatePath string `yaml:"template_path"`
+	// CloudInitPath is the data path of the cloud-init documents served by /_metad/nocloud.
+	CloudInitPath string `yaml:"cloud_init_path"`
+	// ListenIMDS is the address of the EC2, OpenStack and GCE compatible metadata service, disabled if empty.
+	ListenIMDS string `yaml:"listen_imds,omitempty"`
+	// IMDS, OpenStack and GCE are only supported in configuration file.
+	IMDS      IMDSConfig      `yaml:"imds,omitempty"`
+	OpenStack OpenStackConfig `yaml:"openstack,omitempty"`
+	GCE       GCEConfig       `yaml:"gce,omitempty"`
+
+	// Identity is the comma separated resolvers of the client identity, tried in order: ip, xff, proxy, cert, token.
+	Identity string `yaml:"identity,omitempty"`
+	// TrustedProxies is the ips or CIDRs of the proxies trusted by the proxy identity.
+	TrustedProxies []string `yaml:"trusted_proxies,omitempty"`
+	// ProxyHeader is the header of the client ip set by the trusted proxies, default is X-Forwarded-For.
+	ProxyHeader string `yaml:"proxy_header,omitempty"`
+	// TokenSecret is the HMAC secret of the token identity, only supported in configuration file.
+	TokenSecret string `yaml:"token_secret,omitempty"`
+	// TLSCert and TLSKey enable https of the metadata listener, TLSClientCA verify the client certificates of the cert identity.
+	TLSCert     string `yaml:"tls_cert,omitempty"`
+	TLSKey      string `yaml:"tls_key,omitempty"`
+	TLSClientCA string `yaml:"tls_client_ca,omitempty"`
+
+	EmbedName           string   `yaml:"embed_name,omitempty"`
+	EmbedDataDir        string   `yaml:"embed_data_dir,omitempty"`
+	EmbedPeerURLs       []string `yaml:"embed_peer_urls,omitempty"`
+	EmbedInitialCluster string   `yaml:"embed_initial_cluster,omitempty"`
+	EmbedClusterState   string   `yaml:"embed_cluster_state,omitempty"`
+
+	// Layers and WriteLayer are only supported in configuration file, used with -backend=layered.
+	Layers     []backends.Config `yaml:"layers,omitempty"`
+	WriteLayer int               `yaml:"write_layer,omitempty"`
+	// MappingBackend is only supported in configuration file, used with -backend=upstream.
+	MappingBackend *backends.Config `yaml:"mapping_backend,omitempty"`
 }
 
 func init() {
@@ -82,8 +140,17 @@ func init() {
 	flag.BoolVar(&enableXff, "xff", false, "X-Forwarded-For header support")
 	flag.StringVar(&prefix, "prefix", "", "Backend key path prefix")
 	flag.StringVar(&group, "group", "default", "The metad's group name, same group share same mapping config from backend")
+	flag.StringVar(&templatePath, "template_path", DefaultTemplatePath, "The data path of the named templates")
+	flag.StringVar(&cloudInitPath, "cloud_init_path", DefaultCloudInitPath, "The data path of the cloud-init documents")
 	flag.StringVar(&listen, "listen", ":80", "Address to listen to (TCP)")
 	flag.StringVar(&listenManage, "listen_manage", "127.0.0.1:9611", "Address to listen to for manage requests (TCP)")
+	flag.StringVar(&listenIMDS, "listen_imds", "", "Address to listen to for EC2, OpenStack and GCE compatible metadata requests (TCP), disabled if empty")
+	flag.StringVar(&identity, "identity", "", "The comma separated resolvers of the client identity: ip|xff|proxy|cert|token, default is ip")
+	flag.Var(&trustedProxies, "trusted_proxies", "List of ips or CIDRs of the proxies trusted by the proxy identity")
+	flag.StringVar(&proxyHeader, "proxy_header", DefaultProxyHeader, "The header of the client ip set by the trusted proxies")
+	flag.StringVar(&tlsCert, "tls_cert", "", "The certificate of the metadata listener, enable https")
+	flag.StringVar(&tlsKey, "tls_key", "", "The key of the metadata listener")
+	flag.StringVar(&tlsClientCA, "tls_client_ca", "", "The CA to verify the client certificates")
 	flag.BoolVar(&basicAuth, "basic_auth", false, "Use Basic Auth to authenticate (only used with -backend=etcd)")
 	flag.StringVar(&clientCaKeys, "client_ca_keys", "", "The client ca keys")
 	flag.StringVar(&clientCert, "client_cert", "", "The client cert")
@@ -91,18 +158,25 @@ func init() {
 	flag.Var(&nodes, "nodes", "List of backend nodes")
 	flag.StringVar(&username, "username", "", "The username to authenticate as (only used with etcd backends)")
 	flag.StringVar(&password, "password", "", "The password to authenticate with (only used with etcd backends)")
+	flag.StringVar(&embedName, "embed_name", "", "The member name of embedded etcd (only used with -backend=embedded)")
+	flag.StringVar(&embedDataDir, "embed_data_dir", "", "The data dir of embedded etcd (only used with -backend=embedded)")
+	flag.Var(&embedPeerURLs, "embed_peer_urls", "List of peer urls of embedded etcd (only used with -backend=embedded)")
+	flag.StringVar(&embedInitialCluster, "embed_initial_cluster", "", "The initial cluster of embedded etcd, eg: m1=http://10.0.0.1:2380,m2=http://10.0.0.2:2380 (only used with -backend=embedded)")
+	flag.StringVar(&embedClusterState, "embed_cluster_state", "", "The initial cluster state of embedded etcd: new|existing (only used with -backend=embedded)")
 }
 
 func initConfig() (*Config, error) {
 
 	// Set defaults.
 	config := &Config{
-		Backend:      "local",
-		Prefix:       "",
-		Group:        "default",
-		LogLevel:     "info",
-		Listen:       ":80",
-		ListenManage: "127.0.0.1:9611",
+		Backend:       "local",
+		Prefix:        "",
+		Group:         "default",
+		TemplatePath:  DefaultTemplatePath,
+		CloudInitPath: DefaultCloudInitPath,
+		LogLevel:      "info",
+		Listen:        ":80",
+		ListenManage:  "127.0.0.1:9611",
 	}
 	if configFile != "" {
 		err := loadConfigFile(configFile, config)
@@ -170,10 +244,28 @@ func setConfigFromFlag(config *Config, f *flag.Flag) {
 		config.Prefix = prefix
 	case "group":
 		config.Group = group
+	case "template_path":
+		config.TemplatePath = templatePath
+	case "cloud_init_path":
+		config.CloudInitPath = cloudInitPath
 	case "listen":
 		config.Listen = listen
 	case "listen_manage":
 		config.ListenManage = listenManage
+	case "listen_imds":
+		config.ListenIMDS = listenIMDS
+	case "identity":
+		config.Identity = identity
+	case "trusted_proxies":
+		config.TrustedProxies = trustedProxies
+	case "proxy_header":
+		config.ProxyHeader = proxyHeader
+	case "tls_cert":
+		config.TLSCert = tlsCert
+	case "tls_key":
+		config.TLSKey = tlsKey
+	case "tls_client_ca":
+		config.TLSClientCA = tlsClientCA
 	case "basic_auth":
 		config.BasicAuth = basicAuth
 	case "client_cert":
@@ -188,5 +280,15 @@ func setConfigFromFlag(config *Config, f *flag.Flag) {
 		config.Username = username
 	case "password":
 		config.Password = password
+	case "embed_name":
+		config.EmbedName = embedName
+	case "embed_data_dir":
+		config.EmbedDataDir = embedDataDir
+	case "embed_peer_urls":
+		config.EmbedPeerURLs = embedPeerURLs
+	case "embed_initial_cluster":
+		config.EmbedInitialCluster = embedInitialCluster
+	case "embed_cluster_state":
+		config.EmbedClusterState = embedClusterState
 	}
 }
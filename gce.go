@@ -0,0 +1,121 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/yunify/metad/util/flatmap"
+)
+
+const (
+	GCEFlavorHeader = "Metadata-Flavor"
+	GCEFlavor       = "Google"
+)
+
+// GCEConfig is the config of the GCE metadata server compatible api, which serve the client's self
+// metadata under /computeMetadata/v1.
+type GCEConfig struct {
+	// MetaData map the metadata path to the self path, such as "instance/hostname: /host/name",
+	// the whole self is served if it is empty.
+	MetaData map[string]string `yaml:"meta_data,omitempty"`
+}
+
+func (m *Metad) initGCERouter() {
+	m.imdsRouter.HandleFunc("/computeMetadata", m.imdsWrapper(m.gceVersions, m.checkGCEFlavor)).Methods("GET")
+	m.imdsRouter.HandleFunc("/computeMetadata/", m.imdsWrapper(m.gceVersions, m.checkGCEFlavor)).Methods("GET")
+	m.imdsRouter.HandleFunc("/computeMetadata/v1", m.imdsWrapper(m.gceMetaData, m.checkGCEFlavor)).Methods("GET")
+	m.imdsRouter.HandleFunc("/computeMetadata/v1/{nodePath:.*}", m.imdsWrapper(m.gceMetaData, m.checkGCEFlavor)).Methods("GET")
+}
+
+// checkGCEFlavor check the Metadata-Flavor header, same as GCE, it protect the metadata from the request forwarded
+// by the server side request forgery, so the request with X-Forwarded-For is rejected too.
+func (m *Metad) checkGCEFlavor(ctx context.Context, req *http.Request) *HttpError {
+	if req.Header.Get(GCEFlavorHeader) != GCEFlavor {
+		return NewHttpError(http.StatusForbidden, "Missing Metadata-Flavor:Google header")
+	}
+	if !m.config.EnableXff && req.Header.Get("X-Forwarded-For") != "" {
+		return NewHttpError(http.StatusForbidden, "Forbidden")
+	}
+	return nil
+}
+
+func (m *Metad) gceVersions(ctx context.Context, req *http.Request) (string, *HttpError) {
+	setGCEHeader(ctx, ContentTypeText)
+	return "v1/\n", nil
+}
+
+// gceMetaData return the leaf value, or the child names of the dir, support the recursive and alt parameters of GCE.
+// The recursive result is json by default, the keys are lower camel case and the dirs with index keys are arrays.
+func (m *Metad) gceMetaData(ctx context.Context, req *http.Request) (string, *HttpError) {
+	val := subValue(m.metadataRepo.SelfMapped(m.requestClient(ctx, req), m.config.GCE.MetaData), mux.Vars(req)["nodePath"])
+	recursive := strings.ToLower(req.FormValue("recursive")) == "true"
+	alt := strings.ToLower(req.FormValue("alt"))
+	if alt != "" && alt != "json" && alt != "text" {
+		return "", NewHttpError(http.StatusBadRequest, "Invalid alt parameter, should be json or text")
+	}
+	var result interface{}
+	switch v := val.(type) {
+	case string:
+		if alt != "json" {
+			setGCEHeader(ctx, ContentTypeText)
+			return v, nil
+		}
+		result = v
+	case map[string]interface{}:
+		if recursive && alt == "text" {
+			setGCEHeader(ctx, ContentTypeText)
+			return gceText(v), nil
+		}
+		if recursive {
+			result = jsonValue(v, true)
+		} else if alt == "json" {
+			result = childNames(v)
+		} else {
+			setGCEHeader(ctx, ContentTypeText)
+			return strings.Join(childNames(v), "\n") + "\n", nil
+		}
+	default:
+		return "", NewHttpError(http.StatusNotFound, "Not found")
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		return "", NewServerError(err)
+	}
+	setGCEHeader(ctx, ContentTypeJSON)
+	return string(b), nil
+}
+
+// gceText return the leaves of the dir as "path value" lines, same as the recursive text of GCE.
+func gceText(dir map[string]interface{}) string {
+	fm := flatmap.Flatten(dir)
+	var keys []string
+	for k := range fm {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buffer bytes.Buffer
+	for _, k := range keys {
+		buffer.WriteString(strings.TrimPrefix(k, "/"))
+		buffer.WriteString(" ")
+		buffer.WriteString(fm[k])
+		buffer.WriteString("\n")
+	}
+	return buffer.String()
+}
+
+func setGCEHeader(ctx context.Context, contentType string) {
+	if header, ok := ctx.Value("header").(http.Header); ok {
+		header.Set(GCEFlavorHeader, GCEFlavor)
+		header.Set("Content-Type", contentType)
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The identity resolvers, the identity of the ip resolvers is the client ip, the others are "{resolver}:{name}",
+// such as "cert:web-1", so the identity can not be forged by other resolvers.
+const (
+	// IdentityIP is the ip of the connection.
+	IdentityIP = "ip"
+	// IdentityXff is the X-Forwarded-For header from any client, same as -xff, it is trivially spoofable.
+	IdentityXff = "xff"
+	// IdentityProxy is the ip in the proxy header, only trusted when the connection is from the trusted proxies.
+	IdentityProxy = "proxy"
+	// IdentityCert is the common name, or the first DNS SAN of the TLS client certificate.
+	IdentityCert = "cert"
+	// IdentityToken is the subject of the HS256 JWT bearer token.
+	IdentityToken = "token"
+)
+
+const DefaultProxyHeader = "X-Forwarded-For"
+
+var (
+	ErrInvalidToken = errors.New("Invalid token")
+	ErrTokenExpired = errors.New("Token expired")
+)
+
+// IdentityResolver resolve the client identity of the request, which is the key of the mapping and access rule.
+// Return ok false if the request does not carry the identity, return error if the identity is invalid.
+type IdentityResolver interface {
+	Resolve(req *http.Request) (identity string, ok bool, err error)
+}
+
+// chainResolver try the resolvers in order, the first resolved identity is used.
+type chainResolver []IdentityResolver
+
+func (c chainResolver) Resolve(req *http.Request) (string, bool, error) {
+	for _, r := range c {
+		identity, ok, err := r.Resolve(req)
+		if err != nil || ok {
+			return identity, ok, err
+		}
+	}
+	return "", false, nil
+}
+
+// NewIdentityResolver create the resolver of the config, the resolvers in config.Identity are tried in order,
+// the default is "ip", or "xff,ip" if EnableXff.
+func NewIdentityResolver(config *Config) (IdentityResolver, error) {
+	identity := config.Identity
+	if identity == "" {
+		identity = IdentityIP
+		if config.EnableXff {
+			identity = IdentityXff + "," + IdentityIP
+		}
+	}
+	var chain chainResolver
+	for _, name := range strings.Split(identity, ",") {
+		switch strings.TrimSpace(name) {
+		case IdentityIP:
+			chain = append(chain, ipResolver{})
+		case IdentityXff:
+			chain = append(chain, xffResolver{})
+		case IdentityProxy:
+			r, err := newProxyResolver(config.TrustedProxies, config.ProxyHeader)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, r)
+		case IdentityCert:
+			chain = append(chain, certResolver{})
+		case IdentityToken:
+			if config.TokenSecret == "" {
+				return nil, errors.New("token_secret is required by token identity")
+			}
+			chain = append(chain, &tokenResolver{secret: []byte(config.TokenSecret)})
+		default:
+			return nil, fmt.Errorf("Invalid identity resolver [%s]", name)
+		}
+	}
+	return chain, nil
+}
+
+type ipResolver struct{}
+
+func (ipResolver) Resolve(req *http.Request) (string, bool, error) {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return "", false, nil
+	}
+	return ip, true, nil
+}
+
+type xffResolver struct{}
+
+func (xffResolver) Resolve(req *http.Request) (string, bool, error) {
+	xff := req.Header.Get("X-Forwarded-For")
+	return xff, xff != "", nil
+}
+
+// proxyResolver trust the proxy header only from the trusted proxies, the client is the last ip in the header
+// not from the trusted proxies, so the ips prepended by the client are ignored.
+type proxyResolver struct {
+	trusted []*net.IPNet
+	header  string
+}
+
+func newProxyResolver(proxies []string, header string) (*proxyResolver, error) {
+	if len(proxies) == 0 {
+		return nil, errors.New("trusted_proxies is required by proxy identity")
+	}
+	if header == "" {
+		header = DefaultProxyHeader
+	}
+	r := &proxyResolver{header: header}
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p = p + "/32"
+			} else {
+				p = p + "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy [%s]", p)
+		}
+		r.trusted = append(r.trusted, ipNet)
+	}
+	return r, nil
+}
+
+func (r *proxyResolver) isTrusted(ip net.IP) bool {
+	for _, ipNet := range r.trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *proxyResolver) Resolve(req *http.Request) (string, bool, error) {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return "", false, nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !r.isTrusted(ip) {
+		return "", false, nil
+	}
+	ips := strings.Split(strings.Join(req.Header[http.CanonicalHeaderKey(r.header)], ","), ",")
+	for i := len(ips) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(ips[i]))
+		if ip == nil {
+			// the client can not be trusted after an invalid ip.
+			return "", false, nil
+		}
+		if !r.isTrusted(ip) || i == 0 {
+			return ip.String(), true, nil
+		}
+	}
+	return "", false, nil
+}
+
+type certResolver struct{}
+
+func (certResolver) Resolve(req *http.Request) (string, bool, error) {
+	// the certificates are verified by the tls config of the listener.
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return "", false, nil
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+	name := cert.Subject.CommonName
+	if name == "" && len(cert.DNSNames) > 0 {
+		name = cert.DNSNames[0]
+	}
+	if name == "" {
+		return "", false, nil
+	}
+	if strings.Contains(name, "/") {
+		return "", false, fmt.Errorf("Invalid certificate name [%s]", name)
+	}
+	return IdentityCert + ":" + name, true, nil
+}
+
+// tokenResolver verify the HS256 JWT in the Authorization bearer header, the identity is the sub claim.
+type tokenResolver struct {
+	secret []byte
+}
+
+func (r *tokenResolver) Resolve(req *http.Request) (string, bool, error) {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false, nil
+	}
+	sub, err := r.verify(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")))
+	if err != nil {
+		return "", false, err
+	}
+	return IdentityToken + ":" + sub, true, nil
+}
+
+func (r *tokenResolver) verify(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeTokenPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return "", ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, r.sign(parts[0]+"."+parts[1])) {
+		return "", ErrInvalidToken
+	}
+	var claims struct {
+		Sub string `json:"sub"`
+		Exp int64  `json:"exp"`
+		Nbf int64  `json:"nbf"`
+	}
+	if err := decodeTokenPart(parts[1], &claims); err != nil || claims.Sub == "" || strings.Contains(claims.Sub, "/") {
+		return "", ErrInvalidToken
+	}
+	now := time.Now().Unix()
+	if (claims.Exp > 0 && now >= claims.Exp) || (claims.Nbf > 0 && now < claims.Nbf) {
+		return "", ErrTokenExpired
+	}
+	return claims.Sub, nil
+}
+
+func (r *tokenResolver) sign(data string) []byte {
+	mac := hmac.New(sha256.New, r.secret)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func decodeTokenPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,271 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/yunify/metad/log"
+)
+
+const (
+	// DefaultIMDSUserData is the default self path of the user-data.
+	DefaultIMDSUserData = "/user-data"
+
+	IMDSTokenHeader    = "X-aws-ec2-metadata-token"
+	IMDSTokenTTLHeader = "X-aws-ec2-metadata-token-ttl-seconds"
+	// IMDSMaxTokenTTL is the max ttl of the session token, same as EC2, 6 hours.
+	IMDSMaxTokenTTL = 21600
+)
+
+// IMDSConfig is the config of the EC2 instance metadata service compatible api, which serve the client's self
+// metadata under /latest/meta-data. The OpenStack and GCE compatible api are served by the same listener.
+type IMDSConfig struct {
+	// MetaData map the meta-data path to the self path, such as "local-ipv4: /host/ip",
+	// the whole self is served if it is empty.
+	MetaData map[string]string `yaml:"meta_data,omitempty"`
+	// UserData is the self path of the user-data, default is /user-data.
+	UserData string `yaml:"user_data,omitempty"`
+	// TokenRequired require the IMDSv2 session token, same as the HttpTokens=required of EC2.
+	TokenRequired bool `yaml:"token_required,omitempty"`
+}
+
+type imdsFunc func(ctx context.Context, req *http.Request) (string, *HttpError)
+
+func (m *Metad) initIMDSRouter() {
+	m.imdsRouter.HandleFunc("/latest/api/token", m.imdsWrapper(m.imdsToken, nil)).Methods("PUT")
+
+	m.imdsRouter.HandleFunc("/", m.imdsWrapper(m.imdsVersions, m.checkIMDSToken)).Methods("GET")
+	m.imdsRouter.HandleFunc("/latest", m.imdsWrapper(m.imdsLatest, m.checkIMDSToken)).Methods("GET")
+	m.imdsRouter.HandleFunc("/latest/", m.imdsWrapper(m.imdsLatest, m.checkIMDSToken)).Methods("GET")
+	m.imdsRouter.HandleFunc("/latest/user-data", m.imdsWrapper(m.imdsUserData, m.checkIMDSToken)).Methods("GET")
+	m.imdsRouter.HandleFunc("/latest/meta-data", m.imdsWrapper(m.imdsMetaData, m.checkIMDSToken)).Methods("GET")
+	m.imdsRouter.HandleFunc("/latest/meta-data/{nodePath:.*}", m.imdsWrapper(m.imdsMetaData, m.checkIMDSToken)).Methods("GET")
+
+	m.initOpenStackRouter()
+	m.initGCERouter()
+}
+
+func (m *Metad) watchIMDS() {
+	if m.config.ListenIMDS == "" {
+		return
+	}
+	log.Info("Listening for IMDS on %s", m.config.ListenIMDS)
+	go http.ListenAndServe(m.config.ListenIMDS, m.imdsRouter)
+}
+
+// imdsToken create the IMDSv2 session token, the token is signed by the client identity and the expiry time,
+// so it is only valid for the client, and it is invalid after metad restart, the client should get a new one.
+func (m *Metad) imdsToken(ctx context.Context, req *http.Request) (string, *HttpError) {
+	// same as EC2, the token request forwarded by a proxy is rejected.
+	if !m.config.EnableXff && req.Header.Get("X-Forwarded-For") != "" {
+		return "", NewHttpError(http.StatusForbidden, "Forbidden")
+	}
+	ttl, err := strconv.Atoi(req.Header.Get(IMDSTokenTTLHeader))
+	if err != nil || ttl < 1 || ttl > IMDSMaxTokenTTL {
+		return "", NewHttpError(http.StatusBadRequest, fmt.Sprintf("Invalid %s", IMDSTokenTTLHeader))
+	}
+	expiry := time.Now().Add(time.Duration(ttl) * time.Second).Unix()
+	token := fmt.Sprintf("%d.%s", expiry, m.imdsSign(m.requestClient(ctx, req), expiry))
+	if header, ok := ctx.Value("header").(http.Header); ok {
+		header.Set(IMDSTokenTTLHeader, strconv.Itoa(ttl))
+	}
+	return token, nil
+}
+
+func (m *Metad) imdsSign(clientIP string, expiry int64) string {
+	mac := hmac.New(sha256.New, m.imdsSecret)
+	fmt.Fprintf(mac, "%s|%d", clientIP, expiry)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkIMDSToken check the session token of the request, the token is optional unless TokenRequired.
+func (m *Metad) checkIMDSToken(ctx context.Context, req *http.Request) *HttpError {
+	token := req.Header.Get(IMDSTokenHeader)
+	if token == "" {
+		if m.config.IMDS.TokenRequired {
+			return NewHttpError(http.StatusUnauthorized, "Unauthorized")
+		}
+		return nil
+	}
+	i := strings.Index(token, ".")
+	if i < 0 {
+		return NewHttpError(http.StatusUnauthorized, "Unauthorized")
+	}
+	expiry, err := strconv.ParseInt(token[:i], 10, 64)
+	if err != nil || expiry < time.Now().Unix() ||
+		!hmac.Equal([]byte(token[i+1:]), []byte(m.imdsSign(m.requestClient(ctx, req), expiry))) {
+		return NewHttpError(http.StatusUnauthorized, "Unauthorized")
+	}
+	return nil
+}
+
+func (m *Metad) imdsVersions(ctx context.Context, req *http.Request) (string, *HttpError) {
+	return "latest", nil
+}
+
+func (m *Metad) imdsLatest(ctx context.Context, req *http.Request) (string, *HttpError) {
+	names := []string{"meta-data"}
+	if _, ok := m.metadataRepo.Self(m.requestClient(ctx, req), m.imdsUserDataPath()).(string); ok {
+		names = append(names, "user-data")
+	}
+	return strings.Join(names, "\n"), nil
+}
+
+func (m *Metad) imdsUserData(ctx context.Context, req *http.Request) (string, *HttpError) {
+	userData, ok := m.metadataRepo.Self(m.requestClient(ctx, req), m.imdsUserDataPath()).(string)
+	if !ok {
+		return "", NewHttpError(http.StatusNotFound, "Not found")
+	}
+	return userData, nil
+}
+
+// imdsMetaData return the leaf value, or the child names of the dir.
+func (m *Metad) imdsMetaData(ctx context.Context, req *http.Request) (string, *HttpError) {
+	val := m.metadataRepo.SelfMapped(m.requestClient(ctx, req), m.config.IMDS.MetaData)
+	switch v := subValue(val, mux.Vars(req)["nodePath"]).(type) {
+	case string:
+		return v, nil
+	case map[string]interface{}:
+		return strings.Join(childNames(v), "\n"), nil
+	}
+	return "", NewHttpError(http.StatusNotFound, "Not found")
+}
+
+func (m *Metad) imdsUserDataPath() string {
+	if m.config.IMDS.UserData == "" {
+		return DefaultIMDSUserData
+	}
+	return m.config.IMDS.UserData
+}
+
+// imdsWrapper respond the result as text unless the handler set the Content-Type, check the request before handle,
+// such as the session token, if check is not nil.
+func (m *Metad) imdsWrapper(handler imdsFunc, check func(ctx context.Context, req *http.Request) *HttpError) func(w http.ResponseWriter, req *http.Request) {
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		requestID := m.generateRequestID()
+		identity, ok := m.resolveIdentity(w, req, requestID)
+		if !ok {
+			return
+		}
+		ctx := context.WithValue(req.Context(), "requestID", requestID)
+		ctx = context.WithValue(ctx, "identity", identity)
+		ctx = context.WithValue(ctx, "header", w.Header())
+
+		var result string
+		var err *HttpError
+		if check != nil {
+			err = check(ctx, req)
+		}
+		if err == nil {
+			result, err = handler(ctx, req)
+		}
+
+		w.Header().Add("X-Metad-RequestID", requestID)
+		status := 200
+		if err != nil {
+			status = err.Status
+			http.Error(w, err.Message, status)
+			m.errorLog(requestID, req, status, err.Message)
+		} else {
+			if w.Header().Get("Content-Type") == "" {
+				w.Header().Set("Content-Type", ContentTypeText)
+			}
+			w.Write([]byte(result))
+		}
+		m.requestLog(requestID, 0, req, status, time.Since(start), len(result))
+	}
+}
+
+// subValue return the value of the nodePath under val, nil if not exist.
+func subValue(val interface{}, nodePath string) interface{} {
+	for _, name := range strings.Split(path.Clean("/"+nodePath), "/") {
+		if name == "" {
+			continue
+		}
+		dir, ok := val.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		val = dir[name]
+	}
+	return val
+}
+
+// childNames return the sorted child names of the dir, the names of the child dirs end with "/".
+func childNames(dir map[string]interface{}) []string {
+	names := make([]string, 0, len(dir))
+	for k, child := range dir {
+		if _, isDir := child.(map[string]interface{}); isDir {
+			k = k + "/"
+		}
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// jsonValue convert the dirs with the index keys "0" to "n-1" to the arrays. If camel is true, the keys are converted
+// to the lower camel case, such as "network-interfaces" to "networkInterfaces", same as GCE, except the user defined
+// keys under the "attributes" dirs.
+func jsonValue(val interface{}, camel bool) interface{} {
+	dir, ok := val.(map[string]interface{})
+	if !ok {
+		return val
+	}
+	isArray := len(dir) > 0
+	for i := 0; i < len(dir) && isArray; i++ {
+		_, isArray = dir[strconv.Itoa(i)]
+	}
+	if isArray {
+		array := make([]interface{}, len(dir))
+		for i := range array {
+			array[i] = jsonValue(dir[strconv.Itoa(i)], camel)
+		}
+		return array
+	}
+	result := make(map[string]interface{}, len(dir))
+	for k, v := range dir {
+		if camel {
+			result[lowerCamelCase(k)] = jsonValue(v, k != "attributes")
+		} else {
+			result[k] = jsonValue(v, false)
+		}
+	}
+	return result
+}
+
+func lowerCamelCase(key string) string {
+	parts := strings.Split(key, "-")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+func newIMDSSecret() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}
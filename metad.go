@@ -7,22 +7,29 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/golang/gddo/httputil"
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/websocket"
 	yaml "gopkg.in/yaml.v2"
 
 	"github.com/yunify/metad/atomic"
@@ -30,7 +37,9 @@ import (
 	"github.com/yunify/metad/log"
 	"github.com/yunify/metad/metadata"
 	"github.com/yunify/metad/store"
+	"github.com/yunify/metad/util/encoder"
 	"github.com/yunify/metad/util/flatmap"
+	"github.com/yunify/metad/util/jsonpath"
 )
 
 const (
@@ -40,8 +49,25 @@ const (
 	ContentTypeJSON = "application/json"
 	ContentYAML     = 3
 	ContentTypeYAML = "application/yaml"
+	// ContentEnv is the shell export lines, can be eval by the shell.
+	ContentEnv            = 4
+	ContentTypeEnv        = "text/x-shellscript"
+	ContentTOML           = 5
+	ContentTypeTOML       = "application/toml"
+	ContentProperties     = 6
+	ContentTypeProperties = "text/x-java-properties"
 )
 
+// formatContents is the content of the format parameter, it override the Accept header.
+var formatContents = map[string]int{
+	"text":       ContentText,
+	"json":       ContentJSON,
+	"yaml":       ContentYAML,
+	"env":        ContentEnv,
+	"toml":       ContentTOML,
+	"properties": ContentProperties,
+}
+
 type HttpError struct {
 	Status  int
 	Message string
@@ -61,12 +87,40 @@ func (e HttpError) Error() string {
 
 type handleFunc func(ctx context.Context, req *http.Request) (int64, interface{}, *HttpError)
 type manageFunc func(ctx context.Context, req *http.Request) (interface{}, *HttpError)
+type streamFunc func(ctx context.Context, req *http.Request, lastVersion int64, send func(*metadata.StreamEvent) error) error
+
+// The op of wsRequest.
+const (
+	WSOpSubscribe   = "subscribe"
+	WSOpUnsubscribe = "unsubscribe"
+)
+
+// wsRequest is the message client send by websocket, Version is the version of the last event the client got,
+// same as Last-Event-ID of stream.
+type wsRequest struct {
+	Op      string `json:"op"`
+	ID      string `json:"id"`
+	Path    string `json:"path,omitempty"`
+	Version int64  `json:"version,omitempty"`
+}
+
+// wsEvent is the message server push by websocket, Type is snapshot, change or error.
+type wsEvent struct {
+	ID      string      `json:"id"`
+	Type    string      `json:"type"`
+	Version int64       `json:"version,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+	Message string      `json:"message,omitempty"`
+}
 
 type Metad struct {
 	config       *Config
 	metadataRepo *metadata.MetadataRepo
 	router       *mux.Router
 	manageRouter *mux.Router
+	imdsRouter   *mux.Router
+	imdsSecret   []byte
+	identity     IdentityResolver
 	requestIDGen atomic.AtomicLong
 }
 
@@ -83,6 +137,17 @@ func New(config *Config) (*Metad, error) {
 		Username:     config.Username,
 		Prefix:       config.Prefix,
 		Group:        config.Group,
+
+		EmbedName:           config.EmbedName,
+		EmbedDataDir:        config.EmbedDataDir,
+		EmbedPeerURLs:       config.EmbedPeerURLs,
+		EmbedInitialCluster: config.EmbedInitialCluster,
+		EmbedClusterState:   config.EmbedClusterState,
+
+		Layers:     config.Layers,
+		WriteLayer: config.WriteLayer,
+
+		MappingBackend: config.MappingBackend,
 	}
 
 	storeClient, err := backends.New(backendsConfig)
@@ -90,19 +155,55 @@ func New(config *Config) (*Metad, error) {
 		return nil, err
 	}
 
+	if config.TemplatePath == "" {
+		config.TemplatePath = DefaultTemplatePath
+	}
+	if config.CloudInitPath == "" {
+		config.CloudInitPath = DefaultCloudInitPath
+	}
+	identity, err := NewIdentityResolver(config)
+	if err != nil {
+		return nil, err
+	}
+
 	metadataRepo := metadata.New(storeClient)
-	return &Metad{config: config, metadataRepo: metadataRepo, router: mux.NewRouter(), manageRouter: mux.NewRouter()}, nil
+	return &Metad{config: config, metadataRepo: metadataRepo, router: mux.NewRouter(), manageRouter: mux.NewRouter(),
+		imdsRouter: mux.NewRouter(), imdsSecret: newIMDSSecret(), identity: identity}, nil
 }
 
 func (m *Metad) Init() {
 	m.metadataRepo.StartSync()
 	m.initRouter()
 	m.initManageRouter()
+	m.initIMDSRouter()
 }
 
 func (m *Metad) initRouter() {
 	m.router.HandleFunc("/favicon.ico", http.NotFound)
 
+	// stream routes should be registered before the normal routes.
+	m.router.Handle("/", websocket.Server{Handler: m.websocketHandler}).
+		Methods("GET").Queries("stream", "ws")
+
+	m.router.HandleFunc("/self", m.streamWrapper(m.selfStream)).
+		Methods("GET").Queries("stream", "sse")
+
+	m.router.HandleFunc("/self/{nodePath:.*}", m.streamWrapper(m.selfStream)).
+		Methods("GET").Queries("stream", "sse")
+
+	m.router.HandleFunc("/{nodePath:.*}", m.streamWrapper(m.rootStream)).
+		Methods("GET").Queries("stream", "sse")
+
+	// render and nocloud routes are under the reserved /_metad, so they do not shadow the metadata or the self mapping keys.
+	m.router.HandleFunc("/_metad/render", m.handleWrapper(m.selfRender)).
+		Methods("POST")
+
+	m.router.HandleFunc("/_metad/render/{name:.+}", m.handleWrapper(m.selfRender)).
+		Methods("GET", "HEAD")
+
+	m.router.HandleFunc("/_metad/nocloud/{document}", m.imdsWrapper(m.selfNoCloud, nil)).
+		Methods("GET", "HEAD")
+
 	m.router.HandleFunc("/self", m.handleWrapper(m.selfHandler)).
 		Methods("GET", "HEAD")
 
@@ -135,16 +236,25 @@ func (m *Metad) initManageRouter() {
 	mapping.HandleFunc("/{nodePath:.*}", m.manageWrapper(m.mappingUpdate)).Methods("POST", "PUT")
 	mapping.HandleFunc("/{nodePath:.*}", m.manageWrapper(m.mappingDelete)).Methods("DELETE")
 
-	v1.HandleFunc("/data", m.manageWrapper(m.dataGet)).Methods("GET")
+	v1.HandleFunc("/data", m.manageGetWrapper(m.dataGet)).Methods("GET")
 	v1.HandleFunc("/data", m.manageWrapper(m.dataUpdate)).Methods("POST", "PUT")
 	v1.HandleFunc("/data", m.manageWrapper(m.dataDelete)).Methods("DELETE")
 
 	data := v1.PathPrefix("/data").Subrouter()
 	//mapping.HandleFunc("", mappingGET).Methods("GET")
-	data.HandleFunc("/{nodePath:.*}", m.manageWrapper(m.dataGet)).Methods("GET")
+	data.HandleFunc("/{nodePath:.*}", m.manageGetWrapper(m.dataGet)).Methods("GET")
 	data.HandleFunc("/{nodePath:.*}", m.manageWrapper(m.dataUpdate)).Methods("POST", "PUT")
 	data.HandleFunc("/{nodePath:.*}", m.manageWrapper(m.dataDelete)).Methods("DELETE")
 
+	v1.HandleFunc("/txn", m.manageWrapper(m.txnUpdate)).Methods("POST")
+
+	v1.HandleFunc("/keepalive/data", m.manageWrapper(m.dataKeepAlive)).Methods("POST", "PUT")
+	v1.HandleFunc("/keepalive/mapping", m.manageWrapper(m.mappingKeepAlive)).Methods("POST", "PUT")
+
+	keepalive := v1.PathPrefix("/keepalive").Subrouter()
+	keepalive.HandleFunc("/data/{nodePath:.*}", m.manageWrapper(m.dataKeepAlive)).Methods("POST", "PUT")
+	keepalive.HandleFunc("/mapping/{nodePath:.*}", m.manageWrapper(m.mappingKeepAlive)).Methods("POST", "PUT")
+
 	v1.HandleFunc("/rule", m.manageWrapper(m.accessRuleGet)).Methods("GET")
 	v1.HandleFunc("/rule", m.manageWrapper(m.accessRuleUpdate)).Methods("POST", "PUT")
 	v1.HandleFunc("/rule", m.manageWrapper(m.accessRuleDelete)).Methods("DELETE")
@@ -158,9 +268,27 @@ func (m *Metad) initManageRouter() {
 func (m *Metad) Serve() {
 	m.watchSignals()
 	m.watchManage()
+	m.watchIMDS()
 
 	log.Info("Listening on %s", m.config.Listen)
-	log.Fatal("%v", http.ListenAndServe(m.config.Listen, m.router))
+	if m.config.TLSCert == "" {
+		log.Fatal("%v", http.ListenAndServe(m.config.Listen, m.router))
+	}
+	tlsConfig := &tls.Config{}
+	if m.config.TLSClientCA != "" {
+		ca, err := ioutil.ReadFile(m.config.TLSClientCA)
+		if err != nil {
+			log.Fatal("Read tls_client_ca error: %v", err)
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(ca) {
+			log.Fatal("Invalid tls_client_ca: %s", m.config.TLSClientCA)
+		}
+		// the client without certificate is identified by the other resolvers.
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	server := &http.Server{Addr: m.config.Listen, Handler: m.router, TLSConfig: tlsConfig}
+	log.Fatal("%v", server.ListenAndServeTLS(m.config.TLSCert, m.config.TLSKey))
 }
 
 func (m *Metad) Stop() {
@@ -189,17 +317,270 @@ func (m *Metad) watchManage() {
 	go http.ListenAndServe(m.config.ListenManage, m.manageRouter)
 }
 
-func (m *Metad) dataGet(ctx context.Context, req *http.Request) (interface{}, *HttpError) {
+// dataGet support wait and prev_version same as selfHandler, so the downstream metad can sync by long-polling.
+func (m *Metad) dataGet(ctx context.Context, req *http.Request) (currentVersion int64, result interface{}, httpErr *HttpError) {
 	vars := mux.Vars(req)
 	nodePath := vars["nodePath"]
 	if nodePath == "" {
 		nodePath = "/"
 	}
-	val := m.metadataRepo.GetData(nodePath)
-	if val == nil {
-		return nil, NewHttpError(http.StatusNotFound, "Not found")
-	} else {
-		return val, nil
+	wait := strings.ToLower(req.FormValue("wait")) == "true"
+	format, err := metadata.ParseWatchFormat(req.FormValue("watch_format"))
+	if err != nil {
+		httpErr = NewHttpError(http.StatusBadRequest, err.Error())
+		return
+	}
+	// get revision before data, may be cause client repeat get data, but not lost change,
+	// and a stale revision only cause a conflict on the conditional write.
+	createdRev, modifiedRev := m.metadataRepo.DataRevision(nodePath)
+	if wait && format != metadata.WatchFormatFull {
+		return watchChanges(req, modifiedRev, func(prevVersion int64) (int64, interface{}, error) {
+			return m.metadataRepo.WatchDataChanges(ctx, nodePath, prevVersion, format)
+		})
+	}
+	if wait {
+		// the version is the modified revision of nodePath, only the change of nodePath return.
+		if prevVersion := parsePrevVersion(req); prevVersion <= 0 || prevVersion == modifiedRev {
+			// watch since prevVersion, the change after the version check is not missed.
+			m.metadataRepo.WatchDataSince(ctx, nodePath, prevVersion)
+			createdRev, modifiedRev = m.metadataRepo.DataRevision(nodePath)
+		}
+	}
+	currentVersion = modifiedRev
+	result = m.metadataRepo.GetData(nodePath)
+	if result == nil {
+		httpErr = NewHttpError(http.StatusNotFound, "Not found")
+		return
+	}
+	if header, ok := ctx.Value("header").(http.Header); ok {
+		header.Set("ETag", fmt.Sprintf("\"%d\"", modifiedRev))
+		header.Set("X-Metad-Created-Revision", fmt.Sprintf("%d", createdRev))
+	}
+	return
+}
+
+// watchChanges wait the changes after prev_version, and return them in watch_format instead of the full document.
+// If the changes can not be computed, response 410 Gone, the client should resync the full document.
+func watchChanges(req *http.Request, currentVersion int64, watch func(prevVersion int64) (int64, interface{}, error)) (int64, interface{}, *HttpError) {
+	prevVersion := parsePrevVersion(req)
+	if prevVersion > currentVersion {
+		// may be metad reboot and recount version, the previous version is unknown.
+		return currentVersion, nil, NewHttpError(http.StatusGone, store.ErrHistoryCompacted.Error())
+	}
+	version, result, err := watch(prevVersion)
+	if err != nil {
+		return currentVersion, nil, NewHttpError(http.StatusGone, err.Error())
+	}
+	// the changes before currentVersion have been replayed from history, so the version is not less than it.
+	if version < currentVersion {
+		version = currentVersion
+	}
+	return version, result, nil
+}
+
+// parseValueOptions parse the depth, keys and fields parameters, return nil if none present.
+func parseValueOptions(req *http.Request) (*metadata.ValueOptions, *HttpError) {
+	depthStr := req.FormValue("depth")
+	keys := strings.ToLower(req.FormValue("keys")) == "true"
+	fieldsStr := req.FormValue("fields")
+	if depthStr == "" && !keys && fieldsStr == "" {
+		return nil, nil
+	}
+	options := &metadata.ValueOptions{Keys: keys}
+	if depthStr != "" {
+		depth, err := strconv.Atoi(depthStr)
+		if err != nil || depth < 0 {
+			return nil, NewHttpError(http.StatusBadRequest, fmt.Sprintf("Invalid depth [%s]", depthStr))
+		}
+		options.Depth = depth
+	}
+	if fieldsStr != "" {
+		options.Fields = strings.Split(fieldsStr, ",")
+	}
+	return options, nil
+}
+
+// parseQuery parse the JSONPath expression in q parameter, return nil if not present.
+func parseQuery(req *http.Request) (*jsonpath.Path, *HttpError) {
+	q := req.FormValue("q")
+	if q == "" {
+		return nil, nil
+	}
+	query, err := jsonpath.Compile(q)
+	if err != nil {
+		return nil, NewHttpError(http.StatusBadRequest, err.Error())
+	}
+	return query, nil
+}
+
+// parsePrevVersion parse the prev_version parameter of wait, return 0 if not present, -1 if invalid.
+func parsePrevVersion(req *http.Request) int64 {
+	prevVersionStr := req.FormValue("prev_version")
+	if prevVersionStr == "" {
+		return 0
+	}
+	prevVersion, err := strconv.ParseInt(prevVersionStr, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return prevVersion
+}
+
+// matchIfNoneMatch check whether the If-None-Match header of GET or HEAD request match the etag,
+// the header can be a list of etags or "*", the full etag is compared by weak comparison.
+func matchIfNoneMatch(req *http.Request, etag string) bool {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	ifNoneMatch := req.Header.Get("If-None-Match")
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+	tags, ok := parseETags(ifNoneMatch)
+	if !ok {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, t := range tags {
+		if t.tag == "*" || t.tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// entityTag is an etag in If-Match or If-None-Match header, tag is quoted without the weak prefix, or "*".
+type entityTag struct {
+	tag  string
+	weak bool
+}
+
+// parseETags parse the comma separated etag list per RFC 7232, such as `"42-json", W/"43-json"` or `*`,
+// return false if the header is malformed.
+func parseETags(header string) ([]entityTag, bool) {
+	var tags []entityTag
+	s := header
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return tags, len(tags) > 0
+		}
+		if s[0] == '*' {
+			tags = append(tags, entityTag{tag: "*"})
+			s = s[1:]
+		} else {
+			weak := strings.HasPrefix(s, "W/")
+			if weak {
+				s = s[2:]
+			}
+			if s == "" || s[0] != '"' {
+				return nil, false
+			}
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				return nil, false
+			}
+			tags = append(tags, entityTag{tag: s[:end+2], weak: weak})
+			s = s[end+2:]
+		}
+		if s != "" && s[0] != ',' && s[0] != ' ' && s[0] != '\t' {
+			return nil, false
+		}
+	}
+}
+
+// parseIfMatch parse the revision in If-Match header, return false if the header not present.
+// The etag is the revision such as "42", or the ETag of GET with the format such as "42-json", the revision without
+// quotes is also accepted. The weak etag never match, as If-Match use strong comparison. For the list of etags or "*",
+// the current revision of nodePath is returned if it matches, so the write still fail if nodePath changed after.
+func (m *Metad) parseIfMatch(req *http.Request, nodePath string) (int64, bool, *HttpError) {
+	ifMatch := strings.TrimSpace(req.Header.Get("If-Match"))
+	if ifMatch == "" {
+		return 0, false, nil
+	}
+	invalid := NewHttpError(http.StatusBadRequest, fmt.Sprintf("invalid If-Match revision: %s", ifMatch))
+	if !strings.ContainsAny(ifMatch, "\"*") {
+		rev, err := strconv.ParseInt(ifMatch, 10, 64)
+		if err != nil || rev < 0 {
+			return 0, false, invalid
+		}
+		return rev, true, nil
+	}
+	tags, ok := parseETags(ifMatch)
+	if !ok {
+		return 0, false, invalid
+	}
+	var revs []int64
+	star := false
+	for _, t := range tags {
+		if t.tag == "*" {
+			star = true
+			continue
+		}
+		rev, ok := parseRevisionETag(t.tag)
+		if !ok {
+			return 0, false, invalid
+		}
+		if !t.weak {
+			revs = append(revs, rev)
+		}
+	}
+	if !star && len(revs) == 1 {
+		return revs[0], true, nil
+	}
+	_, current := m.metadataRepo.DataRevision(nodePath)
+	if star && current > 0 {
+		return current, true, nil
+	}
+	for _, rev := range revs {
+		if rev == current {
+			return current, true, nil
+		}
+	}
+	return 0, false, newWriteError(store.ErrRevisionConflict)
+}
+
+// parseRevisionETag parse the quoted etag of the revision, such as "42" or "42-json", the suffix must be a format name.
+func parseRevisionETag(tag string) (int64, bool) {
+	revStr := strings.Trim(tag, "\"")
+	if i := strings.LastIndex(revStr, "-"); i >= 0 {
+		if _, ok := formatContents[revStr[i+1:]]; !ok {
+			return 0, false
+		}
+		revStr = revStr[:i]
+	}
+	rev, err := strconv.ParseInt(revStr, 10, 64)
+	if err != nil || rev < 0 {
+		return 0, false
+	}
+	return rev, true
+}
+
+// parseTTL parse the ttl parameter in seconds, return 0 if the parameter not present.
+// the ttl is read from url query, because the json body may be parsed as form.
+func parseTTL(req *http.Request) (time.Duration, *HttpError) {
+	ttlStr := req.URL.Query().Get("ttl")
+	if ttlStr == "" {
+		return 0, nil
+	}
+	ttl, err := strconv.ParseInt(ttlStr, 10, 64)
+	if err != nil || ttl <= 0 {
+		return 0, NewHttpError(http.StatusBadRequest, fmt.Sprintf("invalid ttl: %s", ttlStr))
+	}
+	return time.Duration(ttl) * time.Second, nil
+}
+
+// newWriteError convert the error of write to HttpError.
+func newWriteError(err error) *HttpError {
+	switch err {
+	case store.ErrRevisionConflict:
+		return NewHttpError(http.StatusConflict, err.Error())
+	case store.ErrConditionNotSupported, store.ErrTxnNotSupported, store.ErrTTLNotSupported:
+		return NewHttpError(http.StatusNotImplemented, err.Error())
+	case store.ErrNoTTL:
+		return NewHttpError(http.StatusNotFound, err.Error())
+	default:
+		return NewServerError(err)
 	}
 }
 
@@ -209,6 +590,17 @@ func (m *Metad) dataUpdate(ctx context.Context, req *http.Request) (interface{},
 	if nodePath == "" {
 		nodePath = "/"
 	}
+	rev, ifMatch, httpErr := m.parseIfMatch(req, nodePath)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	ttl, httpErr := parseTTL(req)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	if ifMatch && ttl > 0 {
+		return nil, NewHttpError(http.StatusBadRequest, "If-Match can not be used with ttl")
+	}
 	decoder := json.NewDecoder(req.Body)
 	var data interface{}
 	err := decoder.Decode(&data)
@@ -218,12 +610,18 @@ func (m *Metad) dataUpdate(ctx context.Context, req *http.Request) (interface{},
 		// POST means replace old value
 		// PUT means merge to old value
 		replace := "POST" == strings.ToUpper(req.Method)
-		err = m.metadataRepo.PutData(nodePath, data, replace)
+		if ifMatch {
+			err = m.metadataRepo.PutDataIfMatch(nodePath, data, replace, rev)
+		} else if ttl > 0 {
+			err = m.metadataRepo.PutDataWithTTL(nodePath, data, replace, ttl)
+		} else {
+			err = m.metadataRepo.PutData(nodePath, data, replace)
+		}
 		if err != nil {
 			if log.IsDebugEnable() {
 				log.Debug("dataUpdate  nodePath:%s, data:%v, error:%s", nodePath, data, err.Error())
 			}
-			return nil, NewServerError(err)
+			return nil, newWriteError(err)
 		} else {
 			return nil, nil
 		}
@@ -236,19 +634,45 @@ func (m *Metad) dataDelete(ctx context.Context, req *http.Request) (interface{},
 	if nodePath == "" {
 		nodePath = "/"
 	}
+	rev, ifMatch, httpErr := m.parseIfMatch(req, nodePath)
+	if httpErr != nil {
+		return nil, httpErr
+	}
 	subsParam := req.FormValue("subs")
 	var subs []string
 	if subsParam != "" {
 		subs = strings.Split(subsParam, ",")
 	}
-	err := m.metadataRepo.DeleteData(nodePath, subs...)
+	var err error
+	if ifMatch {
+		if len(subs) > 0 {
+			return nil, NewHttpError(http.StatusBadRequest, "If-Match can not be used with subs")
+		}
+		err = m.metadataRepo.DeleteDataIfMatch(nodePath, rev)
+	} else {
+		err = m.metadataRepo.DeleteData(nodePath, subs...)
+	}
 	if err != nil {
-		return nil, NewServerError(err)
+		return nil, newWriteError(err)
 	} else {
 		return nil, nil
 	}
 }
 
+// dataKeepAlive reset the ttl of the metadata under nodePath.
+func (m *Metad) dataKeepAlive(ctx context.Context, req *http.Request) (interface{}, *HttpError) {
+	vars := mux.Vars(req)
+	nodePath := vars["nodePath"]
+	if nodePath == "" {
+		nodePath = "/"
+	}
+	err := m.metadataRepo.KeepAliveData(nodePath)
+	if err != nil {
+		return nil, newWriteError(err)
+	}
+	return nil, nil
+}
+
 func (m *Metad) mappingGet(ctx context.Context, req *http.Request) (interface{}, *HttpError) {
 	vars := mux.Vars(req)
 	nodePath := vars["nodePath"]
@@ -269,6 +693,10 @@ func (m *Metad) mappingUpdate(ctx context.Context, req *http.Request) (interface
 	if nodePath == "" {
 		nodePath = "/"
 	}
+	ttl, httpErr := parseTTL(req)
+	if httpErr != nil {
+		return nil, httpErr
+	}
 	buf, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		return nil, NewHttpError(http.StatusBadRequest, fmt.Sprintf("read request error:%s", err.Error()))
@@ -283,12 +711,16 @@ func (m *Metad) mappingUpdate(ctx context.Context, req *http.Request) (interface
 		// POST means replace old value
 		// PUT means merge to old value
 		replace := "POST" == strings.ToUpper(req.Method)
-		err = m.metadataRepo.PutMapping(nodePath, data, replace)
+		if ttl > 0 {
+			err = m.metadataRepo.PutMappingWithTTL(nodePath, data, replace, ttl)
+		} else {
+			err = m.metadataRepo.PutMapping(nodePath, data, replace)
+		}
 		if err != nil {
 			if log.IsDebugEnable() {
 				log.Debug("mappingUpdate  nodePath:%s, data:%v, error:%s", nodePath, data, err.Error())
 			}
-			return nil, NewServerError(err)
+			return nil, newWriteError(err)
 		} else {
 			return nil, nil
 		}
@@ -314,6 +746,41 @@ func (m *Metad) mappingDelete(ctx context.Context, req *http.Request) (interface
 	}
 }
 
+// txnUpdate apply a list of data, mapping and rule ops atomically.
+func (m *Metad) txnUpdate(ctx context.Context, req *http.Request) (interface{}, *HttpError) {
+	decoder := json.NewDecoder(req.Body)
+	var ops []store.TxnOp
+	err := decoder.Decode(&ops)
+	if err != nil {
+		return nil, NewHttpError(http.StatusBadRequest, fmt.Sprintf("invalid json format, error:%s", err.Error()))
+	}
+	if len(ops) == 0 {
+		return nil, NewHttpError(http.StatusBadRequest, "txn require at least one op")
+	}
+	err = m.metadataRepo.Txn(ops)
+	if err != nil {
+		if log.IsDebugEnable() {
+			log.Debug("txnUpdate ops:%v, error:%s", ops, err.Error())
+		}
+		return nil, newWriteError(err)
+	}
+	return nil, nil
+}
+
+// mappingKeepAlive reset the ttl of the mapping under nodePath.
+func (m *Metad) mappingKeepAlive(ctx context.Context, req *http.Request) (interface{}, *HttpError) {
+	vars := mux.Vars(req)
+	nodePath := vars["nodePath"]
+	if nodePath == "" {
+		nodePath = "/"
+	}
+	err := m.metadataRepo.KeepAliveMapping(nodePath)
+	if err != nil {
+		return nil, newWriteError(err)
+	}
+	return nil, nil
+}
+
 func (m *Metad) accessRuleGet(ctx context.Context, req *http.Request) (interface{}, *HttpError) {
 	hostsStr := req.FormValue("hosts")
 	var hosts []string
@@ -350,10 +817,29 @@ func (m *Metad) accessRuleDelete(ctx context.Context, req *http.Request) (interf
 		hosts = strings.Split(hostsStr, ",")
 	}
 	err := m.metadataRepo.DeleteAccessRule(hosts)
-	return nil, NewServerError(err)
+	if err != nil {
+		return nil, NewServerError(err)
+	} else {
+		return nil, nil
+	}
+}
+
+// contentETag append the format name of the content to the quoted etag, such as "42-json",
+// so the same version in different encodings has different ETag.
+func contentETag(etag string, content int) string {
+	for format, c := range formatContents {
+		if c == content {
+			return strings.TrimSuffix(etag, "\"") + "-" + format + "\""
+		}
+	}
+	return etag
 }
 
 func contentType(req *http.Request) int {
+	// read the format from the url, req.FormValue may consume the request body.
+	if content, ok := formatContents[strings.ToLower(req.URL.Query().Get("format"))]; ok {
+		return content
+	}
 	str := httputil.NegotiateContentType(req, []string{
 		"text/plain",
 		"application/json",
@@ -361,89 +847,304 @@ func contentType(req *http.Request) int {
 		"application/x-yaml",
 		"text/yaml",
 		"text/x-yaml",
+		ContentTypeEnv,
+		ContentTypeTOML,
+		ContentTypeProperties,
 	}, "text/plain")
 
 	if strings.Contains(str, "json") {
 		return ContentJSON
 	} else if strings.Contains(str, "yaml") {
 		return ContentYAML
+	} else if str == ContentTypeEnv {
+		return ContentEnv
+	} else if str == ContentTypeTOML {
+		return ContentTOML
+	} else if str == ContentTypeProperties {
+		return ContentProperties
 	} else {
 		return ContentText
 	}
 }
 
+// checkFormat check the format parameter, the encoding of the response.
+func checkFormat(req *http.Request) *HttpError {
+	format := req.URL.Query().Get("format")
+	if _, ok := formatContents[strings.ToLower(format)]; format != "" && !ok {
+		return NewHttpError(http.StatusBadRequest, fmt.Sprintf("Invalid format [%s]", format))
+	}
+	return nil
+}
+
 func (m *Metad) rootHandler(ctx context.Context, req *http.Request) (currentVersion int64, result interface{}, httpErr *HttpError) {
-	clientIP := m.requestIP(req)
+	clientIP := m.requestClient(ctx, req)
 	vars := mux.Vars(req)
 	nodePath := vars["nodePath"]
 	if nodePath == "" {
 		nodePath = "/"
 	}
 	wait := strings.ToLower(req.FormValue("wait")) == "true"
+	format, err := metadata.ParseWatchFormat(req.FormValue("watch_format"))
+	if err != nil {
+		httpErr = NewHttpError(http.StatusBadRequest, err.Error())
+		return
+	}
+	options, httpErr := parseValueOptions(req)
+	if httpErr != nil {
+		return
+	}
+	query, httpErr := parseQuery(req)
+	if httpErr != nil {
+		return
+	}
+	// get version first, may be cause client repeat get data, but not lost change.
+	currentVersion = m.metadataRepo.RootVersion(clientIP, nodePath)
+	access := m.metadataRepo.AccessFingerprint(clientIP)
+	if wait && format != metadata.WatchFormatFull {
+		return watchChanges(req, currentVersion, func(prevVersion int64) (int64, interface{}, error) {
+			return m.metadataRepo.WatchChanges(ctx, clientIP, nodePath, prevVersion, format)
+		})
+	}
 	if wait {
-		prevVersionStr := req.FormValue("prev_version")
-		var prevVersion int64
-		if prevVersionStr != "" {
-			var err error
-			prevVersion, err = strconv.ParseInt(prevVersionStr, 10, 64)
-			if err != nil {
-				prevVersion = -1
-			}
-		}
-		if prevVersion > 0 && prevVersion != m.metadataRepo.DataVersion() {
-			currentVersion, result = m.metadataRepo.Root(clientIP, nodePath)
-		} else {
-			m.metadataRepo.Watch(ctx, clientIP, nodePath)
+		// the version is scoped to nodePath, only the change of nodePath return.
+		// if prevVersion > currentVersion, may be metad reboot and recount version, so return immediately, let client use new version.
+		if prevVersion := parsePrevVersion(req); prevVersion <= 0 || prevVersion == currentVersion {
+			// watch since prevVersion, the change after the version check is not missed.
+			m.metadataRepo.WatchSince(ctx, clientIP, nodePath, prevVersion)
 			// directly return new result to client ,not change, for keep same as request with prev_version
-			currentVersion, result = m.metadataRepo.Root(clientIP, nodePath)
+			currentVersion = m.metadataRepo.RootVersion(clientIP, nodePath)
+			access = m.metadataRepo.AccessFingerprint(clientIP)
 		}
-	} else {
-		currentVersion, result = m.metadataRepo.Root(clientIP, nodePath)
 	}
+	_, result = m.metadataRepo.RootWithOptions(clientIP, nodePath, options)
 	if result == nil {
 		httpErr = NewHttpError(http.StatusNotFound, "Not found")
+		return
+	}
+	if query != nil {
+		result = query.Find(result)
 	}
+	setAccessETag(ctx, currentVersion, access)
 	return
 }
 
 func (m *Metad) selfHandler(ctx context.Context, req *http.Request) (currentVersion int64, result interface{}, httpErr *HttpError) {
-	clientIP := m.requestIP(req)
+	clientIP := m.requestClient(ctx, req)
 	vars := mux.Vars(req)
 	nodePath := vars["nodePath"]
 	if nodePath == "" {
 		nodePath = "/"
 	}
 	wait := strings.ToLower(req.FormValue("wait")) == "true"
-	// TODO this version may be not match the data, get version first, may be cause client repeat get data, but not lost change, so it work for now.
-	currentVersion = m.metadataRepo.DataVersion()
+	format, err := metadata.ParseWatchFormat(req.FormValue("watch_format"))
+	if err != nil {
+		httpErr = NewHttpError(http.StatusBadRequest, err.Error())
+		return
+	}
+	options, httpErr := parseValueOptions(req)
+	if httpErr != nil {
+		return
+	}
+	query, httpErr := parseQuery(req)
+	if httpErr != nil {
+		return
+	}
+	// get version first, may be cause client repeat get data, but not lost change.
+	currentVersion = m.metadataRepo.SelfVersion(clientIP, nodePath)
+	access := m.metadataRepo.AccessFingerprint(clientIP)
+	if wait && format != metadata.WatchFormatFull {
+		return watchChanges(req, currentVersion, func(prevVersion int64) (int64, interface{}, error) {
+			return m.metadataRepo.WatchSelfChanges(ctx, clientIP, nodePath, prevVersion, format)
+		})
+	}
 	if wait {
-		prevVersionStr := req.FormValue("prev_version")
-		var prevVersion int64
-		if prevVersionStr != "" {
-			var err error
-			prevVersion, err = strconv.ParseInt(prevVersionStr, 10, 64)
-			if err != nil {
-				prevVersion = -1
-			}
-		}
 		// if prevVersion < currentVersion, client lost change, so return immediately.
 		// if prevVersion > currentVersion, may be metad reboot and recount version, so return immediately, let client use new version.
-		if prevVersion > 0 && prevVersion != currentVersion {
-			result = m.metadataRepo.Self(clientIP, nodePath)
-		} else {
-			m.metadataRepo.WatchSelf(ctx, clientIP, nodePath)
+		if prevVersion := parsePrevVersion(req); prevVersion <= 0 || prevVersion == currentVersion {
+			m.metadataRepo.WatchSelfSince(ctx, clientIP, nodePath, prevVersion)
 			// directly return new result to client ,not change, for pre_version.
-			result = m.metadataRepo.Self(clientIP, nodePath)
+			currentVersion = m.metadataRepo.SelfVersion(clientIP, nodePath)
+			access = m.metadataRepo.AccessFingerprint(clientIP)
 		}
-	} else {
-		result = m.metadataRepo.Self(clientIP, nodePath)
 	}
+	result = m.metadataRepo.SelfWithOptions(clientIP, nodePath, options)
 	if result == nil {
 		httpErr = NewHttpError(http.StatusNotFound, "Not found")
+		return
+	}
+	if query != nil {
+		result = query.Find(result)
 	}
+	setAccessETag(ctx, currentVersion, access)
 	return
 }
 
+// MaxTemplateSize is the max size of the template in the render request body.
+var MaxTemplateSize int64 = 1 << 20
+
+// selfRender render the template in the request body, or the named template under TemplatePath,
+// against the client's self metadata.
+func (m *Metad) selfRender(ctx context.Context, req *http.Request) (currentVersion int64, result interface{}, httpErr *HttpError) {
+	clientIP := m.requestClient(ctx, req)
+	var text string
+	if name := mux.Vars(req)["name"]; name != "" {
+		tmpl, ok := m.metadataRepo.GetData(path.Join(m.config.TemplatePath, name)).(string)
+		if !ok {
+			httpErr = NewHttpError(http.StatusNotFound, fmt.Sprintf("Template [%s] not found", name))
+			return
+		}
+		text = tmpl
+	} else {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(nil, req.Body, MaxTemplateSize))
+		if err != nil {
+			// MaxBytesReader return the limit bytes before the error.
+			if int64(len(body)) >= MaxTemplateSize {
+				httpErr = NewHttpError(http.StatusRequestEntityTooLarge, fmt.Sprintf("Template exceed %v bytes", MaxTemplateSize))
+			} else {
+				httpErr = NewServerError(err)
+			}
+			return
+		}
+		text = string(body)
+	}
+	currentVersion = m.metadataRepo.SelfVersion(clientIP, "/")
+	access := m.metadataRepo.AccessFingerprint(clientIP)
+	rendered, err := m.metadataRepo.Render(clientIP, text)
+	if err != nil {
+		httpErr = NewHttpError(http.StatusBadRequest, err.Error())
+		return
+	}
+	result = rendered
+	setAccessETag(ctx, currentVersion, access)
+	return
+}
+
+// setAccessETag set the ETag of the metadata the client can access, the version only change with the metadata,
+// so the access fingerprint is included, the client get the new result when its rules or mapping changed.
+func setAccessETag(ctx context.Context, version int64, access string) {
+	if header, ok := ctx.Value("header").(http.Header); ok {
+		header.Set("ETag", fmt.Sprintf("\"%d-%s\"", version, access))
+	}
+}
+
+func (m *Metad) rootStream(ctx context.Context, req *http.Request, lastVersion int64, send func(*metadata.StreamEvent) error) error {
+	clientIP := m.requestClient(ctx, req)
+	nodePath := mux.Vars(req)["nodePath"]
+	if nodePath == "" {
+		nodePath = "/"
+	}
+	return m.metadataRepo.StreamRoot(ctx, clientIP, nodePath, lastVersion, send)
+}
+
+func (m *Metad) selfStream(ctx context.Context, req *http.Request, lastVersion int64, send func(*metadata.StreamEvent) error) error {
+	clientIP := m.requestClient(ctx, req)
+	nodePath := mux.Vars(req)["nodePath"]
+	if nodePath == "" {
+		nodePath = "/"
+	}
+	return m.metadataRepo.StreamSelf(ctx, clientIP, nodePath, lastVersion, send)
+}
+
+// websocketHandler serve the subscriptions of one websocket connection, every subscription push its events with its id.
+func (m *Metad) websocketHandler(ws *websocket.Conn) {
+	start := time.Now()
+	requestID := m.generateRequestID()
+	req := ws.Request()
+	clientIP, ok, err := m.identity.Resolve(req)
+	if err == nil && !ok {
+		err = errors.New("Unknown client identity")
+	}
+	if err != nil {
+		websocket.JSON.Send(ws, &wsEvent{Type: "error", Message: err.Error()})
+		m.errorLog(requestID, req, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	ctx, cancelFun := context.WithCancel(context.WithValue(req.Context(), "requestID", requestID))
+	defer cancelFun()
+
+	var sendLock sync.Mutex
+	// send drop the events of the canceled subscription, so the id can be reused after unsubscribe.
+	send := func(subCtx context.Context, e *wsEvent) error {
+		sendLock.Lock()
+		defer sendLock.Unlock()
+		if err := subCtx.Err(); err != nil {
+			return err
+		}
+		if log.IsDebugEnable() {
+			log.Debug("%s\tWS\t%s\t%s\t%v", requestID, e.ID, e.Type, e.Data)
+		}
+		return websocket.JSON.Send(ws, e)
+	}
+
+	var wg sync.WaitGroup
+	subs := make(map[string]context.CancelFunc)
+	for {
+		var r wsRequest
+		if err := websocket.JSON.Receive(ws, &r); err != nil {
+			switch err.(type) {
+			case *json.SyntaxError, *json.UnmarshalTypeError:
+				send(ctx, &wsEvent{Type: "error", Message: fmt.Sprintf("Invalid request: %s", err.Error())})
+				continue
+			}
+			if err != io.EOF {
+				log.Debug("%s\tWS\treceive err: %v", requestID, err)
+			}
+			break
+		}
+		switch r.Op {
+		case WSOpSubscribe:
+			if r.ID == "" {
+				send(ctx, &wsEvent{Type: "error", Message: "Subscription id is required"})
+				continue
+			}
+			if _, ok := subs[r.ID]; ok {
+				send(ctx, &wsEvent{ID: r.ID, Type: "error", Message: fmt.Sprintf("Subscription [%s] already exists", r.ID)})
+				continue
+			}
+			subCtx, subCancel := context.WithCancel(ctx)
+			subs[r.ID] = subCancel
+			wg.Add(1)
+			go func(r wsRequest) {
+				defer wg.Done()
+				err := m.subscribe(subCtx, clientIP, r.Path, r.Version, func(e *metadata.StreamEvent) error {
+					t := "change"
+					if e.Snapshot {
+						t = "snapshot"
+					}
+					return send(subCtx, &wsEvent{ID: r.ID, Type: t, Version: e.Version, Data: e.Value})
+				})
+				log.Debug("%s\tWS\tsubscription %s closed: %v", requestID, r.ID, err)
+			}(r)
+		case WSOpUnsubscribe:
+			subCancel, ok := subs[r.ID]
+			if !ok {
+				send(ctx, &wsEvent{ID: r.ID, Type: "error", Message: fmt.Sprintf("Subscription [%s] not found", r.ID)})
+				continue
+			}
+			// hold the lock, so no event of the subscription is sent after cancel.
+			sendLock.Lock()
+			subCancel()
+			sendLock.Unlock()
+			delete(subs, r.ID)
+		default:
+			send(ctx, &wsEvent{ID: r.ID, Type: "error", Message: fmt.Sprintf("Invalid op [%s]", r.Op)})
+		}
+	}
+	cancelFun()
+	wg.Wait()
+	m.requestLog(requestID, m.metadataRepo.DataVersion(), req, http.StatusSwitchingProtocols, time.Since(start), 0)
+}
+
+// subscribe stream the path, the path under /self is the client's self path.
+func (m *Metad) subscribe(ctx context.Context, clientIP string, nodePath string, lastVersion int64, send func(*metadata.StreamEvent) error) error {
+	nodePath = path.Join("/", nodePath)
+	if nodePath == "/self" || strings.HasPrefix(nodePath, "/self/") {
+		return m.metadataRepo.StreamSelf(ctx, clientIP, strings.TrimPrefix(nodePath, "/self"), lastVersion, send)
+	}
+	return m.metadataRepo.StreamRoot(ctx, clientIP, nodePath, lastVersion, send)
+}
+
 func respondError(w http.ResponseWriter, req *http.Request, msg string, statusCode int) {
 	obj := make(map[string]interface{})
 	obj["message"] = msg
@@ -451,8 +1152,6 @@ func respondError(w http.ResponseWriter, req *http.Request, msg string, statusCo
 	obj["code"] = statusCode
 
 	switch contentType(req) {
-	case ContentText:
-		http.Error(w, msg, statusCode)
 	case ContentJSON:
 		bytes, err := json.Marshal(obj)
 		if err == nil {
@@ -467,6 +1166,8 @@ func respondError(w http.ResponseWriter, req *http.Request, msg string, statusCo
 		} else {
 			http.Error(w, "type: \"error\"\nmessage: \"JSON marshal error\"", http.StatusInternalServerError)
 		}
+	default:
+		http.Error(w, msg, statusCode)
 	}
 }
 
@@ -475,12 +1176,12 @@ func respondSuccessDefault(w http.ResponseWriter, req *http.Request) {
 	obj["type"] = "OK"
 	obj["code"] = 200
 	switch contentType(req) {
-	case ContentText:
-		respondText(w, req, "OK")
 	case ContentJSON:
 		respondJSON(w, req, obj)
 	case ContentYAML:
 		respondYAML(w, req, obj)
+	default:
+		respondText(w, req, "OK")
 	}
 }
 
@@ -492,6 +1193,12 @@ func respondSuccess(w http.ResponseWriter, req *http.Request, val interface{}) i
 		return respondJSON(w, req, val)
 	case ContentYAML:
 		return respondYAML(w, req, val)
+	case ContentEnv:
+		return respondEncoded(w, ContentTypeEnv, encoder.EncodeEnv(val, req.URL.Query().Get("separator")))
+	case ContentTOML:
+		return respondEncoded(w, ContentTypeTOML, encoder.EncodeTOML(val))
+	case ContentProperties:
+		return respondEncoded(w, ContentTypeProperties, encoder.EncodeProperties(val, req.URL.Query().Get("separator")))
 	}
 	return 0
 }
@@ -506,6 +1213,26 @@ func respondText(w http.ResponseWriter, req *http.Request, val interface{}) int
 	switch v := val.(type) {
 	case string:
 		buffer.WriteString(v)
+	case []string:
+		for _, k := range v {
+			buffer.WriteString(k)
+			buffer.WriteString("\n")
+		}
+	case []interface{}:
+		// the query result, the value not string is responded as json.
+		for _, e := range v {
+			if str, ok := e.(string); ok {
+				buffer.WriteString(str)
+			} else {
+				b, _ := json.Marshal(e)
+				buffer.Write(b)
+			}
+			buffer.WriteString("\n")
+		}
+	case []metadata.Change, []metadata.PatchOp:
+		// the changes have no text format, respond as json.
+		b, _ := json.Marshal(v)
+		buffer.Write(b)
 	case map[string]interface{}:
 		fm := flatmap.Flatten(v)
 		var keys []string
@@ -527,6 +1254,12 @@ func respondText(w http.ResponseWriter, req *http.Request, val interface{}) int
 	return buffer.Len()
 }
 
+func respondEncoded(w http.ResponseWriter, contentType string, bytes []byte) int {
+	w.Header().Set("Content-Type", contentType)
+	w.Write(bytes)
+	return len(bytes)
+}
+
 func respondJSON(w http.ResponseWriter, req *http.Request, val interface{}) int {
 	w.Header().Set("Content-Type", ContentTypeJSON)
 	if val == nil {
@@ -576,47 +1309,226 @@ func (m *Metad) requestIP(req *http.Request) string {
 	return clientIp
 }
 
+// requestClient return the client identity kept in the context by the wrappers, which is the key of the mapping
+// and access rule, it is the client ip by default.
+func (m *Metad) requestClient(ctx context.Context, req *http.Request) string {
+	if identity, ok := ctx.Value("identity").(string); ok {
+		return identity
+	}
+	return m.requestIP(req)
+}
+
+// resolveIdentity resolve the client identity of the request, respond 401 if the identity is invalid or can not be resolved.
+func (m *Metad) resolveIdentity(w http.ResponseWriter, req *http.Request, requestID string) (string, bool) {
+	identity, ok, err := m.identity.Resolve(req)
+	if err == nil && !ok {
+		err = errors.New("Unknown client identity")
+	}
+	if err != nil {
+		respondError(w, req, err.Error(), http.StatusUnauthorized)
+		m.errorLog(requestID, req, http.StatusUnauthorized, err.Error())
+		return "", false
+	}
+	return identity, true
+}
+
 func (m *Metad) handleWrapper(handler handleFunc) func(w http.ResponseWriter, req *http.Request) {
 
 	return func(w http.ResponseWriter, req *http.Request) {
 		start := time.Now()
 		requestID := m.generateRequestID()
+		identity, ok := m.resolveIdentity(w, req, requestID)
+		if !ok {
+			return
+		}
 
 		ctx := context.WithValue(req.Context(), "requestID", requestID)
+		ctx = context.WithValue(ctx, "identity", identity)
+		m.serve(ctx, w, req, handler, requestID, start)
+	}
+}
+
+// manageGetWrapper serve the read of the manage api like handleWrapper, but the client identity is not required,
+// so the version, ETag and wait work for admin and upstream sync under any identity resolver.
+func (m *Metad) manageGetWrapper(handler handleFunc) func(w http.ResponseWriter, req *http.Request) {
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		requestID := m.generateRequestID()
+		ctx := context.WithValue(req.Context(), "requestID", requestID)
+		m.serve(ctx, w, req, handler, requestID, start)
+	}
+}
+
+// serve run the handler and respond its result with the version and ETag headers.
+func (m *Metad) serve(ctx context.Context, w http.ResponseWriter, req *http.Request, handler handleFunc, requestID string, start time.Time) {
+	// handler can set the response header by the "header" value.
+	ctx = context.WithValue(ctx, "header", w.Header())
+	cancelCtx, cancelFun := context.WithCancel(ctx)
+	if x, ok := w.(http.CloseNotifier); ok {
+		closeNotify := x.CloseNotify()
+		go func() {
+			select {
+			case <-closeNotify:
+				cancelFun()
+			}
+		}()
+	} else {
+		defer cancelFun()
+	}
+	var version int64
+	var result interface{}
+	err := checkFormat(req)
+	if err == nil {
+		version, result, err = handler(cancelCtx, req)
+	}
+
+	w.Header().Add("X-Metad-RequestID", requestID)
+	w.Header().Add("X-Metad-Version", fmt.Sprintf("%d", version))
+	status := 200
+	var len int
+	if err == nil {
+		etag := w.Header().Get("ETag")
+		if etag == "" {
+			etag = fmt.Sprintf("\"%d\"", version)
+		}
+		// the response is encoded by the Accept header, every encoding has its own ETag.
+		w.Header().Set("ETag", contentETag(etag, contentType(req)))
+		w.Header().Set("Vary", "Accept")
+	}
+	elapsed := time.Since(start)
+	if err != nil {
+		status = err.Status
+		respondError(w, req, err.Message, status)
+		m.errorLog(requestID, req, status, err.Message)
+	} else if matchIfNoneMatch(req, w.Header().Get("ETag")) {
+		status = http.StatusNotModified
+		w.WriteHeader(status)
+	} else {
+		if result == nil {
+			respondSuccessDefault(w, req)
+		} else {
+			len = respondSuccess(w, req, result)
+			if log.IsDebugEnable() {
+				log.Debug("%s\tRESP\t%v", requestID, result)
+			}
+		}
+	}
+	m.requestLog(requestID, version, req, status, elapsed, len)
+}
+
+// StreamKeepAliveInterval is the interval of the comment line pushed to the idle Server-Sent Events stream,
+// keep the proxies and the load balancers from closing the connection.
+var StreamKeepAliveInterval = 15 * time.Second
+
+// streamWrapper keep the connection open and push the events of stream as Server-Sent Events,
+// the event id is the version of the path, client resume from it by Last-Event-ID header.
+func (m *Metad) streamWrapper(stream streamFunc) func(w http.ResponseWriter, req *http.Request) {
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		requestID := m.generateRequestID()
+		identity, ok := m.resolveIdentity(w, req, requestID)
+		if !ok {
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			msg := "Streaming is not supported"
+			respondError(w, req, msg, http.StatusInternalServerError)
+			m.errorLog(requestID, req, http.StatusInternalServerError, msg)
+			return
+		}
+
+		var lastVersion int64
+		if lastEventID := req.Header.Get("Last-Event-ID"); lastEventID != "" {
+			// invalid id is treated as no id, the client will get a snapshot.
+			lastVersion, _ = strconv.ParseInt(lastEventID, 10, 64)
+		}
+
+		ctx := context.WithValue(req.Context(), "requestID", requestID)
+		ctx = context.WithValue(ctx, "identity", identity)
 		cancelCtx, cancelFun := context.WithCancel(ctx)
+		defer cancelFun()
 		if x, ok := w.(http.CloseNotifier); ok {
 			closeNotify := x.CloseNotify()
 			go func() {
 				select {
 				case <-closeNotify:
 					cancelFun()
+				case <-cancelCtx.Done():
 				}
 			}()
-		} else {
-			defer cancelFun()
 		}
-		version, result, err := handler(cancelCtx, req)
 
+		keepAliveInterval := StreamKeepAliveInterval
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
 		w.Header().Add("X-Metad-RequestID", requestID)
-		w.Header().Add("X-Metad-Version", fmt.Sprintf("%d", version))
-		elapsed := time.Since(start)
-		status := 200
+		w.Header().Add("X-Metad-Version", fmt.Sprintf("%d", m.metadataRepo.DataVersion()))
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		var version int64
 		var len int
-		if err != nil {
-			status = err.Status
-			respondError(w, req, err.Message, status)
-			m.errorLog(requestID, req, status, err.Message)
-		} else {
-			if result == nil {
-				respondSuccessDefault(w, req)
-			} else {
-				len = respondSuccess(w, req, result)
-				if log.IsDebugEnable() {
-					log.Debug("%s\tRESP\t%v", requestID, result)
+		// the keepalive and the events are written by different goroutines.
+		var writeLock sync.Mutex
+		keepAliveStop := make(chan struct{})
+		keepAliveDone := make(chan struct{})
+		go func() {
+			defer close(keepAliveDone)
+			ticker := time.NewTicker(keepAliveInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					writeLock.Lock()
+					_, err := fmt.Fprint(w, ":\n\n")
+					if err == nil {
+						flusher.Flush()
+					}
+					writeLock.Unlock()
+					if err != nil {
+						cancelFun()
+						return
+					}
+				case <-keepAliveStop:
+					return
 				}
 			}
+		}()
+		send := func(e *metadata.StreamEvent) error {
+			data, err := json.Marshal(e.Value)
+			if err != nil {
+				return err
+			}
+			event := "change"
+			if e.Snapshot {
+				event = "snapshot"
+			}
+			writeLock.Lock()
+			defer writeLock.Unlock()
+			n, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Version, event, data)
+			if err != nil {
+				return err
+			}
+			flusher.Flush()
+			version = e.Version
+			len += n
+			if log.IsDebugEnable() {
+				log.Debug("%s\tSSE\t%s\t%v", requestID, event, e.Value)
+			}
+			return nil
 		}
-		m.requestLog(requestID, version, req, status, elapsed, len)
+		err := stream(cancelCtx, req, lastVersion, send)
+		close(keepAliveStop)
+		<-keepAliveDone
+		if log.IsDebugEnable() {
+			log.Debug("%s\tSSE\tclosed: %v", requestID, err)
+		}
+		m.requestLog(requestID, version, req, 200, time.Since(start), len)
 	}
 }
 
@@ -5,17 +5,28 @@
 package main
 
 import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math/rand"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
 
+	"github.com/yunify/metad/backends"
+	"github.com/yunify/metad/backends/upstream"
 	"github.com/yunify/metad/log"
 	"github.com/yunify/metad/util"
 )
@@ -277,146 +288,1411 @@ func TestMetadWatch(t *testing.T) {
 	assert.Equal(t, "192.168.3.1", parse(w))
 }
 
+func TestMetadWatchVersion(t *testing.T) {
+	metad := NewTestMetad()
+	defer metad.Stop()
+	ip := "192.168.1.1"
+	remoteAddr := ip + ":1234"
+
+	putData(t, metad, "/", `{"nodes":{"1":{"ip":"192.168.1.1","name":"node1"},"2":{"ip":"192.168.1.2","name":"node2"}}}`)
+
+	req := httptest.NewRequest("PUT", "/v1/rule/", strings.NewReader(fmt.Sprintf(`{"%s":[{"path":"/","mode":1}]}`, ip)))
+	w := httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	req = httptest.NewRequest("PUT", "/v1/mapping/", strings.NewReader(fmt.Sprintf(`{"%s":{"node":"/nodes/1"}}`, ip)))
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	time.Sleep(sleepTime)
+
+	get := func(uri string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", uri, nil)
+		req.Header.Set("accept", "application/json")
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		metad.router.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+		return w
+	}
+	rootVersion := parseVersion(get("/nodes/1"))
+	selfVersion := parseVersion(get("/self/node"))
+	assert.True(t, rootVersion > 0)
+	assert.True(t, selfVersion > 0)
+
+	// the change of other path not change the version.
+	putData(t, metad, "/nodes/2/name", `"node2-new"`)
+	time.Sleep(sleepTime)
+	assert.Equal(t, rootVersion, parseVersion(get("/nodes/1")))
+	assert.Equal(t, selfVersion, parseVersion(get("/self/node")))
+	assert.True(t, parseVersion(get("/nodes")) > rootVersion)
+
+	versions := make(chan int, 2)
+	go func() {
+		versions <- parseVersion(get(fmt.Sprintf("/nodes/1?wait=true&prev_version=%d", rootVersion)))
+	}()
+	go func() {
+		versions <- parseVersion(get(fmt.Sprintf("/self/node?wait=true&prev_version=%d", selfVersion)))
+	}()
+	time.Sleep(sleepTime)
+
+	// the waits with the version not return.
+	putData(t, metad, "/nodes/2/ip", `"192.168.2.2"`)
+	time.Sleep(sleepTime * 3)
+	assert.Equal(t, 0, len(versions))
+
+	putData(t, metad, "/nodes/1/name", `"node1-new"`)
+	for i := 0; i < 2; i++ {
+		select {
+		case v := <-versions:
+			assert.True(t, v > rootVersion)
+		case <-time.After(time.Second):
+			t.Fatal("Wait version change timeout")
+		}
+	}
+
+	// the mapping change the self version.
+	selfVersion = parseVersion(get("/self/node"))
+	req = httptest.NewRequest("PUT", "/v1/mapping/"+ip, strings.NewReader(`{"node":"/nodes/2"}`))
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	time.Sleep(sleepTime)
+	w = get(fmt.Sprintf("/self/node?wait=true&prev_version=%d", selfVersion))
+	assert.True(t, parseVersion(w) > selfVersion)
+	assert.Equal(t, "node2-new", parse(w).(map[string]interface{})["name"])
+}
+
+func TestMetadETag(t *testing.T) {
+	metad := NewTestMetad()
+	defer metad.Stop()
+	ip := "192.168.1.1"
+
+	putData(t, metad, "/", `{"nodes":{"1":{"ip":"192.168.1.1","name":"node1"},"2":{"ip":"192.168.1.2","name":"node2"}}}`)
+
+	req := httptest.NewRequest("PUT", "/v1/mapping/", strings.NewReader(fmt.Sprintf(`{"%s":{"node":"/nodes/1"}}`, ip)))
+	w := httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	time.Sleep(sleepTime)
+
+	get := func(uri string, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", uri, nil)
+		req.Header.Set("accept", "application/json")
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		metad.router.ServeHTTP(w, req)
+		return w
+	}
+
+	w = get("/nodes/1", "")
+	assert.Equal(t, 200, w.Code)
+	rootETag := w.Header().Get("ETag")
+	assert.NotEmpty(t, rootETag)
+	assert.Equal(t, "Accept", w.Header().Get("Vary"))
+
+	// the other encoding of the same version has different etag.
+	req = httptest.NewRequest("GET", "/nodes/1", nil)
+	req.Header.Set("accept", "application/yaml")
+	req.Header.Set("If-None-Match", rootETag)
+	req.RemoteAddr = ip + ":1234"
+	w = httptest.NewRecorder()
+	metad.router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.NotEqual(t, rootETag, w.Header().Get("ETag"))
+	assert.Equal(t, 304, get("/nodes/1?format=yaml", w.Header().Get("ETag")).Code)
+
+	w = get("/self/node", "")
+	assert.Equal(t, 200, w.Code)
+	selfETag := w.Header().Get("ETag")
+	assert.NotEmpty(t, selfETag)
+
+	w = get("/nodes/1", rootETag)
+	assert.Equal(t, 304, w.Code)
+	assert.Equal(t, 0, w.Body.Len())
+	assert.Equal(t, rootETag, w.Header().Get("ETag"))
+	assert.Equal(t, 304, get("/nodes/1", `"other", W/`+rootETag).Code)
+	assert.Equal(t, 304, get("/self/node", selfETag).Code)
+	assert.Equal(t, 304, get("/self/node", "*").Code)
+	assert.Equal(t, 304, get("/nodes/1", `"a,b", `+rootETag).Code)
+	// the etag is compared in full, include the access and the format.
+	assert.Equal(t, 200, get("/nodes/1", rootETag[:strings.Index(rootETag, "-")]+`"`).Code)
+	assert.Equal(t, 200, get("/nodes/1", strings.Replace(rootETag, "-json", "-yaml", 1)).Code)
+	assert.Equal(t, 200, get("/nodes/1", strings.Trim(rootETag, `"`)).Code)
+
+	// the change of other path not change the etag.
+	putData(t, metad, "/nodes/2/name", `"node2-new"`)
+	time.Sleep(sleepTime)
+	assert.Equal(t, 304, get("/nodes/1", rootETag).Code)
+	assert.Equal(t, 304, get("/self/node", selfETag).Code)
+
+	putData(t, metad, "/nodes/1/name", `"node1-new"`)
+	time.Sleep(sleepTime)
+	w = get("/nodes/1", rootETag)
+	assert.Equal(t, 200, w.Code)
+	assert.NotEqual(t, rootETag, w.Header().Get("ETag"))
+	assert.Equal(t, "node1-new", util.GetMapValue(parse(w), "/name"))
+	rootETag = w.Header().Get("ETag")
+	w = get("/self/node", selfETag)
+	assert.Equal(t, 200, w.Code)
+	selfETag = w.Header().Get("ETag")
+
+	// the change of access rule change the etag, even the metadata not change.
+	req = httptest.NewRequest("PUT", "/v1/rule/", strings.NewReader(fmt.Sprintf(`{"%s":[{"path":"/","mode":1},{"path":"/nodes/1/ip","mode":0}]}`, ip)))
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	time.Sleep(sleepTime)
+	w = get("/nodes/1", rootETag)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "", util.GetMapValue(parse(w), "/ip"))
+	assert.Equal(t, 200, get("/self/node", selfETag).Code)
+
+	// manage data api
+	req = httptest.NewRequest("GET", "/v1/data/nodes/1", nil)
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	dataETag := w.Header().Get("ETag")
+	req = httptest.NewRequest("GET", "/v1/data/nodes/1", nil)
+	req.Header.Set("If-None-Match", dataETag)
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 304, w.Code)
+
+	// not found response has no etag.
+	w = get("/nodes/3", "")
+	assert.Equal(t, 404, w.Code)
+	assert.Equal(t, "", w.Header().Get("ETag"))
+}
+
+func TestMetadWatchFormat(t *testing.T) {
+	metad := NewTestMetad()
+	defer metad.Stop()
+	ip := "192.168.1.1"
+
+	putData(t, metad, "/", `{"nodes":{"1":{"ip":"192.168.1.1","name":"node1"},"2":{"ip":"192.168.1.2","name":"node2"}}}`)
+
+	req := httptest.NewRequest("PUT", "/v1/rule/", strings.NewReader(fmt.Sprintf(`{"%s":[{"path":"/","mode":1}]}`, ip)))
+	w := httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	req = httptest.NewRequest("PUT", "/v1/mapping/", strings.NewReader(fmt.Sprintf(`{"%s":{"node":"/nodes/1"}}`, ip)))
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	time.Sleep(sleepTime)
+
+	get := func(uri string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", uri, nil)
+		req.Header.Set("accept", "application/json")
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		metad.router.ServeHTTP(w, req)
+		return w
+	}
+	parseList := func(w *httptest.ResponseRecorder) []interface{} {
+		var list []interface{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+		return list
+	}
+
+	rootVersion := parseVersion(get("/nodes"))
+	selfVersion := parseVersion(get("/self"))
+
+	putData(t, metad, "/nodes/1/name", `"node1-new"`)
+	time.Sleep(sleepTime)
+
+	w = get(fmt.Sprintf("/nodes?wait=true&prev_version=%d&watch_format=changes", rootVersion))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"op": "replace", "path": "/1/name", "old": "node1", "new": "node1-new"},
+	}, parseList(w))
+	rootVersion = parseVersion(w)
+
+	w = get(fmt.Sprintf("/self?wait=true&prev_version=%d&watch_format=patch", selfVersion))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"op": "replace", "path": "/node/name", "value": "node1-new"},
+	}, parseList(w))
+
+	// wait the new change.
+	ch := make(chan *httptest.ResponseRecorder)
+	go func() {
+		ch <- get(fmt.Sprintf("/nodes?wait=true&prev_version=%d&watch_format=patch", rootVersion))
+	}()
+	time.Sleep(sleepTime)
+	putData(t, metad, "/nodes/3", `{"name":"node3"}`)
+	select {
+	case w = <-ch:
+	case <-time.After(time.Second):
+		t.Fatal("TestMetadWatchFormat wait timeout")
+	}
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"op": "add", "path": "/3", "value": map[string]interface{}{"name": "node3"}},
+	}, parseList(w))
+
+	w = get(fmt.Sprintf("/nodes?wait=true&prev_version=%d&watch_format=tree", rootVersion))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "UPDATE|node3", util.GetMapValue(parse(w), "/3/name"))
+
+	// the previous version is unknown, client should resync.
+	w = get(fmt.Sprintf("/nodes?wait=true&prev_version=%d&watch_format=changes", parseVersion(w)+100))
+	assert.Equal(t, 410, w.Code)
+
+	w = get("/nodes?wait=true&watch_format=diff")
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestMetadValueOptions(t *testing.T) {
+	metad := NewTestMetad()
+	defer metad.Stop()
+	ip := "192.168.1.1"
+
+	putData(t, metad, "/", `{"clusters":{"cl-1":{"name":"cl-1","env":{"user":"u1"}},"cl-2":{"name":"cl-2","env":{"user":"u2"}}}}`)
+
+	req := httptest.NewRequest("PUT", "/v1/rule/", strings.NewReader(fmt.Sprintf(`{"%s":[{"path":"/","mode":1}]}`, ip)))
+	w := httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	req = httptest.NewRequest("PUT", "/v1/mapping/", strings.NewReader(fmt.Sprintf(`{"%s":{"cluster":"/clusters/cl-1","links":{"c2":"/clusters/cl-2"}}}`, ip)))
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	time.Sleep(sleepTime)
+
+	get := func(uri string, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", uri, nil)
+		req.Header.Set("accept", accept)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		metad.router.ServeHTTP(w, req)
+		return w
+	}
+
+	w = get("/clusters?keys=true", "application/json")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, `["cl-1","cl-2"]`, strings.TrimSpace(w.Body.String()))
+	w = get("/clusters?keys=true", "text/plain")
+	assert.Equal(t, "cl-1\ncl-2\n", w.Body.String())
+
+	w = get("/clusters?depth=1", "application/json")
+	assert.Equal(t, map[string]interface{}{
+		"cl-1": map[string]interface{}{},
+		"cl-2": map[string]interface{}{},
+	}, parse(w))
+
+	w = get("/clusters?fields=cl-1/name,cl-2/env", "application/json")
+	assert.Equal(t, map[string]interface{}{
+		"cl-1": map[string]interface{}{"name": "cl-1"},
+		"cl-2": map[string]interface{}{"env": map[string]interface{}{"user": "u2"}},
+	}, parse(w))
+
+	w = get("/?fields=self/cluster/name,clusters/cl-2/name", "application/json")
+	assert.Equal(t, map[string]interface{}{
+		"clusters": map[string]interface{}{"cl-2": map[string]interface{}{"name": "cl-2"}},
+		"self":     map[string]interface{}{"cluster": map[string]interface{}{"name": "cl-1"}},
+	}, parse(w))
+
+	w = get("/self?depth=2", "application/json")
+	assert.Equal(t, map[string]interface{}{
+		"cluster": map[string]interface{}{"name": "cl-1", "env": map[string]interface{}{}},
+		"links":   map[string]interface{}{"c2": map[string]interface{}{}},
+	}, parse(w))
+
+	w = get("/self/links?keys=true&fields=c2,c3", "application/json")
+	assert.Equal(t, `["c2"]`, strings.TrimSpace(w.Body.String()))
+
+	w = get("/clusters?depth=a", "application/json")
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestMetadQuery(t *testing.T) {
+	metad := NewTestMetad()
+	defer metad.Stop()
+	ip := "192.168.1.1"
+
+	putData(t, metad, "/", `{"hosts":{"i-1":{"role":"master","ip":"192.168.1.1"},"i-2":{"role":"slave","ip":"192.168.1.2"},"i-3":{"role":"master","ip":"192.168.1.3"}}}`)
+
+	req := httptest.NewRequest("PUT", "/v1/mapping/", strings.NewReader(fmt.Sprintf(`{"%s":{"hosts":"/hosts"}}`, ip)))
+	w := httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	time.Sleep(sleepTime)
+
+	get := func(uri string, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", uri, nil)
+		req.Header.Set("accept", accept)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		metad.router.ServeHTTP(w, req)
+		return w
+	}
+
+	q := url.QueryEscape("$[?(@.role=='master')].ip")
+	w = get("/hosts?q="+q, "application/json")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, `["192.168.1.1","192.168.1.3"]`, strings.TrimSpace(w.Body.String()))
+	w = get("/self/hosts?q="+q, "text/plain")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "192.168.1.1\n192.168.1.3\n", w.Body.String())
+
+	w = get("/?q="+url.QueryEscape("hosts['i-2']"), "text/plain")
+	assert.Equal(t, `{"ip":"192.168.1.2","role":"slave"}`+"\n", w.Body.String())
+
+	w = get("/hosts?q="+url.QueryEscape("$.none"), "application/json")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, `[]`, strings.TrimSpace(w.Body.String()))
+
+	w = get("/hosts?q="+url.QueryEscape("$[?(@.role==)]"), "application/json")
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestMetadFormat(t *testing.T) {
+	metad := NewTestMetad()
+	defer metad.Stop()
+	ip := "192.168.1.1"
+
+	putData(t, metad, "/", `{"clusters":{"cl-1":{"name":"cl-1","env":{"jvm.opts":"-Xmx1g"}}}}`)
+
+	req := httptest.NewRequest("PUT", "/v1/rule/", strings.NewReader(fmt.Sprintf(`{"%s":[{"path":"/","mode":1}]}`, ip)))
+	w := httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	time.Sleep(sleepTime)
+
+	get := func(uri string, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", uri, nil)
+		req.Header.Set("accept", accept)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		metad.router.ServeHTTP(w, req)
+		return w
+	}
+
+	w = get("/clusters/cl-1?format=env", "application/json")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, ContentTypeEnv, w.Header().Get("Content-Type"))
+	assert.Equal(t, "export ENV_JVM_OPTS='-Xmx1g'\nexport NAME='cl-1'\n", w.Body.String())
+
+	w = get("/clusters/cl-1", ContentTypeProperties)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, ContentTypeProperties, w.Header().Get("Content-Type"))
+	assert.Equal(t, "env.jvm.opts=-Xmx1g\nname=cl-1\n", w.Body.String())
+
+	w = get("/clusters/cl-1?format=properties&separator=/", "")
+	assert.Equal(t, "env/jvm.opts=-Xmx1g\nname=cl-1\n", w.Body.String())
+
+	w = get("/clusters/cl-1", ContentTypeTOML)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, ContentTypeTOML, w.Header().Get("Content-Type"))
+	assert.Equal(t, "name = \"cl-1\"\n\n[env]\n\"jvm.opts\" = \"-Xmx1g\"\n", w.Body.String())
+
+	w = get("/clusters/cl-1?format=xml", "")
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestMetadIMDS(t *testing.T) {
+	metad := NewTestMetad()
+	defer metad.Stop()
+	ip := "192.168.1.1"
+
+	putData(t, metad, "/", `{"hosts":{"i-1":{"ip":"192.168.1.1","instance_id":"i-1","user_data":"#cloud-config\nhostname: i-1\n"}}}`)
+
+	req := httptest.NewRequest("PUT", "/v1/mapping/", strings.NewReader(fmt.Sprintf(`{"%s":{"host":"/hosts/i-1","user-data":"/hosts/i-1/user_data"}}`, ip)))
+	w := httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	time.Sleep(sleepTime)
+
+	request := func(method string, uri string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, uri, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		metad.imdsRouter.ServeHTTP(w, req)
+		return w
+	}
+
+	// serve the whole self without mapping.
+	w = request("GET", "/latest/meta-data/", nil)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "host/\nuser-data", w.Body.String())
+	w = request("GET", "/latest/meta-data/host/ip", nil)
+	assert.Equal(t, "192.168.1.1", w.Body.String())
+
+	w = request("GET", "/latest/", nil)
+	assert.Equal(t, "meta-data\nuser-data", w.Body.String())
+	w = request("GET", "/latest/user-data", nil)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "#cloud-config\nhostname: i-1\n", w.Body.String())
+
+	metad.config.IMDS.MetaData = map[string]string{
+		"instance-id":       "/host/instance_id",
+		"local-ipv4":        "/host/ip",
+		"network/interface": "/host/none",
+		"placement/zone":    "/host/ip",
+	}
+	w = request("GET", "/latest/meta-data", nil)
+	assert.Equal(t, "instance-id\nlocal-ipv4\nplacement/", w.Body.String())
+	w = request("GET", "/latest/meta-data/instance-id", nil)
+	assert.Equal(t, "i-1", w.Body.String())
+	w = request("GET", "/latest/meta-data/host/ip", nil)
+	assert.Equal(t, 404, w.Code)
+
+	// IMDSv2 session token.
+	w = request("PUT", "/latest/api/token", nil)
+	assert.Equal(t, 400, w.Code)
+	w = request("PUT", "/latest/api/token", map[string]string{IMDSTokenTTLHeader: "60"})
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "60", w.Header().Get(IMDSTokenTTLHeader))
+	token := w.Body.String()
+
+	w = request("GET", "/latest/meta-data/local-ipv4", map[string]string{IMDSTokenHeader: token})
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "192.168.1.1", w.Body.String())
+	w = request("GET", "/latest/meta-data/local-ipv4", map[string]string{IMDSTokenHeader: token + "x"})
+	assert.Equal(t, 401, w.Code)
+
+	metad.config.IMDS.TokenRequired = true
+	w = request("GET", "/latest/meta-data/local-ipv4", nil)
+	assert.Equal(t, 401, w.Code)
+
+	// the token is bound to the client.
+	req = httptest.NewRequest("GET", "/latest/meta-data/local-ipv4", nil)
+	req.Header.Set(IMDSTokenHeader, token)
+	req.RemoteAddr = "192.168.1.2:1234"
+	w = httptest.NewRecorder()
+	metad.imdsRouter.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+}
+
+func TestMetadOpenStackAndGCE(t *testing.T) {
+	metad := NewTestMetad()
+	defer metad.Stop()
+	ip := "192.168.1.1"
+
+	putData(t, metad, "/", `{"hosts":{"i-1":{"ip":"192.168.1.1","instance_id":"i-1","mac":"52:54:00:00:00:01","labels":{"app-name":"web"}}}}`)
+
+	req := httptest.NewRequest("PUT", "/v1/mapping/", strings.NewReader(fmt.Sprintf(`{"%s":{"host":"/hosts/i-1"}}`, ip)))
+	w := httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	time.Sleep(sleepTime)
+
+	metad.config.OpenStack = OpenStackConfig{
+		MetaData: map[string]string{
+			"uuid":     "/host/instance_id",
+			"hostname": "/host/instance_id",
+		},
+		NetworkData: map[string]string{
+			"links/0/id":                   "/host/instance_id",
+			"links/0/ethernet_mac_address": "/host/mac",
+			"networks/0/ip_address":        "/host/ip",
+		},
+	}
+	metad.config.GCE = GCEConfig{
+		MetaData: map[string]string{
+			"instance/id":                       "/host/instance_id",
+			"instance/network-interfaces/0/ip":  "/host/ip",
+			"instance/attributes":               "/host/labels",
+			"instance/network-interfaces/0/mac": "/host/mac",
+		},
+	}
+
+	request := func(uri string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", uri, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		metad.imdsRouter.ServeHTTP(w, req)
+		return w
+	}
+
+	w = request("/openstack/latest/", nil)
+	assert.Equal(t, "meta_data.json\nnetwork_data.json", w.Body.String())
+	w = request("/openstack/latest/meta_data.json", nil)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, ContentTypeJSON, w.Header().Get("Content-Type"))
+	assert.Equal(t, `{"hostname":"i-1","uuid":"i-1"}`, w.Body.String())
+	w = request("/openstack/latest/network_data.json", nil)
+	assert.Equal(t, `{"links":[{"ethernet_mac_address":"52:54:00:00:00:01","id":"i-1"}],"networks":[{"ip_address":"192.168.1.1"}]}`, w.Body.String())
+	w = request("/openstack/latest/user_data", nil)
+	assert.Equal(t, 404, w.Code)
+
+	flavor := map[string]string{GCEFlavorHeader: GCEFlavor}
+	w = request("/computeMetadata/v1/instance/id", nil)
+	assert.Equal(t, 403, w.Code)
+	w = request("/computeMetadata/v1/instance/id", flavor)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, GCEFlavor, w.Header().Get(GCEFlavorHeader))
+	assert.Equal(t, "i-1", w.Body.String())
+	w = request("/computeMetadata/v1/instance/", flavor)
+	assert.Equal(t, "attributes/\nid\nnetwork-interfaces/\n", w.Body.String())
+	w = request("/computeMetadata/v1/instance/?recursive=true", flavor)
+	assert.Equal(t, ContentTypeJSON, w.Header().Get("Content-Type"))
+	assert.Equal(t, `{"attributes":{"app-name":"web"},"id":"i-1","networkInterfaces":[{"ip":"192.168.1.1","mac":"52:54:00:00:00:01"}]}`, w.Body.String())
+	w = request("/computeMetadata/v1/instance/network-interfaces/?recursive=true&alt=text", flavor)
+	assert.Equal(t, "0/ip 192.168.1.1\n0/mac 52:54:00:00:00:01\n", w.Body.String())
+	w = request("/computeMetadata/v1/instance/none", flavor)
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestMetadNoCloud(t *testing.T) {
+	metad := NewTestMetad()
+	defer metad.Stop()
+	ip := "192.168.1.1"
+
+	userData := "Content-Type: multipart/mixed; boundary=\"BOUNDARY\"\r\nMIME-Version: 1.0\r\n\r\n--BOUNDARY\r\nContent-Type: text/x-shellscript\r\n\r\n#!/bin/sh\r\necho hi\r\n--BOUNDARY--\r\n"
+	data := map[string]interface{}{
+		"_cloudinit": map[string]interface{}{
+			"web": map[string]interface{}{
+				"meta-data":   map[string]interface{}{"instance-id": "i-1", "local-hostname": "web-1"},
+				"user-data":   userData,
+				"vendor-data": "#!/bin/sh\necho vendor\n",
+			},
+		},
+		"hosts": map[string]interface{}{"i-1": map[string]interface{}{"ip": "192.168.1.1"}},
+	}
+	b, _ := json.Marshal(data)
+	putData(t, metad, "/", string(b))
+
+	req := httptest.NewRequest("PUT", "/v1/mapping/", strings.NewReader(fmt.Sprintf(`{"%s":{"cloud-init":"/_cloudinit/web"},"192.168.1.2":{"cloud-init":"/hosts/i-1"}}`, ip)))
+	w := httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	time.Sleep(sleepTime)
+
+	get := func(ip string, uri string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", uri, nil)
+		req.Header.Set("Accept", "application/json")
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		metad.router.ServeHTTP(w, req)
+		return w
+	}
+
+	w = get(ip, "/_metad/nocloud/user-data")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, `multipart/mixed; boundary="BOUNDARY"`, w.Header().Get("Content-Type"))
+	assert.Equal(t, userData, w.Body.String())
+
+	w = get(ip, "/_metad/nocloud/vendor-data")
+	assert.Equal(t, "text/x-shellscript", w.Header().Get("Content-Type"))
+	assert.Equal(t, "#!/bin/sh\necho vendor\n", w.Body.String())
+
+	w = get(ip, "/_metad/nocloud/meta-data")
+	assert.Equal(t, ContentTypeYAML, w.Header().Get("Content-Type"))
+	assert.Equal(t, "instance-id: i-1\nlocal-hostname: web-1\n", w.Body.String())
+
+	w = get(ip, "/_metad/nocloud/network-config")
+	assert.Equal(t, 404, w.Code)
+	w = get(ip, "/_metad/nocloud/secret")
+	assert.Equal(t, 404, w.Code)
+
+	// the mapping out of the cloud_init_path is not served.
+	w = get("192.168.1.2", "/_metad/nocloud/meta-data")
+	assert.Equal(t, 404, w.Code)
+
+	// the binary user-data is stored as base64, and served as is.
+	binary := []byte{0x1f, 0x8b, 0x08, 0x00, 0x00, 0xff, 0xfe, 0x0a}
+	encoded := base64.StdEncoding.EncodeToString(binary)
+	putData(t, metad, "/_cloudinit/bin", fmt.Sprintf(`{"user-data.b64":"%s\n%s","vendor-data.b64":"!invalid"}`, encoded[:4], encoded[4:]))
+	req = httptest.NewRequest("PUT", "/v1/mapping/192.168.1.3", strings.NewReader(`{"cloud-init":"/_cloudinit/bin"}`))
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	time.Sleep(sleepTime)
+	w = get("192.168.1.3", "/_metad/nocloud/user-data")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, ContentTypeBinary, w.Header().Get("Content-Type"))
+	assert.Equal(t, binary, w.Body.Bytes())
+	w = get("192.168.1.3", "/_metad/nocloud/vendor-data")
+	assert.Equal(t, 500, w.Code)
+	w = get("192.168.1.3", "/_metad/nocloud/user-data.b64")
+	assert.Equal(t, 404, w.Code)
+
+	// the documents are read through the access rules of the client.
+	req = httptest.NewRequest("PUT", "/v1/rule/", strings.NewReader(fmt.Sprintf(`{"%s":[{"path":"/hosts","mode":1}]}`, ip)))
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	time.Sleep(sleepTime)
+	w = get(ip, "/_metad/nocloud/user-data")
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestMetadRender(t *testing.T) {
+	metad := NewTestMetad()
+	defer metad.Stop()
+	ip := "192.168.1.1"
+
+	putData(t, metad, "/", `{"hosts":{"i-1":{"ip":"192.168.1.1"},"i-2":{"ip":"192.168.1.2"}},"_templates":{"hosts":"{{range gets \"/hosts/*/ip\"}}{{.Value}} {{base (dir .Key)}}\n{{end}}"}}`)
+
+	req := httptest.NewRequest("PUT", "/v1/mapping/", strings.NewReader(fmt.Sprintf(`{"%s":{"hosts":"/hosts","host":"/hosts/i-1","render":"/hosts/i-2"}}`, ip)))
+	w := httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	time.Sleep(sleepTime)
+
+	req = httptest.NewRequest("POST", "/_metad/render", strings.NewReader(`ip={{getv "/host/ip"}}`))
+	req.RemoteAddr = ip + ":1234"
+	w = httptest.NewRecorder()
+	metad.router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "ip=192.168.1.1", w.Body.String())
+	assert.NotEmpty(t, w.Header().Get("ETag"))
+
+	req = httptest.NewRequest("GET", "/_metad/render/hosts", nil)
+	req.RemoteAddr = ip + ":1234"
+	w = httptest.NewRecorder()
+	metad.router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "192.168.1.1 i-1\n192.168.1.2 i-2\n", w.Body.String())
+
+	etag := w.Header().Get("ETag")
+	req = httptest.NewRequest("GET", "/_metad/render/hosts", nil)
+	req.RemoteAddr = ip + ":1234"
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	metad.router.ServeHTTP(w, req)
+	assert.Equal(t, 304, w.Code)
+
+	req = httptest.NewRequest("GET", "/_metad/render/none", nil)
+	req.RemoteAddr = ip + ":1234"
+	w = httptest.NewRecorder()
+	metad.router.ServeHTTP(w, req)
+	assert.Equal(t, 404, w.Code)
+
+	req = httptest.NewRequest("POST", "/_metad/render", strings.NewReader(`{{getv "/host/name"}}`))
+	req.RemoteAddr = ip + ":1234"
+	w = httptest.NewRecorder()
+	metad.router.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+
+	req = httptest.NewRequest("POST", "/_metad/render", strings.NewReader(strings.Repeat(" ", int(MaxTemplateSize)+1)))
+	req.RemoteAddr = ip + ":1234"
+	w = httptest.NewRecorder()
+	metad.router.ServeHTTP(w, req)
+	assert.Equal(t, 413, w.Code)
+
+	// the self mapping key "render" is not shadowed.
+	req = httptest.NewRequest("GET", "/self/render/ip", nil)
+	req.RemoteAddr = ip + ":1234"
+	w = httptest.NewRecorder()
+	metad.router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "192.168.1.2", w.Body.String())
+}
+
+func TestMetadIdentity(t *testing.T) {
+	group := fmt.Sprintf("/group%v", rand.Intn(10000))
+	config := &Config{
+		Backend:        testBackend,
+		Group:          group,
+		Identity:       "token,proxy,ip",
+		TokenSecret:    "secret",
+		TrustedProxies: []string{"10.0.0.0/8"},
+	}
+	metad, err := New(config)
+	assert.NoError(t, err)
+	metad.Init()
+	defer metad.Stop()
+
+	putData(t, metad, "/", `{"nodes":{"1":{"name":"node1"},"2":{"name":"node2"},"3":{"name":"node3"}}}`)
+
+	req := httptest.NewRequest("PUT", "/v1/mapping/", strings.NewReader(`{"token:web-1":{"node":"/nodes/1"},"192.168.1.2":{"node":"/nodes/2"},"10.0.0.1":{"node":"/nodes/3"}}`))
+	w := httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	// the first level key of the mapping should be ip or identity.
+	req = httptest.NewRequest("PUT", "/v1/mapping/", strings.NewReader(`{"web-1":{"node":"/nodes/1"}}`))
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 500, w.Code)
+
+	time.Sleep(sleepTime)
+
+	sign := func(claims string) string {
+		data := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." +
+			base64.RawURLEncoding.EncodeToString([]byte(claims))
+		mac := hmac.New(sha256.New, []byte(config.TokenSecret))
+		mac.Write([]byte(data))
+		return data + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+	get := func(remoteIP string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/self/node/name", nil)
+		req.RemoteAddr = remoteIP + ":1234"
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		metad.router.ServeHTTP(w, req)
+		return w
+	}
+
+	w = get("192.168.1.5", map[string]string{"Authorization": "Bearer " + sign(`{"sub":"web-1"}`)})
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "node1", w.Body.String())
+
+	w = get("192.168.1.5", map[string]string{"Authorization": "Bearer " + sign(fmt.Sprintf(`{"sub":"web-1","exp":%d}`, time.Now().Unix()-1))})
+	assert.Equal(t, 401, w.Code)
+
+	w = get("192.168.1.5", map[string]string{"Authorization": "Bearer " + sign(`{"sub":"web-1"}`) + "x"})
+	assert.Equal(t, 401, w.Code)
+
+	// the proxy header is trusted only from the trusted proxies, the ips prepended by the client are ignored.
+	w = get("10.0.0.1", map[string]string{"X-Forwarded-For": "192.168.1.9, 192.168.1.2, 10.0.0.2"})
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "node2", w.Body.String())
+
+	w = get("192.168.1.5", map[string]string{"X-Forwarded-For": "192.168.1.2"})
+	assert.Equal(t, 404, w.Code)
+
+	// the trusted proxy itself without the proxy header is identified by its ip.
+	w = get("10.0.0.1", nil)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "node3", w.Body.String())
+}
+
+func TestMetadManageGetIdentity(t *testing.T) {
+	group := fmt.Sprintf("/group%v", rand.Intn(10000))
+	config := &Config{
+		Backend:     testBackend,
+		Group:       group,
+		Identity:    "token",
+		TokenSecret: "secret",
+	}
+	metad, err := New(config)
+	assert.NoError(t, err)
+	metad.Init()
+	defer metad.Stop()
+
+	putData(t, metad, "/", `{"nodes":{"1":{"name":"node1"}}}`)
+	time.Sleep(sleepTime)
+
+	// the manage api does not require the client identity.
+	req := httptest.NewRequest("GET", "/v1/data/nodes/1/name", nil)
+	w := httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "node1", w.Body.String())
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.NotEqual(t, "0", w.Header().Get("X-Metad-Version"))
+
+	req = httptest.NewRequest("GET", "/v1/data/nodes/1/name", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 304, w.Code)
+
+	version := metad.metadataRepo.DataVersion()
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/v1/data/nodes/1/name?wait=true&prev_version=%d", version), nil)
+		w := httptest.NewRecorder()
+		metad.manageRouter.ServeHTTP(w, req)
+		done <- w
+	}()
+	time.Sleep(sleepTime)
+	putData(t, metad, "/nodes/1/name", `"node2"`)
+	select {
+	case w = <-done:
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "node2", w.Body.String())
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "wait on the manage api should return after the change")
+	}
+
+	// the metadata api still require the token.
+	req = httptest.NewRequest("GET", "/nodes/1/name", nil)
+	w = httptest.NewRecorder()
+	metad.router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+}
+
 func TestMetadWatchSelf(t *testing.T) {
 	metad := NewTestMetad()
 
-	defer metad.Stop()
+	defer metad.Stop()
+
+	dataJson := `
+	{
+		"nodes": {
+	"1": {
+	"ip": "192.168.1.1",
+	"name": "node1"
+	}
+	}
+	}
+	`
+	data := make(map[string]interface{})
+	json.Unmarshal([]byte(dataJson), &data)
+
+	req := httptest.NewRequest("PUT", "/v1/data/", strings.NewReader(dataJson))
+	w := httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	req = httptest.NewRequest("POST", "/v1/mapping", strings.NewReader(`{"192.168.1.1":{"node":"/nodes/1"}}`))
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	time.Sleep(sleepTime)
+
+	//test self request
+	req = httptest.NewRequest("GET", "/self", nil)
+	req.RemoteAddr = "192.168.1.1:1234"
+	req.Header.Set("accept", "application/json")
+	w = httptest.NewRecorder()
+	metad.router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "node1", util.GetMapValue(parse(w), "/node/name"))
+
+	versions := make(chan int, 1)
+	go func() {
+		req := httptest.NewRequest("GET", "/self?wait=true", nil)
+		req.Header.Set("accept", "application/json")
+		req.RemoteAddr = "192.168.1.1:1234"
+		w := httptest.NewRecorder()
+		metad.router.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+		assert.Equal(t, "192.168.2.1", util.GetMapValue(parse(w), "/node/ip"))
+		version := parseVersion(w)
+		versions <- version
+	}()
+
+	time.Sleep(sleepTime)
+
+	req = httptest.NewRequest("PUT", "/v1/data/nodes/1/ip", strings.NewReader(`"192.168.2.1"`))
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	v := <-versions
+	assert.True(t, v >= 0)
+
+	// change again
+	req = httptest.NewRequest("PUT", "/v1/data/nodes/1/ip", strings.NewReader(`"192.168.3.1"`))
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	time.Sleep(sleepTime)
+
+	//wait with prev_version should return immediately
+	req = httptest.NewRequest("GET", fmt.Sprintf("/self?wait=true&prev_version=%d", v), nil)
+	req.Header.Set("accept", "application/json")
+	req.RemoteAddr = "192.168.1.1:1234"
+	w = httptest.NewRecorder()
+	metad.router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	v2 := parseVersion(w)
+	assert.True(t, v2 > v)
+	assert.Equal(t, "192.168.3.1", util.GetMapValue(parse(w), "/node/ip"))
+}
+
+func TestMetadMappingDelete(t *testing.T) {
+	metad := NewTestMetad()
+
+	defer metad.Stop()
+
+	dataJson := `
+	{
+		"nodes": {
+	"1": {
+	"ip": "192.168.1.1",
+	"name": "node1"
+	}
+	}
+	}
+	`
+	data := make(map[string]interface{})
+	json.Unmarshal([]byte(dataJson), &data)
+
+	req := httptest.NewRequest("PUT", "/v1/data/", strings.NewReader(dataJson))
+	w := httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	ip := "192.168.1.1"
+	req = httptest.NewRequest("POST", "/v1/mapping", strings.NewReader(`{"192.168.1.1":{"node":"/nodes/1"}}`))
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	time.Sleep(sleepTime)
+
+	getAndCheckMapping(metad, t, ip, true)
+
+	req = httptest.NewRequest("DELETE", "/v1/mapping?subs=192.168.1.2,,", nil)
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	time.Sleep(sleepTime)
+
+	getAndCheckMapping(metad, t, ip, true)
+
+	req = httptest.NewRequest("DELETE", "/v1/mapping?subs=,,", nil)
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	time.Sleep(sleepTime)
+
+	getAndCheckMapping(metad, t, ip, true)
+
+	req = httptest.NewRequest("DELETE", "/v1/mapping?subs=192.168.1.1", nil)
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	time.Sleep(sleepTime)
+
+	getAndCheckMapping(metad, t, ip, false)
+}
+
+func TestMetadDataIfMatch(t *testing.T) {
+	metad := NewTestMetad()
+	defer metad.Stop()
+
+	// create only if not exist.
+	req := httptest.NewRequest("PUT", "/v1/data/nodes/1", strings.NewReader(`{"ip":"192.168.1.1"}`))
+	req.Header.Set("If-Match", `"0"`)
+	w := httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	time.Sleep(sleepTime)
+
+	req = httptest.NewRequest("GET", "/v1/data/nodes/1", nil)
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	etag := w.Header().Get("ETag")
+	assert.NotEqual(t, "", etag)
+	assert.NotEqual(t, `"0"`, etag)
+	assert.True(t, strings.HasSuffix(etag, `-text"`))
+
+	req = httptest.NewRequest("PUT", "/v1/data/nodes/1", strings.NewReader(`{"name":"node1"}`))
+	req.Header.Set("If-Match", etag)
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	time.Sleep(sleepTime)
+
+	// the revision has been changed by last write.
+	req = httptest.NewRequest("POST", "/v1/data/nodes/1", strings.NewReader(`{"ip":"192.168.1.2"}`))
+	req.Header.Set("If-Match", etag)
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 409, w.Code)
+
+	req = httptest.NewRequest("DELETE", "/v1/data/nodes/1", nil)
+	req.Header.Set("If-Match", etag)
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 409, w.Code)
+
+	req = httptest.NewRequest("DELETE", "/v1/data/nodes?subs=1", nil)
+	req.Header.Set("If-Match", etag)
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
 
-	dataJson := `
-	{
-		"nodes": {
-	"1": {
-	"ip": "192.168.1.1",
-	"name": "node1"
-	}
+	req = httptest.NewRequest("PUT", "/v1/data/nodes/1", strings.NewReader(`{"name":"node1"}`))
+	req.Header.Set("If-Match", "invalid")
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+
+	req = httptest.NewRequest("GET", "/v1/data/nodes/1", nil)
+	req.Header.Set("accept", "application/json")
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, map[string]interface{}{"ip": "192.168.1.1", "name": "node1"}, parse(w))
+	etag = w.Header().Get("ETag")
+
+	req = httptest.NewRequest("DELETE", "/v1/data/nodes/1", nil)
+	req.Header.Set("If-Match", etag)
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	time.Sleep(sleepTime)
+
+	req = httptest.NewRequest("GET", "/v1/data/nodes/1", nil)
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 404, w.Code)
+
+	put := func(ifMatch string) int {
+		req := httptest.NewRequest("PUT", "/v1/data/nodes/2", strings.NewReader(`{"name":"node2"}`))
+		req.Header.Set("If-Match", ifMatch)
+		w := httptest.NewRecorder()
+		metad.manageRouter.ServeHTTP(w, req)
+		return w.Code
 	}
+	// "*" only match the exist node.
+	assert.Equal(t, 409, put("*"))
+	assert.Equal(t, 200, put(`"0"`))
+	time.Sleep(sleepTime)
+	assert.Equal(t, 200, put("*"))
+	time.Sleep(sleepTime)
+
+	req = httptest.NewRequest("GET", "/v1/data/nodes/2", nil)
+	req.Header.Set("accept", "application/json")
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	etag = w.Header().Get("ETag")
+	rev := strings.TrimSuffix(strings.TrimPrefix(etag, `"`), `-json"`)
+
+	// the etag with the access part or an unknown format is not a revision.
+	for _, ifMatch := range []string{fmt.Sprintf(`"%s-5f1e2c3a-json"`, rev), fmt.Sprintf(`"%s-xml"`, rev), `"` + rev, "W/"} {
+		assert.Equal(t, 400, put(ifMatch), ifMatch)
 	}
-	`
-	data := make(map[string]interface{})
-	json.Unmarshal([]byte(dataJson), &data)
+	// the weak etag never match, the list match if any etag match.
+	assert.Equal(t, 409, put("W/"+etag))
+	assert.Equal(t, 409, put(`"1-json", "2"`))
+	assert.Equal(t, 200, put(`"1-json", `+etag))
+}
 
-	req := httptest.NewRequest("PUT", "/v1/data/", strings.NewReader(dataJson))
+func TestMetadTxn(t *testing.T) {
+	metad := NewTestMetad()
+	defer metad.Stop()
+
+	txnJson := `
+	[
+		{"target": "data", "action": "merge", "path": "/clusters/cl-1/hosts", "value": {"i-1": "192.168.1.1"}, "if_match": 0},
+		{"target": "mapping", "action": "put", "path": "/192.168.1.1", "value": {"host": "/clusters/cl-1/hosts/i-1"}},
+		{"target": "rule", "action": "put", "path": "192.168.1.1", "value": [{"path": "/clusters/cl-1", "mode": 1}]}
+	]
+	`
+	req := httptest.NewRequest("POST", "/v1/txn", strings.NewReader(txnJson))
 	w := httptest.NewRecorder()
 	metad.manageRouter.ServeHTTP(w, req)
 	assert.Equal(t, 200, w.Code)
 
-	req = httptest.NewRequest("POST", "/v1/mapping", strings.NewReader(`{"192.168.1.1":{"node":"/nodes/1"}}`))
+	time.Sleep(sleepTime)
+
+	req = httptest.NewRequest("GET", "/v1/data/clusters/cl-1/hosts", nil)
+	req.Header.Set("accept", "application/json")
 	w = httptest.NewRecorder()
 	metad.manageRouter.ServeHTTP(w, req)
 	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, map[string]interface{}{"i-1": "192.168.1.1"}, parse(w))
 
-	time.Sleep(sleepTime)
-
-	//test self request
-	req = httptest.NewRequest("GET", "/self", nil)
+	req = httptest.NewRequest("GET", "/self/host", nil)
 	req.RemoteAddr = "192.168.1.1:1234"
 	req.Header.Set("accept", "application/json")
 	w = httptest.NewRecorder()
 	metad.router.ServeHTTP(w, req)
 	assert.Equal(t, 200, w.Code)
-	assert.Equal(t, "node1", util.GetMapValue(parse(w), "/node/name"))
+	assert.Equal(t, "192.168.1.1", parse(w))
 
-	versions := make(chan int, 1)
-	go func() {
-		req := httptest.NewRequest("GET", "/self?wait=true", nil)
-		req.Header.Set("accept", "application/json")
-		req.RemoteAddr = "192.168.1.1:1234"
-		w := httptest.NewRecorder()
-		metad.router.ServeHTTP(w, req)
-		assert.Equal(t, 200, w.Code)
-		assert.Equal(t, "192.168.2.1", util.GetMapValue(parse(w), "/node/ip"))
-		version := parseVersion(w)
-		versions <- version
-	}()
+	req = httptest.NewRequest("GET", "/v1/rule?hosts=192.168.1.1", nil)
+	req.Header.Set("accept", "application/json")
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "/clusters/cl-1", util.GetMapValue(parse(w), "/192.168.1.1/0/path"))
 
-	time.Sleep(sleepTime)
+	// the data has been created, the txn conflict.
+	req = httptest.NewRequest("POST", "/v1/txn", strings.NewReader(txnJson))
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 409, w.Code)
 
-	req = httptest.NewRequest("PUT", "/v1/data/nodes/1/ip", strings.NewReader(`"192.168.2.1"`))
+	req = httptest.NewRequest("POST", "/v1/txn", strings.NewReader(`[{"target": "data", "action": "replace", "path": "/clusters"}]`))
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 500, w.Code)
+
+	req = httptest.NewRequest("POST", "/v1/txn", strings.NewReader(`[]`))
 	w = httptest.NewRecorder()
 	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestMetadTTL(t *testing.T) {
+	metad := NewTestMetad()
+	defer metad.Stop()
+
+	req := httptest.NewRequest("PUT", "/v1/data/agents/1?ttl=1", strings.NewReader(`{"status":"up"}`))
+	w := httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
 	assert.Equal(t, 200, w.Code)
 
-	v := <-versions
-	assert.True(t, v >= 0)
+	req = httptest.NewRequest("PUT", "/v1/mapping/192.168.1.1?ttl=1", strings.NewReader(`{"agent":"/agents/1"}`))
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
 
-	// change again
-	req = httptest.NewRequest("PUT", "/v1/data/nodes/1/ip", strings.NewReader(`"192.168.3.1"`))
+	req = httptest.NewRequest("PUT", "/v1/data/agents/2?ttl=invalid", strings.NewReader(`{"status":"up"}`))
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+
+	time.Sleep(700 * time.Millisecond)
+
+	req = httptest.NewRequest("POST", "/v1/keepalive/data/agents/1", nil)
 	w = httptest.NewRecorder()
 	metad.manageRouter.ServeHTTP(w, req)
 	assert.Equal(t, 200, w.Code)
 
-	time.Sleep(sleepTime)
+	req = httptest.NewRequest("POST", "/v1/keepalive/mapping/192.168.1.1", nil)
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
 
-	//wait with prev_version should return immediately
-	req = httptest.NewRequest("GET", fmt.Sprintf("/self?wait=true&prev_version=%d", v), nil)
-	req.Header.Set("accept", "application/json")
+	req = httptest.NewRequest("POST", "/v1/keepalive/data/agents/2", nil)
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 404, w.Code)
+
+	time.Sleep(700 * time.Millisecond)
+
+	req = httptest.NewRequest("GET", "/self/agent/status", nil)
 	req.RemoteAddr = "192.168.1.1:1234"
+	req.Header.Set("accept", "application/json")
 	w = httptest.NewRecorder()
 	metad.router.ServeHTTP(w, req)
 	assert.Equal(t, 200, w.Code)
-	v2 := parseVersion(w)
-	assert.True(t, v2 > v)
-	assert.Equal(t, "192.168.3.1", util.GetMapValue(parse(w), "/node/ip"))
+	assert.Equal(t, "up", parse(w))
+
+	time.Sleep(1000 * time.Millisecond)
+
+	req = httptest.NewRequest("GET", "/v1/data/agents/1", nil)
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 404, w.Code)
+
+	req = httptest.NewRequest("GET", "/v1/mapping/192.168.1.1", nil)
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 404, w.Code)
 }
 
-func TestMetadMappingDelete(t *testing.T) {
+func TestMetadStream(t *testing.T) {
 	metad := NewTestMetad()
-
 	defer metad.Stop()
 
-	dataJson := `
-	{
-		"nodes": {
-	"1": {
-	"ip": "192.168.1.1",
-	"name": "node1"
-	}
-	}
-	}
-	`
-	data := make(map[string]interface{})
-	json.Unmarshal([]byte(dataJson), &data)
+	server := httptest.NewServer(metad.router)
+	defer server.Close()
+	// the request of test server come from localhost.
+	ip := "127.0.0.1"
 
-	req := httptest.NewRequest("PUT", "/v1/data/", strings.NewReader(dataJson))
+	req := httptest.NewRequest("PUT", "/v1/data/", strings.NewReader(`{"nodes":{"1":{"ip":"192.168.1.1","name":"node1"}}}`))
 	w := httptest.NewRecorder()
 	metad.manageRouter.ServeHTTP(w, req)
 	assert.Equal(t, 200, w.Code)
-	ip := "192.168.1.1"
-	req = httptest.NewRequest("POST", "/v1/mapping", strings.NewReader(`{"192.168.1.1":{"node":"/nodes/1"}}`))
+
+	req = httptest.NewRequest("PUT", "/v1/rule/", strings.NewReader(fmt.Sprintf(`{"%s":[{"path":"/nodes","mode":1}]}`, ip)))
 	w = httptest.NewRecorder()
 	metad.manageRouter.ServeHTTP(w, req)
 	assert.Equal(t, 200, w.Code)
 
-	time.Sleep(sleepTime)
-
-	getAndCheckMapping(metad, t, ip, true)
-
-	req = httptest.NewRequest("DELETE", "/v1/mapping?subs=192.168.1.2,,", nil)
+	req = httptest.NewRequest("PUT", "/v1/mapping/", strings.NewReader(fmt.Sprintf(`{"%s":{"node":"/nodes/1"}}`, ip)))
 	w = httptest.NewRecorder()
 	metad.manageRouter.ServeHTTP(w, req)
 	assert.Equal(t, 200, w.Code)
 
 	time.Sleep(sleepTime)
 
-	getAndCheckMapping(metad, t, ip, true)
-
-	req = httptest.NewRequest("DELETE", "/v1/mapping?subs=,,", nil)
+	resp, events := openStream(t, server.URL+"/nodes/1?stream=sse", "")
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	e := nextStreamEvent(t, events)
+	assert.Equal(t, "snapshot", e.event)
+	assert.Equal(t, map[string]interface{}{"ip": "192.168.1.1", "name": "node1"}, e.data)
+
+	putData(t, metad, "/nodes/1/ip", `"192.168.2.1"`)
+	e = nextStreamEvent(t, events)
+	assert.Equal(t, "change", e.event)
+	assert.Equal(t, map[string]interface{}{"ip": "UPDATE|192.168.2.1"}, e.data)
+	assert.Equal(t, fmt.Sprintf("%d", metad.metadataRepo.DataVersion()), e.id)
+	resp.Body.Close()
+
+	// resume from the last event id, no snapshot, the changes out of the path do not make the id stale.
+	putData(t, metad, "/other", `"value"`)
+	resp, events = openStream(t, server.URL+"/nodes/1?stream=sse", e.id)
+	putData(t, metad, "/nodes/1/name", `"node1-new"`)
+	e = nextStreamEvent(t, events)
+	assert.Equal(t, "change", e.event)
+	assert.Equal(t, map[string]interface{}{"name": "UPDATE|node1-new"}, e.data)
+	resp.Body.Close()
+
+	// the changes invisible to the client are not pushed.
+	resp, events = openStream(t, server.URL+"/?stream=sse", e.id)
+	putData(t, metad, "/secret", `"password"`)
+	putData(t, metad, "/nodes/2/ip", `"192.168.1.2"`)
+	e = nextStreamEvent(t, events)
+	assert.Equal(t, "change", e.event)
+	assert.Equal(t, map[string]interface{}{"nodes": map[string]interface{}{"2": map[string]interface{}{"ip": "UPDATE|192.168.1.2"}}}, e.data)
+	resp.Body.Close()
+
+	// resume from a stale id, resync by snapshot.
+	resp, events = openStream(t, server.URL+"/self/node?stream=sse", "1")
+	e = nextStreamEvent(t, events)
+	assert.Equal(t, "snapshot", e.event)
+	assert.Equal(t, map[string]interface{}{"ip": "192.168.2.1", "name": "node1-new"}, e.data)
+
+	// self stream follow the mapping changes.
+	req = httptest.NewRequest("PUT", "/v1/mapping/"+ip, strings.NewReader(`{"node":"/nodes/2"}`))
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	e = nextStreamEvent(t, events)
+	assert.Equal(t, "change", e.event)
+	assert.Equal(t, map[string]interface{}{"ip": "UPDATE|192.168.1.2", "name": "DELETE|node1-new"}, e.data)
+
+	putData(t, metad, "/nodes/2/ip", `"192.168.2.2"`)
+	e = nextStreamEvent(t, events)
+	assert.Equal(t, map[string]interface{}{"ip": "UPDATE|192.168.2.2"}, e.data)
+	resp.Body.Close()
+
+	// resume after disconnected, the changes missed are replayed instead of a snapshot.
+	putData(t, metad, "/nodes/2/name", `"node2"`)
+	req = httptest.NewRequest("DELETE", "/v1/data/nodes/2/ip", nil)
 	w = httptest.NewRecorder()
 	metad.manageRouter.ServeHTTP(w, req)
 	assert.Equal(t, 200, w.Code)
-
 	time.Sleep(sleepTime)
+	resp, events = openStream(t, server.URL+"/nodes/2?stream=sse", e.id)
+	e = nextStreamEvent(t, events)
+	assert.Equal(t, "change", e.event)
+	assert.Equal(t, map[string]interface{}{"ip": "DELETE|192.168.2.2", "name": "UPDATE|node2"}, e.data)
+	assert.Equal(t, fmt.Sprintf("%d", metad.metadataRepo.DataVersion()), e.id)
+	resp.Body.Close()
+
+	// the idle stream get the keepalive comment.
+	oldInterval := StreamKeepAliveInterval
+	StreamKeepAliveInterval = 100 * time.Millisecond
+	defer func() { StreamKeepAliveInterval = oldInterval }()
+	resp, events = openStream(t, server.URL+"/nodes/2?stream=sse", e.id)
+	e = nextStreamEvent(t, events)
+	assert.Equal(t, "comment", e.event)
+	resp.Body.Close()
+}
 
-	getAndCheckMapping(metad, t, ip, true)
+func TestMetadWebsocket(t *testing.T) {
+	metad := NewTestMetad()
+	defer metad.Stop()
 
-	req = httptest.NewRequest("DELETE", "/v1/mapping?subs=192.168.1.1", nil)
-	w = httptest.NewRecorder()
+	server := httptest.NewServer(metad.router)
+	defer server.Close()
+	ip := "127.0.0.1"
+
+	putData(t, metad, "/", `{"hosts":{"1":{"ip":"192.168.1.1"}},"clusters":{"c1":{"name":"cluster1"}}}`)
+
+	req := httptest.NewRequest("PUT", "/v1/mapping/", strings.NewReader(fmt.Sprintf(`{"%s":{"host":"/hosts/1","cluster":"/clusters/c1"}}`, ip)))
+	w := httptest.NewRecorder()
 	metad.manageRouter.ServeHTTP(w, req)
 	assert.Equal(t, 200, w.Code)
 
 	time.Sleep(sleepTime)
 
-	getAndCheckMapping(metad, t, ip, false)
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/?stream=ws", "", server.URL)
+	if err != nil {
+		t.Fatal("Dial websocket err:", err)
+	}
+	defer ws.Close()
+	events := make(chan *wsEvent, 10)
+	go func() {
+		defer close(events)
+		for {
+			e := &wsEvent{}
+			if err := websocket.JSON.Receive(ws, e); err != nil {
+				return
+			}
+			events <- e
+		}
+	}()
+	nextEvent := func() *wsEvent {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.Fatal("Websocket closed")
+			}
+			return e
+		case <-time.After(3 * time.Second):
+			t.Fatal("Wait websocket event timeout")
+		}
+		return nil
+	}
+
+	assert.NoError(t, websocket.JSON.Send(ws, &wsRequest{Op: WSOpSubscribe, ID: "host", Path: "/self/host"}))
+	e := nextEvent()
+	assert.Equal(t, "host", e.ID)
+	assert.Equal(t, "snapshot", e.Type)
+	assert.Equal(t, map[string]interface{}{"ip": "192.168.1.1"}, e.Data)
+
+	assert.NoError(t, websocket.JSON.Send(ws, &wsRequest{Op: WSOpSubscribe, ID: "cluster", Path: "/self/cluster/name"}))
+	e = nextEvent()
+	assert.Equal(t, "cluster", e.ID)
+	assert.Equal(t, "snapshot", e.Type)
+	assert.Equal(t, "cluster1", e.Data)
+
+	// subscription id should be unique.
+	assert.NoError(t, websocket.JSON.Send(ws, &wsRequest{Op: WSOpSubscribe, ID: "host", Path: "/hosts"}))
+	e = nextEvent()
+	assert.Equal(t, "host", e.ID)
+	assert.Equal(t, "error", e.Type)
+
+	putData(t, metad, "/clusters/c1/name", `"cluster1-new"`)
+	e = nextEvent()
+	assert.Equal(t, "cluster", e.ID)
+	assert.Equal(t, "change", e.Type)
+	assert.Equal(t, "UPDATE|cluster1-new", e.Data)
+	assert.Equal(t, metad.metadataRepo.DataVersion(), e.Version)
+
+	putData(t, metad, "/hosts/1/ip", `"192.168.2.1"`)
+	e = nextEvent()
+	assert.Equal(t, "host", e.ID)
+	assert.Equal(t, map[string]interface{}{"ip": "UPDATE|192.168.2.1"}, e.Data)
+
+	// no event after unsubscribe.
+	assert.NoError(t, websocket.JSON.Send(ws, &wsRequest{Op: WSOpUnsubscribe, ID: "host"}))
+	time.Sleep(sleepTime)
+	putData(t, metad, "/hosts/1/ip", `"192.168.3.1"`)
+	putData(t, metad, "/clusters/c1/name", `"cluster1"`)
+	e = nextEvent()
+	assert.Equal(t, "cluster", e.ID)
+	assert.Equal(t, "UPDATE|cluster1", e.Data)
+
+	assert.NoError(t, websocket.JSON.Send(ws, &wsRequest{Op: WSOpUnsubscribe, ID: "host"}))
+	e = nextEvent()
+	assert.Equal(t, "error", e.Type)
+
+	assert.NoError(t, websocket.Message.Send(ws, "invalid"))
+	e = nextEvent()
+	assert.Equal(t, "error", e.Type)
 }
 
 func TestMetadAccessRule(t *testing.T) {
@@ -503,6 +1779,153 @@ func TestMetadAccessRule(t *testing.T) {
 	assert.Equal(t, "", util.GetMapValue(parse(w), "/clusters/cl-1/name"))
 }
 
+func TestMetadUpstream(t *testing.T) {
+	waitTimeout := upstream.WaitTimeout
+	upstream.WaitTimeout = 200 * time.Millisecond
+	defer func() {
+		upstream.WaitTimeout = waitTimeout
+	}()
+	upstreamMetad := NewTestMetad()
+	defer upstreamMetad.Stop()
+	server := httptest.NewServer(upstreamMetad.manageRouter)
+	defer server.Close()
+
+	req := httptest.NewRequest("PUT", "/v1/data/", strings.NewReader(`{"nodes":{"1":{"ip":"192.168.1.1"}}}`))
+	w := httptest.NewRecorder()
+	upstreamMetad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	// the downstream keeps its own mapping in local backend.
+	config := &Config{
+		Backend:        "upstream",
+		Group:          "downstream",
+		BackendNodes:   []string{server.URL},
+		MappingBackend: &backends.Config{Backend: "local"},
+	}
+	metad, err := New(config)
+	assert.NoError(t, err)
+	metad.Init()
+	defer metad.Stop()
+
+	req = httptest.NewRequest("GET", "/v1/data/nodes/1/ip", nil)
+	req.Header.Set("accept", "application/json")
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "192.168.1.1", parse(w))
+
+	// the change of upstream is synced by long-polling.
+	req = httptest.NewRequest("PUT", "/v1/data/nodes/1/ip", strings.NewReader(`"192.168.2.1"`))
+	w = httptest.NewRecorder()
+	upstreamMetad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	time.Sleep(500 * time.Millisecond)
+
+	req = httptest.NewRequest("GET", "/v1/data/nodes/1/ip", nil)
+	req.Header.Set("accept", "application/json")
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "192.168.2.1", parse(w))
+
+	// only the changes are applied, the wait is repeated after WaitTimeout.
+	time.Sleep(2 * upstream.WaitTimeout)
+	req = httptest.NewRequest("PUT", "/v1/data/nodes/3", strings.NewReader(`{"ip":"192.168.1.3","label":""}`))
+	w = httptest.NewRecorder()
+	upstreamMetad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, map[string]interface{}{"ip": "192.168.1.3", "label": ""}, metad.metadataRepo.GetData("/nodes/3"))
+	req = httptest.NewRequest("DELETE", "/v1/data/nodes/3", nil)
+	w = httptest.NewRecorder()
+	upstreamMetad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	time.Sleep(500 * time.Millisecond)
+	assert.Nil(t, metad.metadataRepo.GetData("/nodes/3"))
+
+	// write to downstream go to upstream.
+	req = httptest.NewRequest("PUT", "/v1/data/nodes/2/ip", strings.NewReader(`"192.168.1.2"`))
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "192.168.1.2", upstreamMetad.metadataRepo.GetData("/nodes/2/ip"))
+
+	req = httptest.NewRequest("PUT", "/v1/mapping/192.168.1.1", strings.NewReader(`{"node":"/nodes/1"}`))
+	w = httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Nil(t, upstreamMetad.metadataRepo.GetMapping("/192.168.1.1"))
+	time.Sleep(sleepTime)
+
+	req = httptest.NewRequest("GET", "/self/node/ip", nil)
+	req.Header.Set("accept", "application/json")
+	req.RemoteAddr = "192.168.1.1:1234"
+	w = httptest.NewRecorder()
+	metad.router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "192.168.2.1", parse(w))
+}
+
+func TestMetadUpstreamNotFound(t *testing.T) {
+	waitTimeout, retryInterval := upstream.WaitTimeout, upstream.RetryInterval
+	upstream.WaitTimeout, upstream.RetryInterval = 200*time.Millisecond, 100*time.Millisecond
+	defer func() {
+		upstream.WaitTimeout, upstream.RetryInterval = waitTimeout, retryInterval
+	}()
+	upstreamMetad := NewTestMetad()
+	defer upstreamMetad.Stop()
+	// the upstream response 404 without version while missing is set.
+	var requests, missing int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&missing) == 1 {
+			http.NotFound(w, req)
+			return
+		}
+		upstreamMetad.manageRouter.ServeHTTP(w, req)
+	}))
+	defer server.Close()
+
+	// the prefix of downstream not exists in upstream yet, init should return.
+	config := &Config{
+		Backend:        "upstream",
+		Group:          "downstream",
+		Prefix:         "/missing",
+		BackendNodes:   []string{server.URL},
+		MappingBackend: &backends.Config{Backend: "local"},
+	}
+	metad, err := New(config)
+	assert.NoError(t, err)
+	metad.Init()
+	defer metad.Stop()
+	assert.Nil(t, metad.metadataRepo.GetData("/nodes/1/ip"))
+
+	// synced after the prefix created in upstream.
+	req := httptest.NewRequest("PUT", "/v1/data/missing", strings.NewReader(`{"nodes":{"1":{"ip":"192.168.1.1"}}}`))
+	w := httptest.NewRecorder()
+	upstreamMetad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, "192.168.1.1", metad.metadataRepo.GetData("/nodes/1/ip"))
+
+	// the local data is kept while not found, and the request is retried after RetryInterval, not busy loop.
+	atomic.StoreInt32(&missing, 1)
+	time.Sleep(2 * upstream.WaitTimeout)
+	atomic.StoreInt32(&requests, 0)
+	time.Sleep(1 * time.Second)
+	assert.True(t, atomic.LoadInt32(&requests) <= 20, "requests: %v", atomic.LoadInt32(&requests))
+	assert.Equal(t, "192.168.1.1", metad.metadataRepo.GetData("/nodes/1/ip"))
+
+	// synced again after upstream recovered.
+	atomic.StoreInt32(&missing, 0)
+	req = httptest.NewRequest("PUT", "/v1/data/missing/nodes/1/ip", strings.NewReader(`"192.168.2.1"`))
+	w = httptest.NewRecorder()
+	upstreamMetad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, "192.168.2.1", metad.metadataRepo.GetData("/nodes/1/ip"))
+}
+
 func NewTestMetad() *Metad {
 	group := fmt.Sprintf("/group%v", rand.Intn(10000))
 	config := &Config{
@@ -558,3 +1981,72 @@ func parse(w *httptest.ResponseRecorder) interface{} {
 	}
 	return result
 }
+
+type streamEvent struct {
+	id    string
+	event string
+	data  interface{}
+}
+
+func openStream(t *testing.T, url string, lastEventID string) (*http.Response, <-chan *streamEvent) {
+	req, _ := http.NewRequest("GET", url, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Open stream err:", err)
+	}
+	assert.Equal(t, 200, resp.StatusCode)
+	events := make(chan *streamEvent, 10)
+	go readStream(resp.Body, events)
+	return resp, events
+}
+
+func readStream(body io.Reader, events chan<- *streamEvent) {
+	defer close(events)
+	reader := bufio.NewReader(body)
+	e := &streamEvent{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if e.event != "" {
+				events <- e
+			}
+			e = &streamEvent{}
+		case strings.HasPrefix(line, ":"):
+			e.event = "comment"
+		case strings.HasPrefix(line, "id: "):
+			e.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			e.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e.data)
+		}
+	}
+}
+
+func nextStreamEvent(t *testing.T, events <-chan *streamEvent) *streamEvent {
+	select {
+	case e, ok := <-events:
+		if !ok {
+			t.Fatal("Stream closed")
+		}
+		return e
+	case <-time.After(3 * time.Second):
+		t.Fatal("Wait stream event timeout")
+	}
+	return nil
+}
+
+func putData(t *testing.T, metad *Metad, nodePath string, value string) {
+	req := httptest.NewRequest("PUT", "/v1/data"+nodePath, strings.NewReader(value))
+	w := httptest.NewRecorder()
+	metad.manageRouter.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+}
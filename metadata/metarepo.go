@@ -6,14 +6,18 @@ package metadata
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"net"
 	"path"
 	"reflect"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/yunify/metad/atomic"
 	"github.com/yunify/metad/backends"
 	"github.com/yunify/metad/log"
 	"github.com/yunify/metad/store"
@@ -35,10 +39,12 @@ type MetadataRepo struct {
 }
 
 func New(storeClient backends.StoreClient) *MetadataRepo {
+	// data and mapping share the version, so their revisions are comparable when backend not provide revision.
+	version := new(atomic.AtomicLong)
 	metadataRepo := MetadataRepo{
-		mapping:            store.New(),
+		mapping:            store.NewWithVersion(version),
 		storeClient:        storeClient,
-		data:               store.New(),
+		data:               store.NewWithVersion(version),
 		accessStore:        store.NewAccessStore(),
 		metaStopChan:       make(chan bool),
 		mappingStopChan:    make(chan bool),
@@ -82,7 +88,7 @@ func (r *MetadataRepo) getAccessTree(clientIP string) store.AccessTree {
 	accessTree := r.accessStore.Get(clientIP)
 	//for compatible with old version, auto convert mapping to AccessRule
 	if accessTree == nil {
-		mappingData := r.GetMapping(path.Join("/", clientIP))
+		mappingData := r.GetMapping(path.Join("/", r.mappingHost(clientIP)))
 		if mappingData == nil {
 			if log.IsDebugEnable() {
 				log.Debug("Can not find mapping for %s", clientIP)
@@ -104,7 +110,60 @@ func (r *MetadataRepo) getAccessTree(clientIP string) store.AccessTree {
 	return accessTree
 }
 
+// mappingHost return the first level key of the client's mapping, the client itself, or the longest prefix CIDR block
+// contains the client ip, or the wildcard, see store.MatchHost.
+func (r *MetadataRepo) mappingHost(clientIP string) string {
+	return store.MatchHost(clientIP, func(host string) bool {
+		_, val := r.mapping.Get(path.Join("/", host))
+		return val != nil
+	})
+}
+
+// ValueOptions limit the value got by Root and Self.
+type ValueOptions struct {
+	// Depth is the max depth of the dirs expanded, the deeper dirs are truncated to empty map, 0 means no limit.
+	Depth int
+	// Keys return the sorted child names instead of the value.
+	Keys bool
+	// Fields is the relative paths selected, such as "a/b", empty means all.
+	Fields []string
+}
+
+func (o *ValueOptions) selector() *store.ValueSelector {
+	if o == nil {
+		return nil
+	}
+	depth := o.Depth
+	if o.Keys {
+		// only the children are required.
+		depth = 1
+	}
+	return store.NewValueSelector(depth, o.Fields)
+}
+
+// apply convert the value to the child names if Keys is required.
+func (o *ValueOptions) apply(val interface{}) interface{} {
+	if o == nil || !o.Keys {
+		return val
+	}
+	m, ok := val.(map[string]interface{})
+	if !ok {
+		return val
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func (r *MetadataRepo) Root(clientIP string, nodePath string) (currentVersion int64, val interface{}) {
+	return r.RootWithOptions(clientIP, nodePath, nil)
+}
+
+// RootWithOptions same as Root, but the value is limited by options, the dirs not required are not traveled.
+func (r *MetadataRepo) RootWithOptions(clientIP string, nodePath string, options *ValueOptions) (currentVersion int64, val interface{}) {
 	if clientIP == "" {
 		panic(errors.New("clientIP must not be empty."))
 	}
@@ -119,9 +178,15 @@ func (r *MetadataRepo) Root(clientIP string, nodePath string) (currentVersion in
 		return
 	}
 	currentVersion = traveller.GetVersion()
-	val = traveller.GetValue()
-	if val != nil && nodePath == "/" {
-		selfVal := r.self(clientIP, "/", traveller)
+	selector := options.selector()
+	val = traveller.GetSelectedValue(selector)
+	if selfSelector, ok := selector.Child("self"); val != nil && nodePath == "/" && ok {
+		var selfVal interface{}
+		if selfSelector.Truncated() {
+			selfVal = make(map[string]interface{})
+		} else {
+			selfVal = r.self(clientIP, "/", traveller, selfSelector)
+		}
 		if selfVal != nil {
 			mapVal, ok := val.(map[string]interface{})
 			if ok {
@@ -129,20 +194,52 @@ func (r *MetadataRepo) Root(clientIP string, nodePath string) (currentVersion in
 			}
 		}
 	}
+	val = options.apply(val)
 	return
 }
 
 func (r *MetadataRepo) Watch(ctx context.Context, clientIP string, nodePath string) interface{} {
+	return r.WatchData(ctx, nodePath)
+}
+
+// WatchSince wait the changes after prevVersion, same as Watch, prevVersion is the version got by RootVersion.
+// If there are changes after prevVersion, return them immediately,
+// return store.ErrHistoryCompacted if the changes have been evicted from history.
+func (r *MetadataRepo) WatchSince(ctx context.Context, clientIP string, nodePath string, prevVersion int64) (interface{}, error) {
+	return r.WatchDataSince(ctx, nodePath, prevVersion)
+}
+
+// WatchData wait the data change of nodePath without access control, for manage api.
+func (r *MetadataRepo) WatchData(ctx context.Context, nodePath string) interface{} {
+	result, _ := r.WatchDataSince(ctx, nodePath, 0)
+	return result
+}
+
+// WatchDataSince wait the data change of nodePath after prevVersion without access control, same as WatchSince.
+func (r *MetadataRepo) WatchDataSince(ctx context.Context, nodePath string, prevVersion int64) (interface{}, error) {
+	events, err := r.watchDataEvents(ctx, nodePath, prevVersion)
+	if err != nil {
+		return nil, err
+	}
+	return eventsToTree(events), nil
+}
+
+func (r *MetadataRepo) watchDataEvents(ctx context.Context, nodePath string, prevVersion int64) ([]*store.Event, error) {
 	nodePath = path.Join("/", nodePath)
-	w := r.data.Watch(nodePath, DEFAULT_WATCH_BUF_LEN)
-	return r.changeToResult(w, ctx.Done())
+	w, err := r.data.WatchSince(nodePath, prevVersion, DEFAULT_WATCH_BUF_LEN)
+	if err != nil {
+		return nil, err
+	}
+	return r.collectEvents(w, ctx.Done())
 }
 
 var TIMER_NIL *time.Timer = &time.Timer{C: nil}
 
-func (r *MetadataRepo) changeToResult(watcher store.Watcher, stopChan <-chan struct{}) interface{} {
+// collectEvents wait the first event, then collect the following events in the coalesce window,
+// return nil if stopped, the prev events are discarded.
+func (r *MetadataRepo) collectEvents(watcher store.Watcher, stopChan <-chan struct{}) ([]*store.Event, error) {
 	defer watcher.Remove()
-	m := make(map[string]string)
+	var events []*store.Event
 	timer := TIMER_NIL
 
 	for {
@@ -150,12 +247,20 @@ func (r *MetadataRepo) changeToResult(watcher store.Watcher, stopChan <-chan str
 		select {
 		case e, ok := <-watcher.EventChan():
 			if ok {
-				value := fmt.Sprintf("%s|%s", e.Action, e.Value)
-				// if event is one leaf node, just return value.
-				if e.Path == "/" {
-					return value
+				if e.Action == store.Resync {
+					if timer.C != nil {
+						r.timerPool.ReleaseTimer(timer)
+					}
+					return nil, store.ErrHistoryCompacted
+				}
+				events = append(events, e)
+				// if event is one leaf node, just return the last value.
+				if e.Path == "/" && len(watcher.EventChan()) == 0 {
+					if timer.C != nil {
+						r.timerPool.ReleaseTimer(timer)
+					}
+					return events, nil
 				}
-				m[e.Path] = value
 				if timer.C != nil {
 					r.timerPool.ReleaseTimer(timer)
 				}
@@ -166,8 +271,8 @@ func (r *MetadataRepo) changeToResult(watcher store.Watcher, stopChan <-chan str
 		case <-timer.C:
 			finish = true
 		case <-stopChan:
-			//when stop, return empty map, discard prev result.
-			m = make(map[string]string)
+			//when stop, discard prev result.
+			events = nil
 			finish = true
 		}
 
@@ -177,29 +282,55 @@ func (r *MetadataRepo) changeToResult(watcher store.Watcher, stopChan <-chan str
 			}
 			break
 		}
-		//TODO check map size, avoid too big result.
+		//TODO check events size, avoid too big result.
 	}
-	return flatmap.Expand(m, "/")
+	return events, nil
 }
 
 func (r *MetadataRepo) WatchSelf(ctx context.Context, clientIP string, nodePath string) interface{} {
-	nodePath = path.Join(clientIP, "/", nodePath)
+	result, _ := r.WatchSelfSince(ctx, clientIP, nodePath, 0)
+	return result
+}
+
+// WatchSelfSince wait the changes of the client's self nodePath after prevVersion, same as WatchSince,
+// prevVersion is the version got by SelfVersion. The watch stop when the mapping change, the changes are discarded.
+func (r *MetadataRepo) WatchSelfSince(ctx context.Context, clientIP string, nodePath string, prevVersion int64) (interface{}, error) {
+	events, dataPath, err := r.watchSelfEvents(ctx, clientIP, nodePath, prevVersion)
+	if err == ErrMappingChanged {
+		return eventsToTree(nil), nil
+	}
+	if err != nil || dataPath == nil {
+		return nil, err
+	}
+	return eventsToTree(events), nil
+}
+
+// watchSelfEvents wait the events of the client's self nodePath, return the events and the function convert
+// the event path to the data path, the function is nil if the client has no mapping.
+// Return ErrMappingChanged if the watch is stopped by the mapping change.
+func (r *MetadataRepo) watchSelfEvents(ctx context.Context, clientIP string, nodePath string, prevVersion int64) ([]*store.Event, func(string) string, error) {
+	nodePath = path.Join("/", nodePath)
 	if log.IsDebugEnable() {
-		log.Debug("WatchSelf nodePath: %s", nodePath)
+		log.Debug("WatchSelf clientIP: %s, nodePath: %s", clientIP, nodePath)
 	}
-	mappingData := r.GetMapping(nodePath)
+	mappingPath, mappingData, subPath := r.resolveSelfMapping(clientIP, nodePath)
 	if mappingData == nil {
-		return nil
+		return nil, nil, nil
+	}
+	mappingWatcher, err := r.mapping.WatchSince(mappingPath, prevVersion, DEFAULT_WATCH_BUF_LEN)
+	if err != nil {
+		return nil, nil, err
 	}
-	mappingWatcher := r.mapping.Watch(nodePath, DEFAULT_WATCH_BUF_LEN)
 	defer mappingWatcher.Remove()
 
 	stopChan := make(chan struct{})
+	mappingChanged := make(chan struct{})
 
 	go func() {
 		select {
 		case _, ok := <-mappingWatcher.EventChan():
 			if ok {
+				close(mappingChanged)
 				close(stopChan)
 			}
 		case <-ctx.Done():
@@ -207,25 +338,106 @@ func (r *MetadataRepo) WatchSelf(ctx context.Context, clientIP string, nodePath
 		}
 	}()
 
+	var events []*store.Event
+	dataPath := selfDataPath(mappingData, subPath)
 	mapping, mok := mappingData.(map[string]interface{})
 	if !mok {
-		dataNodePath := fmt.Sprintf("%s", mappingData)
+		dataNodePath := path.Join(fmt.Sprintf("%s", mappingData), subPath)
 		//log.Debug("watcher: %v", dataNodePath)
-		w := r.data.Watch(dataNodePath, DEFAULT_WATCH_BUF_LEN)
-		return r.changeToResult(w, stopChan)
+		w, err := r.data.WatchSince(dataNodePath, prevVersion, DEFAULT_WATCH_BUF_LEN)
+		if err != nil {
+			return nil, nil, err
+		}
+		events, err = r.collectEvents(w, stopChan)
+		if err != nil {
+			return nil, nil, err
+		}
 	} else {
 		flatMapping := flatmap.Flatten(mapping)
 		watchers := make(map[string]store.Watcher)
 		for k, v := range flatMapping {
-			watchers[k] = r.data.Watch(v, DEFAULT_WATCH_BUF_LEN)
+			w, err := r.data.WatchSince(v, prevVersion, DEFAULT_WATCH_BUF_LEN)
+			if err != nil {
+				for _, w := range watchers {
+					w.Remove()
+				}
+				return nil, nil, err
+			}
+			watchers[k] = w
 		}
 		//log.Debug("aggWatcher: %v", watchers)
 		aggWatcher := store.NewAggregateWatcher(watchers)
-		return r.changeToResult(aggWatcher, stopChan)
+		events, err = r.collectEvents(aggWatcher, stopChan)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	select {
+	case <-mappingChanged:
+		return nil, dataPath, ErrMappingChanged
+	default:
 	}
+	return events, dataPath, nil
 }
 
 func (r *MetadataRepo) Self(clientIP string, nodePath string) interface{} {
+	return r.SelfWithOptions(clientIP, nodePath, nil)
+}
+
+// selfDataPath return the func convert the path relative to the client's self nodePath to the data path,
+// by the mapping resolved by resolveSelfMapping, "" if the path is not mapped.
+func selfDataPath(mappingData interface{}, subPath string) func(string) string {
+	mapping, mok := mappingData.(map[string]interface{})
+	if !mok {
+		dataNodePath := path.Join(fmt.Sprintf("%s", mappingData), subPath)
+		return func(p string) string {
+			return path.Join(dataNodePath, p)
+		}
+	}
+	flatMapping := flatmap.Flatten(mapping)
+	return func(p string) string {
+		for k, v := range flatMapping {
+			if p == k || strings.HasPrefix(p, k+"/") {
+				return path.Join(v, strings.TrimPrefix(p, k))
+			}
+		}
+		return ""
+	}
+}
+
+// SelfDataPath return the data path the client's self nodePath mapped to, "" if it is not mapped.
+func (r *MetadataRepo) SelfDataPath(clientIP string, nodePath string) string {
+	_, mapping, subPath := r.resolveSelfMapping(clientIP, path.Join("/", nodePath))
+	if dataPath, ok := mapping.(string); ok {
+		return path.Join(dataPath, subPath)
+	}
+	return ""
+}
+
+// SelfMapped return the client's self metadata translated by the fields mapping, the key of fields is the path of
+// the result and the value is the path of self, such as {"local-ipv4": "/host/ip"}, the missing fields are omitted.
+// Return the whole self if fields is empty.
+func (r *MetadataRepo) SelfMapped(clientIP string, fields map[string]string) interface{} {
+	self := r.Self(clientIP, "/")
+	if len(fields) == 0 || self == nil {
+		return self
+	}
+	var keys []string
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var result interface{}
+	for _, k := range keys {
+		if v := getPathValue(self, splitPath(fields[k])); v != nil {
+			result = setPathValue(result, splitPath(k), copyValue(v))
+		}
+	}
+	return result
+}
+
+// SelfWithOptions same as Self, but the value is limited by options same as RootWithOptions.
+func (r *MetadataRepo) SelfWithOptions(clientIP string, nodePath string, options *ValueOptions) interface{} {
 	if clientIP == "" {
 		panic(errors.New("clientIP must not be empty."))
 	}
@@ -237,11 +449,11 @@ func (r *MetadataRepo) Self(clientIP string, nodePath string) interface{} {
 	}
 	traveller := r.data.Traveller(accessTree)
 	defer traveller.Close()
-	return r.self(clientIP, nodePath, traveller)
+	return options.apply(r.self(clientIP, nodePath, traveller, options.selector()))
 }
 
-func (r *MetadataRepo) self(clientIP string, nodePath string, traveller store.Traveller) interface{} {
-	mappingData := r.GetMapping(path.Join("/", clientIP))
+func (r *MetadataRepo) self(clientIP string, nodePath string, traveller store.Traveller, selector *store.ValueSelector) interface{} {
+	mappingData := r.GetMapping(path.Join("/", r.mappingHost(clientIP)))
 	if mappingData == nil {
 		if log.IsDebugEnable() {
 			log.Debug("Can not find mapping for %s", clientIP)
@@ -253,29 +465,36 @@ func (r *MetadataRepo) self(clientIP string, nodePath string, traveller store.Tr
 		log.Warning("Mapping for %s is not a map, result:%v", clientIP, mappingData)
 		return nil
 	}
-	return r.getMappingDatas(nodePath, mapping, traveller)
+	return r.getMappingDatas(nodePath, mapping, traveller, selector)
 }
 
-func (r *MetadataRepo) getMappingData(nodePath, link string, traveller store.Traveller) interface{} {
+func (r *MetadataRepo) getMappingData(nodePath, link string, traveller store.Traveller, selector *store.ValueSelector) interface{} {
 	nodePath = path.Join(link, nodePath)
 	if traveller.Enter(nodePath) {
-		val := traveller.GetValue()
+		val := traveller.GetSelectedValue(selector)
 		traveller.BackToRoot()
 		return val
 	}
 	return nil
 }
 
-func (r *MetadataRepo) getMappingDatas(nodePath string, mapping map[string]interface{}, traveller store.Traveller) interface{} {
+func (r *MetadataRepo) getMappingDatas(nodePath string, mapping map[string]interface{}, traveller store.Traveller, selector *store.ValueSelector) interface{} {
 	nodePath = path.Join("/", nodePath)
 	paths := strings.Split(nodePath, "/")[1:] // trim first blank item
 	// nodePath is "/"
 	if paths[0] == "" {
 		meta := make(map[string]interface{})
+		if selector.Truncated() {
+			return meta
+		}
 		for k, v := range mapping {
+			sub, ok := selector.Child(k)
+			if !ok {
+				continue
+			}
 			submapping, isMap := v.(map[string]interface{})
 			if isMap {
-				val := r.getMappingDatas("/", submapping, traveller)
+				val := r.getMappingDatas("/", submapping, traveller, sub)
 				if val != nil {
 					meta[k] = val
 				} else {
@@ -283,7 +502,7 @@ func (r *MetadataRepo) getMappingDatas(nodePath string, mapping map[string]inter
 				}
 			} else {
 				subNodePath := fmt.Sprintf("%v", v)
-				val := r.getMappingData("/", subNodePath, traveller)
+				val := r.getMappingData("/", subNodePath, traveller, sub)
 				if val != nil {
 					meta[k] = val
 				} else {
@@ -299,9 +518,9 @@ func (r *MetadataRepo) getMappingDatas(nodePath string, mapping map[string]inter
 		if ok {
 			submapping, isMap := elemValue.(map[string]interface{})
 			if isMap {
-				return r.getMappingDatas(path.Join(paths[1:]...), submapping, traveller)
+				return r.getMappingDatas(path.Join(paths[1:]...), submapping, traveller, selector)
 			} else {
-				return r.getMappingData(path.Join(paths[1:]...), fmt.Sprintf("%v", elemValue), traveller)
+				return r.getMappingData(path.Join(paths[1:]...), fmt.Sprintf("%v", elemValue), traveller, selector)
 			}
 		} else {
 			if log.IsDebugEnable() {
@@ -321,6 +540,37 @@ func (r *MetadataRepo) PutData(nodePath string, data interface{}, replace bool)
 	return r.storeClient.Put(nodePath, data, replace)
 }
 
+// PutDataWithTTL put the data, the nodes put are deleted after ttl unless kept alive.
+func (r *MetadataRepo) PutDataWithTTL(nodePath string, data interface{}, replace bool, ttl time.Duration) error {
+	return r.storeClient.PutWithTTL(nodePath, data, replace, ttl)
+}
+
+// KeepAliveData reset the ttl of the nodes under nodePath.
+func (r *MetadataRepo) KeepAliveData(nodePath string) error {
+	return r.storeClient.KeepAlive(nodePath)
+}
+
+// PutDataIfMatch put the data only if the modified revision of nodePath is rev, rev 0 means nodePath not exist.
+func (r *MetadataRepo) PutDataIfMatch(nodePath string, data interface{}, replace bool, rev int64) error {
+	if _, modifiedRev := r.data.GetRevision(nodePath); modifiedRev != rev {
+		return store.ErrRevisionConflict
+	}
+	return r.storeClient.PutIfMatch(nodePath, data, replace, rev)
+}
+
+// DeleteDataIfMatch delete nodePath only if the modified revision of nodePath is rev.
+func (r *MetadataRepo) DeleteDataIfMatch(nodePath string, rev int64) error {
+	if _, modifiedRev := r.data.GetRevision(nodePath); modifiedRev != rev {
+		return store.ErrRevisionConflict
+	}
+	_, v := r.data.Get(nodePath)
+	if v == nil {
+		return nil
+	}
+	_, dir := v.(map[string]interface{})
+	return r.storeClient.DeleteIfMatch(nodePath, dir, rev)
+}
+
 func (r *MetadataRepo) DeleteData(nodePath string, subs ...string) error {
 	err := checkSubs(subs)
 	if err != nil {
@@ -352,61 +602,61 @@ func (r *MetadataRepo) DeleteData(nodePath string, subs ...string) error {
 }
 
 func (r *MetadataRepo) GetMapping(nodePath string) interface{} {
+	if p, err := normalizeMappingPath(nodePath); err == nil {
+		nodePath = p
+	}
 	_, val := r.mapping.Get(nodePath)
 	return val
 }
 
 func (r *MetadataRepo) PutMapping(nodePath string, data interface{}, replace bool) error {
-	nodePath = path.Join("/", nodePath)
-	if nodePath == "/" {
-		m, ok := data.(map[string]interface{})
-		if !ok {
-			log.Warning("Unexpect data type for mapping: %s", reflect.TypeOf(data))
-			return errors.New("mapping data should be json object.")
-		}
-		for k, v := range m {
-			ip := net.ParseIP(k)
-			if ip == nil {
-				return errors.New("mapping's first level key should be ip .")
-			}
-			err := checkMapping(v)
-			if err != nil {
-				return err
-			}
-		}
-	} else {
-		parts := strings.Split(nodePath, "/")
-		ip := net.ParseIP(parts[1])
-		if ip == nil {
-			return errors.New("mapping's first level key should be ip .")
-		}
-		// nodePath: /ip
-		if len(parts) == 2 {
-			err := checkMapping(data)
-			if err != nil {
-				return err
-			}
-		} else {
-			// nodePath: /ip/{key:.*}
-			_, isMap := data.(map[string]interface{})
-			if isMap {
-				err := checkMapping(data)
-				if err != nil {
-					return err
-				}
-			} else {
-				err := checkMappingPath(data)
-				if err != nil {
-					return err
-				}
-			}
-		}
+	nodePath, err := normalizeMappingPath(nodePath)
+	if err != nil {
+		return err
+	}
+	data = normalizeMappingHosts(nodePath, data)
+	if err := checkMappingData(nodePath, data); err != nil {
+		return err
 	}
 	return r.storeClient.PutMapping(nodePath, data, replace)
 }
 
+// PutMappingWithTTL put the mapping, the nodes put are deleted after ttl unless kept alive.
+func (r *MetadataRepo) PutMappingWithTTL(nodePath string, data interface{}, replace bool, ttl time.Duration) error {
+	nodePath, err := normalizeMappingPath(nodePath)
+	if err != nil {
+		return err
+	}
+	data = normalizeMappingHosts(nodePath, data)
+	if err := checkMappingData(nodePath, data); err != nil {
+		return err
+	}
+	return r.storeClient.PutMappingWithTTL(nodePath, data, replace, ttl)
+}
+
+// KeepAliveMapping reset the ttl of the mapping nodes under nodePath.
+func (r *MetadataRepo) KeepAliveMapping(nodePath string) error {
+	nodePath, err := normalizeMappingPath(nodePath)
+	if err != nil {
+		return err
+	}
+	return r.storeClient.KeepAliveMapping(nodePath)
+}
+
 func (r *MetadataRepo) DeleteMapping(nodePath string, subs ...string) error {
-	err := checkSubs(subs)
+	nodePath, err := normalizeMappingPath(nodePath)
+	if err != nil {
+		return err
+	}
+	if nodePath == "/" {
+		// the subs of "/" are hosts, the CIDR host in "/" form is converted to the host key.
+		hosts := make([]string, 0, len(subs))
+		for _, sub := range subs {
+			hosts = append(hosts, store.NormalizeHost(strings.TrimSpace(sub)))
+		}
+		subs = hosts
+	}
+	err = checkSubs(subs)
 	if err != nil {
 		return err
 	}
@@ -438,29 +688,160 @@ func (r *MetadataRepo) DeleteMapping(nodePath string, subs ...string) error {
 	}
 }
 
+// Txn check the ops, and apply them atomically by the backend.
+func (r *MetadataRepo) Txn(ops []store.TxnOp) error {
+	for i := range ops {
+		op := &ops[i]
+		if op.Target == store.TxnTargetRule {
+			op.Path = store.NormalizeHost(op.Path)
+		}
+		if op.Target == store.TxnTargetMapping {
+			p, err := normalizeMappingPath(op.Path)
+			if err != nil {
+				return err
+			}
+			op.Path = p
+		}
+		if err := store.CheckTxnOp(op); err != nil {
+			return err
+		}
+		var s store.Store
+		switch op.Target {
+		case store.TxnTargetData:
+			s = r.data
+		case store.TxnTargetMapping:
+			s = r.mapping
+			if op.Action != store.TxnActionDelete {
+				op.Value = normalizeMappingHosts(op.Path, op.Value)
+				if err := checkMappingData(op.Path, op.Value); err != nil {
+					return err
+				}
+			}
+		case store.TxnTargetRule:
+			if op.Action != store.TxnActionDelete {
+				if !store.IsHost(op.Path) {
+					return fmt.Errorf("Invalid access rule host [%s], should be ip, CIDR, * or identity.", op.Path)
+				}
+				// re-marshal to convert the generic json value to rules.
+				b, _ := json.Marshal(op.Value)
+				rules, err := store.UnmarshalAccessRule(string(b))
+				if err != nil {
+					return fmt.Errorf("Invalid access rule for host %s: %s", op.Path, err.Error())
+				}
+				if err = store.CheckAccessRules(rules); err != nil {
+					return err
+				}
+				op.Rules = rules
+			}
+			continue
+		}
+		if op.IfMatch != nil {
+			if _, modifiedRev := s.GetRevision(op.Path); modifiedRev != *op.IfMatch {
+				return store.ErrRevisionConflict
+			}
+		}
+		if op.Action == store.TxnActionDelete {
+			_, v := s.Get(op.Path)
+			_, op.Dir = v.(map[string]interface{})
+		}
+	}
+	return r.storeClient.Txn(ops)
+}
+
 func (r *MetadataRepo) DataVersion() int64 {
 	return r.data.Version()
 }
 
+// RootVersion return the version of nodePath, it is the max modified revision under nodePath,
+// include the client's mapping if nodePath is "/", so it only change when the result of Root change.
+func (r *MetadataRepo) RootVersion(clientIP string, nodePath string) int64 {
+	nodePath = path.Join("/", nodePath)
+	version := r.data.LastRevision(nodePath)
+	if nodePath == "/" {
+		if mappingRev := r.mapping.LastRevision(path.Join("/", r.mappingHost(clientIP))); mappingRev > version {
+			version = mappingRev
+		}
+	}
+	return version
+}
+
+// SelfVersion return the version of the client's self nodePath, it is the max modified revision of the mapping
+// and the data nodes mapped, so it only change when the result of Self change.
+func (r *MetadataRepo) SelfVersion(clientIP string, nodePath string) int64 {
+	mappingPath, mappingData, subPath := r.resolveSelfMapping(clientIP, path.Join("/", nodePath))
+	version := r.mapping.LastRevision(mappingPath)
+	var dataPaths []string
+	switch mapping := mappingData.(type) {
+	case map[string]interface{}:
+		for _, v := range flatmap.Flatten(mapping) {
+			dataPaths = append(dataPaths, v)
+		}
+	case string:
+		dataPaths = append(dataPaths, path.Join(mapping, subPath))
+	}
+	for _, p := range dataPaths {
+		if rev := r.data.LastRevision(p); rev > version {
+			version = rev
+		}
+	}
+	return version
+}
+
+// DataRevision return the created and modified revision of the data node.
+func (r *MetadataRepo) DataRevision(nodePath string) (createdRev, modifiedRev int64) {
+	return r.data.GetRevision(nodePath)
+}
+
+// PutAccessRule put the rules of the hosts, the CIDR host in "/" form is converted to the host key, see store.NormalizeHost.
 func (r *MetadataRepo) PutAccessRule(rulesMap map[string][]store.AccessRule) error {
-	for _, v := range rulesMap {
+	normalized := make(map[string][]store.AccessRule, len(rulesMap))
+	for k, v := range rulesMap {
+		k = store.NormalizeHost(k)
+		if !store.IsHost(k) {
+			return fmt.Errorf("Invalid access rule host [%s], should be ip, CIDR, * or identity.", k)
+		}
 		err := store.CheckAccessRules(v)
 		if err != nil {
 			return err
 		}
+		normalized[k] = v
 	}
-	return r.storeClient.PutAccessRule(rulesMap)
+	return r.storeClient.PutAccessRule(normalized)
 }
 
 func (r *MetadataRepo) DeleteAccessRule(hosts []string) error {
 	if len(hosts) == 0 {
 		return nil
 	}
-	return r.storeClient.DeleteAccessRule(hosts)
+	return r.storeClient.DeleteAccessRule(normalizeHosts(hosts))
 }
 
 func (r *MetadataRepo) GetAccessRule(hosts []string) map[string][]store.AccessRule {
-	return r.accessStore.GetAccessRule(hosts)
+	return r.accessStore.GetAccessRule(normalizeHosts(hosts))
+}
+
+func normalizeHosts(hosts []string) []string {
+	if hosts == nil {
+		return nil
+	}
+	result := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		result = append(result, store.NormalizeHost(host))
+	}
+	return result
+}
+
+// AccessFingerprint return a fingerprint of what the client can access, it change when the access rules of the client change,
+// or the mapping change if the client has no rule, so the result of Root and Self may change even the version not.
+func (r *MetadataRepo) AccessFingerprint(clientIP string) string {
+	var rules string
+	if accessTree := r.accessStore.Get(clientIP); accessTree != nil {
+		rules = store.MarshalAccessRule(accessTree.ToAccessRule())
+	}
+	_, mappingRev := r.mapping.GetRevision(path.Join("/", r.mappingHost(clientIP)))
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s|%d", rules, mappingRev)
+	return fmt.Sprintf("%08x", h.Sum32())
 }
 
 func checkSubs(subs []string) error {
@@ -472,6 +853,86 @@ func checkSubs(subs []string) error {
 	return nil
 }
 
+// normalizeMappingHosts convert the CIDR host keys in "/" form of the mapping put to "/", see store.NormalizeHost.
+func normalizeMappingHosts(nodePath string, data interface{}) interface{} {
+	m, ok := data.(map[string]interface{})
+	if nodePath != "/" || !ok {
+		return data
+	}
+	result := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		result[store.NormalizeHost(k)] = v
+	}
+	return result
+}
+
+// normalizeMappingPath convert the leading CIDR host in "/" form of the mapping path to the host key,
+// such as "/10.0.3.0/24/node" to "/10.0.3.0_24/node", see store.NormalizeHost.
+// The CIDR with the host bits set is rejected, as it is not a valid host.
+func normalizeMappingPath(nodePath string) (string, error) {
+	nodePath = path.Join("/", nodePath)
+	parts := strings.SplitN(nodePath, "/", 4)
+	if len(parts) < 3 {
+		return nodePath, nil
+	}
+	cidr := parts[1] + "/" + parts[2]
+	if _, _, err := net.ParseCIDR(cidr); err != nil {
+		return nodePath, nil
+	}
+	host := store.NormalizeHost(cidr)
+	if host == cidr {
+		return "", fmt.Errorf("Invalid mapping host [%s], the CIDR should be the network address.", cidr)
+	}
+	return path.Join(append([]string{"/", host}, parts[3:]...)...), nil
+}
+
+// checkMappingData check the mapping data put to nodePath.
+func checkMappingData(nodePath string, data interface{}) error {
+	if nodePath == "/" {
+		m, ok := data.(map[string]interface{})
+		if !ok {
+			log.Warning("Unexpect data type for mapping: %s", reflect.TypeOf(data))
+			return errors.New("mapping data should be json object.")
+		}
+		for k, v := range m {
+			if !store.IsHost(k) {
+				return errors.New("mapping's first level key should be ip, CIDR, * or identity .")
+			}
+			err := checkMapping(v)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		parts := strings.Split(nodePath, "/")
+		if !store.IsHost(parts[1]) {
+			return errors.New("mapping's first level key should be ip, CIDR, * or identity .")
+		}
+		// nodePath: /ip
+		if len(parts) == 2 {
+			err := checkMapping(data)
+			if err != nil {
+				return err
+			}
+		} else {
+			// nodePath: /ip/{key:.*}
+			_, isMap := data.(map[string]interface{})
+			if isMap {
+				err := checkMapping(data)
+				if err != nil {
+					return err
+				}
+			} else {
+				err := checkMappingPath(data)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
 func checkMapping(data interface{}) error {
 	m, ok := data.(map[string]interface{})
 	if !ok {
@@ -356,6 +356,171 @@ func TestWatch(t *testing.T) {
 	metarepo.StopSync()
 }
 
+func TestWatchSince(t *testing.T) {
+	metarepo := NewTestMetarepo()
+	metarepo.DeleteMapping("/")
+	metarepo.DeleteData("/")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ip := "192.168.1.1"
+
+	FillTestData(metarepo)
+	metarepo.StartSync()
+	time.Sleep(sleepTime)
+
+	version := metarepo.RootVersion(ip, "/nodes")
+	metarepo.PutData("/nodes/1/name", "n1", false)
+	metarepo.PutData("/nodes/2/name", "n2", false)
+	metarepo.PutData("/nodes/1/name", "n1-new", false)
+	time.Sleep(sleepTime)
+
+	// the changes after the version are replayed.
+	result, err := metarepo.WatchSince(ctx, ip, "/nodes", version)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"1": map[string]interface{}{"name": "UPDATE|n1-new"},
+		"2": map[string]interface{}{"name": "UPDATE|n2"},
+	}, result)
+
+	result, err = metarepo.WatchSince(ctx, ip, "/nodes/1/name", version)
+	assert.NoError(t, err)
+	assert.Equal(t, "UPDATE|n1-new", result)
+
+	// the version is scoped to the path, the change of other path not affect it.
+	version = metarepo.RootVersion(ip, "/nodes/1")
+	metarepo.PutData("/nodes/2/name", "n2-new", false)
+	time.Sleep(sleepTime)
+	assert.Equal(t, version, metarepo.RootVersion(ip, "/nodes/1"))
+	assert.True(t, metarepo.RootVersion(ip, "/nodes") > version)
+
+	// nothing changed after the version, wait the new change.
+	ch := make(chan interface{})
+	go func() {
+		result, _ := metarepo.WatchSince(ctx, ip, "/nodes/1/name", version)
+		ch <- result
+	}()
+	time.Sleep(sleepTime)
+	metarepo.PutData("/nodes/1/name", "n1-2", false)
+	select {
+	case result = <-ch:
+	case <-time.After(time.Second):
+		t.Fatal("TestWatchSince wait timeout")
+	}
+	assert.Equal(t, "UPDATE|n1-2", result)
+	metarepo.StopSync()
+}
+
+func TestWatchChanges(t *testing.T) {
+	metarepo := NewTestMetarepo()
+	metarepo.DeleteMapping("/")
+	metarepo.DeleteData("/")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ip := "192.168.1.1"
+
+	FillTestData(metarepo)
+	metarepo.StartSync()
+	err := metarepo.PutAccessRule(map[string][]store.AccessRule{
+		ip: {{Path: "/", Mode: store.AccessModeRead}, {Path: "/nodes/2", Mode: store.AccessModeForbidden}},
+	})
+	assert.NoError(t, err)
+	err = metarepo.PutMapping(ip, map[string]interface{}{
+		"node": "/nodes/1",
+	}, true)
+	assert.NoError(t, err)
+	time.Sleep(sleepTime)
+
+	version := metarepo.RootVersion(ip, "/nodes")
+	selfVersion := metarepo.SelfVersion(ip, "/")
+	metarepo.PutData("/nodes/1/name", "n1", false)
+	metarepo.PutData("/nodes/1/label", "l1", false)
+	metarepo.DeleteData("/nodes/1/ip")
+	metarepo.PutData("/nodes/2/name", "n2", false)
+	time.Sleep(sleepTime)
+
+	// the change of /nodes/2 is not visible.
+	changesVersion, result, err := metarepo.WatchChanges(ctx, ip, "/nodes", version, WatchFormatChanges)
+	assert.NoError(t, err)
+	// the version include the invisible changes, the client not wait them again.
+	assert.Equal(t, metarepo.RootVersion(ip, "/nodes"), changesVersion)
+	assert.Equal(t, []Change{
+		{Op: ChangeOpRemove, Path: "/1/ip", Old: "192.168.1.1"},
+		{Op: ChangeOpAdd, Path: "/1/label", New: "l1"},
+		{Op: ChangeOpReplace, Path: "/1/name", Old: "node1", New: "n1"},
+	}, result)
+
+	_, result, err = metarepo.WatchChanges(ctx, ip, "/nodes", version, WatchFormatPatch)
+	assert.NoError(t, err)
+	assert.Equal(t, []PatchOp{
+		{Op: ChangeOpRemove, Path: "/1/ip"},
+		{Op: ChangeOpAdd, Path: "/1/label", Value: "l1"},
+		{Op: ChangeOpReplace, Path: "/1/name", Value: "n1"},
+	}, result)
+
+	_, result, err = metarepo.WatchSelfChanges(ctx, ip, "/", selfVersion, WatchFormatChanges)
+	assert.NoError(t, err)
+	assert.Equal(t, []Change{
+		{Op: ChangeOpRemove, Path: "/node/ip", Old: "192.168.1.1"},
+		{Op: ChangeOpAdd, Path: "/node/label", New: "l1"},
+		{Op: ChangeOpReplace, Path: "/node/name", Old: "node1", New: "n1"},
+	}, result)
+
+	// the self changes can not apply after the mapping changed.
+	err = metarepo.PutMapping(ip, map[string]interface{}{
+		"node": "/nodes/3",
+	}, true)
+	assert.NoError(t, err)
+	time.Sleep(sleepTime)
+	_, _, err = metarepo.WatchSelfChanges(ctx, ip, "/", selfVersion, WatchFormatChanges)
+	assert.Equal(t, ErrMappingChanged, err)
+	metarepo.StopSync()
+}
+
+func TestWatchChangesSnapshot(t *testing.T) {
+	metarepo := NewTestMetarepo()
+	metarepo.DeleteMapping("/")
+	metarepo.DeleteData("/")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	FillTestData(metarepo)
+	metarepo.StartSync()
+	defer metarepo.StopSync()
+	time.Sleep(sleepTime)
+
+	_, version := metarepo.DataRevision("/nodes")
+	metarepo.PutData("/nodes/1/name", "n1", false)
+	events, err := metarepo.watchDataEvents(ctx, "/nodes", version)
+	assert.NoError(t, err)
+
+	// the change after the events collected and before the value read is in both the patch and the version.
+	changed := false
+	get := func() interface{} {
+		if !changed {
+			changed = true
+			metarepo.PutData("/nodes/1/label", "", false)
+			time.Sleep(sleepTime)
+		}
+		return metarepo.GetData("/nodes")
+	}
+	since := func(rev int64) ([]*store.Event, error) {
+		return metarepo.data.EventsSince("/nodes", rev)
+	}
+	changesVersion, result, err := metarepo.formatEvents(events, version, nil, WatchFormatPatch, get, since)
+	assert.NoError(t, err)
+	_, lastRev := metarepo.DataRevision("/nodes")
+	assert.Equal(t, lastRev, changesVersion)
+	assert.Equal(t, []PatchOp{
+		{Op: ChangeOpAdd, Path: "/1/label", Value: ""},
+		{Op: ChangeOpReplace, Path: "/1/name", Value: "n1"},
+	}, result)
+}
+
 func TestWatchSelf(t *testing.T) {
 	metarepo := NewTestMetarepo()
 	metarepo.DeleteMapping("/")
@@ -427,6 +592,40 @@ func TestWatchSelf(t *testing.T) {
 	metarepo.StopSync()
 }
 
+func TestSelfVersionDelete(t *testing.T) {
+	metarepo := NewTestMetarepo()
+	metarepo.DeleteMapping("/")
+	metarepo.DeleteData("/")
+
+	FillTestData(metarepo)
+	metarepo.StartSync()
+	defer metarepo.StopSync()
+
+	ip := "192.168.1.1"
+	err := metarepo.PutMapping(ip, map[string]interface{}{
+		"node": "/nodes/1",
+	}, true)
+	assert.NoError(t, err)
+	time.Sleep(sleepTime)
+
+	version := metarepo.SelfVersion(ip, "/")
+	err = metarepo.DeleteData("/nodes/1")
+	assert.NoError(t, err)
+	time.Sleep(sleepTime)
+
+	// the version does not go backward when the mapped node deleted.
+	deletedVersion := metarepo.SelfVersion(ip, "/")
+	assert.True(t, deletedVersion > version)
+	assert.Equal(t, deletedVersion, metarepo.RootVersion(ip, "/nodes/1"))
+
+	// the delete event is not replayed to the client already got it.
+	ctx, cancel := context.WithTimeout(context.Background(), 3*sleepTime)
+	defer cancel()
+	_, result, err := metarepo.WatchSelfChanges(ctx, ip, "/", deletedVersion, WatchFormatChanges)
+	assert.NoError(t, err)
+	assert.Empty(t, result)
+}
+
 func TestWatchCloseChan(t *testing.T) {
 	metarepo := NewTestMetarepo()
 
@@ -558,6 +757,89 @@ func TestAccessRule(t *testing.T) {
 	metarepo.StopSync()
 }
 
+func TestMappingCIDR(t *testing.T) {
+	metarepo := NewTestMetarepo()
+	metarepo.DeleteMapping("/")
+	metarepo.DeleteData("/")
+
+	FillTestData(metarepo)
+	metarepo.StartSync()
+	defer metarepo.StopSync()
+
+	err := metarepo.PutMapping("/", map[string]interface{}{
+		"10.0.0.0_8":       map[string]interface{}{"node": "/nodes/1"},
+		"10.0.3.0_24":      map[string]interface{}{"node": "/nodes/2"},
+		store.WildcardHost: map[string]interface{}{"node": "/nodes/3"},
+	}, true)
+	assert.NoError(t, err)
+
+	// the ip of the CIDR block should be the network address.
+	err = metarepo.PutMapping("/10.0.3.1_24", map[string]interface{}{"node": "/nodes/2"}, true)
+	assert.Error(t, err)
+	err = metarepo.PutMapping("/", map[string]interface{}{"10.0.3.1/24": map[string]interface{}{"node": "/nodes/2"}}, false)
+	assert.Error(t, err)
+	// the "/" form key is converted to the host key.
+	err = metarepo.PutMapping("/", map[string]interface{}{"10.0.3.0/24": map[string]interface{}{"node": "/nodes/2"}}, false)
+	assert.NoError(t, err)
+
+	err = metarepo.PutAccessRule(map[string][]store.AccessRule{
+		"10.0.3.0/24": {{Path: "/", Mode: store.AccessModeRead}},
+	})
+	assert.NoError(t, err)
+	err = metarepo.PutAccessRule(map[string][]store.AccessRule{
+		"10.0.3.1/24": {{Path: "/", Mode: store.AccessModeRead}},
+	})
+	assert.Error(t, err)
+	time.Sleep(sleepTime)
+
+	assert.Equal(t, "node2", metarepo.Self("10.0.3.5", "/node/name"))
+	assert.Equal(t, "node1", metarepo.Self("10.0.4.5", "/node/name"))
+	assert.Equal(t, "node3", metarepo.Self("192.168.1.5", "/node/name"))
+	assert.Equal(t, "node3", metarepo.Self("cert:web-1", "/node/name"))
+
+	// the subnet can read all by its rule, the others only the mapped nodes.
+	_, val := metarepo.Root("10.0.3.5", "/nodes/0/name")
+	assert.Equal(t, "node0", val)
+	_, val = metarepo.Root("10.0.4.5", "/nodes/0/name")
+	assert.Nil(t, val)
+	_, val = metarepo.Root("10.0.4.5", "/nodes/1/name")
+	assert.Equal(t, "node1", val)
+
+	// the exact ip is matched first.
+	err = metarepo.PutMapping("/10.0.3.5", map[string]interface{}{"node": "/nodes/0"}, true)
+	assert.NoError(t, err)
+	time.Sleep(sleepTime)
+	assert.Equal(t, "node0", metarepo.Self("10.0.3.5", "/node/name"))
+	assert.Equal(t, "node2", metarepo.Self("10.0.3.6", "/node/name"))
+
+	_, ok := metarepo.GetAccessRule([]string{"10.0.3.0/24"})["10.0.3.0_24"]
+	assert.True(t, ok)
+
+	// the CIDR host in "/" form of the path is converted to the host key.
+	err = metarepo.PutMapping("/10.0.3.0/24", map[string]interface{}{"node": "/nodes/1"}, true)
+	assert.NoError(t, err)
+	err = metarepo.PutMapping("/10.0.3.0/24/node", "/nodes/4", false)
+	assert.NoError(t, err)
+	err = metarepo.PutMapping("/10.0.3.1/24", map[string]interface{}{"node": "/nodes/2"}, true)
+	assert.Error(t, err)
+	time.Sleep(sleepTime)
+	assert.Nil(t, metarepo.GetMapping("/10.0.3.0"))
+	assert.Equal(t, map[string]interface{}{"node": "/nodes/4"}, metarepo.GetMapping("/10.0.3.0/24"))
+	assert.Equal(t, "node4", metarepo.Self("10.0.3.6", "/node/name"))
+
+	err = metarepo.DeleteMapping("/10.0.3.0/24/node")
+	assert.NoError(t, err)
+	time.Sleep(sleepTime)
+	assert.Nil(t, metarepo.GetMapping("/10.0.3.0_24/node"))
+
+	err = metarepo.DeleteMapping("/", "10.0.3.0/24", "10.0.0.0/8")
+	assert.NoError(t, err)
+	time.Sleep(sleepTime)
+	assert.Nil(t, metarepo.GetMapping("/10.0.3.0_24"))
+	assert.Nil(t, metarepo.GetMapping("/10.0.0.0_8"))
+	assert.Equal(t, "node3", metarepo.Self("10.0.3.6", "/node/name"))
+}
+
 func NewTestMetarepo() *MetadataRepo {
 	prefix := fmt.Sprintf("/prefix%v", rand.Intn(10000))
 	group := fmt.Sprintf("/group%v", rand.Intn(10000))
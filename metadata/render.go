@@ -0,0 +1,179 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package metadata
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/yunify/metad/util/flatmap"
+)
+
+// KVPair is the key and value of a leaf got by the template functions, same as confd.
+type KVPair struct {
+	Key   string
+	Value string
+}
+
+// Render render the text/template against the client's self metadata, the keys are same as the self api,
+// such as "/host/ip", the template functions are a subset of confd. getenv is not supported,
+// the template is rendered on the server, it should not expose the server's environment to the client.
+func (r *MetadataRepo) Render(clientIP string, text string) (string, error) {
+	val := r.Self(clientIP, "/")
+	var kvs map[string]string
+	if m, ok := val.(map[string]interface{}); ok {
+		kvs = flatmap.Flatten(m)
+	} else {
+		kvs = map[string]string{}
+	}
+	s := templateStore(kvs)
+	tmpl, err := template.New("render").Funcs(s.funcMap()).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, nil); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// templateStore is the flatten metadata for the template functions.
+type templateStore map[string]string
+
+func (s templateStore) funcMap() template.FuncMap {
+	return template.FuncMap{
+		"get":        s.get,
+		"gets":       s.gets,
+		"getv":       s.getv,
+		"getvs":      s.getvs,
+		"exists":     s.exists,
+		"ls":         s.ls,
+		"lsdir":      s.lsdir,
+		"json":       unmarshalJSONObject,
+		"jsonArray":  unmarshalJSONArray,
+		"base":       path.Base,
+		"dir":        path.Dir,
+		"split":      strings.Split,
+		"join":       strings.Join,
+		"toUpper":    strings.ToUpper,
+		"toLower":    strings.ToLower,
+		"contains":   strings.Contains,
+		"replace":    strings.Replace,
+		"trimSuffix": strings.TrimSuffix,
+		"datetime":   time.Now,
+	}
+}
+
+func (s templateStore) get(key string) (KVPair, error) {
+	key = path.Join("/", key)
+	v, ok := s[key]
+	if !ok {
+		return KVPair{}, fmt.Errorf("Key [%s] not found", key)
+	}
+	return KVPair{Key: key, Value: v}, nil
+}
+
+// gets return the leaves match the pattern, the pattern syntax is same as path.Match.
+func (s templateStore) gets(pattern string) ([]KVPair, error) {
+	pattern = path.Join("/", pattern)
+	result := []KVPair{}
+	for k, v := range s {
+		matched, err := path.Match(pattern, k)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			result = append(result, KVPair{Key: k, Value: v})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	return result, nil
+}
+
+func (s templateStore) getv(key string, defaultValue ...string) (string, error) {
+	kv, err := s.get(key)
+	if err != nil {
+		if len(defaultValue) > 0 {
+			return defaultValue[0], nil
+		}
+		return "", err
+	}
+	return kv.Value, nil
+}
+
+func (s templateStore) getvs(pattern string) ([]string, error) {
+	kvs, err := s.gets(pattern)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0, len(kvs))
+	for _, kv := range kvs {
+		result = append(result, kv.Value)
+	}
+	return result, nil
+}
+
+func (s templateStore) exists(key string) bool {
+	_, ok := s[path.Join("/", key)]
+	return ok
+}
+
+// ls return the sorted child names of the dir.
+func (s templateStore) ls(dir string) []string {
+	return s.children(dir, false)
+}
+
+// lsdir return the sorted names of the child dirs of the dir.
+func (s templateStore) lsdir(dir string) []string {
+	return s.children(dir, true)
+}
+
+func (s templateStore) children(dir string, onlyDir bool) []string {
+	prefix := path.Join("/", dir)
+	if prefix != "/" {
+		prefix = prefix + "/"
+	}
+	names := make(map[string]struct{})
+	for k := range s {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		name := strings.TrimPrefix(k, prefix)
+		i := strings.Index(name, "/")
+		if i >= 0 {
+			name = name[:i]
+		} else if onlyDir {
+			continue
+		}
+		names[name] = struct{}{}
+	}
+	result := make([]string, 0, len(names))
+	for name := range names {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func unmarshalJSONObject(data string) (map[string]interface{}, error) {
+	var ret map[string]interface{}
+	err := json.Unmarshal([]byte(data), &ret)
+	return ret, err
+}
+
+func unmarshalJSONArray(data string) ([]interface{}, error) {
+	var ret []interface{}
+	err := json.Unmarshal([]byte(data), &ret)
+	return ret, err
+}
@@ -0,0 +1,99 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package metadata
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yunify/metad/store"
+)
+
+func TestTemplateStore(t *testing.T) {
+	s := templateStore{
+		"/self/host/ip":              "192.168.1.1",
+		"/self/host/name":            "node1",
+		"/self/host/env":             `{"user":"admin"}`,
+		"/clusters/cl-1/hosts/i-1":   "192.168.1.1",
+		"/clusters/cl-1/hosts/i-2":   "192.168.1.2",
+		"/clusters/cl-1/name":        "cl-1",
+		"/clusters/cl-2/hosts/i-3":   "192.168.1.3",
+		"/clusters/cl-2/description": "",
+	}
+
+	v, err := s.getv("/self/host/ip")
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.1", v)
+	_, err = s.getv("/self/host/role")
+	assert.Error(t, err)
+	v, err = s.getv("/self/host/role", "worker")
+	assert.NoError(t, err)
+	assert.Equal(t, "worker", v)
+
+	kvs, err := s.gets("/clusters/cl-1/hosts/*")
+	assert.NoError(t, err)
+	assert.Equal(t, []KVPair{
+		{Key: "/clusters/cl-1/hosts/i-1", Value: "192.168.1.1"},
+		{Key: "/clusters/cl-1/hosts/i-2", Value: "192.168.1.2"},
+	}, kvs)
+	vs, err := s.getvs("/clusters/*/hosts/*")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.168.1.1", "192.168.1.2", "192.168.1.3"}, vs)
+
+	assert.True(t, s.exists("self/host/name"))
+	assert.False(t, s.exists("/self/host"))
+
+	assert.Equal(t, []string{"clusters", "self"}, s.ls("/"))
+	assert.Equal(t, []string{"hosts", "name"}, s.ls("/clusters/cl-1"))
+	assert.Equal(t, []string{"hosts"}, s.lsdir("/clusters/cl-2"))
+	assert.Equal(t, []string{}, s.ls("/clusters/cl-3"))
+}
+
+func TestRender(t *testing.T) {
+	metarepo := NewTestMetarepo()
+
+	metarepo.DeleteMapping("/")
+	metarepo.DeleteData("/")
+
+	FillTestData(metarepo)
+
+	metarepo.StartSync()
+	time.Sleep(sleepTime)
+
+	ip := "192.168.1.0"
+	metarepo.PutAccessRule(map[string][]store.AccessRule{
+		ip: {
+			{Path: "/", Mode: store.AccessModeRead},
+		},
+	})
+	err := metarepo.PutMapping(ip, map[string]interface{}{"node": "/nodes/0", "nodes": "/nodes"}, true)
+	assert.NoError(t, err)
+	time.Sleep(sleepTime)
+
+	text := `name={{getv "/node/name"}}
+{{range lsdir "/nodes"}}{{if eq . "1" "2"}}server {{getv (printf "/nodes/%s/ip" .)}}
+{{end}}{{end}}role={{getv "/node/role" "worker"}}`
+	result, err := metarepo.Render(ip, text)
+	assert.NoError(t, err)
+	assert.Equal(t, "name=node0\nserver 192.168.1.1\nserver 192.168.1.2\nrole=worker", result)
+
+	_, err = metarepo.Render(ip, `{{getv "/node/role"}}`)
+	assert.Error(t, err)
+	_, err = metarepo.Render(ip, `{{getv`)
+	assert.Error(t, err)
+
+	result, err = metarepo.Render(ip, `{{datetime.Format "2006"}}`)
+	assert.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(time.Now().Year()), result)
+	// getenv is not supported, the server's environment is not exposed.
+	_, err = metarepo.Render(ip, `{{getenv "HOME"}}`)
+	assert.Error(t, err)
+
+	metarepo.DeleteData("/")
+	metarepo.DeleteMapping("/")
+	metarepo.StopSync()
+}
@@ -0,0 +1,279 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/yunify/metad/log"
+	"github.com/yunify/metad/store"
+	"github.com/yunify/metad/util/flatmap"
+)
+
+// StreamEvent is a coalesced change set pushed by the stream watch.
+type StreamEvent struct {
+	// Version is the version of the path the event include, client can resume from it.
+	Version int64
+	// Snapshot is true if Value is the full value of the path, otherwise Value is the changes same as Watch.
+	Snapshot bool
+	Value    interface{}
+}
+
+// StreamRoot push the changes of nodePath visible to the client, until ctx done or send return error.
+// A snapshot is pushed first, unless lastVersion is the current version, which means the client is up to date,
+// or the changes after lastVersion can be replayed from the history.
+func (r *MetadataRepo) StreamRoot(ctx context.Context, clientIP string, nodePath string, lastVersion int64, send func(*StreamEvent) error) error {
+	nodePath = path.Join("/", nodePath)
+	mappingPath := path.Join("/", r.mappingHost(clientIP))
+	watch := func() store.Watcher {
+		return store.NewAggregateWatcher(map[string]store.Watcher{
+			"/data":    r.data.Watch(nodePath, DEFAULT_WATCH_BUF_LEN),
+			"/mapping": r.mapping.Watch(mappingPath, DEFAULT_WATCH_BUF_LEN),
+		})
+	}
+	get := func() interface{} {
+		_, val := r.Root(clientIP, nodePath)
+		return val
+	}
+	version := func() int64 {
+		return r.RootVersion(clientIP, nodePath)
+	}
+	since := func(rev int64) ([]*store.Event, error) {
+		if nodePath == "/" && r.mapping.LastRevision(mappingPath) > rev {
+			return nil, ErrMappingChanged
+		}
+		return r.data.EventsSince(nodePath, rev)
+	}
+	accessTree := r.getAccessTree(clientIP)
+	visible := func(p string) bool {
+		return accessTree != nil && store.CanAccess(accessTree, path.Join(nodePath, p))
+	}
+	return r.stream(ctx, lastVersion, send, watch, get, version, since, visible)
+}
+
+// StreamSelf push the changes of the client's self nodePath, same as StreamRoot.
+func (r *MetadataRepo) StreamSelf(ctx context.Context, clientIP string, nodePath string, lastVersion int64, send func(*StreamEvent) error) error {
+	nodePath = path.Join("/", nodePath)
+	watch := func() store.Watcher {
+		mappingPath, mappingData, subPath := r.resolveSelfMapping(clientIP, nodePath)
+		watchers := map[string]store.Watcher{
+			"/mapping": r.mapping.Watch(mappingPath, DEFAULT_WATCH_BUF_LEN),
+		}
+		switch mapping := mappingData.(type) {
+		case map[string]interface{}:
+			for k, v := range flatmap.Flatten(mapping) {
+				watchers[path.Join("/data", k)] = r.data.Watch(v, DEFAULT_WATCH_BUF_LEN)
+			}
+		case string:
+			watchers["/data"] = r.data.Watch(path.Join(mapping, subPath), DEFAULT_WATCH_BUF_LEN)
+		}
+		return store.NewAggregateWatcher(watchers)
+	}
+	get := func() interface{} {
+		return r.Self(clientIP, nodePath)
+	}
+	version := func() int64 {
+		return r.SelfVersion(clientIP, nodePath)
+	}
+	since := func(rev int64) ([]*store.Event, error) {
+		return r.selfEventsSince(clientIP, nodePath, rev)
+	}
+	_, mappingData, subPath := r.resolveSelfMapping(clientIP, nodePath)
+	dataPath := selfDataPath(mappingData, subPath)
+	accessTree := r.getAccessTree(clientIP)
+	visible := func(p string) bool {
+		dp := dataPath(p)
+		return accessTree != nil && dp != "" && store.CanAccess(accessTree, dp)
+	}
+	return r.stream(ctx, lastVersion, send, watch, get, version, since, visible)
+}
+
+// resolveSelfMapping walk the client's mapping along the self nodePath, stop at the mapping leaf,
+// return the mapping path, the mapping, and the sub path of nodePath under the leaf.
+// The mapping path under a leaf should not be watched, otherwise the leaf is converted to dir.
+func (r *MetadataRepo) resolveSelfMapping(clientIP string, nodePath string) (mappingPath string, mapping interface{}, subPath string) {
+	mappingPath = path.Join("/", r.mappingHost(clientIP))
+	mapping = r.GetMapping(mappingPath)
+	paths := strings.Split(strings.Trim(nodePath, "/"), "/")
+	for i, p := range paths {
+		if p == "" {
+			break
+		}
+		m, ok := mapping.(map[string]interface{})
+		if !ok {
+			return mappingPath, mapping, path.Join("/", path.Join(paths[i:]...))
+		}
+		mappingPath = path.Join(mappingPath, p)
+		mapping = m[p]
+	}
+	return mappingPath, mapping, "/"
+}
+
+// stream use the watcher as the trigger, and push the difference between the values got before and after the changes,
+// so the changes invisible to the client are filtered. The watcher is recreated when mapping changed.
+// The version of the path is the event version, so the changes out of the path do not make lastVersion stale.
+// The client resume from lastVersion get the changes replayed by the events since it, or a snapshot if they are compacted.
+func (r *MetadataRepo) stream(ctx context.Context, lastVersion int64, send func(*StreamEvent) error, watch func() store.Watcher, get func() interface{}, getVersion func() int64, since func(int64) ([]*store.Event, error), visible func(string) bool) error {
+	w := watch()
+	defer func() {
+		w.Remove()
+	}()
+
+	// get version first, the value may include newer changes, but not lost change.
+	version := getVersion()
+	val := get()
+	prev := toStreamFlatmap(val)
+	if version != lastVersion {
+		var event *StreamEvent
+		if lastVersion > 0 {
+			var err error
+			if version, prev, event, err = r.replay(lastVersion, get, getVersion, since, visible); err != nil {
+				log.Info("Stream replay changes since %v fail: %s, push snapshot.", lastVersion, err.Error())
+				event = nil
+			}
+		}
+		if event == nil {
+			version = getVersion()
+			val = get()
+			prev = toStreamFlatmap(val)
+			event = &StreamEvent{Version: version, Snapshot: true, Value: val}
+		}
+		if err := send(event); err != nil {
+			return err
+		}
+	}
+	for {
+		mappingChanged, ok := r.waitChanges(w, ctx.Done())
+		if !ok {
+			return ctx.Err()
+		}
+		if mappingChanged {
+			// watch the new mapping before get value, avoid missing the change between them.
+			old := w
+			w = watch()
+			old.Remove()
+		}
+		version = getVersion()
+		curr := toStreamFlatmap(get())
+		changes := diffStreamFlatmap(prev, curr)
+		prev = curr
+		if len(changes) == 0 {
+			continue
+		}
+		value := streamChanges(changes)
+		if log.IsDebugEnable() {
+			log.Debug("Stream changes version: %v, changes: %v", version, changes)
+		}
+		if err := send(&StreamEvent{Version: version, Value: value}); err != nil {
+			return err
+		}
+	}
+}
+
+// replay return the current version and value, and the changes event from the value at lastVersion to it.
+// The value at lastVersion is got by revert the visible events since lastVersion on the current value,
+// they are read at the same store version. Return store.ErrHistoryCompacted if the events have been evicted.
+func (r *MetadataRepo) replay(lastVersion int64, get func() interface{}, getVersion func() int64, since func(int64) ([]*store.Event, error), visible func(string) bool) (int64, map[string]string, *StreamEvent, error) {
+	for i := 0; i < SnapshotRetryTimes; i++ {
+		dataVersion := r.DataVersion()
+		version := getVersion()
+		curr := toStreamFlatmap(get())
+		events, err := since(lastVersion)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		if r.DataVersion() != dataVersion {
+			continue
+		}
+		var visibleEvents []*store.Event
+		for _, e := range events {
+			if visible(e.Path) {
+				visibleEvents = append(visibleEvents, e)
+			}
+		}
+		prev := make(map[string]string, len(curr))
+		for k, v := range curr {
+			prev[k] = v
+		}
+		for _, c := range eventsToChanges(visibleEvents) {
+			if c.Old == nil {
+				delete(prev, c.Path)
+			} else {
+				prev[c.Path] = fmt.Sprintf("%v", c.Old)
+			}
+		}
+		value := streamChanges(diffStreamFlatmap(prev, curr))
+		return version, curr, &StreamEvent{Version: version, Value: value}, nil
+	}
+	return 0, nil, nil, ErrSnapshotConflict
+}
+
+// waitChanges wait the first event, then collect the following events in the coalesce window,
+// return whether the mapping changed, and false if stopped.
+func (r *MetadataRepo) waitChanges(watcher store.Watcher, stopChan <-chan struct{}) (mappingChanged bool, ok bool) {
+	timer := TIMER_NIL
+	defer func() {
+		if timer.C != nil {
+			r.timerPool.ReleaseTimer(timer)
+		}
+	}()
+	for {
+		select {
+		case e, ok := <-watcher.EventChan():
+			if !ok {
+				return mappingChanged, false
+			}
+			if strings.HasPrefix(e.Path, "/mapping") {
+				mappingChanged = true
+			}
+			if timer.C != nil {
+				r.timerPool.ReleaseTimer(timer)
+			}
+			timer = r.timerPool.AcquireTimer()
+		case <-timer.C:
+			return mappingChanged, true
+		case <-stopChan:
+			return mappingChanged, false
+		}
+	}
+}
+
+func toStreamFlatmap(val interface{}) map[string]string {
+	switch t := val.(type) {
+	case map[string]interface{}:
+		return flatmap.Flatten(t)
+	case string:
+		return map[string]string{"/": t}
+	default:
+		return map[string]string{}
+	}
+}
+
+// streamChanges return the changes as the value of the stream event, the value if the path is a leaf node.
+func streamChanges(changes map[string]string) interface{} {
+	if v, ok := changes["/"]; ok && len(changes) == 1 {
+		return v
+	}
+	return flatmap.Expand(changes, "/")
+}
+
+// diffStreamFlatmap return the changes from prev to curr, the value format is same as Watch.
+func diffStreamFlatmap(prev, curr map[string]string) map[string]string {
+	changes := make(map[string]string)
+	for k, v := range prev {
+		if _, ok := curr[k]; !ok {
+			changes[k] = fmt.Sprintf("%s|%s", store.Delete, v)
+		}
+	}
+	for k, v := range curr {
+		if pv, ok := prev[k]; !ok || pv != v {
+			changes[k] = fmt.Sprintf("%s|%s", store.Update, v)
+		}
+	}
+	return changes
+}
@@ -0,0 +1,408 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/yunify/metad/store"
+	"github.com/yunify/metad/util/flatmap"
+)
+
+// WatchFormat is the format of the changes returned by the watch.
+type WatchFormat string
+
+const (
+	// WatchFormatFull is the full new document, the default format of the wait request.
+	WatchFormatFull WatchFormat = "full"
+	// WatchFormatTree is the flatmap expanded tree, the leaves are "ACTION|value", same as Watch.
+	WatchFormatTree WatchFormat = "tree"
+	// WatchFormatChanges is a list of Change.
+	WatchFormatChanges WatchFormat = "changes"
+	// WatchFormatPatch is a RFC 6902 JSON Patch against the previous version.
+	WatchFormatPatch WatchFormat = "patch"
+)
+
+const (
+	ChangeOpAdd     = "add"
+	ChangeOpReplace = "replace"
+	ChangeOpRemove  = "remove"
+)
+
+// ErrMappingChanged is returned by the self watch when the mapping changed,
+// the changes can not be applied to the previous version, the client should resync the full data.
+var ErrMappingChanged = errors.New("Mapping changed, resync")
+
+// Change is the change of a leaf, the path is relative to the watched path.
+type Change struct {
+	Op   string      `json:"op"`
+	Path string      `json:"path"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// PatchOp is a RFC 6902 JSON Patch operation.
+type PatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// MarshalJSON omit the value of the remove op only, the empty value of add and replace is kept.
+func (op PatchOp) MarshalJSON() ([]byte, error) {
+	if op.Op == ChangeOpRemove {
+		return json.Marshal(struct {
+			Op   string `json:"op"`
+			Path string `json:"path"`
+		}{op.Op, op.Path})
+	}
+	type patchOp PatchOp
+	return json.Marshal(patchOp(op))
+}
+
+func ParseWatchFormat(format string) (WatchFormat, error) {
+	switch f := WatchFormat(strings.ToLower(format)); f {
+	case "":
+		return WatchFormatFull, nil
+	case WatchFormatFull, WatchFormatTree, WatchFormatChanges, WatchFormatPatch:
+		return f, nil
+	}
+	return "", fmt.Errorf("Invalid watch_format [%s]", format)
+}
+
+// WatchChanges wait the changes of nodePath visible to the client after prevVersion, same as WatchSince,
+// return the max revision of the changes and the changes in format, the changes of self are not included.
+func (r *MetadataRepo) WatchChanges(ctx context.Context, clientIP string, nodePath string, prevVersion int64, format WatchFormat) (int64, interface{}, error) {
+	nodePath = path.Join("/", nodePath)
+	events, err := r.watchDataEvents(ctx, nodePath, prevVersion)
+	if err != nil {
+		return 0, nil, err
+	}
+	accessTree := r.getAccessTree(clientIP)
+	visible := func(p string) bool {
+		return accessTree != nil && store.CanAccess(accessTree, path.Join(nodePath, p))
+	}
+	get := func() interface{} {
+		_, val := r.Root(clientIP, nodePath)
+		return val
+	}
+	since := func(rev int64) ([]*store.Event, error) {
+		return r.data.EventsSince(nodePath, rev)
+	}
+	return r.formatEvents(events, prevVersion, visible, format, get, since)
+}
+
+// WatchSelfChanges wait the changes of the client's self nodePath after prevVersion, same as WatchChanges,
+// return ErrMappingChanged if the mapping changed.
+func (r *MetadataRepo) WatchSelfChanges(ctx context.Context, clientIP string, nodePath string, prevVersion int64, format WatchFormat) (int64, interface{}, error) {
+	events, dataPath, err := r.watchSelfEvents(ctx, clientIP, nodePath, prevVersion)
+	if err != nil || dataPath == nil {
+		return 0, nil, err
+	}
+	accessTree := r.getAccessTree(clientIP)
+	visible := func(p string) bool {
+		dp := dataPath(p)
+		return accessTree != nil && dp != "" && store.CanAccess(accessTree, dp)
+	}
+	get := func() interface{} {
+		return r.Self(clientIP, nodePath)
+	}
+	since := func(rev int64) ([]*store.Event, error) {
+		return r.selfEventsSince(clientIP, nodePath, rev)
+	}
+	return r.formatEvents(events, prevVersion, visible, format, get, since)
+}
+
+// WatchDataChanges wait the data changes of nodePath after prevVersion without access control, same as WatchChanges.
+func (r *MetadataRepo) WatchDataChanges(ctx context.Context, nodePath string, prevVersion int64, format WatchFormat) (int64, interface{}, error) {
+	events, err := r.watchDataEvents(ctx, nodePath, prevVersion)
+	if err != nil {
+		return 0, nil, err
+	}
+	get := func() interface{} {
+		return r.GetData(nodePath)
+	}
+	since := func(rev int64) ([]*store.Event, error) {
+		return r.data.EventsSince(nodePath, rev)
+	}
+	return r.formatEvents(events, prevVersion, nil, format, get, since)
+}
+
+// selfEventsSince return the events of the client's self nodePath after rev from the history, the path of events
+// is relative to nodePath, same as watchSelfEvents. Return ErrMappingChanged if the mapping changed after rev.
+func (r *MetadataRepo) selfEventsSince(clientIP string, nodePath string, rev int64) ([]*store.Event, error) {
+	nodePath = path.Join("/", nodePath)
+	mappingPath, mappingData, subPath := r.resolveSelfMapping(clientIP, nodePath)
+	if r.mapping.LastRevision(mappingPath) > rev {
+		return nil, ErrMappingChanged
+	}
+	mapping, mok := mappingData.(map[string]interface{})
+	if !mok {
+		return r.data.EventsSince(path.Join(fmt.Sprintf("%s", mappingData), subPath), rev)
+	}
+	var events []*store.Event
+	for k, v := range flatmap.Flatten(mapping) {
+		dataEvents, err := r.data.EventsSince(v, rev)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range dataEvents {
+			event := *e
+			event.Path = path.Join(k, e.Path)
+			events = append(events, &event)
+		}
+	}
+	return events, nil
+}
+
+// SnapshotRetryTimes is the max times to read the value and the events again when the store changed between them.
+var SnapshotRetryTimes = 10
+
+// ErrSnapshotConflict is returned when the store keep changing while reading the value and the events,
+// the client should resync the full data.
+var ErrSnapshotConflict = errors.New("Metadata changed while reading, resync")
+
+// snapshot return the value of the watched path and the events since the revision before the first collected event,
+// they are read at the same store version, so the events and their max revision match the value.
+func (r *MetadataRepo) snapshot(events []*store.Event, prevVersion int64, get func() interface{}, since func(int64) ([]*store.Event, error)) ([]*store.Event, interface{}, error) {
+	if len(events) == 0 {
+		return nil, get(), nil
+	}
+	// the revisions from backend may be not in order, so use the min one.
+	rev := events[0].Rev
+	for _, e := range events {
+		if e.Rev < rev {
+			rev = e.Rev
+		}
+	}
+	rev--
+	if rev < prevVersion {
+		rev = prevVersion
+	}
+	for i := 0; i < SnapshotRetryTimes; i++ {
+		version := r.DataVersion()
+		val := get()
+		events, err := since(rev)
+		if err != nil {
+			return nil, nil, err
+		}
+		if r.DataVersion() == version {
+			return events, val, nil
+		}
+	}
+	return nil, nil, ErrSnapshotConflict
+}
+
+// formatEvents return the max revision of the events and the events visible in format,
+// get return the current value of the watched path, since return the events after the revision from the history,
+// the full and patch format read them again with the value by snapshot.
+func (r *MetadataRepo) formatEvents(events []*store.Event, prevVersion int64, visible func(string) bool, format WatchFormat, get func() interface{}, since func(int64) ([]*store.Event, error)) (int64, interface{}, error) {
+	var val interface{}
+	if format != WatchFormatTree && format != WatchFormatChanges {
+		var err error
+		if events, val, err = r.snapshot(events, prevVersion, get, since); err != nil {
+			return 0, nil, err
+		}
+	}
+	var version int64
+	var visibleEvents []*store.Event
+	for _, e := range events {
+		if e.Rev > version {
+			version = e.Rev
+		}
+		if visible == nil || visible(e.Path) {
+			visibleEvents = append(visibleEvents, e)
+		}
+	}
+	switch format {
+	case WatchFormatTree:
+		return version, eventsToTree(visibleEvents), nil
+	case WatchFormatChanges:
+		return version, eventsToChanges(visibleEvents), nil
+	case WatchFormatPatch:
+		return version, changesToPatch(eventsToChanges(visibleEvents), val), nil
+	default:
+		return version, val, nil
+	}
+}
+
+// eventsToTree return the flatmap expanded tree of the events, the leaves are "ACTION|value" of the last event,
+// return the value if the watched path is a leaf.
+func eventsToTree(events []*store.Event) interface{} {
+	m := make(map[string]string)
+	for _, e := range events {
+		m[e.Path] = fmt.Sprintf("%s|%s", e.Action, e.Value)
+	}
+	if v, ok := m["/"]; ok && len(m) == 1 {
+		return v
+	}
+	return flatmap.Expand(m, "/")
+}
+
+// eventsToChanges coalesce the events of the same path, the old value is the value before the first event,
+// and the new value is the value after the last event, the changes restore the value are dropped.
+func eventsToChanges(events []*store.Event) []Change {
+	changes := make(map[string]*Change)
+	for _, e := range events {
+		c, ok := changes[e.Path]
+		if !ok {
+			c = &Change{Path: e.Path}
+			if e.PrevExist {
+				c.Old = e.PrevValue
+			}
+			changes[e.Path] = c
+		}
+		if e.Action == store.Delete {
+			c.New = nil
+		} else {
+			c.New = e.Value
+		}
+	}
+	result := []Change{}
+	for _, c := range changes {
+		switch {
+		case c.Old == nil && c.New == nil:
+			continue
+		case c.Old == nil:
+			c.Op = ChangeOpAdd
+		case c.New == nil:
+			c.Op = ChangeOpRemove
+		case c.Old == c.New:
+			continue
+		default:
+			c.Op = ChangeOpReplace
+		}
+		result = append(result, *c)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Path < result[j].Path
+	})
+	return result
+}
+
+// changesToPatch revert the changes on the current value to get the previous value,
+// and return the JSON Patch from the previous value to the current value.
+// The changes are of the leaves, so the patch is computed by the documents, to create and remove the dirs.
+func changesToPatch(changes []Change, value interface{}) []PatchOp {
+	prev := copyValue(value)
+	// remove the created first, the leaf may be converted from a dir.
+	for _, c := range changes {
+		if c.Old == nil {
+			prev = removePathValue(prev, splitPath(c.Path))
+		}
+	}
+	for _, c := range changes {
+		if c.Old != nil {
+			prev = setPathValue(prev, splitPath(c.Path), c.Old)
+		}
+	}
+	return diffPatch("", prev, value, []PatchOp{})
+}
+
+func diffPatch(pointer string, prev, curr interface{}, ops []PatchOp) []PatchOp {
+	prevMap, prevIsMap := prev.(map[string]interface{})
+	currMap, currIsMap := curr.(map[string]interface{})
+	switch {
+	case prev == nil && curr == nil:
+	case prev == nil:
+		ops = append(ops, PatchOp{Op: ChangeOpAdd, Path: pointer, Value: curr})
+	case curr == nil:
+		ops = append(ops, PatchOp{Op: ChangeOpRemove, Path: pointer})
+	case prevIsMap && currIsMap:
+		var keys []string
+		for k := range prevMap {
+			keys = append(keys, k)
+		}
+		for k := range currMap {
+			if _, ok := prevMap[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			ops = diffPatch(pointer+"/"+pointerEscaper.Replace(k), prevMap[k], currMap[k], ops)
+		}
+	case prevIsMap || currIsMap || prev != curr:
+		ops = append(ops, PatchOp{Op: ChangeOpReplace, Path: pointer, Value: curr})
+	}
+	return ops
+}
+
+// pointerEscaper escape the key to the JSON Pointer reference token.
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+func copyValue(val interface{}) interface{} {
+	m, ok := val.(map[string]interface{})
+	if !ok {
+		return val
+	}
+	result := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		result[k] = copyValue(v)
+	}
+	return result
+}
+
+// getPathValue return the value of the path, nil if not exist.
+func getPathValue(val interface{}, components []string) interface{} {
+	for _, c := range components {
+		m, ok := val.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		val = m[c]
+	}
+	return val
+}
+
+// setPathValue return val with the value of the path set, the dirs are created if not exist.
+func setPathValue(val interface{}, components []string, value interface{}) interface{} {
+	if len(components) == 0 {
+		return value
+	}
+	m, ok := val.(map[string]interface{})
+	if !ok {
+		m = make(map[string]interface{})
+	}
+	m[components[0]] = setPathValue(m[components[0]], components[1:], value)
+	return m
+}
+
+// removePathValue return val with the value of the path removed, the empty dirs are removed too, same as store,
+// so return nil if val become empty.
+func removePathValue(val interface{}, components []string) interface{} {
+	if len(components) == 0 {
+		return nil
+	}
+	m, ok := val.(map[string]interface{})
+	if !ok {
+		return val
+	}
+	if v, ok := m[components[0]]; ok {
+		if v = removePathValue(v, components[1:]); v == nil {
+			delete(m, components[0])
+		} else {
+			m[components[0]] = v
+		}
+	}
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
@@ -0,0 +1,94 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package metadata
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yunify/metad/store"
+)
+
+func TestParseWatchFormat(t *testing.T) {
+	format, err := ParseWatchFormat("")
+	assert.NoError(t, err)
+	assert.Equal(t, WatchFormatFull, format)
+	format, err = ParseWatchFormat("Patch")
+	assert.NoError(t, err)
+	assert.Equal(t, WatchFormatPatch, format)
+	_, err = ParseWatchFormat("diff")
+	assert.Error(t, err)
+}
+
+func TestEventsToChanges(t *testing.T) {
+	events := []*store.Event{
+		{Action: store.Update, Path: "/name", Value: "n1", PrevValue: "n0", PrevExist: true},
+		{Action: store.Update, Path: "/name", Value: "n2", PrevValue: "n1", PrevExist: true},
+		{Action: store.Update, Path: "/tmp", Value: "t1"},
+		{Action: store.Delete, Path: "/tmp", Value: "t1", PrevValue: "t1", PrevExist: true},
+		{Action: store.Update, Path: "/ip", Value: "ip1", PrevValue: "ip0", PrevExist: true},
+		{Action: store.Update, Path: "/ip", Value: "ip0", PrevValue: "ip1", PrevExist: true},
+		{Action: store.Delete, Path: "/label", Value: "", PrevValue: "", PrevExist: true},
+		{Action: store.Update, Path: "/desc", Value: "d1", PrevValue: "", PrevExist: true},
+		{Action: store.Update, Path: "/zone", Value: "z1"},
+	}
+	// the created then deleted and the restored are dropped, the update of the empty leaf is a replace.
+	assert.Equal(t, []Change{
+		{Op: ChangeOpReplace, Path: "/desc", Old: "", New: "d1"},
+		{Op: ChangeOpRemove, Path: "/label", Old: ""},
+		{Op: ChangeOpReplace, Path: "/name", Old: "n0", New: "n2"},
+		{Op: ChangeOpAdd, Path: "/zone", New: "z1"},
+	}, eventsToChanges(events))
+	assert.Equal(t, map[string]interface{}{
+		"name":  "UPDATE|n2",
+		"tmp":   "DELETE|t1",
+		"ip":    "UPDATE|ip0",
+		"label": "DELETE|",
+		"desc":  "UPDATE|d1",
+		"zone":  "UPDATE|z1",
+	}, eventsToTree(events))
+}
+
+func TestChangesToPatch(t *testing.T) {
+	// the leaf /label convert to dir, and the dir /env is removed.
+	changes := []Change{
+		{Op: ChangeOpRemove, Path: "/env/a", Old: "1"},
+		{Op: ChangeOpRemove, Path: "/env/b/c", Old: "2"},
+		{Op: ChangeOpRemove, Path: "/label", Old: "l1"},
+		{Op: ChangeOpAdd, Path: "/label/k~/1", New: "v1"},
+		{Op: ChangeOpReplace, Path: "/name", Old: "n1", New: "n2"},
+	}
+	value := map[string]interface{}{
+		"ip":    "192.168.1.1",
+		"label": map[string]interface{}{"k~": map[string]interface{}{"1": "v1"}},
+		"name":  "n2",
+	}
+	assert.Equal(t, []PatchOp{
+		{Op: ChangeOpRemove, Path: "/env"},
+		{Op: ChangeOpReplace, Path: "/label", Value: map[string]interface{}{"k~": map[string]interface{}{"1": "v1"}}},
+		{Op: ChangeOpReplace, Path: "/name", Value: "n2"},
+	}, changesToPatch(changes, value))
+	// the value is not modified.
+	assert.Equal(t, "n2", value["name"])
+
+	// the watched path is a leaf.
+	assert.Equal(t, []PatchOp{
+		{Op: ChangeOpReplace, Path: "", Value: "n2"},
+	}, changesToPatch([]Change{{Op: ChangeOpReplace, Path: "/", Old: "n1", New: "n2"}}, "n2"))
+	assert.Equal(t, []PatchOp{
+		{Op: ChangeOpAdd, Path: "/dir", Value: map[string]interface{}{"k": "v"}},
+	}, changesToPatch([]Change{{Op: ChangeOpAdd, Path: "/dir/k", New: "v"}}, map[string]interface{}{"dir": map[string]interface{}{"k": "v"}, "other": "o"}))
+}
+
+func TestPatchOpJSON(t *testing.T) {
+	b, err := json.Marshal([]PatchOp{
+		{Op: ChangeOpAdd, Path: "/label", Value: ""},
+		{Op: ChangeOpRemove, Path: "/name"},
+	})
+	assert.NoError(t, err)
+	// the empty value of add is kept, the remove has no value.
+	assert.Equal(t, `[{"op":"add","path":"/label","value":""},{"op":"remove","path":"/name"}]`, string(b))
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gorilla/mux"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// NoCloudMappingKey is the key of the client's self mapping, which map to the dir of the client's cloud-init
+// documents under CloudInitPath, such as {"cloud-init": "/_cloudinit/web"}.
+const NoCloudMappingKey = "cloud-init"
+
+// NoCloudBase64Suffix is the suffix of the user-data and vendor-data key whose value is base64 encoded,
+// such as "user-data.b64", for the binary document like the gzip compressed user-data.
+const NoCloudBase64Suffix = ".b64"
+
+// ContentTypeBinary is the content type of the binary document decoded from base64.
+const ContentTypeBinary = "application/octet-stream"
+
+// noCloudDocuments is the cloud-init documents served by /_metad/nocloud.
+var noCloudDocuments = map[string]bool{
+	"meta-data":      true,
+	"user-data":      true,
+	"vendor-data":    true,
+	"network-config": true,
+}
+
+// userDataContentTypes is the content types of the user-data, detected by the first line same as cloud-init.
+var userDataContentTypes = []struct {
+	prefix      string
+	contentType string
+}{
+	{"#cloud-config", "text/cloud-config"},
+	{"#cloud-boothook", "text/cloud-boothook"},
+	{"#include", "text/x-include-url"},
+	{"#part-handler", "text/part-handler"},
+	{"## template: jinja", "text/jinja2"},
+	{"#!", "text/x-shellscript"},
+}
+
+// selfNoCloud serve the client's cloud-init document as the NoCloud datasource, the seedfrom url is /_metad/nocloud/.
+// The document is the raw string, the dir is encoded as yaml, for user-data and vendor-data, it is a cloud-config.
+// The user-data and vendor-data not exist are read from the base64 encoded key, and served as binary.
+func (m *Metad) selfNoCloud(ctx context.Context, req *http.Request) (string, *HttpError) {
+	document := mux.Vars(req)["document"]
+	if !noCloudDocuments[document] {
+		return "", NewHttpError(http.StatusNotFound, "Not found")
+	}
+	clientIP := m.requestClient(ctx, req)
+	// only the dir under CloudInitPath can be mapped, so the other self metadata is not served as the documents.
+	dir := m.metadataRepo.SelfDataPath(clientIP, NoCloudMappingKey)
+	if dir == "" || !strings.HasPrefix(dir+"/", strings.TrimSuffix(path.Join("/", m.config.CloudInitPath), "/")+"/") {
+		return "", NewHttpError(http.StatusNotFound, "Not found")
+	}
+	var result string
+	var contentType string
+	// read through self, so the access rules of the client are applied.
+	v := m.metadataRepo.Self(clientIP, path.Join(NoCloudMappingKey, document))
+	if v == nil && (document == "user-data" || document == "vendor-data") {
+		if encoded, ok := m.metadataRepo.Self(clientIP, path.Join(NoCloudMappingKey, document+NoCloudBase64Suffix)).(string); ok {
+			// the line breaks of the encoded value are ignored.
+			b, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(encoded), ""))
+			if err != nil {
+				return "", NewServerError(fmt.Errorf("Invalid base64 %s%s: %s", document, NoCloudBase64Suffix, err.Error()))
+			}
+			if header, ok := ctx.Value("header").(http.Header); ok {
+				header.Set("Content-Type", ContentTypeBinary)
+			}
+			return string(b), nil
+		}
+	}
+	switch v := v.(type) {
+	case string:
+		result = v
+		contentType = noCloudContentType(document, v)
+	case map[string]interface{}:
+		b, err := yaml.Marshal(v)
+		if err != nil {
+			return "", NewServerError(err)
+		}
+		if document == "user-data" || document == "vendor-data" {
+			result = "#cloud-config\n" + string(b)
+			contentType = "text/cloud-config"
+		} else {
+			result = string(b)
+			contentType = ContentTypeYAML
+		}
+	default:
+		return "", NewHttpError(http.StatusNotFound, "Not found")
+	}
+	if header, ok := ctx.Value("header").(http.Header); ok {
+		header.Set("Content-Type", contentType)
+	}
+	return result, nil
+}
+
+func noCloudContentType(document string, value string) string {
+	if document != "user-data" && document != "vendor-data" {
+		return ContentTypeYAML
+	}
+	// the multipart document start with the MIME headers, use its Content-Type with the boundary.
+	if headers := strings.SplitN(strings.Replace(value, "\r\n", "\n", -1), "\n\n", 2); len(headers) == 2 {
+		for _, line := range strings.Split(headers[0], "\n") {
+			name, contentType := headerLine(line)
+			if strings.EqualFold(name, "Content-Type") && strings.HasPrefix(strings.ToLower(contentType), "multipart/") {
+				return contentType
+			}
+		}
+	}
+	for _, t := range userDataContentTypes {
+		if strings.HasPrefix(value, t.prefix) {
+			return t.contentType
+		}
+	}
+	return ContentTypeText
+}
+
+func headerLine(line string) (string, string) {
+	i := strings.Index(line, ":")
+	if i < 0 {
+		return "", ""
+	}
+	return strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// OpenStackConfig is the config of the OpenStack metadata service compatible api, which serve the client's self
+// metadata as /openstack/latest/meta_data.json and network_data.json.
+type OpenStackConfig struct {
+	// MetaData map the meta_data.json path to the self path, such as "uuid: /host/instance_id",
+	// the whole self is served if it is empty.
+	MetaData map[string]string `yaml:"meta_data,omitempty"`
+	// NetworkData map the network_data.json path to the self path, such as "links/0/id: /host/nic",
+	// network_data.json is not served if it is empty.
+	NetworkData map[string]string `yaml:"network_data,omitempty"`
+	// UserData is the self path of the user_data, default is /user-data.
+	UserData string `yaml:"user_data,omitempty"`
+}
+
+func (m *Metad) initOpenStackRouter() {
+	m.imdsRouter.HandleFunc("/openstack", m.imdsWrapper(m.openStackVersions, nil)).Methods("GET")
+	m.imdsRouter.HandleFunc("/openstack/", m.imdsWrapper(m.openStackVersions, nil)).Methods("GET")
+	m.imdsRouter.HandleFunc("/openstack/latest", m.imdsWrapper(m.openStackLatest, nil)).Methods("GET")
+	m.imdsRouter.HandleFunc("/openstack/latest/", m.imdsWrapper(m.openStackLatest, nil)).Methods("GET")
+	m.imdsRouter.HandleFunc("/openstack/latest/meta_data.json", m.imdsWrapper(m.openStackMetaData, nil)).Methods("GET")
+	m.imdsRouter.HandleFunc("/openstack/latest/network_data.json", m.imdsWrapper(m.openStackNetworkData, nil)).Methods("GET")
+	m.imdsRouter.HandleFunc("/openstack/latest/user_data", m.imdsWrapper(m.openStackUserData, nil)).Methods("GET")
+}
+
+func (m *Metad) openStackVersions(ctx context.Context, req *http.Request) (string, *HttpError) {
+	return "latest", nil
+}
+
+func (m *Metad) openStackLatest(ctx context.Context, req *http.Request) (string, *HttpError) {
+	names := []string{"meta_data.json"}
+	if len(m.config.OpenStack.NetworkData) > 0 {
+		names = append(names, "network_data.json")
+	}
+	if _, ok := m.metadataRepo.Self(m.requestClient(ctx, req), m.openStackUserDataPath()).(string); ok {
+		names = append(names, "user_data")
+	}
+	return strings.Join(names, "\n"), nil
+}
+
+func (m *Metad) openStackMetaData(ctx context.Context, req *http.Request) (string, *HttpError) {
+	return respondOpenStackJSON(ctx, m.metadataRepo.SelfMapped(m.requestClient(ctx, req), m.config.OpenStack.MetaData))
+}
+
+func (m *Metad) openStackNetworkData(ctx context.Context, req *http.Request) (string, *HttpError) {
+	if len(m.config.OpenStack.NetworkData) == 0 {
+		return "", NewHttpError(http.StatusNotFound, "Not found")
+	}
+	return respondOpenStackJSON(ctx, m.metadataRepo.SelfMapped(m.requestClient(ctx, req), m.config.OpenStack.NetworkData))
+}
+
+func (m *Metad) openStackUserData(ctx context.Context, req *http.Request) (string, *HttpError) {
+	userData, ok := m.metadataRepo.Self(m.requestClient(ctx, req), m.openStackUserDataPath()).(string)
+	if !ok {
+		return "", NewHttpError(http.StatusNotFound, "Not found")
+	}
+	return userData, nil
+}
+
+func (m *Metad) openStackUserDataPath() string {
+	if m.config.OpenStack.UserData == "" {
+		return DefaultIMDSUserData
+	}
+	return m.config.OpenStack.UserData
+}
+
+// respondOpenStackJSON return the json of the dir, the dirs with the index keys are converted to the arrays,
+// such as the links of network_data.json.
+func respondOpenStackJSON(ctx context.Context, val interface{}) (string, *HttpError) {
+	dir, ok := val.(map[string]interface{})
+	if !ok {
+		return "", NewHttpError(http.StatusNotFound, "Not found")
+	}
+	b, err := json.Marshal(jsonValue(dir, false))
+	if err != nil {
+		return "", NewServerError(err)
+	}
+	if header, ok := ctx.Value("header").(http.Header); ok {
+		header.Set("Content-Type", ContentTypeJSON)
+	}
+	return string(b), nil
+}
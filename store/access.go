@@ -113,10 +113,15 @@ func (s *accessStore) Delete(host string) {
 	s.lock.Unlock()
 }
 
+// Get return the access tree of the host, or of the longest prefix CIDR block contains the host,
+// or of the WildcardHost, see MatchHost.
 func (s *accessStore) Get(host string) AccessTree {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
-	return s.m[host]
+	return s.m[MatchHost(host, func(h string) bool {
+		_, ok := s.m[h]
+		return ok
+	})]
 }
 
 func (s *accessStore) Put(host string, rules []AccessRule) {
@@ -155,6 +160,33 @@ func (s *accessStore) GetAccessRule(hosts []string) map[string][]AccessRule {
 	return result
 }
 
+// CanAccess check whether the node of nodePath can be accessed by the access tree,
+// same as the traveller enter it, so it can be checked after the node deleted.
+func CanAccess(tree AccessTree, nodePath string) bool {
+	an := tree.GetRoot()
+	mode := an.Mode
+	for _, component := range strings.Split(nodePath, "/") {
+		if component == "" {
+			continue
+		}
+		if an != nil {
+			an = an.GetChild(component, false)
+		}
+		if an != nil {
+			// if an HasChild, means exist other rule for future access
+			if !an.HasChild() && an.Mode < AccessModeRead {
+				return false
+			}
+			if an.Mode != AccessModeNil {
+				mode = an.Mode
+			}
+		} else if mode < AccessModeRead {
+			return false
+		}
+	}
+	return true
+}
+
 type AccessTree interface {
 	GetRoot() *accessNode
 	ToAccessRule() []AccessRule
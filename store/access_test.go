@@ -41,6 +41,27 @@ func TestAccessStore(t *testing.T) {
 	assert.Equal(t, 1, len(rulesGet3))
 }
 
+func TestAccessStoreCIDR(t *testing.T) {
+	accessStore := NewAccessStore()
+	subnetRules := []AccessRule{{Path: "/clusters/cl-1", Mode: AccessModeRead}}
+	defaultRules := []AccessRule{{Path: "/", Mode: AccessModeForbidden}}
+	accessStore.Puts(map[string][]AccessRule{
+		"10.0.3.0_24": subnetRules,
+		WildcardHost:  defaultRules,
+	})
+
+	assert.Equal(t, subnetRules, accessStore.Get("10.0.3.5").ToAccessRule())
+	assert.Equal(t, defaultRules, accessStore.Get("10.0.4.5").ToAccessRule())
+
+	// the exact host is matched first.
+	ipRules := []AccessRule{{Path: "/", Mode: AccessModeRead}}
+	accessStore.Put("10.0.3.5", ipRules)
+	assert.Equal(t, ipRules, accessStore.Get("10.0.3.5").ToAccessRule())
+
+	accessStore.Delete(WildcardHost)
+	assert.Nil(t, accessStore.Get("10.0.4.5"))
+}
+
 func TestAccessTree(t *testing.T) {
 	rules := []AccessRule{
 		{Path: "/", Mode: AccessModeForbidden},
@@ -61,3 +82,19 @@ func TestAccessTree(t *testing.T) {
 	assert.Equal(t, AccessModeRead, root.GetChild("clusters", true).
 		GetChild("cl-1", false).GetChild("env", true).GetChild("secret", true).Mode)
 }
+
+func TestCanAccess(t *testing.T) {
+	rules := []AccessRule{
+		{Path: "/", Mode: AccessModeForbidden},
+		{Path: "/clusters", Mode: AccessModeRead},
+		{Path: "/clusters/*/env", Mode: AccessModeForbidden},
+		{Path: "/clusters/cl-1/env/secret", Mode: AccessModeRead},
+	}
+	tree := NewAccessTree(rules)
+	assert.True(t, CanAccess(tree, "/"))
+	assert.False(t, CanAccess(tree, "/nodes/1"))
+	assert.True(t, CanAccess(tree, "/clusters/cl-2/name"))
+	assert.False(t, CanAccess(tree, "/clusters/cl-2/env/secret"))
+	assert.True(t, CanAccess(tree, "/clusters/cl-1/env/secret"))
+	assert.False(t, CanAccess(tree, "/clusters/cl-2/env/username"))
+}
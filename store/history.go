@@ -0,0 +1,108 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package store
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	// ErrHistoryCompacted is returned when the events after the version have been evicted from the history,
+	// the client should resync the full data.
+	ErrHistoryCompacted = errors.New("History compacted, resync")
+
+	// EventHistorySize is the max count of events kept in the history of a store.
+	EventHistorySize = 10000
+)
+
+// eventHistory is a ring buffer of the recent events, the path of event is absolute.
+// Every event has a continuous index, so the watcher can replay the events it missed.
+// It is protected by the worldLock of store.
+type eventHistory struct {
+	events []*Event
+	// start is the position of the oldest event.
+	start int
+	count int
+	// lastIndex is the index of the newest event.
+	lastIndex int64
+	// compactedRev is the max revision of the evicted events.
+	compactedRev int64
+}
+
+func newEventHistory(size int) *eventHistory {
+	if size < 1 {
+		size = 1
+	}
+	return &eventHistory{events: make([]*Event, size)}
+}
+
+func (h *eventHistory) add(e *Event) {
+	h.lastIndex++
+	e.index = h.lastIndex
+	if h.count == len(h.events) {
+		if rev := h.events[h.start].Rev; rev > h.compactedRev {
+			h.compactedRev = rev
+		}
+		h.events[h.start] = e
+		h.start = (h.start + 1) % len(h.events)
+	} else {
+		h.events[(h.start+h.count)%len(h.events)] = e
+		h.count++
+	}
+}
+
+func (h *eventHistory) at(i int) *Event {
+	return h.events[(h.start+i)%len(h.events)]
+}
+
+// sinceIndex return the events under nodePath after the index, the path of events is relative to nodePath.
+func (h *eventHistory) sinceIndex(nodePath string, index int64) ([]*Event, error) {
+	firstIndex := h.lastIndex - int64(h.count) + 1
+	if index < firstIndex-1 {
+		return nil, ErrHistoryCompacted
+	}
+	var events []*Event
+	for i := int(index - firstIndex + 1); i < h.count; i++ {
+		if e := relativeEvent(h.at(i), nodePath); e != nil {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+// sinceRevision return the events under nodePath modified after the revision, the path of events is relative to nodePath.
+// The revisions from backend may be not in order, so scan all the events.
+func (h *eventHistory) sinceRevision(nodePath string, rev int64) ([]*Event, error) {
+	if rev < h.compactedRev {
+		return nil, ErrHistoryCompacted
+	}
+	var events []*Event
+	for i := 0; i < h.count; i++ {
+		e := h.at(i)
+		if e.Rev <= rev {
+			continue
+		}
+		if e = relativeEvent(e, nodePath); e != nil {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+// relativeEvent return a copy of the event with the path relative to nodePath, nil if the event is not under nodePath.
+func relativeEvent(e *Event, nodePath string) *Event {
+	if !isSubPath(e.Path, nodePath) {
+		return nil
+	}
+	relativePath := "/"
+	if e.Path != nodePath {
+		relativePath = e.Path
+		if nodePath != "/" {
+			relativePath = strings.TrimPrefix(e.Path, nodePath)
+		}
+	}
+	return e.withPath(relativePath)
+}
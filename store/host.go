@@ -0,0 +1,81 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package store
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// WildcardHost is the host key of the mapping and access rule for the clients without a more specific key.
+const WildcardHost = "*"
+
+// CIDRHost return the host key of the CIDR block, the "/" is replaced by "_" as it is the path separator,
+// such as "10.0.3.0_24".
+func CIDRHost(ipNet *net.IPNet) string {
+	ones, _ := ipNet.Mask.Size()
+	return fmt.Sprintf("%s_%d", ipNet.IP.String(), ones)
+}
+
+// ParseCIDRHost parse the CIDR block of the host key, return nil if the key is not a CIDR block,
+// or the ip of the key is not the network address of the block.
+func ParseCIDRHost(host string) *net.IPNet {
+	i := strings.LastIndex(host, "_")
+	if i < 0 {
+		return nil
+	}
+	_, ipNet, err := net.ParseCIDR(host[:i] + "/" + host[i+1:])
+	if err != nil || CIDRHost(ipNet) != host {
+		return nil
+	}
+	return ipNet
+}
+
+// NormalizeHost convert the CIDR block in the "/" form, such as "10.0.3.0/24", to the host key "10.0.3.0_24",
+// the other keys are returned as is.
+func NormalizeHost(key string) string {
+	if !strings.Contains(key, "/") {
+		return key
+	}
+	ip, ipNet, err := net.ParseCIDR(key)
+	if err != nil || !ip.Equal(ipNet.IP) {
+		return key
+	}
+	return CIDRHost(ipNet)
+}
+
+// IsHost check the key is the client ip, the CIDR block, the WildcardHost, or the identity "{resolver}:{name}".
+func IsHost(key string) bool {
+	if key == WildcardHost || net.ParseIP(key) != nil || ParseCIDRHost(key) != nil {
+		return true
+	}
+	i := strings.Index(key, ":")
+	return i > 0 && i < len(key)-1 && !strings.Contains(key, "/")
+}
+
+// MatchHost return the host key of the client, the client itself if exists, then the longest prefix CIDR block
+// contains the client ip, then the WildcardHost, and return the client itself if none of them exists.
+func MatchHost(client string, exists func(host string) bool) string {
+	if exists(client) {
+		return client
+	}
+	if ip := net.ParseIP(client); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		for ones := bits; ones >= 0; ones-- {
+			mask := net.CIDRMask(ones, bits)
+			if host := CIDRHost(&net.IPNet{IP: ip.Mask(mask), Mask: mask}); exists(host) {
+				return host
+			}
+		}
+	}
+	if exists(WildcardHost) {
+		return WildcardHost
+	}
+	return client
+}
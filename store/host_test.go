@@ -0,0 +1,64 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsHost(t *testing.T) {
+	assert.True(t, IsHost("192.168.1.1"))
+	assert.True(t, IsHost("fd00::1"))
+	assert.True(t, IsHost("10.0.3.0_24"))
+	assert.True(t, IsHost("fd00::_64"))
+	assert.True(t, IsHost(WildcardHost))
+	assert.True(t, IsHost("cert:web-1"))
+
+	// the ip of the CIDR block should be the network address.
+	assert.False(t, IsHost("10.0.3.1_24"))
+	assert.False(t, IsHost("10.0.3.0_33"))
+	assert.False(t, IsHost("10.0.3.0/24"))
+	assert.False(t, IsHost("fd00::/64"))
+	assert.True(t, IsHost(NormalizeHost("10.0.3.0/24")))
+	assert.True(t, IsHost(NormalizeHost("fd00::/64")))
+	assert.False(t, IsHost("web-1"))
+	assert.False(t, IsHost("cert:"))
+}
+
+func TestNormalizeHost(t *testing.T) {
+	assert.Equal(t, "10.0.3.0_24", NormalizeHost("10.0.3.0/24"))
+	assert.Equal(t, "fd00::_64", NormalizeHost("fd00::/64"))
+	assert.Equal(t, "10.0.3.0_24", NormalizeHost("10.0.3.0_24"))
+	assert.Equal(t, "192.168.1.1", NormalizeHost("192.168.1.1"))
+	// the ip of the key is not the network address.
+	assert.Equal(t, "10.0.3.1/24", NormalizeHost("10.0.3.1/24"))
+	assert.Equal(t, "cert:web/1", NormalizeHost("cert:web/1"))
+}
+
+func TestMatchHost(t *testing.T) {
+	hosts := map[string]bool{}
+	exists := func(host string) bool {
+		return hosts[host]
+	}
+	assert.Equal(t, "10.0.3.1", MatchHost("10.0.3.1", exists))
+
+	hosts[WildcardHost] = true
+	assert.Equal(t, WildcardHost, MatchHost("10.0.3.1", exists))
+	assert.Equal(t, WildcardHost, MatchHost("cert:web-1", exists))
+
+	hosts["10.0.0.0_8"] = true
+	hosts["10.0.3.0_24"] = true
+	assert.Equal(t, "10.0.3.0_24", MatchHost("10.0.3.1", exists))
+	assert.Equal(t, "10.0.0.0_8", MatchHost("10.0.4.1", exists))
+	assert.Equal(t, WildcardHost, MatchHost("192.168.1.1", exists))
+
+	hosts["10.0.3.1"] = true
+	assert.Equal(t, "10.0.3.1", MatchHost("10.0.3.1", exists))
+
+	hosts["fd00::_64"] = true
+	assert.Equal(t, "fd00::_64", MatchHost("fd00::1", exists))
+}
@@ -24,6 +24,11 @@ type node struct {
 
 	store *store // A reference to the store this node is attached to.
 
+	// the revision when the node created and last modified,
+	// the modified revision of dir is the max modified revision of the nodes in it, include the deleted.
+	createdRev  int64
+	modifiedRev int64
+
 	watcherLock sync.RWMutex
 }
 
@@ -38,10 +43,12 @@ func newKV(store *store, nodeName string, value string, parent *node) *node {
 		Children:    nil,
 		Value:       value,
 		store:       store,
+		createdRev:  store.createdRev,
 		watcherLock: sync.RWMutex{},
 	}
 	parent.Add(n)
-	n.Notify(Update)
+	n.touch()
+	n.Notify(Update, "", false)
 	return n
 }
 
@@ -56,6 +63,8 @@ func newDir(store *store, nodeName string, parent *node) *node {
 		Children: make(map[string]*node),
 		store:    store,
 	}
+	n.createdRev = store.createdRev
+	n.modifiedRev = store.modifiedRev
 	if parent != nil {
 		parent.Add(n)
 	}
@@ -89,11 +98,15 @@ func (n *node) IsDir() bool {
 
 // AsDir convert node to dir
 func (n *node) AsDir() {
+	n.asDir(n.Value)
+}
+
+func (n *node) asDir(prevValue string) {
 	if !n.IsDir() {
 		n.Children = make(map[string]*node)
 	}
 	// treat convert leaf to dir as a delete.
-	n.Notify(Delete)
+	n.Notify(Delete, prevValue, true)
 }
 
 func (n *node) AsLeaf() {
@@ -101,7 +114,7 @@ func (n *node) AsLeaf() {
 		n.Children = nil
 	}
 	// treat convert dir to leaf as a update.
-	n.Notify(Update)
+	n.Notify(Update, "", false)
 }
 
 // Read function gets the value of the node.
@@ -120,15 +133,39 @@ func (n *node) Write(value string) {
 	if n.IsDir() {
 		// if dir is empty, and set a text value ,so convert to leaf
 		if n.ChildrenCount() == 0 {
+			n.touch()
 			n.AsLeaf()
 		}
 	} else {
 		if oldValue != value {
-			n.Notify(Update)
+			n.touch()
+			n.Notify(Update, oldValue, true)
+		} else if n.store.forceRev {
+			// the backend revision changed, even the value not.
+			n.touch()
+		}
+	}
+}
+
+// touch set the node's modified revision to the store's current change revision, and pop up to the parents.
+func (n *node) touch() {
+	rev := n.store.modifiedRev
+	if rev == 0 {
+		return
+	}
+	n.modifiedRev = rev
+	for p := n.parent; p != nil; p = p.parent {
+		if p.modifiedRev < rev {
+			p.modifiedRev = rev
 		}
 	}
 }
 
+// Revision return the created and modified revision of the node.
+func (n *node) Revision() (createdRev, modifiedRev int64) {
+	return n.createdRev, n.modifiedRev
+}
+
 // List function return a slice of nodes under the receiver node.
 func (n *node) List() []*node {
 
@@ -184,14 +221,17 @@ func (n *node) Remove() bool {
 	if !n.IsDir() {
 		// do not remove node has watcher
 		if n.HasWatcher() {
+			prevValue := n.Value
 			n.Value = ""
-			n.AsDir()
+			n.touch()
+			n.asDir(prevValue)
 			return true
 		}
 		if n.parent != nil && n.parent.Children[n.Name] == n {
+			n.touch()
 			delete(n.parent.Children, n.Name)
 			// only leaf node trigger delete event.
-			n.Notify(Delete)
+			n.Notify(Delete, n.Value, true)
 			n.parent.Clean()
 			return true
 		}
@@ -252,33 +292,32 @@ func (n *node) GetValue() interface{} {
 	}
 }
 
-func (n *node) internalNotify(action string, eventNode *node) {
+func (n *node) internalNotify(action string, eventNode *node, historyEvent *Event) {
 
 	if n.HasWatcher() {
-		event := newEvent(action, eventNode.RelativePath(n), eventNode.Value)
+		event := historyEvent.withPath(eventNode.RelativePath(n))
 		n.watcherLock.RLock()
 		for e := n.watchers.Front(); e != nil; e = e.Next() {
-			w := e.Value.(Watcher)
-			select {
-			case w.EventChan() <- event:
-				break
-			default:
-				//avoid block, just drop
-				//TODO use a more grace method.
-				println("drop event:", event.Path, event.Action, event.Value)
-			}
+			// the watcher replay the events from history when its channel is full, not block.
+			e.Value.(*watcher).notify(event)
 		}
 		n.watcherLock.RUnlock()
 	}
 
 	// pop up event.
 	if n.parent != nil {
-		n.parent.internalNotify(action, eventNode)
+		n.parent.internalNotify(action, eventNode, historyEvent)
 	}
 }
 
-func (n *node) Notify(action string) {
-	n.internalNotify(action, n)
+// Notify record the change of the node to history, and send it to the watchers of the node and its parents,
+// prevValue is the value before the change, prevExist is false if the leaf is created.
+func (n *node) Notify(action string, prevValue string, prevExist bool) {
+	historyEvent := newEvent(action, n.Path(), n.Value, n.modifiedRev, n.store.changeVersion())
+	historyEvent.PrevValue = prevValue
+	historyEvent.PrevExist = prevExist
+	n.store.history.add(historyEvent)
+	n.internalNotify(action, n, historyEvent)
 }
 
 func (n *node) Watch(bufLen int) Watcher {
@@ -289,6 +328,8 @@ func (n *node) Watch(bufLen int) Watcher {
 		n.watchers = list.New()
 	}
 	w := newWatcher(n, bufLen)
+	// the events after it should be delivered.
+	w.lastIndex = n.store.history.lastIndex
 	elem := n.watchers.PushBack(w)
 	w.remove = func() {
 
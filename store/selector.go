@@ -0,0 +1,90 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package store
+
+import (
+	"strings"
+)
+
+// ValueSelector select the children got by Traveller, limit the depth of dirs and project the fields,
+// so the value of the large dir is not built. The nil selector select all.
+type ValueSelector struct {
+	// depth is the remain depth of dirs can be expanded, negative means no limit.
+	depth  int
+	fields fieldTree
+}
+
+// fieldTree is the tree of the selected fields, nil means select all.
+type fieldTree map[string]fieldTree
+
+// NewValueSelector return a selector expand depth level dirs and select the fields, fields are the relative paths such as "a/b",
+// depth <= 0 means no limit, empty fields means select all.
+func NewValueSelector(depth int, fields []string) *ValueSelector {
+	if depth <= 0 {
+		depth = -1
+	}
+	var tree fieldTree
+	for _, field := range fields {
+		components := strings.Split(strings.Trim(field, "/"), "/")
+		if components[0] == "" {
+			// select the whole value.
+			tree = nil
+			break
+		}
+		if tree == nil {
+			tree = make(fieldTree)
+		}
+		tree.add(components)
+	}
+	return &ValueSelector{depth: depth, fields: tree}
+}
+
+func (t fieldTree) add(components []string) {
+	name := components[0]
+	sub, ok := t[name]
+	if ok && sub == nil {
+		// the parent field has been selected.
+		return
+	}
+	if len(components) == 1 {
+		t[name] = nil
+		return
+	}
+	if sub == nil {
+		sub = make(fieldTree)
+		t[name] = sub
+	}
+	sub.add(components[1:])
+}
+
+// Child return the selector of the child, false if the child is not selected.
+func (s *ValueSelector) Child(name string) (*ValueSelector, bool) {
+	if s == nil || (s.depth < 0 && s.fields == nil) {
+		return s, true
+	}
+	var fields fieldTree
+	if s.fields != nil {
+		sub, ok := s.fields[name]
+		if !ok {
+			return nil, false
+		}
+		fields = sub
+	}
+	depth := s.depth
+	if depth > 0 {
+		depth--
+	}
+	return &ValueSelector{depth: depth, fields: fields}, true
+}
+
+// fieldsSelected return true if only some fields of the value are selected.
+func (s *ValueSelector) fieldsSelected() bool {
+	return s != nil && s.fields != nil
+}
+
+// Truncated return true if the dir should not be expanded.
+func (s *ValueSelector) Truncated() bool {
+	return s != nil && s.depth == 0
+}
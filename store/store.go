@@ -5,11 +5,13 @@
 package store
 
 import (
+	"errors"
 	"fmt"
 	"path"
 	"reflect"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/yunify/metad/atomic"
 	"github.com/yunify/metad/util"
@@ -28,7 +30,30 @@ type Store interface {
 	Delete(nodePath string)
 	// PutBulk value should be a flatmap
 	PutBulk(nodePath string, value map[string]string)
+	// PutWithRevision put the leaf value with the revision from backend,
+	// createdRev is used when the node is new created, if createdRev is 0, use modifiedRev.
+	PutWithRevision(nodePath string, value string, createdRev, modifiedRev int64)
+	// DeleteWithRevision delete the node with the revision from backend.
+	DeleteWithRevision(nodePath string, rev int64)
+	// GetRevision return the created and modified revision of the node,
+	// the modified revision of dir is the max modified revision of the nodes in it.
+	// return 0, 0 if the node not exist.
+	GetRevision(nodePath string) (createdRev, modifiedRev int64)
+	// LastRevision return the modified revision of the node, or of the nearest existing parent if the node not exist,
+	// the parent is modified when the node deleted, so it does not go backward when the node deleted.
+	LastRevision(nodePath string) int64
+	// PutWithTTL put the value same as Put, the leaf nodes put are deleted after ttl unless refreshed,
+	// put the node again without ttl cancel the ttl.
+	PutWithTTL(nodePath string, value interface{}, ttl time.Duration)
+	// Refresh reset the expire time of the ttl nodes under nodePath, return the count of refreshed nodes.
+	Refresh(nodePath string) int
 	Watch(nodePath string, buf int) Watcher
+	// WatchSince watch the nodePath same as Watch, and replay the events after the modified revision from the history first,
+	// return ErrHistoryCompacted if the events have been evicted. rev 0 means watch from now.
+	WatchSince(nodePath string, rev int64, buf int) (Watcher, error)
+	// EventsSince return the events under nodePath after the modified revision from the history, same as replayed by WatchSince,
+	// return ErrHistoryCompacted if the events have been evicted.
+	EventsSince(nodePath string, rev int64) ([]*Event, error)
 	// Clean clean the nodePath's node
 	Clean(nodePath string)
 	// Json output store as json
@@ -41,11 +66,33 @@ type Store interface {
 	Traveller(accessTree AccessTree) Traveller
 }
 
+var (
+	// ErrRevisionConflict is returned by conditional write when the revision not match.
+	ErrRevisionConflict = errors.New("Revision conflict")
+	// ErrConditionNotSupported is returned by the backend not support conditional write.
+	ErrConditionNotSupported = errors.New("Conditional write is not supported by the backend")
+)
+
 type store struct {
 	Root      *node
-	version   atomic.AtomicLong
+	version   *atomic.AtomicLong
 	worldLock sync.RWMutex // stop the world lock
 	cleanChan chan string
+	// stopChan is closed when destroy, stop the background goroutines.
+	stopChan chan bool
+
+	// the revision of the current change, only valid with worldLock.
+	createdRev  int64
+	modifiedRev int64
+	// forceRev is true when the revision is from backend.
+	forceRev bool
+
+	// expiry is created when the first ttl node put.
+	expiry *expiryWheel
+
+	// the version of the current change, only valid with worldLock.
+	changingVersion int64
+	history         *eventHistory
 }
 
 func New() Store {
@@ -53,11 +100,21 @@ func New() Store {
 	return s
 }
 
+// NewWithVersion create a store share the version with other stores, so the revisions of them are comparable,
+// such as the data and mapping store.
+func NewWithVersion(version *atomic.AtomicLong) Store {
+	s := newStore()
+	s.version = version
+	return s
+}
+
 func newStore() *store {
 	s := new(store)
-	s.version = atomic.AtomicLong(int64(0))
+	s.version = new(atomic.AtomicLong)
+	s.history = newEventHistory(EventHistorySize)
 	s.Root = newDir(s, "/", nil)
 	s.cleanChan = make(chan string, 100)
+	s.stopChan = make(chan bool)
 	go func() {
 		for {
 			select {
@@ -123,11 +180,27 @@ func (s *store) PutBulk(nodePath string, values map[string]string) {
 	s.internalPutBulk(nodePath, values)
 }
 
+func (s *store) PutWithRevision(nodePath string, value string, createdRev, modifiedRev int64) {
+	nodePath = path.Clean(path.Join("/", nodePath))
+
+	s.worldLock.Lock()
+	defer s.worldLock.Unlock()
+	s.internalPutWithRevision(nodePath, value, createdRev, modifiedRev)
+}
+
 // Delete deletes the node at the given path.
 func (s *store) Delete(nodePath string) {
+	s.DeleteWithRevision(nodePath, 0)
+}
+
+func (s *store) DeleteWithRevision(nodePath string, rev int64) {
 
 	s.worldLock.Lock()
 	defer s.worldLock.Unlock()
+	s.internalDelete(nodePath, rev)
+}
+
+func (s *store) internalDelete(nodePath string, rev int64) {
 
 	nodePath = path.Clean(path.Join("/", nodePath))
 
@@ -136,13 +209,182 @@ func (s *store) Delete(nodePath string) {
 		// if the node does not exist, treat as success
 		return
 	}
-	s.version.IncrementAndGet()
+	version := s.version.IncrementAndGet()
+	s.begin(0, rev, version)
+	defer s.end()
+	if s.expiry != nil {
+		s.expiry.removeAll(nodePath)
+	}
 	n.Remove()
 }
 
+func (s *store) PutWithTTL(nodePath string, value interface{}, ttl time.Duration) {
+	nodePath = path.Clean(path.Join("/", nodePath))
+
+	s.worldLock.Lock()
+	defer s.worldLock.Unlock()
+	if s.expiry == nil {
+		s.expiry = newExpiryWheel(ExpiryTick, ExpirySlots)
+		go s.expire(s.expiry)
+	}
+	now := time.Now()
+	switch t := value.(type) {
+	case map[string]interface{}, map[string]string, []interface{}:
+		flatValues := flatmap.Flatten(t)
+		s.internalPutBulk(nodePath, flatValues)
+		for k := range flatValues {
+			s.expiry.add(util.AppendPathPrefix(k, nodePath), ttl, now)
+		}
+	case string:
+		s.internalPut(nodePath, t)
+		s.expiry.add(nodePath, ttl, now)
+	default:
+		panic(fmt.Sprintf("Unsupport type: %s", reflect.TypeOf(t)))
+	}
+}
+
+func (s *store) Refresh(nodePath string) int {
+	nodePath = path.Clean(path.Join("/", nodePath))
+
+	s.worldLock.Lock()
+	defer s.worldLock.Unlock()
+	if s.expiry == nil {
+		return 0
+	}
+	return s.expiry.refresh(nodePath, time.Now())
+}
+
+// expire turn the expiry wheel every tick, and delete the expired nodes, which fire Delete events to watchers.
+func (s *store) expire(wheel *expiryWheel) {
+	ticker := time.NewTicker(wheel.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.worldLock.Lock()
+			// the store may be destroyed while waiting the lock.
+			if s.Root == nil {
+				s.worldLock.Unlock()
+				return
+			}
+			for _, nodePath := range wheel.advance(now) {
+				// only leaf node has ttl, the dir is created by other put after ttl put.
+				if n := s.internalGet(nodePath); n != nil && !n.IsDir() {
+					s.internalDelete(nodePath, 0)
+				}
+			}
+			s.worldLock.Unlock()
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+func (s *store) GetRevision(nodePath string) (createdRev, modifiedRev int64) {
+	s.worldLock.RLock()
+	defer s.worldLock.RUnlock()
+
+	nodePath = path.Clean(path.Join("/", nodePath))
+	n := s.internalGet(nodePath)
+	if n == nil {
+		return 0, 0
+	}
+	// treat empty dir as not found, same as Get.
+	if m, ok := n.GetValue().(map[string]interface{}); ok && len(m) == 0 && !n.IsRoot() {
+		return 0, 0
+	}
+	return n.Revision()
+}
+
+func (s *store) LastRevision(nodePath string) int64 {
+	s.worldLock.RLock()
+	defer s.worldLock.RUnlock()
+
+	curr := s.Root
+	for _, component := range strings.Split(path.Clean(path.Join("/", nodePath)), "/") {
+		if component == "" {
+			continue
+		}
+		if !curr.IsDir() {
+			break
+		}
+		child := curr.GetChild(component)
+		if child == nil {
+			break
+		}
+		curr = child
+	}
+	_, modifiedRev := curr.Revision()
+	return modifiedRev
+}
+
+// begin set the revision of the change, if rev is 0, use the store version.
+func (s *store) begin(createdRev, rev, version int64) {
+	s.forceRev = rev > 0
+	if rev <= 0 {
+		rev = version
+	}
+	if createdRev <= 0 {
+		createdRev = rev
+	}
+	s.createdRev = createdRev
+	s.modifiedRev = rev
+	s.changingVersion = version
+}
+
+func (s *store) end() {
+	s.createdRev = 0
+	s.modifiedRev = 0
+	s.forceRev = false
+	s.changingVersion = 0
+}
+
+// changeVersion return the version of the current change, the change out of begin and end, such as clean, use the current version.
+func (s *store) changeVersion() int64 {
+	if s.changingVersion > 0 {
+		return s.changingVersion
+	}
+	return s.version.Get()
+}
+
 func (s *store) Watch(nodePath string, buf int) Watcher {
 	s.worldLock.Lock()
 	defer s.worldLock.Unlock()
+	return s.internalWatch(nodePath, buf)
+}
+
+func (s *store) WatchSince(nodePath string, rev int64, buf int) (Watcher, error) {
+	s.worldLock.Lock()
+	defer s.worldLock.Unlock()
+	nodePath = path.Join("/", nodePath)
+	var events []*Event
+	// nothing changed under the node after rev if its modified revision is not greater, no need to check the history.
+	if n := s.internalGet(nodePath); rev > 0 && (n == nil || n.modifiedRev > rev) {
+		var err error
+		events, err = s.history.sinceRevision(nodePath, rev)
+		if err != nil {
+			return nil, err
+		}
+	}
+	w := s.internalWatch(nodePath, buf)
+	if len(events) > 0 {
+		// replay from the event before the first one, the watcher refill the events exceed the buffer.
+		nw := w.(*watcher)
+		nw.lastIndex = events[0].index - 1
+		for _, e := range events {
+			nw.notify(e)
+		}
+	}
+	return w, nil
+}
+
+func (s *store) EventsSince(nodePath string, rev int64) ([]*Event, error) {
+	s.worldLock.RLock()
+	defer s.worldLock.RUnlock()
+	return s.history.sinceRevision(path.Join("/", nodePath), rev)
+}
+
+func (s *store) internalWatch(nodePath string, buf int) Watcher {
 	var n *node
 	if nodePath == "/" {
 		n = s.Root
@@ -183,6 +425,7 @@ func (s *store) Destroy() {
 	s.worldLock.Lock()
 	defer s.worldLock.Unlock()
 	close(s.cleanChan)
+	close(s.stopChan)
 	s.Root = nil
 }
 
@@ -211,8 +454,18 @@ func (s *store) walk(nodePath string, walkFunc func(prev *node, component string
 }
 
 func (s *store) internalPut(nodePath string, value string) *node {
+	return s.internalPutWithRevision(nodePath, value, 0, 0)
+}
 
-	s.version.IncrementAndGet()
+func (s *store) internalPutWithRevision(nodePath string, value string, createdRev, modifiedRev int64) *node {
+
+	version := s.version.IncrementAndGet()
+	s.begin(createdRev, modifiedRev, version)
+	defer s.end()
+	if s.expiry != nil {
+		// put without ttl cancel the ttl, PutWithTTL add it again after put.
+		s.expiry.remove(nodePath)
+	}
 
 	// nodePath is "/", just ignore put value.
 	if nodePath == "/" {
@@ -288,3 +541,45 @@ func (s *store) checkDir(parent *node, dirName string) *node {
 	n := newDir(s, dirName, parent)
 	return n
 }
+
+// Replicate make the store to same as from, copy the leaf nodes with revisions, and delete the nodes not in from.
+func Replicate(from Store, to Store) {
+	var fromValues map[string]string
+	if m, ok := getValue(from).(map[string]interface{}); ok {
+		fromValues = flatmap.Flatten(m)
+	}
+	// copy with revision, keep the revisions same as the backend.
+	ApplyFlatmap(to, fromValues, from.GetRevision, 0)
+}
+
+// ApplyFlatmap make the leaf nodes of the store same as the flatmap, delete the nodes not in values, and put the changed.
+// If revision is nil, the store version is used as the revision. Otherwise the nodes are put with the revisions from it,
+// the unchanged value is put again if its modified revision is different, and the nodes are deleted with deletedRev.
+func ApplyFlatmap(s Store, values map[string]string, revision func(nodePath string) (createdRev, modifiedRev int64), deletedRev int64) {
+	old := map[string]string{}
+	if m, ok := getValue(s).(map[string]interface{}); ok {
+		old = flatmap.Flatten(m)
+	}
+	for k := range old {
+		if _, ok := values[k]; !ok {
+			s.DeleteWithRevision(k, deletedRev)
+		}
+	}
+	for k, v := range values {
+		var createdRev, modifiedRev int64
+		if revision != nil {
+			createdRev, modifiedRev = revision(k)
+		}
+		if ov, ok := old[k]; ok && ov == v {
+			if _, rev := s.GetRevision(k); revision == nil || rev == modifiedRev {
+				continue
+			}
+		}
+		s.PutWithRevision(k, v, createdRev, modifiedRev)
+	}
+}
+
+func getValue(s Store) interface{} {
+	_, val := s.Get("/")
+	return val
+}
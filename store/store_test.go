@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"net/http"
 	_ "net/http/pprof"
+	"runtime"
 	"sync"
 	"testing"
 	"time"
@@ -56,6 +57,141 @@ func TestStoreDir(t *testing.T) {
 
 }
 
+func TestStoreRevision(t *testing.T) {
+	s := New()
+
+	s.Put("/nodes/1/name", "node1")
+	created1, modified1 := s.GetRevision("/nodes/1/name")
+	assert.True(t, created1 > 0)
+	assert.Equal(t, created1, modified1)
+
+	s.Put("/nodes/2/name", "node2")
+	_, modified2 := s.GetRevision("/nodes/2/name")
+	assert.True(t, modified2 > modified1)
+	// the dir's modified revision is the max of its nodes.
+	_, dirModified := s.GetRevision("/nodes")
+	assert.Equal(t, modified2, dirModified)
+	_, dirModified = s.GetRevision("/nodes/1")
+	assert.Equal(t, modified1, dirModified)
+
+	// put same value not change revision.
+	s.Put("/nodes/1/name", "node1")
+	_, modified := s.GetRevision("/nodes/1/name")
+	assert.Equal(t, modified1, modified)
+
+	s.Put("/nodes/1/name", "node1-1")
+	created, modified := s.GetRevision("/nodes/1/name")
+	assert.Equal(t, created1, created)
+	assert.True(t, modified > modified2)
+
+	// delete change the parent's revision.
+	s.Delete("/nodes/2")
+	created, modified = s.GetRevision("/nodes/2")
+	assert.Equal(t, int64(0), created)
+	assert.Equal(t, int64(0), modified)
+	_, dirModified = s.GetRevision("/nodes")
+	assert.True(t, dirModified > modified2)
+	// the last revision of the deleted node is the parent's, not go backward.
+	assert.Equal(t, dirModified, s.LastRevision("/nodes/2"))
+	assert.Equal(t, dirModified, s.LastRevision("/nodes/2/name"))
+	_, modified1 = s.GetRevision("/nodes/1/name")
+	assert.Equal(t, modified1, s.LastRevision("/nodes/1/name"))
+
+	// revision from backend.
+	s.PutWithRevision("/nodes/3/name", "node3", 100, 200)
+	created, modified = s.GetRevision("/nodes/3/name")
+	assert.Equal(t, int64(100), created)
+	assert.Equal(t, int64(200), modified)
+	s.PutWithRevision("/nodes/3/name", "node3", 100, 300)
+	_, modified = s.GetRevision("/nodes/3/name")
+	assert.Equal(t, int64(300), modified)
+	w := s.Watch("/nodes", 10)
+	s.DeleteWithRevision("/nodes/3/name", 400)
+	e := <-w.EventChan()
+	assert.Equal(t, Delete, e.Action)
+	assert.Equal(t, int64(400), e.Rev)
+	w.Remove()
+	_, modified = s.GetRevision("/")
+	assert.Equal(t, int64(400), modified)
+	s.Destroy()
+}
+
+func TestApplyFlatmap(t *testing.T) {
+	s := New()
+	s.Put("/nodes/1/name", "node1")
+	s.Put("/nodes/2/name", "node2")
+	_, modified1 := s.GetRevision("/nodes/1/name")
+
+	w := s.Watch("/", 10)
+	ApplyFlatmap(s, map[string]string{"/nodes/1/name": "node1", "/nodes/3/name": "node3"}, nil, 0)
+	// the unchanged node is not put again.
+	assert.Equal(t, 2, len(w.EventChan()))
+	w.Remove()
+	_, modified := s.GetRevision("/nodes/1/name")
+	assert.Equal(t, modified1, modified)
+	_, val := s.Get("/nodes")
+	assert.Equal(t, map[string]interface{}{
+		"1": map[string]interface{}{"name": "node1"},
+		"3": map[string]interface{}{"name": "node3"},
+	}, val)
+
+	// with revision, the unchanged value is put again with the new revision.
+	revisions := map[string]int64{"/nodes/1/name": 100, "/nodes/4/name": 200}
+	ApplyFlatmap(s, map[string]string{"/nodes/1/name": "node1", "/nodes/4/name": "node4"}, func(nodePath string) (int64, int64) {
+		return revisions[nodePath], revisions[nodePath]
+	}, 300)
+	_, modified = s.GetRevision("/nodes/1/name")
+	assert.Equal(t, int64(100), modified)
+	created, modified := s.GetRevision("/nodes/4/name")
+	assert.Equal(t, int64(200), created)
+	assert.Equal(t, int64(200), modified)
+	assert.Equal(t, int64(300), s.LastRevision("/nodes/3/name"))
+	s.Destroy()
+}
+
+func TestStoreTTL(t *testing.T) {
+	s := New()
+	w := s.Watch("/agents", 10)
+
+	ttl := 500 * time.Millisecond
+	s.PutWithTTL("/agents/1", map[string]interface{}{"status": "up", "ip": "192.168.1.1"}, ttl)
+	s.PutWithTTL("/agents/2/status", "up", ttl)
+	s.PutWithTTL("/agents/3/status", "up", ttl)
+	// put without ttl cancel the ttl.
+	s.Put("/agents/3/status", "down")
+	for i := 0; i < 5; i++ {
+		<-w.EventChan()
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, 2, s.Refresh("/agents/1"))
+	assert.Equal(t, 0, s.Refresh("/agents/3"))
+
+	// agents/2 expired, fire delete event.
+	e := <-w.EventChan()
+	assert.Equal(t, Delete, e.Action)
+	assert.Equal(t, "/2/status", e.Path)
+	_, val := s.Get("/agents/2")
+	assert.Nil(t, val)
+	_, val = s.Get("/agents/1/status")
+	assert.Equal(t, "up", val)
+
+	time.Sleep(600 * time.Millisecond)
+	_, val = s.Get("/agents")
+	assert.Equal(t, map[string]interface{}{"3": map[string]interface{}{"status": "down"}}, val)
+	w.Remove()
+	s.Destroy()
+}
+
+func TestStoreDestroyStopExpire(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	s := New()
+	s.PutWithTTL("/agents/1/status", "up", time.Second)
+	s.Destroy()
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, runtime.NumGoroutine() <= goroutines)
+}
+
 func TestStoreBulk(t *testing.T) {
 	s := New()
 
@@ -160,6 +296,8 @@ func TestWatch(t *testing.T) {
 	assert.Equal(t, Update, e.Action)
 	assert.Equal(t, "/", e.Path)
 	assert.Equal(t, "node6", e.Value)
+	assert.Equal(t, "", e.PrevValue)
+	assert.False(t, e.PrevExist)
 
 	s.Put("/nodes/6/label/key1", "value1")
 
@@ -167,6 +305,7 @@ func TestWatch(t *testing.T) {
 	e = readEvent(w.EventChan())
 	assert.Equal(t, Delete, e.Action)
 	assert.Equal(t, "/", e.Path)
+	assert.Equal(t, "node6", e.PrevValue)
 
 	e = readEvent(w.EventChan())
 	assert.Equal(t, Update, e.Action)
@@ -179,12 +318,15 @@ func TestWatch(t *testing.T) {
 	assert.Equal(t, Update, e.Action)
 	assert.Equal(t, "/label/key1", e.Path)
 	assert.Equal(t, "value2", e.Value)
+	assert.Equal(t, "value1", e.PrevValue)
+	assert.True(t, e.PrevExist)
 
 	s.Delete("/nodes/6/label/key1")
 
 	e = readEvent(w.EventChan())
 	assert.Equal(t, Delete, e.Action)
 	assert.Equal(t, "/label/key1", e.Path)
+	assert.Equal(t, "value2", e.PrevValue)
 
 	// when /nodes/6's children remove, it return to a leaf node.
 	e = readEvent(w.EventChan())
@@ -244,6 +386,20 @@ func TestWatch(t *testing.T) {
 	s.Destroy()
 }
 
+func TestWatchEmptyLeaf(t *testing.T) {
+	s := New()
+	s.Put("/nodes/7/desc", "")
+	w := s.Watch("/nodes/7/desc", 10)
+	defer w.Remove()
+
+	// the update of the empty leaf is not a create.
+	s.Put("/nodes/7/desc", "desc7")
+	e := readEvent(w.EventChan())
+	assert.Equal(t, Update, e.Action)
+	assert.Equal(t, "desc7", e.Value)
+	assert.Equal(t, "", e.PrevValue)
+	assert.True(t, e.PrevExist)
+}
 func TestWatchRoot(t *testing.T) {
 	s := New()
 	s.Put("/nodes/6/name", "node6")
@@ -276,6 +432,105 @@ func TestWatchRoot(t *testing.T) {
 	s.Destroy()
 }
 
+func TestWatchSince(t *testing.T) {
+	s := New()
+	s.Put("/nodes/1/name", "node1")
+	version := s.Version()
+	s.Put("/nodes/1/ip", "192.168.1.1")
+	s.Put("/nodes/2/name", "node2")
+	s.Put("/nodes/1/name", "node1-new")
+
+	// replay the events under the path after the version.
+	w, err := s.WatchSince("/nodes/1", version, 100)
+	assert.NoError(t, err)
+	e := readEvent(w.EventChan())
+	assert.Equal(t, "/ip", e.Path)
+	assert.Equal(t, version+1, e.Version)
+	e = readEvent(w.EventChan())
+	assert.Equal(t, "/name", e.Path)
+	assert.Equal(t, "node1-new", e.Value)
+	assert.Equal(t, version+3, e.Version)
+
+	// then the new events.
+	s.Delete("/nodes/1/ip")
+	e = readEvent(w.EventChan())
+	assert.Equal(t, Delete, e.Action)
+	assert.Equal(t, "/ip", e.Path)
+	assert.Nil(t, readEvent(w.EventChan()))
+	w.Remove()
+
+	// nothing to replay after the newest revision.
+	w, err = s.WatchSince("/nodes/1", s.Version()+1, 100)
+	assert.NoError(t, err)
+	assert.Nil(t, readEvent(w.EventChan()))
+	w.Remove()
+	s.Destroy()
+
+	historySize := EventHistorySize
+	EventHistorySize = 10
+	defer func() {
+		EventHistorySize = historySize
+	}()
+	s = New()
+	s.Put("/nodes/0/name", "node0")
+	s.Put("/nodes/1/name", "node1")
+	version = s.Version()
+	for i := 0; i < 10; i++ {
+		s.Put("/nodes/1/name", fmt.Sprintf("node%v", i))
+	}
+	// the event of the revision has been evicted.
+	_, err = s.WatchSince("/nodes/1", version-1, 100)
+	assert.Equal(t, ErrHistoryCompacted, err)
+	w, err = s.WatchSince("/nodes/1", version, 100)
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		e = readEvent(w.EventChan())
+		assert.Equal(t, fmt.Sprintf("node%v", i), e.Value)
+	}
+	w.Remove()
+	s.Destroy()
+}
+
+func TestWatchOverflow(t *testing.T) {
+	s := New()
+	w := s.Watch("/nodes", 2)
+	for i := 0; i < 100; i++ {
+		s.Put(fmt.Sprintf("/nodes/%v", i), fmt.Sprintf("node%v", i))
+	}
+	// the events exceed the buffer are replayed from history, not dropped.
+	for i := 0; i < 100; i++ {
+		e := readEvent(w.EventChan())
+		assert.Equal(t, fmt.Sprintf("/%v", i), e.Path)
+	}
+	s.Put("/nodes/100", "node100")
+	e := readEvent(w.EventChan())
+	assert.Equal(t, "/100", e.Path)
+	assert.Nil(t, readEvent(w.EventChan()))
+	w.Remove()
+	s.Destroy()
+
+	historySize := EventHistorySize
+	EventHistorySize = 10
+	defer func() {
+		EventHistorySize = historySize
+	}()
+	s = New()
+	w = s.Watch("/nodes", 2)
+	nodes := make(map[string]interface{})
+	for i := 0; i < 20; i++ {
+		nodes[fmt.Sprintf("%v", i)] = fmt.Sprintf("node%v", i)
+	}
+	// put in one lock, the events have been evicted before refill, get a resync.
+	s.Put("/nodes", nodes)
+	assert.Equal(t, Update, readEvent(w.EventChan()).Action)
+	assert.Equal(t, Update, readEvent(w.EventChan()).Action)
+	assert.Equal(t, Resync, readEvent(w.EventChan()).Action)
+	s.Put("/nodes/20", "node20")
+	assert.Equal(t, "/20", readEvent(w.EventChan()).Path)
+	w.Remove()
+	s.Destroy()
+}
+
 func TestEmptyStore(t *testing.T) {
 	s := newStore()
 	_, val := s.Get("/")
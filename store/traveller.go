@@ -19,6 +19,8 @@ type Traveller interface {
 	BackToRoot()
 	// GetValue get current node value, if node is dir, will return a map contains children's value, otherwise return node.Value
 	GetValue() interface{}
+	// GetSelectedValue get current node value same as GetValue, but only the children selected by selector are got.
+	GetSelectedValue(selector *ValueSelector) interface{}
 	// Close release traveller
 	Close()
 	// GetVersion get store version.
@@ -159,6 +161,10 @@ func (t *nodeTraveller) BackToRoot() {
 }
 
 func (t *nodeTraveller) GetValue() interface{} {
+	return t.GetSelectedValue(nil)
+}
+
+func (t *nodeTraveller) GetSelectedValue(selector *ValueSelector) interface{} {
 	if t.store == nil {
 		panic("illegal status: access a closed traveller.")
 	}
@@ -167,11 +173,27 @@ func (t *nodeTraveller) GetValue() interface{} {
 	}
 	if t.currNode.IsDir() {
 		values := make(map[string]interface{})
+		if selector.Truncated() {
+			return values
+		}
 		for k, node := range t.currNode.Children {
+			sub, ok := selector.Child(k)
+			// the fields under a leaf can not be selected.
+			if !ok || (!node.IsDir() && sub.fieldsSelected()) {
+				continue
+			}
 			if !t.Enter(node.Name) {
 				continue
 			}
-			v := t.GetValue()
+			if node.IsDir() && sub.Truncated() {
+				// keep the truncated dir as empty map, so client know it exist, but skip the empty dir.
+				if t.hasValue() {
+					values[k] = make(map[string]interface{})
+				}
+				t.Back()
+				continue
+			}
+			v := t.GetSelectedValue(sub)
 			t.Back()
 			m, isMap := v.(map[string]interface{})
 			// skip empty dir.
@@ -186,6 +208,24 @@ func (t *nodeTraveller) GetValue() interface{} {
 	}
 }
 
+// hasValue check whether the current node has any value can be accessed, without build the value.
+func (t *nodeTraveller) hasValue() bool {
+	if !t.currNode.IsDir() {
+		return true
+	}
+	for _, node := range t.currNode.Children {
+		if !t.Enter(node.Name) {
+			continue
+		}
+		ok := t.hasValue()
+		t.Back()
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
 func (t *nodeTraveller) GetVersion() int64 {
 	if t.store == nil {
 		panic("illegal status: access a closed traveller.")
@@ -145,3 +145,63 @@ func TestTraveller(t *testing.T) {
 	assert.Equal(t, 2, len(envM))
 	assert.Nil(t, cl2["env"])
 }
+
+func TestTravellerSelectedValue(t *testing.T) {
+	s := New()
+	data := map[string]interface{}{
+		"clusters": map[string]interface{}{
+			"cl-1": map[string]interface{}{
+				"env": map[string]interface{}{
+					"name":   "app1",
+					"secret": "123456",
+				},
+				"public_key": "public_key_val",
+			},
+			"cl-2": map[string]interface{}{
+				"env": map[string]interface{}{
+					"secret": "1234567",
+				},
+				"public_key": "public_key_val2",
+			},
+		},
+	}
+	s.Put("/", data)
+
+	accessRules := []AccessRule{
+		{Path: "/", Mode: AccessModeRead},
+		{Path: "/clusters/cl-2/env", Mode: AccessModeForbidden},
+	}
+	traveller := s.Traveller(NewAccessTree(accessRules))
+	defer traveller.Close()
+	assert.True(t, traveller.Enter("/clusters"))
+
+	// the dir without accessible value is skipped.
+	assert.Equal(t, map[string]interface{}{
+		"cl-1": map[string]interface{}{
+			"env":        map[string]interface{}{},
+			"public_key": "public_key_val",
+		},
+		"cl-2": map[string]interface{}{
+			"public_key": "public_key_val2",
+		},
+	}, traveller.GetSelectedValue(NewValueSelector(2, nil)))
+
+	assert.Equal(t, map[string]interface{}{
+		"cl-1": map[string]interface{}{},
+		"cl-2": map[string]interface{}{},
+	}, traveller.GetSelectedValue(NewValueSelector(1, nil)))
+
+	assert.Equal(t, map[string]interface{}{
+		"cl-1": map[string]interface{}{
+			"env": map[string]interface{}{
+				"name": "app1",
+			},
+		},
+		"cl-2": map[string]interface{}{
+			"public_key": "public_key_val2",
+		},
+	}, traveller.GetSelectedValue(NewValueSelector(0, []string{"cl-1/env/name", "cl-2/public_key", "cl-2/public_key/none", "cl-3"})))
+
+	assert.Equal(t, traveller.GetValue(), traveller.GetSelectedValue(NewValueSelector(0, []string{"cl-1/env", "/"})))
+	assert.Equal(t, traveller.GetValue(), traveller.GetSelectedValue(nil))
+}
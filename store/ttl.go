@@ -0,0 +1,118 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package store
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrTTLNotSupported is returned by the backend not support ttl.
+	ErrTTLNotSupported = errors.New("TTL is not supported by the backend")
+	// ErrNoTTL is returned by keepalive when there is no ttl node under the path.
+	ErrNoTTL = errors.New("No ttl node found")
+
+	// ExpiryTick is the tick of the expiry wheel, the ttl node is deleted in one tick after it expired.
+	ExpiryTick = 100 * time.Millisecond
+	// ExpirySlots is the slot count of the expiry wheel,
+	// the node expire after a full round is put back to the wheel when the wheel turn to it.
+	ExpirySlots = 600
+)
+
+// expiryWheel is a timing wheel for the ttl nodes, a node is put into the slot of its deadline,
+// and checked when the wheel turn to the slot. It is protected by the worldLock of store.
+type expiryWheel struct {
+	tick      time.Duration
+	slots     []map[string]time.Time
+	current   int
+	ttls      map[string]time.Duration
+	deadlines map[string]time.Time
+}
+
+func newExpiryWheel(tick time.Duration, slotCount int) *expiryWheel {
+	slots := make([]map[string]time.Time, slotCount)
+	for i := range slots {
+		slots[i] = make(map[string]time.Time)
+	}
+	return &expiryWheel{
+		tick:      tick,
+		slots:     slots,
+		ttls:      make(map[string]time.Duration),
+		deadlines: make(map[string]time.Time),
+	}
+}
+
+// add schedule the node expire after ttl, replace the former deadline.
+func (w *expiryWheel) add(nodePath string, ttl time.Duration, now time.Time) {
+	deadline := now.Add(ttl)
+	w.ttls[nodePath] = ttl
+	w.deadlines[nodePath] = deadline
+	w.schedule(nodePath, deadline, now)
+}
+
+func (w *expiryWheel) schedule(nodePath string, deadline time.Time, now time.Time) {
+	ticks := int((deadline.Sub(now) + w.tick - 1) / w.tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+	if ticks >= len(w.slots) {
+		ticks = len(w.slots) - 1
+	}
+	w.slots[(w.current+ticks)%len(w.slots)][nodePath] = deadline
+}
+
+// remove cancel the ttl of the node, the entry in slot is skipped when the wheel turn to it.
+func (w *expiryWheel) remove(nodePath string) {
+	delete(w.ttls, nodePath)
+	delete(w.deadlines, nodePath)
+}
+
+// removeAll cancel the ttl of the node and the nodes under it.
+func (w *expiryWheel) removeAll(nodePath string) {
+	for p := range w.ttls {
+		if isSubPath(p, nodePath) {
+			w.remove(p)
+		}
+	}
+}
+
+// refresh reset the deadline of the node and the nodes under it with their ttl, return the refreshed count.
+func (w *expiryWheel) refresh(nodePath string, now time.Time) int {
+	count := 0
+	for p, ttl := range w.ttls {
+		if isSubPath(p, nodePath) {
+			w.add(p, ttl, now)
+			count++
+		}
+	}
+	return count
+}
+
+// advance turn the wheel one tick, return the expired nodes.
+func (w *expiryWheel) advance(now time.Time) []string {
+	w.current = (w.current + 1) % len(w.slots)
+	slot := w.slots[w.current]
+	w.slots[w.current] = make(map[string]time.Time)
+	var expired []string
+	for p, deadline := range slot {
+		// the node has been removed or refreshed.
+		if d, ok := w.deadlines[p]; !ok || !d.Equal(deadline) {
+			continue
+		}
+		if deadline.After(now) {
+			w.schedule(p, deadline, now)
+			continue
+		}
+		expired = append(expired, p)
+		w.remove(p)
+	}
+	return expired
+}
+
+func isSubPath(p string, dir string) bool {
+	return p == dir || dir == "/" || strings.HasPrefix(p, dir+"/")
+}
@@ -0,0 +1,74 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"path"
+)
+
+// The target of TxnOp.
+const (
+	TxnTargetData    = "data"
+	TxnTargetMapping = "mapping"
+	TxnTargetRule    = "rule"
+)
+
+// The action of TxnOp.
+const (
+	// TxnActionPut create or replace the node, same as POST.
+	TxnActionPut = "put"
+	// TxnActionMerge create or merge to the node, same as PUT.
+	TxnActionMerge = "merge"
+	// TxnActionDelete delete the node.
+	TxnActionDelete = "delete"
+)
+
+// ErrTxnNotSupported is returned by the backend not support transaction.
+var ErrTxnNotSupported = errors.New("Transaction is not supported by the backend")
+
+// TxnOp is a operation in a transaction.
+// For data and mapping, Path is the node path, for rule, Path is the host and Rules is the access rules of the host.
+type TxnOp struct {
+	Target string      `json:"target"`
+	Action string      `json:"action"`
+	Path   string      `json:"path"`
+	Value  interface{} `json:"value,omitempty"`
+	// IfMatch is the precondition of the op, the transaction only apply when the modified revision of Path is IfMatch,
+	// 0 means Path not exist. Only data and mapping support it.
+	IfMatch *int64 `json:"if_match,omitempty"`
+
+	Rules []AccessRule `json:"-"`
+	// Dir is true if the deleted node is a dir.
+	Dir bool `json:"-"`
+}
+
+// CheckTxnOp check the target and action of the op, and clean the path.
+func CheckTxnOp(op *TxnOp) error {
+	switch op.Target {
+	case TxnTargetData, TxnTargetMapping:
+		op.Path = path.Join("/", op.Path)
+	case TxnTargetRule:
+		if op.Path == "" || path.Base(op.Path) != op.Path {
+			return fmt.Errorf("Invalid rule host [%s]", op.Path)
+		}
+		if op.IfMatch != nil {
+			return errors.New("Rule op does not support if_match")
+		}
+	default:
+		return fmt.Errorf("Invalid txn target [%s]", op.Target)
+	}
+	switch op.Action {
+	case TxnActionPut, TxnActionMerge:
+		if op.Value == nil {
+			return fmt.Errorf("Txn op %s %s require value", op.Action, op.Path)
+		}
+	case TxnActionDelete:
+	default:
+		return fmt.Errorf("Invalid txn action [%s]", op.Action)
+	}
+	return nil
+}
@@ -13,23 +13,46 @@ import (
 const (
 	Update = "UPDATE"
 	Delete = "DELETE"
+	// Resync means the events the watcher missed have been evicted from the history,
+	// the watcher should resync the full data, the following events are after the resync.
+	Resync = "RESYNC"
 )
 
 type Event struct {
 	Action string `json:"action"`
 	Path   string `json:"path"`
 	Value  string `json:"value"`
+	// Rev is the revision of the change.
+	Rev int64 `json:"rev"`
+	// Version is the store version of the change.
+	Version int64 `json:"version"`
+	// PrevValue is the value before the change, the deleted value for delete, empty if the node is created.
+	PrevValue string `json:"prev_value,omitempty"`
+	// PrevExist is true if the leaf exists before the change, so the empty PrevValue is an empty value, not a create.
+	PrevExist bool `json:"prev_exist,omitempty"`
+
+	// index is the index of the event in the history.
+	index int64
 }
 
 func (e *Event) String() string {
 	return fmt.Sprintf("%s:%s|%s", e.Path, e.Action, e.Value)
 }
 
-func newEvent(action string, path string, value string) *Event {
+// withPath return a copy of the event with the path.
+func (e *Event) withPath(p string) *Event {
+	event := *e
+	event.Path = p
+	return &event
+}
+
+func newEvent(action string, path string, value string, rev int64, version int64) *Event {
 	return &Event{
-		Action: action,
-		Path:   path,
-		Value:  value,
+		Action:  action,
+		Path:    path,
+		Value:   value,
+		Rev:     rev,
+		Version: version,
 	}
 }
 
@@ -43,12 +66,23 @@ type watcher struct {
 	removed   bool
 	node      *node
 	remove    func()
+
+	// lost is true when the eventChan is full, the events after lastIndex are replayed from the history
+	// by refill, instead of dropped. lost and lastIndex are protected by the worldLock of store.
+	lost      bool
+	lastIndex int64
+
+	// stopChan and closed stop the refill when remove.
+	stopChan chan struct{}
+	sendLock sync.Mutex
+	closed   bool
 }
 
 func newWatcher(node *node, bufLen int) *watcher {
 	w := &watcher{
 		eventChan: make(chan *Event, bufLen),
 		node:      node,
+		stopChan:  make(chan struct{}),
 	}
 	return w
 }
@@ -57,7 +91,68 @@ func (w *watcher) EventChan() chan *Event {
 	return w.eventChan
 }
 
+// notify send the event without block, if the eventChan is full, start refill.
+func (w *watcher) notify(e *Event) {
+	if w.lost {
+		// refill will replay it from history.
+		return
+	}
+	select {
+	case w.eventChan <- e:
+		w.lastIndex = e.index
+	default:
+		w.lost = true
+		go w.refill()
+	}
+}
+
+// refill replay the events after lastIndex from the history until catch up,
+// if the events have been evicted, send a Resync event and continue from the newest event.
+func (w *watcher) refill() {
+	s := w.node.store
+	for {
+		s.worldLock.RLock()
+		events, err := s.history.sinceIndex(w.node.Path(), w.lastIndex)
+		if err == ErrHistoryCompacted {
+			events = []*Event{newEvent(Resync, "/", "", 0, s.version.Get())}
+			events[0].index = s.history.lastIndex
+		} else if len(events) == 0 {
+			w.lost = false
+			s.worldLock.RUnlock()
+			return
+		}
+		s.worldLock.RUnlock()
+		for _, e := range events {
+			if !w.send(e) {
+				return
+			}
+			w.lastIndex = e.index
+		}
+	}
+}
+
+// send the event with block, return false if the watcher is removed.
+func (w *watcher) send(e *Event) bool {
+	w.sendLock.Lock()
+	defer w.sendLock.Unlock()
+	if w.closed {
+		return false
+	}
+	select {
+	case w.eventChan <- e:
+		return true
+	case <-w.stopChan:
+		return false
+	}
+}
+
 func (w *watcher) Remove() {
+	// stop the refill first, refill should not hold the sendLock when eventChan closed.
+	close(w.stopChan)
+	w.sendLock.Lock()
+	defer w.sendLock.Unlock()
+	w.closed = true
+
 	w.node.watcherLock.Lock()
 	defer w.node.watcherLock.Unlock()
 
@@ -83,7 +178,7 @@ func NewAggregateWatcher(watchers map[string]Watcher) Watcher {
 				select {
 				case event, ok := <-watcher.EventChan():
 					if ok {
-						eventChan <- newEvent(event.Action, path.Join(pathPrefix, event.Path), event.Value)
+						eventChan <- event.withPath(path.Join(pathPrefix, event.Path))
 					} else {
 						waitGroup.Done()
 						return
@@ -0,0 +1,294 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+// Package encoder encode the metadata value to the config file formats: shell env, Java properties and TOML.
+// The value is flattened by flatmap, the keys are derived from the flatmap paths, the slices are treated as
+// the maps with index keys, and a leaf value is encoded with the key "value".
+package encoder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+
+	"github.com/yunify/metad/util/flatmap"
+)
+
+const (
+	// DefaultEnvSeparator is the default separator of the path components of the env key.
+	DefaultEnvSeparator = "_"
+	// DefaultPropertiesSeparator is the default separator of the path components of the properties key.
+	DefaultPropertiesSeparator = "."
+	// LeafKey is the key of the leaf value.
+	LeafKey = "value"
+)
+
+// EncodeEnv encode the value as the shell export lines, such as "export NODES_1_IP='192.168.1.1'",
+// the key is upper case and the chars not allowed in shell variable name are replaced by "_",
+// the value is single quoted, so the output is safe to eval.
+func EncodeEnv(val interface{}, separator string) []byte {
+	if separator == "" {
+		separator = DefaultEnvSeparator
+	}
+	var buffer bytes.Buffer
+	for _, kv := range flatten(val) {
+		buffer.WriteString("export ")
+		buffer.WriteString(envKey(strings.Join(kv.components, separator)))
+		buffer.WriteString("=")
+		buffer.WriteString(shellQuote(kv.value))
+		buffer.WriteString("\n")
+	}
+	return buffer.Bytes()
+}
+
+// EncodeProperties encode the value as the Java properties, such as "nodes.1.ip=192.168.1.1",
+// the key and value are escaped by the properties syntax, and the non ASCII chars are written as \uXXXX.
+func EncodeProperties(val interface{}, separator string) []byte {
+	if separator == "" {
+		separator = DefaultPropertiesSeparator
+	}
+	var buffer bytes.Buffer
+	for _, kv := range flatten(val) {
+		buffer.WriteString(propertiesEscape(strings.Join(kv.components, separator), true))
+		buffer.WriteString("=")
+		buffer.WriteString(propertiesEscape(kv.value, false))
+		buffer.WriteString("\n")
+	}
+	return buffer.Bytes()
+}
+
+// EncodeTOML encode the value as TOML, the dirs are the tables and the leaves are the strings.
+func EncodeTOML(val interface{}) []byte {
+	var buffer bytes.Buffer
+	encodeTable(&buffer, nil, toTree(val))
+	return buffer.Bytes()
+}
+
+func encodeTable(buffer *bytes.Buffer, keys []string, table map[string]interface{}) {
+	var names []string
+	for k := range table {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	// the leaves should be written before the sub tables.
+	var tables []string
+	for _, k := range names {
+		if v, ok := table[k].(string); ok {
+			buffer.WriteString(tomlKey(k))
+			buffer.WriteString(" = ")
+			buffer.WriteString(tomlQuote(v))
+			buffer.WriteString("\n")
+		} else {
+			tables = append(tables, k)
+		}
+	}
+	for _, k := range tables {
+		subKeys := append(append([]string{}, keys...), tomlKey(k))
+		if buffer.Len() > 0 {
+			buffer.WriteString("\n")
+		}
+		buffer.WriteString("[")
+		buffer.WriteString(strings.Join(subKeys, "."))
+		buffer.WriteString("]\n")
+		encodeTable(buffer, subKeys, table[k].(map[string]interface{}))
+	}
+}
+
+type keyValue struct {
+	components []string
+	value      string
+}
+
+// flatten return the leaves of the value sorted by the path.
+func flatten(val interface{}) []keyValue {
+	var fm map[string]string
+	switch v := normalize(val).(type) {
+	case map[string]interface{}:
+		fm = flatmap.Flatten(v)
+	case []interface{}:
+		fm = flatmap.FlattenSlice(v)
+	default:
+		fm = map[string]string{"/" + LeafKey: leafString(v)}
+	}
+	var keys []string
+	for k := range fm {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	result := make([]keyValue, 0, len(keys))
+	for _, k := range keys {
+		result = append(result, keyValue{components: strings.Split(strings.TrimPrefix(k, "/"), "/"), value: fm[k]})
+	}
+	return result
+}
+
+// toTree convert the value to the nested map of string.
+func toTree(val interface{}) map[string]interface{} {
+	switch v := normalize(val).(type) {
+	case map[string]interface{}:
+		return treeMap(v)
+	case []interface{}:
+		return treeSlice(v)
+	default:
+		return map[string]interface{}{LeafKey: leafString(v)}
+	}
+}
+
+func treeValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		return treeMap(v)
+	case []interface{}:
+		return treeSlice(v)
+	default:
+		return leafString(v)
+	}
+}
+
+func treeMap(m map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		result[k] = treeValue(v)
+	}
+	return result
+}
+
+func treeSlice(s []interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(s))
+	for i, v := range s {
+		result[strconv.Itoa(i)] = treeValue(v)
+	}
+	return result
+}
+
+// normalize convert the value of other types, such as the structs and []string, to the json generic value.
+func normalize(val interface{}) interface{} {
+	switch val.(type) {
+	case nil, string, map[string]interface{}, []interface{}:
+		return val
+	}
+	b, err := json.Marshal(val)
+	if err != nil {
+		return fmt.Sprintf("%v", val)
+	}
+	var result interface{}
+	if err = json.Unmarshal(b, &result); err != nil {
+		return fmt.Sprintf("%v", val)
+	}
+	return result
+}
+
+func leafString(val interface{}) string {
+	switch v := val.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+func envKey(key string) string {
+	b := []byte(strings.ToUpper(key))
+	for i, c := range b {
+		if !(c == '_' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 || b[0] >= '0' && b[0] <= '9' {
+		return "_" + string(b)
+	}
+	return string(b)
+}
+
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+func propertiesEscape(s string, isKey bool) string {
+	var buffer bytes.Buffer
+	for i, r := range s {
+		switch r {
+		case '\\':
+			buffer.WriteString(`\\`)
+		case '\n':
+			buffer.WriteString(`\n`)
+		case '\r':
+			buffer.WriteString(`\r`)
+		case '\t':
+			buffer.WriteString(`\t`)
+		case '\f':
+			buffer.WriteString(`\f`)
+		case '=', ':', '#', '!':
+			buffer.WriteRune('\\')
+			buffer.WriteRune(r)
+		case ' ':
+			// the space in the key and the leading space of the value should be escaped.
+			if isKey || i == 0 {
+				buffer.WriteRune('\\')
+			}
+			buffer.WriteRune(r)
+		default:
+			if r > unicode.MaxASCII || r < ' ' {
+				if r1, r2 := utf16.EncodeRune(r); r1 != unicode.ReplacementChar {
+					fmt.Fprintf(&buffer, `\u%04x\u%04x`, r1, r2)
+				} else {
+					fmt.Fprintf(&buffer, `\u%04x`, r)
+				}
+			} else {
+				buffer.WriteRune(r)
+			}
+		}
+	}
+	return buffer.String()
+}
+
+// tomlQuote quote the string as the TOML basic string.
+func tomlQuote(s string) string {
+	var buffer bytes.Buffer
+	buffer.WriteRune('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			buffer.WriteString(`\"`)
+		case '\\':
+			buffer.WriteString(`\\`)
+		case '\n':
+			buffer.WriteString(`\n`)
+		case '\r':
+			buffer.WriteString(`\r`)
+		case '\t':
+			buffer.WriteString(`\t`)
+		default:
+			if r < ' ' || r == 0x7f {
+				fmt.Fprintf(&buffer, `\u%04X`, r)
+			} else {
+				buffer.WriteRune(r)
+			}
+		}
+	}
+	buffer.WriteRune('"')
+	return buffer.String()
+}
+
+// tomlKey quote the key if it is not a bare key.
+func tomlKey(key string) string {
+	if key == "" {
+		return `""`
+	}
+	for _, c := range key {
+		if !(c == '_' || c == '-' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9') {
+			return tomlQuote(key)
+		}
+	}
+	return key
+}
@@ -0,0 +1,63 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package encoder
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testValue = map[string]interface{}{
+	"name": "cl-1",
+	"hosts": map[string]interface{}{
+		"i-1": map[string]interface{}{
+			"ip":  "192.168.1.1",
+			"env": "a='1' b=2",
+		},
+	},
+	"desc": "集群 #1\nline2",
+}
+
+func TestEncodeEnv(t *testing.T) {
+	assert.Equal(t, `export DESC='集群 #1
+line2'
+export HOSTS_I_1_ENV='a='\''1'\'' b=2'
+export HOSTS_I_1_IP='192.168.1.1'
+export NAME='cl-1'
+`, string(EncodeEnv(testValue, "")))
+	assert.Equal(t, "export HOSTS__I_1__IP='192.168.1.1'\n", string(EncodeEnv(map[string]interface{}{
+		"hosts": map[string]interface{}{"i-1": map[string]interface{}{"ip": "192.168.1.1"}},
+	}, "__")))
+	assert.Equal(t, "export _0='a'\nexport _1='b'\n", string(EncodeEnv([]string{"a", "b"}, "")))
+	assert.Equal(t, "export VALUE='v'\n", string(EncodeEnv("v", "")))
+}
+
+func TestEncodeProperties(t *testing.T) {
+	assert.Equal(t, `desc=\u96c6\u7fa4 \#1\nline2
+hosts.i-1.env=a\='1' b\=2
+hosts.i-1.ip=192.168.1.1
+name=cl-1
+`, string(EncodeProperties(testValue, "")))
+	assert.Equal(t, "hosts/i-1/ip=192.168.1.1\n", string(EncodeProperties(map[string]interface{}{
+		"hosts": map[string]interface{}{"i-1": map[string]interface{}{"ip": "192.168.1.1"}},
+	}, "/")))
+	assert.Equal(t, `\ a\:b=\ v`+"\n", string(EncodeProperties(map[string]interface{}{" a:b": " v"}, "")))
+}
+
+func TestEncodeTOML(t *testing.T) {
+	assert.Equal(t, `desc = "集群 #1\nline2"
+name = "cl-1"
+
+[hosts]
+
+[hosts.i-1]
+env = "a='1' b=2"
+ip = "192.168.1.1"
+`, string(EncodeTOML(testValue)))
+	assert.Equal(t, `"a.b" = "\"v\""`+"\n", string(EncodeTOML(map[string]interface{}{"a.b": `"v"`})))
+	assert.Equal(t, `value = "v"`+"\n", string(EncodeTOML("v")))
+	assert.Equal(t, "[0]\nop = \"add\"\n", string(EncodeTOML([]map[string]string{{"op": "add"}})))
+}
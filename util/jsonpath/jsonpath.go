@@ -0,0 +1,544 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+// Package jsonpath implement a subset of JSONPath for the metadata value, which is the nested map of string.
+//
+// Supported syntax:
+//
+//	$                     the root, can be omitted
+//	.name or ['name']     the child
+//	.* or [*]             all children
+//	..name or ..*         the descendants
+//	[?(filter)]           the children match the filter
+//
+// The filter is the comparison of the relative path of the child and a literal, such as
+// @.role == 'master', combined by &&, ||, ! and parentheses, the comparison operators are
+// ==, !=, <, <=, > and >=, the values are compared as numbers if both are numbers.
+// A relative path without comparison checks the existence.
+package jsonpath
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type selectorKind int
+
+const (
+	selectKey selectorKind = iota
+	selectWildcard
+	selectFilter
+)
+
+type segment struct {
+	// recursive select the descendants of the node, not only the children.
+	recursive bool
+	kind      selectorKind
+	key       string
+	filter    filter
+}
+
+// Path is a compiled JSONPath expression.
+type Path struct {
+	expr     string
+	segments []*segment
+}
+
+// Compile parse the JSONPath expression.
+func Compile(expr string) (*Path, error) {
+	p := &parser{s: strings.TrimSpace(expr)}
+	segments, err := p.parsePath()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid JSONPath [%s]: %s", expr, err.Error())
+	}
+	return &Path{expr: expr, segments: segments}, nil
+}
+
+func (p *Path) String() string {
+	return p.expr
+}
+
+// Find return the values matched in val, the children of a map are visited in the order of key.
+func (p *Path) Find(val interface{}) []interface{} {
+	nodes := []interface{}{val}
+	for _, seg := range p.segments {
+		var next []interface{}
+		for _, node := range nodes {
+			candidates := []interface{}{node}
+			if seg.recursive {
+				candidates = descendants(node, candidates)
+			}
+			for _, c := range candidates {
+				next = seg.selectChildren(c, next)
+			}
+		}
+		nodes = next
+	}
+	if nodes == nil {
+		return []interface{}{}
+	}
+	return nodes
+}
+
+func (s *segment) selectChildren(node interface{}, result []interface{}) []interface{} {
+	switch s.kind {
+	case selectKey:
+		if v, ok := child(node, s.key); ok {
+			result = append(result, v)
+		}
+	case selectWildcard:
+		result = append(result, children(node)...)
+	case selectFilter:
+		for _, c := range children(node) {
+			if s.filter.match(c) {
+				result = append(result, c)
+			}
+		}
+	}
+	return result
+}
+
+func child(node interface{}, key string) (interface{}, bool) {
+	switch t := node.(type) {
+	case map[string]interface{}:
+		v, ok := t[key]
+		return v, ok
+	case []interface{}:
+		i, err := strconv.Atoi(key)
+		if err != nil || i < 0 || i >= len(t) {
+			return nil, false
+		}
+		return t[i], true
+	}
+	return nil, false
+}
+
+func children(node interface{}) []interface{} {
+	switch t := node.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		result := make([]interface{}, 0, len(keys))
+		for _, k := range keys {
+			result = append(result, t[k])
+		}
+		return result
+	case []interface{}:
+		return t
+	}
+	return nil
+}
+
+// descendants append the descendants of node to result, parent before children.
+func descendants(node interface{}, result []interface{}) []interface{} {
+	for _, c := range children(node) {
+		result = append(result, c)
+		result = descendants(c, result)
+	}
+	return result
+}
+
+type filter interface {
+	match(val interface{}) bool
+}
+
+type orFilter []filter
+
+func (f orFilter) match(val interface{}) bool {
+	for _, sub := range f {
+		if sub.match(val) {
+			return true
+		}
+	}
+	return false
+}
+
+type andFilter []filter
+
+func (f andFilter) match(val interface{}) bool {
+	for _, sub := range f {
+		if !sub.match(val) {
+			return false
+		}
+	}
+	return true
+}
+
+type notFilter struct {
+	filter filter
+}
+
+func (f *notFilter) match(val interface{}) bool {
+	return !f.filter.match(val)
+}
+
+// operand is a relative path of @ or a literal.
+type operand struct {
+	isPath  bool
+	path    []string
+	literal string
+}
+
+func (o *operand) resolve(val interface{}) (interface{}, bool) {
+	if !o.isPath {
+		return o.literal, true
+	}
+	for _, key := range o.path {
+		v, ok := child(val, key)
+		if !ok {
+			return nil, false
+		}
+		val = v
+	}
+	return val, val != nil
+}
+
+type compareFilter struct {
+	left  *operand
+	op    string
+	right *operand
+}
+
+func (f *compareFilter) match(val interface{}) bool {
+	l, ok := f.left.resolve(val)
+	if !ok {
+		return false
+	}
+	if f.op == "" {
+		return true
+	}
+	r, ok := f.right.resolve(val)
+	if !ok {
+		return false
+	}
+	ls, lok := l.(string)
+	rs, rok := r.(string)
+	if !lok || !rok {
+		return false
+	}
+	var c int
+	lf, lerr := strconv.ParseFloat(ls, 64)
+	rf, rerr := strconv.ParseFloat(rs, 64)
+	if lerr == nil && rerr == nil {
+		switch {
+		case lf < rf:
+			c = -1
+		case lf > rf:
+			c = 1
+		}
+	} else {
+		c = strings.Compare(ls, rs)
+	}
+	switch f.op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+type parser struct {
+	s   string
+	pos int
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *parser) skipSpace() {
+	for !p.eof() && p.s[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *parser) consume(token string) bool {
+	if strings.HasPrefix(p.s[p.pos:], token) {
+		p.pos += len(token)
+		return true
+	}
+	return false
+}
+
+func (p *parser) parsePath() ([]*segment, error) {
+	var segments []*segment
+	if !p.consume("$") && !p.eof() && p.s[p.pos] != '.' && p.s[p.pos] != '[' {
+		// the leading name without dot, such as "hosts.*".
+		seg, err := p.parseName()
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, seg)
+	}
+	for !p.eof() {
+		var seg *segment
+		var err error
+		recursive := false
+		switch {
+		case p.consume(".."):
+			recursive = true
+			if !p.eof() && p.s[p.pos] == '[' {
+				seg, err = p.parseBracket()
+			} else {
+				seg, err = p.parseName()
+			}
+		case p.consume("."):
+			seg, err = p.parseName()
+		case !p.eof() && p.s[p.pos] == '[':
+			seg, err = p.parseBracket()
+		default:
+			err = fmt.Errorf("unexpected character '%c' at %d", p.s[p.pos], p.pos)
+		}
+		if err != nil {
+			return nil, err
+		}
+		seg.recursive = recursive
+		segments = append(segments, seg)
+	}
+	return segments, nil
+}
+
+func (p *parser) parseName() (*segment, error) {
+	start := p.pos
+	for !p.eof() && p.s[p.pos] != '.' && p.s[p.pos] != '[' {
+		p.pos++
+	}
+	name := strings.TrimSpace(p.s[start:p.pos])
+	if name == "" {
+		return nil, fmt.Errorf("missing name at %d", start)
+	}
+	if name == "*" {
+		return &segment{kind: selectWildcard}, nil
+	}
+	return &segment{kind: selectKey, key: name}, nil
+}
+
+func (p *parser) parseBracket() (*segment, error) {
+	// skip '['
+	p.pos++
+	p.skipSpace()
+	var seg *segment
+	switch {
+	case p.consume("*"):
+		seg = &segment{kind: selectWildcard}
+	case p.consume("?"):
+		p.skipSpace()
+		if !p.consume("(") {
+			return nil, fmt.Errorf("missing '(' of filter at %d", p.pos)
+		}
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if !p.consume(")") {
+			return nil, fmt.Errorf("missing ')' of filter at %d", p.pos)
+		}
+		seg = &segment{kind: selectFilter, filter: f}
+	case !p.eof() && (p.s[p.pos] == '\'' || p.s[p.pos] == '"'):
+		key, err := p.parseQuoted()
+		if err != nil {
+			return nil, err
+		}
+		seg = &segment{kind: selectKey, key: key}
+	default:
+		start := p.pos
+		for !p.eof() && p.s[p.pos] != ']' {
+			p.pos++
+		}
+		key := strings.TrimSpace(p.s[start:p.pos])
+		if key == "" {
+			return nil, fmt.Errorf("missing key at %d", start)
+		}
+		seg = &segment{kind: selectKey, key: key}
+	}
+	p.skipSpace()
+	if !p.consume("]") {
+		return nil, fmt.Errorf("missing ']' at %d", p.pos)
+	}
+	return seg, nil
+}
+
+func (p *parser) parseQuoted() (string, error) {
+	quote := p.s[p.pos]
+	start := p.pos
+	p.pos++
+	var buf []byte
+	for !p.eof() {
+		c := p.s[p.pos]
+		p.pos++
+		switch {
+		case c == '\\' && !p.eof():
+			buf = append(buf, p.s[p.pos])
+			p.pos++
+		case c == quote:
+			return string(buf), nil
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return "", fmt.Errorf("unterminated string at %d", start)
+}
+
+func (p *parser) parseOr() (filter, error) {
+	f, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	filters := orFilter{f}
+	for {
+		p.skipSpace()
+		if !p.consume("||") {
+			break
+		}
+		f, err = p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return filters, nil
+}
+
+func (p *parser) parseAnd() (filter, error) {
+	f, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	filters := andFilter{f}
+	for {
+		p.skipSpace()
+		if !p.consume("&&") {
+			break
+		}
+		f, err = p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return filters, nil
+}
+
+func (p *parser) parseUnary() (filter, error) {
+	p.skipSpace()
+	if strings.HasPrefix(p.s[p.pos:], "!") && !strings.HasPrefix(p.s[p.pos:], "!=") {
+		p.pos++
+		f, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notFilter{filter: f}, nil
+	}
+	if p.consume("(") {
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if !p.consume(")") {
+			return nil, fmt.Errorf("missing ')' at %d", p.pos)
+		}
+		return f, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *parser) parseCompare() (filter, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if p.consume(op) {
+			right, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			return &compareFilter{left: left, op: op, right: right}, nil
+		}
+	}
+	if !left.isPath {
+		return nil, fmt.Errorf("missing comparison at %d", p.pos)
+	}
+	return &compareFilter{left: left}, nil
+}
+
+func (p *parser) parseOperand() (*operand, error) {
+	p.skipSpace()
+	if p.eof() {
+		return nil, fmt.Errorf("missing operand at %d", p.pos)
+	}
+	switch c := p.s[p.pos]; {
+	case c == '@':
+		p.pos++
+		o := &operand{isPath: true}
+		for !p.eof() {
+			if p.consume(".") {
+				start := p.pos
+				for !p.eof() && isNameChar(p.s[p.pos]) {
+					p.pos++
+				}
+				if start == p.pos {
+					return nil, fmt.Errorf("missing name at %d", start)
+				}
+				o.path = append(o.path, p.s[start:p.pos])
+			} else if strings.HasPrefix(p.s[p.pos:], "['") || strings.HasPrefix(p.s[p.pos:], "[\"") {
+				p.pos++
+				key, err := p.parseQuoted()
+				if err != nil {
+					return nil, err
+				}
+				if !p.consume("]") {
+					return nil, fmt.Errorf("missing ']' at %d", p.pos)
+				}
+				o.path = append(o.path, key)
+			} else {
+				break
+			}
+		}
+		return o, nil
+	case c == '\'' || c == '"':
+		s, err := p.parseQuoted()
+		if err != nil {
+			return nil, err
+		}
+		return &operand{literal: s}, nil
+	default:
+		start := p.pos
+		for !p.eof() && (isNameChar(p.s[p.pos]) || p.s[p.pos] == '.') {
+			p.pos++
+		}
+		if start == p.pos {
+			return nil, fmt.Errorf("unexpected character '%c' at %d", c, p.pos)
+		}
+		// number, true, false or null, compared as string.
+		return &operand{literal: p.s[start:p.pos]}, nil
+	}
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || c == '-' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
@@ -0,0 +1,58 @@
+// Copyright 2018 Yunify Inc. All rights reserved.
+// Use of this source code is governed by a Apache license
+// that can be found in the LICENSE file.
+
+package jsonpath
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFind(t *testing.T) {
+	data := map[string]interface{}{
+		"hosts": map[string]interface{}{
+			"i-1": map[string]interface{}{"role": "master", "ip": "192.168.1.1", "cpu": "8"},
+			"i-2": map[string]interface{}{"role": "slave", "ip": "192.168.1.2", "cpu": "16"},
+			"i-3": map[string]interface{}{"role": "master", "ip": "192.168.1.3", "cpu": "4", "label": map[string]interface{}{"a.b": "1"}},
+		},
+		"name": "cl-1",
+	}
+	tests := []struct {
+		expr   string
+		result []interface{}
+	}{
+		{"$.name", []interface{}{"cl-1"}},
+		{"name", []interface{}{"cl-1"}},
+		{"$", []interface{}{data}},
+		{"$.none", []interface{}{}},
+		{"$.hosts['i-2'].ip", []interface{}{"192.168.1.2"}},
+		{"hosts.*.ip", []interface{}{"192.168.1.1", "192.168.1.2", "192.168.1.3"}},
+		{"$..ip", []interface{}{"192.168.1.1", "192.168.1.2", "192.168.1.3"}},
+		{"$.hosts[?(@.role == 'master')].ip", []interface{}{"192.168.1.1", "192.168.1.3"}},
+		{"$.hosts[?(@.role != \"master\")].ip", []interface{}{"192.168.1.2"}},
+		{"$.hosts[?(@.cpu > 4 && @.cpu <= 8)].ip", []interface{}{"192.168.1.1"}},
+		{"$.hosts[?(@.cpu >= 16 || !(@.role == 'slave'))].ip", []interface{}{"192.168.1.1", "192.168.1.2", "192.168.1.3"}},
+		{"$.hosts[?(@.label)].ip", []interface{}{"192.168.1.3"}},
+		{"$.hosts[?(@.label['a.b'] == 1)].ip", []interface{}{"192.168.1.3"}},
+		{"$.hosts[*].label", []interface{}{map[string]interface{}{"a.b": "1"}}},
+	}
+	for _, test := range tests {
+		p, err := Compile(test.expr)
+		assert.NoError(t, err, test.expr)
+		assert.Equal(t, test.result, p.Find(data), test.expr)
+	}
+
+	// the slice
+	p, err := Compile("$[1]")
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"b"}, p.Find([]interface{}{"a", "b"}))
+}
+
+func TestCompileError(t *testing.T) {
+	for _, expr := range []string{"$.", "$[", "$['a", "$[?(@.a == )]", "$[?(@.a == 'b']", "$.a[?('b')]", "$a"} {
+		_, err := Compile(expr)
+		assert.Error(t, err, expr)
+	}
+}